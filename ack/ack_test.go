@@ -0,0 +1,70 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"testing"
+
+	"github.com/gmallard/stompngo_examples/sngecomm/testbroker"
+	"github.com/gmallard/stompngo_examples/sngecomm/testbroker/brokertest"
+)
+
+/*
+Test ack against a test broker.
+*/
+func TestRun(t *testing.T) {
+	b, cfg, done := brokertest.Start(t, testbroker.Options{})
+	defer done()
+	//
+	cfg.Dest = "/queue/ack.test"
+	cfg.Nmsgs = 3
+	for j := 1; j <= cfg.Nmsgs; j++ {
+		b.Publish(cfg.Dest, []byte(fmt.Sprintf("body %d", j)))
+	}
+	r, e := Run(context.Background(), cfg, log.New(ioutil.Discard, "", 0))
+	if e != nil {
+		t.Fatalf("Run, expected no error, got [%v]\n", e)
+	}
+	if len(r.Messages) != 3 || r.Acked != 3 {
+		t.Fatalf("Run, expected 3 received and acked, got [%+v]\n", r)
+	}
+	for j, m := range r.Messages {
+		if string(m.Body) != fmt.Sprintf("body %d", j+1) {
+			t.Errorf("Message %d, got [%s]\n", j+1, m.Body)
+		}
+	}
+	// Every ACK names the message it acks
+	ids := map[string]bool{}
+	for _, m := range r.Messages {
+		ids[m.Headers.Value("message-id")] = true
+		ids[m.Headers.Value("ack")] = true
+	}
+	for _, f := range b.Frames("ACK") {
+		if !ids[f.Value("id")] && !ids[f.Value("message-id")] {
+			t.Errorf("ACK, for no received message, got [%v]\n", f.Headers)
+		}
+	}
+	if s := b.Stats(); s.Acked != 3 || s.Frames["ACK"] != 3 || s.Redelivered != 0 ||
+		b.Unacked(cfg.Dest) != 0 || b.Depth(cfg.Dest) != 0 {
+		t.Errorf("Stats, expected 3 acked and none left, got [%+v] depth %d\n", s,
+			b.Depth(cfg.Dest))
+	}
+}
@@ -18,8 +18,8 @@ package main
 
 import (
 	//"fmt"
+	"flag"
 	"log"
-	"net"
 	"os"
 	"time"
 	//
@@ -36,65 +36,74 @@ var (
 	exampid = "reader: "
 
 	//
-	n    net.Conn             // Network Connection
+	rc   *sngecomm.Resilient  // Reconnecting Connection
 	conn *stompngo.Connection // Stomp Connection
+	cfg  *sngecomm.Config     // Run parameters
 
 	lhl = 44
 
 	tag = "reader"
 )
 
-// A forever reader.
+// A forever reader.  Stop via ^C, or an EOF message when STOMP_USEEOF is set.
 func main() {
 
 	st := time.Now()
 
+	var e error
+	cfg, e = sngecomm.LoadConfig(flag.CommandLine, os.Args[1:])
+	if e != nil {
+		ll.Fatalf("%stag:%s connsess:%s main_config error:%v",
+			exampid, tag, sngecomm.Lcs,
+			e.Error()) // Handle this ......
+	}
+
 	sngecomm.ShowRunParms(exampid)
 
-	// Standard example connect sequence
-	var e error
-	n, conn, e = sngecomm.CommonConnect(exampid, tag, ll)
+	// Connect, and reconnect when the broker goes away
+	rc, e = sngecomm.ResilientConnect(exampid, tag, ll)
 	if e != nil {
-		if conn != nil {
-			ll.Printf("%stag:%s  connsess:%s Connect Response headers:%v body%s\n",
-				exampid, tag, conn.Session(), conn.ConnectResponse.Headers,
-				string(conn.ConnectResponse.Body))
-		}
 		ll.Fatalf("%stag:%s connsess:%s main_on_connect error:%v",
 			exampid, tag, sngecomm.Lcs,
 			e.Error()) // Handle this ......
 	}
+	conn = rc.Conn()
 
 	//**
 	qn := 1
 	ltag := tag + "-receiver"
 
 	id := stompngo.Uuid() // A unique subscription ID
-	d := sngecomm.Dest()
+	d := cfg.Destination()
 
 	ll.Printf("%stag:%s connsess:%s queue_info id:%v d:%v qnum:%v\n",
 		exampid, ltag, conn.Session(),
 		id, d, qn)
 	// Subscribe
-	sc := sngecomm.HandleSubscribe(conn, d, id, sngecomm.AckMode())
+	sc := sngecomm.HandleSubscribe(conn, d, id, cfg.AckMode)
 	ll.Printf("%stag:%s connsess:%s subscribe_complete id:%v d:%v qnum:%v\n",
 		exampid, ltag, conn.Session(),
 		id, d, qn)
 	//
+	sd := sngecomm.NewShutdown(exampid, tag, ll)
+	ctx := sd.Context()
 	var md stompngo.MessageData
 	// Receive loop
 	mc := 1
-	for {
+	for ctx.Err() == nil { // Until shutdown
 		ll.Println("========================== ", "Expecting Message:", mc,
 			"==========================")
 		select {
+		case <-ctx.Done():
+			continue
 		case md = <-sc:
-		case md = <-conn.MessageData:
+		case md = <-rc.MessageData:
 			// A RECEIPT or ERROR frame is unexpected here
 			ll.Fatalf("%stag:%s connsess:%s bad_frame qnum:%v headers:%v body:%s",
 				exampid, tag, conn.Session(),
 				qn, md.Message.Headers, md.Message.Body) // Handle this ......
 		}
+		conn = rc.Conn() // Possibly reconnected
 		if md.Error != nil {
 			ll.Fatalf("%stag:%s connsess:%s recv_error qnum:%v error:%v",
 				exampid, tag, conn.Session(),
@@ -107,7 +116,7 @@ func main() {
 			mc, md.Message.Command, md.Message.Headers, mbs) // Handle this ......
 
 		mc++
-		if sngecomm.UseEOF() && mbs == sngecomm.EOFMsg {
+		if cfg.UseEOF && mbs == sngecomm.EOFMsg {
 			ll.Printf("%stag:%s connsess:%s received EOF\n",
 				exampid, tag, conn.Session())
 			break
@@ -116,18 +125,31 @@ func main() {
 
 	//**
 
+	// Shutdown: NACK anything not yet processed, and unsubscribe
+	nn, e := sngecomm.StopConsumer(conn, sc, d, id, cfg.AckMode)
+	if e != nil {
+		sd.Fail("unsubscribe", e)
+	}
+	ll.Printf("%stag:%s connsess:%s unsubscribe_complete nacked:%d\n",
+		exampid, ltag, conn.Session(),
+		nn)
+	sd.Wait()
+
 	// Standard example disconnect sequence
-	e = sngecomm.CommonDisconnect(n, conn, exampid, tag, ll)
+	conn = rc.Conn()
+	e = rc.Disconnect()
 	if e != nil {
-		ll.Fatalf("%stag:%s connsess:%s main_on_disconnect error:%v",
+		sd.Fail("disconnect", e)
+	} else {
+		ll.Printf("%stag:%s connsess:%s disconnect_receipt:%v\n",
 			exampid, tag, conn.Session(),
-			e.Error()) // Handle this ......
+			conn.DisconnectReceipt.Message.Headers)
 	}
 
 	sngecomm.ShowStats(exampid, tag, conn)
 
-	ll.Printf("%stag:%s connsess:%s main_elapsed:%v\n",
+	ll.Printf("%stag:%s connsess:%s main_elapsed:%v code:%d\n",
 		exampid, tag, conn.Session(),
-		time.Now().Sub(st))
-
+		time.Now().Sub(st), sd.Code())
+	os.Exit(sd.Code())
 }
@@ -22,13 +22,13 @@ Function: read the code :-).
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"os"
 	"time"
 	//
 	"github.com/gmallard/stompngo"
-	"github.com/gmallard/stompngo/senv"
 	"github.com/gmallard/stompngo_examples/sngecomm"
 )
 
@@ -39,27 +39,30 @@ var (
 	unsub   = true
 	dodisc  = true
 	ar      = false // Want ACK RECEIPT
+	cfg     *sngecomm.Config
 	session = ""
 	wlp     = "publish: message: " // Expected/wanted payload data, left part
 )
 
-func init() {
-	if os.Getenv("VMG_NOUNSUB") != "" {
-		unsub = false
-	}
-	if os.Getenv("VMG_NODISC") != "" {
-		dodisc = false
-	}
-	if os.Getenv("VMG_GETAR") != "" {
-		ar = true
-	}
-}
-
 // Connect to a STOMP broker, subscribe and receive some messages and disconnect.
 func main() {
 
 	st := time.Now()
 
+	// Run parameters.  Invalid combinations, e.g. client-individual ACKs with
+	// STOMP 1.0, are reported here, before connecting.
+	var e error
+	cfg, e = sngecomm.LoadConfig(flag.CommandLine, os.Args[1:])
+	if e != nil {
+		ll.Fatalf("%stag:%s connsess:%s main_config error:%v",
+			exampid, tag, sngecomm.Lcs,
+			e.Error()) // Handle this ......
+	}
+	unsub = !cfg.VmgNoUnsub
+	dodisc = !cfg.VmgNoDisc
+	ar = cfg.VmgGetAR
+	cfg.ShowRunParms(exampid, ll)
+
 	// Standard example connect sequence
 	n, conn, e := sngecomm.CommonConnect(exampid, tag, ll)
 	if e != nil {
@@ -69,25 +72,18 @@ func main() {
 	}
 	session = conn.Session()
 	conn.SetLogger(ll)              // stompngo logging
-	pbc := sngecomm.Pbc()           // Print byte count
-	d := senv.Dest()                // Destination
+	pbc := cfg.Pbc                  // Print byte count
+	d := cfg.Destination()          // Destination
 	id := stompngo.Uuid()           // A unique name/id
-	nmsgs := senv.Nmsgs()           // int number of messages to get
+	nmsgs := cfg.Nmsgs              // int number of messages to get
 	mns := fmt.Sprintf("%d", nmsgs) // string number of messages to get
 	d = d + ".1"                    // Adjust destination from 'publish'
-	am := sngecomm.AckMode()        // ACK mode to use on SUBSCRIBE
+	am := cfg.AckMode               // ACK mode to use on SUBSCRIBE
 	nfa := true                     // Need "final" ACK (possiby reset below)
 	wh := stompngo.Headers{         // Starting SUBSCRIBE headers
 		stompngo.StompPlusDrainAfter,
 		mns} // Need a string here
 
-	// Sanity check ACK mode
-	if conn.Protocol() == stompngo.SPL_10 &&
-		am == stompngo.AckModeClientIndividual {
-		ll.Fatalf("%stag:%s connsess:%s invalid_ack_mode am:%v proto:%v\n",
-			exampid, tag, session,
-			am, conn.Protocol()) //
-	}
 	// Do not do final ACK if running ACKs are issued
 	if am == stompngo.AckModeClientIndividual ||
 		am == stompngo.AckModeAuto {
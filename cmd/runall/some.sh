@@ -8,6 +8,8 @@ pushd $SNGD
 #
 export STOMP_NMSGS=1
 export STOMP_NQS=1
+# Broker profile, see stomp_profiles.yaml
+export STOMP_PROFILE=${STOMP_PROFILE:-activemq}
 #
 STOMP_DEST=/queue/snge.ack go run publish/publish.go
 STOMP_DEST=/queue/snge.ack.1 go run ack/ack.go
@@ -18,7 +20,7 @@ STOMP_USEEOF=y STOMP_DEST=/queue/snge.rdr.1 go run adhoc/reader/reader.go
 go run conndisc/conndisc.go
 #
 # Port 61611: AMQ, TLS, No cert required
-STOMP_PORT=61611 go run conndisc_tls/conndisc_tls.go
+STOMP_PROFILE=amqtls go run conndisc_tls/conndisc_tls.go
 #
 go run srmgor_1conn/srmgor_1conn.go
 go run srmgor_1smrconn/srmgor_1smrconn.go
@@ -0,0 +1,245 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+/*
+Run the TLS use case examples, tlsuc1 to tlsuc4, against in-process TLS
+STOMP brokers (see sngecomm/testbroker), and check each result against the
+expectation in the example's documentation.
+
+Subcase A brokers do not require client authentication, subcase B brokers
+do.  The expectations are read from the "Subcase N.X ... - Expect
+connection success|failure" lines of each example's doc comment.  The
+certificates are a throwaway test PKI (see cmd/tlspki), and the examples
+are run with its tlsucN.env settings.
+
+A pass/fail matrix is printed.  The exit status is 1 if any result does not
+match its expectation.  No network access or broker is needed, so the
+runner suits CI.
+
+	Example use might be, from the repository root:
+
+		go run ./cmd/tlsmatrix
+		go run ./cmd/tlsmatrix -v -keytype rsa
+*/
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gmallard/stompngo_examples/sngecomm"
+	"github.com/gmallard/stompngo_examples/sngecomm/testbroker"
+)
+
+var (
+	ll      = log.New(os.Stdout, "TLSMTX ", log.Ldate|log.Lmicroseconds|log.Lshortfile)
+	exampid = "tlsmatrix: "
+	//
+	examps  = flag.String("examples", "tlsexamps", "the TLS examples directory")
+	keyType = flag.String("keytype", "ecdsa", "key type, rsa or ecdsa")
+	timeout = flag.Duration("timeout", 60*time.Second, "time limit for each example run")
+	verbose = flag.Bool("v", false, "print the output of each example run")
+	//
+	useCases = []string{"tlsuc1", "tlsuc2", "tlsuc3", "tlsuc4"}
+	// A documented expectation
+	expectRE = regexp.MustCompile(`Subcase (\d\.[AB])[^\n]*\n\s*-\s*Expect connection (success|failure)`)
+)
+
+// A matrix cell.
+type cell struct {
+	uc, subcase      string
+	expected, actual string
+	detail           string
+}
+
+// expectations returns the documented expectations of an example, by
+// subcase.
+func expectations(uc string) (map[string]string, error) {
+	fn := filepath.Join(*examps, uc, uc+".go")
+	f, e := parser.ParseFile(token.NewFileSet(), fn, nil,
+		parser.PackageClauseOnly|parser.ParseComments)
+	if e != nil {
+		return nil, e
+	}
+	r := map[string]string{}
+	if f.Doc != nil {
+		for _, m := range expectRE.FindAllStringSubmatch(f.Doc.Text(), -1) {
+			r[m[1]] = m[2]
+		}
+	}
+	if len(r) != 2 {
+		return nil, fmt.Errorf("%s: expected subcase A and B expectations, found %v", fn, r)
+	}
+	return r, nil
+}
+
+// envFile reads the settings from a tlsucN.env file.
+func envFile(fn string) ([]string, error) {
+	b, e := ioutil.ReadFile(fn)
+	if e != nil {
+		return nil, e
+	}
+	var r []string
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		if l := s.Text(); strings.HasPrefix(l, "export ") {
+			r = append(r, strings.TrimPrefix(l, "export "))
+		}
+	}
+	return r, s.Err()
+}
+
+// environ returns the environment, without any STOMP_ settings.
+func environ() []string {
+	var r []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "STOMP_") {
+			r = append(r, kv)
+		}
+	}
+	return r
+}
+
+// run runs an example, returning success or failure, and the error logged
+// on failure.
+func run(bin string, env []string) (string, string) {
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	c := exec.CommandContext(ctx, bin)
+	c.Env = env
+	o, e := c.CombinedOutput()
+	if *verbose {
+		ll.Printf("%s run:%s output:\n%s", exampid, filepath.Base(bin), o)
+	}
+	if e == nil {
+		return "success", ""
+	}
+	d := e.Error()
+	for _, l := range strings.Split(string(o), "\n") {
+		if i := strings.Index(l, "error:"); i >= 0 {
+			d = l[i+len("error:"):]
+		}
+	}
+	return "failure", d
+}
+
+// matrix runs the examples with the PKI in dir, and prints the matrix.  It
+// returns the number of failed cells.
+func matrix(dir string) (int, error) {
+	p, e := sngecomm.GeneratePKI(sngecomm.PKIOptions{KeyType: *keyType})
+	if e != nil {
+		return 0, fmt.Errorf("generate error:%v", e)
+	}
+	if e = p.Write(dir, "changeit"); e != nil {
+		return 0, fmt.Errorf("write dir:%s error:%v", dir, e)
+	}
+	// The brokers, by subcase
+	bs := map[string]string{} // Ports
+	for sc, ca := range map[string]tls.ClientAuthType{
+		"A": tls.VerifyClientCertIfGiven,
+		"B": tls.RequireAndVerifyClientCert,
+	} {
+		b, e := testbroker.Start(testbroker.Options{Server: "tlsmatrix",
+			TLS: &tls.Config{Certificates: []tls.Certificate{p.Broker},
+				ClientCAs: p.Pool(), ClientAuth: ca}})
+		if e != nil {
+			return 0, fmt.Errorf("broker subcase:%s error:%v", sc, e)
+		}
+		defer b.Close()
+		_, bs[sc] = b.HostPort()
+	}
+	//
+	var cells []cell
+	for _, uc := range useCases {
+		ex, e := expectations(uc)
+		if e != nil {
+			return 0, fmt.Errorf("expectations error:%v", e)
+		}
+		bin := filepath.Join(dir, uc)
+		o, e := exec.Command("go", "build", "-o", bin,
+			"./"+filepath.Join(*examps, uc)).CombinedOutput()
+		if e != nil {
+			return 0, fmt.Errorf("build:%s error:%v\n%s", uc, e, o)
+		}
+		env, e := envFile(filepath.Join(dir, uc+".env"))
+		if e != nil {
+			return 0, fmt.Errorf("env:%s error:%v", uc, e)
+		}
+		for _, sc := range []string{"A", "B"} {
+			n := uc[len(uc)-1:] + "." + sc
+			c := cell{uc: uc, subcase: n, expected: ex[n]}
+			c.actual, c.detail = run(bin, append(append(environ(), env...),
+				"STOMP_HOST=127.0.0.1", "STOMP_PORT="+bs[sc]))
+			cells = append(cells, c)
+		}
+	}
+	//
+	fails := 0
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "USE CASE\tSUBCASE\tEXPECTED\tACTUAL\tRESULT\tDETAIL")
+	for _, c := range cells {
+		r := "PASS"
+		if c.actual != c.expected {
+			r = "FAIL"
+			fails++
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", c.uc, c.subcase, c.expected,
+			c.actual, r, strings.TrimSpace(c.detail))
+	}
+	tw.Flush()
+	ll.Printf("%s cells:%d failed:%d\n", exampid, len(cells), fails)
+	return fails, nil
+}
+
+// tlsMatrix runs the matrix in a temporary directory, and returns the exit
+// code.  The directory holds private keys, and is always removed.
+func tlsMatrix() int {
+	dir, e := ioutil.TempDir("", "tlsmatrix")
+	if e != nil {
+		ll.Printf("%s tempdir error:%v\n", exampid, e)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+	fails, e := matrix(dir)
+	if e != nil {
+		ll.Printf("%s%v\n", exampid, e)
+		return 1
+	}
+	if fails > 0 {
+		return 1
+	}
+	return 0
+}
+
+func main() {
+	flag.Parse()
+	os.Exit(tlsMatrix())
+}
@@ -0,0 +1,76 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+/*
+Generate a throwaway test PKI for the TLS examples: a CA, a broker
+certificate, client certificates, deliberately bad variants (expired, wrong
+CA, wrong host name), PKCS#12 broker keystores, and STOMP_TLS_* settings for
+each of tlsuc1 to tlsuc4.  See README.txt in the output directory.
+
+	Example use might be:
+
+		go run cmd/tlspki/main.go -dir $HOME/tls-certs -hosts localhost,broker.example
+		. $HOME/tls-certs/tlsuc4.env
+		STOMP_PORT=61612 go run tlsexamps/tlsuc4/tlsuc4.go
+*/
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gmallard/stompngo_examples/sngecomm"
+)
+
+var (
+	ll      = log.New(os.Stdout, "TLSPKI ", log.Ldate|log.Lmicroseconds|log.Lshortfile)
+	exampid = "tlspki: "
+	//
+	dir      = flag.String("dir", filepath.Join(os.Getenv("HOME"), "tls-certs"), "output directory")
+	hosts    = flag.String("hosts", "localhost,127.0.0.1,::1", "broker DNS names and IP addresses")
+	clients  = flag.String("clients", "client", "client certificate common names")
+	days     = flag.Int("days", 365, "validity in days")
+	keyType  = flag.String("keytype", "rsa", "key type, rsa or ecdsa")
+	password = flag.String("password", "changeit", "PKCS#12 keystore password")
+)
+
+// split splits a comma separated list.
+func split(s string) []string {
+	var r []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			r = append(r, v)
+		}
+	}
+	return r
+}
+
+func main() {
+	flag.Parse()
+	p, e := sngecomm.GeneratePKI(sngecomm.PKIOptions{Hosts: split(*hosts),
+		Clients: split(*clients), Days: *days, KeyType: *keyType})
+	if e != nil {
+		ll.Fatalf("%s generate error:%v\n", exampid, e) // Handle this ......
+	}
+	if e = p.Write(*dir, *password); e != nil {
+		ll.Fatalf("%s write dir:%s error:%v\n", exampid, *dir, e) // Handle this ......
+	}
+	ll.Printf("%s dir:%s ca:%s broker:%s clients:%s days:%d\n", exampid, *dir,
+		p.CA.Subject.CommonName, *hosts, *clients, *days)
+}
@@ -18,7 +18,9 @@
 Connect and Disconnect from a STOMP broker using TLS.
 
 All examples in the 'conndisc' directory also apply here.  This example shows
-that TLS is requested by using a specific port and tls.Dial.
+that TLS is requested by using a specific port and tls.Dial.  The TLS
+configuration comes from the STOMP_TLS_* variables or a broker profile.
+Without a CA file, the broker certificate is not checked.
 
 	Example:
 
@@ -53,14 +55,18 @@ func main() {
 	ll.Printf("%stag:%s connsess:%s starts\n",
 		exampid, tag, sngecomm.Lcs)
 
-	// TLS Configuration.  This configuration assumes that:
-	// a) The server used does *not* require client certificates
-	// b) This client has no need to authenticate the server
-	// Note that the tls.Config structure can be modified to support any
-	// authentication scheme, including two-way/mutual authentication. Examples
-	// are provided elsewhere in this project.
-	tc = new(tls.Config)
-	tc.InsecureSkipVerify = true // Do *not* check the server's certificate
+	// TLS Configuration, from the STOMP_TLS_* environment variables, STOMP_URL
+	// or the broker profile.  See sngecomm.TLSConfigFromEnv.
+	var e error
+	tc, e = sngecomm.TLSConfigFromEnv()
+	if e != nil {
+		ll.Fatalf("%stag:%s connsess:%s main_tls_config error:%v",
+			exampid, tag, sngecomm.Lcs,
+			e.Error()) // Handle this ......
+	}
+	if tc.RootCAs == nil {
+		tc.InsecureSkipVerify = true // No CA, do *not* check the server's certificate
+	}
 
 	// Standard example TLS connect sequence
 	n, conn, e := sngecomm.CommonTLSConnect(exampid, tag, ll, tc)
@@ -71,7 +77,7 @@ func main() {
 	}
 
 	nc := n.(*tls.Conn)
-	sngecomm.DumpTLSConfig(exampid, tc, nc)
+	sngecomm.ReportTLS(exampid, tag, ll, tc, nc)
 
 	// *NOTE* application specific functionaltiy starts here!
 	// For you to add.
@@ -2,6 +2,10 @@ module github.com/gmallard/stompngo_examples
 
 go 1.13
 
-require github.com/gmallard/stompngo v0.0.0
+require (
+	github.com/gmallard/stompngo v0.0.0
+	gopkg.in/yaml.v2 v2.4.0
+	software.sslmate.com/src/go-pkcs12 v0.4.0
+)
 
 replace github.com/gmallard/stompngo => ../stompngo
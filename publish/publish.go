@@ -52,23 +52,30 @@ Publish messages to a STOMP broker.
 		# for STOMP_NGORS.  If this value is specified, all go routines
 		# are multi-plexed across this number of queues.
 
+		# STOMP_SENDDELAY - the variable sleep time distribution, used
+		# with STOMP_DOSLEEP, e.g. exp:500ms or normal:500ms,100ms.  Use
+		# STOMP_SEED for reproducible runs.
+
+		# STOMP_PAYLOAD - a payload generator for message bodies, e.g.
+		# uniform:64,4K, histogram:64=50,1K=30,32K=20, random:1K,
+		# json:/path/template.json, or corpus:/path/dir.  See
+		# sngecomm.NewPayloadGenerator.
+
 */
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
-	"net"
 	"os"
 	"runtime"
 	"runtime/pprof"
-	"strconv"
 	"sync"
 	"time"
 	//
 	"github.com/gmallard/stompngo"
-	// senv methods could be used in general by stompngo clients.
-	"github.com/gmallard/stompngo/senv"
 	// sngecomm methods are used specifically for these example clients.
 	"github.com/gmallard/stompngo_examples/sngecomm"
 )
@@ -77,95 +84,42 @@ var (
 	exampid = "publish: "
 	ll      = log.New(os.Stdout, "EPUB ", log.Ldate|log.Lmicroseconds|log.Lshortfile)
 	tag     = "pubmain"
-	wg      sync.WaitGroup
-	conn    *stompngo.Connection
-	n       net.Conn
-	e       error
-	nqs     int
-	ngor    int
 	// MNHDR is the message number, in message headers
-	MNHDR  = "sng_msgnum"
-	gorstr = 1 // Starting destination number
-	//
-	msfl  = true // Fixed message length
-	mslen = 1024 // The fixed length
-	msf   []byte
-	//
-	gorsl   = false
-	gorslfb = false
-	gorslfx = time.Duration(250 * time.Millisecond)
-	gorslms = 250
-	//
-	max int64 = 1e9      // Max stagger time (nanoseconds)
-	min       = max / 10 // Min stagger time (nanoseconds)
-	// Sleep multipliers
-	sf = 1.0
-	rf = 1.0
+	MNHDR = "sng_msgnum"
 )
 
-func init() {
-	ngor = sngecomm.Ngors()
-	nqs = sngecomm.Nqs()
-
-	// Options around message length:
-	// 1) fixed length
-	// 2) randomly variable length
-	if os.Getenv("STOMP_VARMSL") != "" {
-		msfl = false // Use randomly variable message lengths
-	}
-	if msfl {
-		if s := os.Getenv("STOMP_FXMSLEN"); s != "" {
-			i, e := strconv.ParseInt(s, 10, 32)
-			if nil != e {
-				log.Printf("v1:%v v2:%v\n", "FXMSLEN conversion error", e)
-			} else {
-				mslen = int(i) // The fixed length to use
-			}
-		}
-		msf = sngecomm.PartialSubstr(mslen)
-	}
+// Result is the outcome of a Run.
+type Result struct {
+	Sent    int            // Messages sent, without EOF messages
+	Dests   map[string]int // Messages sent, by destination
+	Elapsed time.Duration
+}
 
-	// Options controlling sleeps between message sends.  Options are:
-	// 1) Don't sleep
-	// 2) Sleep a fixed amount of time
-	// 3) Sleep a random variable amount of time
-	if os.Getenv("STOMP_DOSLEEP") != "" {
-		gorsl = true // Do sleep
-	}
-	if os.Getenv("STOMP_FIXSLEEP") != "" {
-		gorslfb = true // Do a fixed length sleep
-	}
-	if gorsl {
-		var err error
-		if s := os.Getenv("STOMP_SLEEPMS"); s != "" { // Fixed length milliseconds
-			mss := fmt.Sprintf("%s", s) + "ms"
-			gorslfx, err = time.ParseDuration(mss)
-			if err != nil {
-				log.Printf("v1:%v v2:%v v3:%v\n", "ParseDuration conversion error", mss, e)
-			}
-		}
-	}
-	// Option controlling destination numbering.  Destinations are normally
-	// suffixed with a sequence number, starting at 1.  This option allows
-	// that starting sequence number to be arbitrary.
-	if s := os.Getenv("STOMP_GORNSTR"); s != "" {
-		i, e := strconv.ParseInt(s, 10, 32)
-		if nil != e {
-			log.Printf("v1:%v v2:%v\n", "GORNSTR conversion error", e)
-		} else {
-			gorstr = int(i) // The starting sequence number to use.
-		}
-	}
+// A publisher is the state of one Run.
+type publisher struct {
+	cfg     *sngecomm.Config
+	ll      *log.Logger
+	conn    *stompngo.Connection
+	ps      string        // Message body specification
+	gorslfx time.Duration // Fixed sleep time
 }
-func runSends(gr int, qn int) {
-	var err error
+
+// runSends sends all messages for one go routine, and returns the
+// destination and the number sent.
+func (p *publisher) runSends(gr int, qn int) (string, int, error) {
+	cfg, ll, conn := p.cfg, p.ll, p.conn
 	qns := fmt.Sprintf("%d", qn)
-	qname := sngecomm.Dest() + "." + qns
+	sd := cfg.NewSendDelay(fmt.Sprintf("%d", gr)) // Variable sleep times
+	pg, e := cfg.NewPayloadGenerator(p.ps, fmt.Sprintf("%d", gr))
+	if e != nil {
+		return "", 0, e
+	}
+	qname := cfg.Destination() + "." + qns
 	sh := stompngo.Headers{"destination", qname}
 	ll.Printf("%stag:%s connsess:%s destination dest:%s BEGIN_runSends %d\n",
 		exampid, tag, conn.Session(),
 		qname, gr)
-	if senv.Persistent() {
+	if cfg.Persistent {
 		sh = sh.Add("persistent", "true")
 	}
 	sh = sh.Add(MNHDR, "0")
@@ -173,7 +127,7 @@ func runSends(gr int, qn int) {
 	ll.Printf("%stag:%s connsess:%s send headers:%v\n",
 		exampid, tag, conn.Session(),
 		sh)
-	for i := 1; i <= senv.Nmsgs(); i++ {
+	for i := 1; i <= cfg.Nmsgs; i++ {
 		is := fmt.Sprintf("%d", i) // Next message number
 		sh[mnhnum+1] = is          // Put message number in headers
 		// Log send headers
@@ -181,111 +135,161 @@ func runSends(gr int, qn int) {
 			exampid, tag, conn.Session(),
 			gr, sh)
 
-		// Handle fixed or variable message length
-		rml := 0
-		if msfl {
-			err = conn.SendBytes(sh, msf)
-			rml = len(msf)
-		} else {
-			// ostr := string(sngecomm.Partial())
-			// err = conn.Send(sh, ostr)
-			oby := sngecomm.Partial()
-			err = conn.SendBytes(sh, oby)
-			rml = len(oby)
+		// Next message body, fixed or variable length
+		b := pg.Next()
+		if e := conn.SendBytes(sh, b); e != nil {
+			return qname, i - 1, e
 		}
-		if err != nil {
-			ll.Fatalf("%stag:%s connsess:%s main_on_connect error:%v",
-				exampid, tag, conn.Session(),
-				err.Error()) // Handle this ......
-		}
-		ll.Printf("%stag:%s connsess:%s main_send_complete gr:%d msfl:~%t~len:%d\n",
+		ll.Printf("%stag:%s connsess:%s main_send_complete gr:%d payload:~%s~len:%d\n",
 			exampid, tag, conn.Session(),
-			gr, msfl, rml)
+			gr, pg.Spec(), len(b))
 
 		// Handle sleep options
-		if gorsl {
-			if gorslfb {
+		if cfg.DoSleep {
+			if cfg.FixSleep {
 				// Fixed time to sleep
 				ll.Printf("%stag:%s connsess:%s gr:%d main_fixed sleep:~%v\n",
-					exampid, tag, conn.Session(), gr, gorslfx)
-				time.Sleep(gorslfx)
+					exampid, tag, conn.Session(), gr, p.gorslfx)
+				time.Sleep(p.gorslfx)
 			} else {
 				// Variable time to sleep
-				dt := time.Duration(sngecomm.ValueBetween(min, max, sf))
+				dt := sd.Next()
 				ll.Printf("%stag:%s connsess:%s gr:%d main_rand sleep:~%v\n",
 					exampid, tag, conn.Session(), gr, dt)
 				time.Sleep(dt)
 			}
 		}
 	}
-	if sngecomm.UseEOF() {
+	if cfg.UseEOF {
 		sh := stompngo.Headers{"destination", qname}
-		_ = conn.Send(sh, sngecomm.EOFMsg)
+		if e := conn.Send(sh, sngecomm.EOFMsg); e != nil {
+			return qname, cfg.Nmsgs, e
+		}
 		ll.Printf("%stag:%s connsess:%s gr:%d sent EOF [%s]\n",
 			exampid, tag, conn.Session(), gr, sngecomm.EOFMsg)
 	}
-	wg.Done() // signal a goroutine completion
+	return qname, cfg.Nmsgs, nil
 }
 
-// Connect to a STOMP broker, publish some messages and disconnect.
-func main() {
-
-	if sngecomm.Pprof() {
-		if sngecomm.Cpuprof() != "" {
-			ll.Printf("%stag:%s connsess:%s CPUPROF %s\n",
-				exampid, tag, sngecomm.Lcs, sngecomm.Cpuprof())
-			f, err := os.Create(sngecomm.Cpuprof())
-			if err != nil {
-				log.Fatal("could not create CPU profile: ", err)
-			}
-			if err := pprof.StartCPUProfile(f); err != nil {
-				log.Fatal("could not start CPU profile: ", err)
-			}
-			defer pprof.StopCPUProfile()
-		}
+/*
+Run connects to a STOMP broker, publishes cfg.Nmsgs messages from each of
+cfg.Ngors go routines, and disconnects.  Go routines are numbered from
+cfg.GorNStr, and are multiplexed across cfg.Nqs destinations.  The first
+send error is returned, after all go routines end.
+*/
+func Run(ctx context.Context, cfg *sngecomm.Config, ll *log.Logger) (Result, error) {
+	r := Result{Dests: map[string]int{}}
+	p := &publisher{cfg: cfg, ll: ll}
+	// Options around message bodies:
+	// 1) fixed length
+	// 2) randomly variable length
+	// 3) a named payload generator (STOMP_PAYLOAD)
+	p.ps = fmt.Sprintf("fixed:%d", cfg.FxMsLen)
+	if cfg.VarMsl {
+		p.ps = cfg.VariablePayload()
 	}
+	// Options controlling sleeps between message sends.  Options are:
+	// 1) Don't sleep
+	// 2) Sleep a fixed amount of time
+	// 3) Sleep a random variable amount of time
+	p.gorslfx = time.Duration(cfg.SleepMs) * time.Millisecond
+	// Option controlling destination numbering.  Destinations are normally
+	// suffixed with a sequence number, starting at 1.  This option allows
+	// that starting sequence number to be arbitrary.
+	gorstr := cfg.GorNStr
 
 	st := time.Now()
 
-	// Standard example connect sequence
-	n, conn, e = sngecomm.CommonConnect(exampid, tag, ll)
+	// Standard example connect sequence, bounded by any timeout
+	cctx, cancel := cfg.OpContext(ctx)
+	n, conn, e := cfg.Connect(cctx, exampid, tag, ll)
+	cancel()
 	if e != nil {
-		ll.Fatalf("%stag:%s connsess:%s main_on_connect error:%v",
-			exampid, tag, sngecomm.Lcs,
-			e.Error()) // Handle this ......
+		return r, e
 	}
+	p.conn = conn
 
 	ll.Printf("%stag:%s connsess:%s START gorstr:%d ngor:%d nqs:%d nmsgs:%d\n",
-		exampid, tag, conn.Session(), gorstr, ngor, nqs, senv.Nmsgs())
+		exampid, tag, conn.Session(), gorstr, cfg.Ngors, cfg.Nqs, cfg.Nmsgs)
 
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var se error // First send error
 	rqn := gorstr - 1
-	for i := gorstr; i <= gorstr+ngor-1; i++ {
+	for i := gorstr; i <= gorstr+cfg.Ngors-1; i++ {
 		wg.Add(1)
 		rqn++
-		if nqs > 1 && rqn > nqs {
+		if cfg.Nqs > 1 && rqn > cfg.Nqs {
 			rqn = gorstr
 		}
-		go runSends(i, rqn)
+		go func(gr, qn int) {
+			defer wg.Done() // signal a goroutine completion
+			d, ns, e := p.runSends(gr, qn)
+			mu.Lock()
+			defer mu.Unlock()
+			r.Sent += ns
+			r.Dests[d] += ns
+			if e != nil && se == nil {
+				se = e
+			}
+		}(i, rqn)
 	}
 	wg.Wait()
+	if se != nil {
+		_ = n.Close()
+		return r, se
+	}
 
 	// Standard example disconnect sequence
-	e = sngecomm.CommonDisconnect(n, conn, exampid, tag, ll)
+	e = cfg.Disconnect(ctx, n, conn, exampid, tag, ll)
 	if e != nil {
-		ll.Fatalf("%stag:%s connsess:%s main_on_disconnect error:%v",
-			exampid, tag, conn.Session(),
-			e.Error()) // Handle this ......
+		return r, e
 	}
 
+	r.Elapsed = time.Now().Sub(st)
 	ll.Printf("%stag:%s connsess:%s main_elapsed:%v\n",
 		exampid, tag, conn.Session(),
-		time.Now().Sub(st))
+		r.Elapsed)
+	return r, nil
+}
+
+// Connect to a STOMP broker, publish some messages and disconnect.
+func main() {
+
+	cfg, e := sngecomm.LoadConfig(flag.CommandLine, os.Args[1:])
+	if e != nil {
+		ll.Fatalf("%stag:%s connsess:%s main_config error:%v",
+			exampid, tag, sngecomm.Lcs,
+			e.Error()) // Handle this ......
+	}
+
+	if cfg.Pprof {
+		if cfg.Cpuprof != "" {
+			ll.Printf("%stag:%s connsess:%s CPUPROF %s\n",
+				exampid, tag, sngecomm.Lcs, cfg.Cpuprof)
+			f, err := os.Create(cfg.Cpuprof)
+			if err != nil {
+				log.Fatal("could not create CPU profile: ", err)
+			}
+			if err := pprof.StartCPUProfile(f); err != nil {
+				log.Fatal("could not start CPU profile: ", err)
+			}
+			defer pprof.StopCPUProfile()
+		}
+	}
+
+	r, e := Run(context.Background(), cfg, ll)
+	if e != nil {
+		ll.Fatalf("%stag:%s connsess:%s main_run sent:%d error:%v",
+			exampid, tag, sngecomm.Lcs,
+			r.Sent, e.Error()) // Handle this ......
+	}
 
-	if sngecomm.Pprof() {
-		if sngecomm.Memprof() != "" {
+	if cfg.Pprof {
+		if cfg.Memprof != "" {
 			ll.Printf("%stag:%s connsess:%s MEMPROF %s\n",
-				exampid, tag, conn.Session(), sngecomm.Memprof())
-			f, err := os.Create(sngecomm.Memprof())
+				exampid, tag, sngecomm.Lcs, cfg.Memprof)
+			f, err := os.Create(cfg.Memprof)
 			if err != nil {
 				log.Fatal("could not create memory profile: ", err)
 			}
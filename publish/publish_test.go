@@ -0,0 +1,80 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"testing"
+
+	"github.com/gmallard/stompngo_examples/sngecomm"
+	"github.com/gmallard/stompngo_examples/sngecomm/testbroker"
+	"github.com/gmallard/stompngo_examples/sngecomm/testbroker/brokertest"
+)
+
+/*
+Test publish against a test broker: 3 go routines multiplexed across 2
+queues, persistent, with EOF messages.
+*/
+func TestRun(t *testing.T) {
+	b, cfg, done := brokertest.Start(t, testbroker.Options{})
+	defer done()
+	//
+	cfg.Dest = "/queue/publish.test"
+	cfg.Ngors, cfg.Nqs, cfg.Nmsgs = 3, 2, 4
+	cfg.FxMsLen = 100
+	cfg.Persistent, cfg.UseEOF = true, true
+	r, e := Run(context.Background(), cfg, log.New(ioutil.Discard, "", 0))
+	if e != nil {
+		t.Fatalf("Run, expected no error, got [%v]\n", e)
+	}
+	q1, q2 := cfg.Dest+".1", cfg.Dest+".2"
+	if r.Sent != 12 || r.Dests[q1] != 8 || r.Dests[q2] != 4 {
+		t.Errorf("Run, expected 12 sent, 8 to %s and 4 to %s, got [%+v]\n", q1, q2, r)
+	}
+	// Everything is held by the broker, there being no subscribers
+	if b.Depth(q1) != 10 || b.Depth(q2) != 5 {
+		t.Errorf("Depth, expected 10 and 5, got %d and %d\n", b.Depth(q1), b.Depth(q2))
+	}
+	// Headers, and message number order for the single writer queue
+	mn := 0
+	for _, f := range b.Frames("SEND") {
+		if f.Value("destination") != q2 {
+			continue
+		}
+		if f.Value(MNHDR) == "" {
+			if mn != cfg.Nmsgs || string(f.Body) != sngecomm.EOFMsg {
+				t.Errorf("EOF, expected after %d messages, got [%s] after %d\n",
+					cfg.Nmsgs, f.Body, mn)
+			}
+			continue
+		}
+		mn++
+		if f.Value(MNHDR) != strconv.Itoa(mn) || f.Value("persistent") != "true" ||
+			len(f.Body) != cfg.FxMsLen {
+			t.Errorf("SEND %d, got [%v] length %d\n", mn, f.Headers, len(f.Body))
+		}
+	}
+	if mn != cfg.Nmsgs {
+		t.Errorf("SEND, expected %d to %s, got %d\n", cfg.Nmsgs, q2, mn)
+	}
+	if s := b.Stats(); s.Frames["CONNECT"]+s.Frames["STOMP"] != 1 || s.Frames["DISCONNECT"] != 1 {
+		t.Errorf("Stats, expected one connection, got [%+v]\n", s)
+	}
+}
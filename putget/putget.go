@@ -16,14 +16,13 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
-	"net"
 	"os"
-	"strconv"
 	"time"
 
 	"github.com/gmallard/stompngo"
-	"github.com/gmallard/stompngo/senv"
 	"github.com/gmallard/stompngo_examples/sngecomm"
 )
 
@@ -31,79 +30,90 @@ var (
 	exampid = "putget: "
 	ll      = log.New(os.Stdout, "PUGT ", log.Ldate|log.Lmicroseconds|log.Lshortfile)
 	tag     = "putgemm"
-	conn    *stompngo.Connection
-	n       net.Conn
-	e       error
-	u2      = false
-	wns     int64
-	wd      time.Duration
 )
 
-func main() {
+// Result is the outcome of a Run.
+type Result struct {
+	Sent     int
+	Messages []stompngo.Message // Received, in order
+	Elapsed  time.Duration
+}
+
+/*
+Run puts cfg.Nmsgs messages to a queue, and then gets them, on one
+connection, or two with cfg.TwoConn.  Each connect and receive is bounded by
+the timeout run parameter.
+*/
+func Run(ctx context.Context, cfg *sngecomm.Config, ll *log.Logger) (Result, error) {
 	st := time.Now()
-	// Environment variable controls
-	if os.Getenv("STOMP_2CONN") != "" {
-		u2 = true
+	var r Result
+	// Run controls
+	u2 := cfg.TwoConn
+	wd := time.Duration(cfg.WTime) * time.Millisecond
+	wns := wd.Nanoseconds()
+	// Standard example connect sequence, bounded by any timeout
+	cctx, cancel := cfg.OpContext(ctx)
+	n, conn, e := cfg.Connect(cctx, exampid, tag, ll)
+	cancel()
+	if e != nil {
+		return r, e
 	}
-	wt := os.Getenv("STOMP_WTIME")
-	if wt != "" {
-		_, err := strconv.ParseInt(wt, 10, 64)
-		if err != nil {
-			ll.Fatalf("%stag:%s connsess:%s conversion error:%v",
-				exampid, tag, sngecomm.Lcs,
-				e.Error()) // Handle this ......
-		} else {
-			d, err := time.ParseDuration(wt + "ms")
-			if err != nil {
-				ll.Fatalf("%stag:%s connsess:%s parse error:%v",
-					exampid, tag, sngecomm.Lcs,
-					e.Error()) // Handle this ......
-			}
-			wd = d
-			wns = wd.Nanoseconds()
-		}
+	// fail ends the run when the connection failed, or the broker is not
+	// answering.  quit ends it with the connection still working.
+	fail := func(e error) (Result, error) {
+		_ = n.Close()
+		return r, e
 	}
-	// Standard example connect sequence
-	n, conn, e = sngecomm.CommonConnect(exampid, tag, ll)
-	if e != nil {
-		ll.Fatalf("%stag:%s connsess:%s main_on_connect error:%v",
-			exampid, tag, sngecomm.Lcs,
-			e.Error()) // Handle this ......
+	quit := func(e error) (Result, error) {
+		// Standard example disconnect sequence
+		_ = cfg.Disconnect(ctx, n, conn, exampid, tag, ll)
+		return r, e
 	}
 
 	ll.Printf("%stag:%s connsess:%s START nmsgs:%d\n",
-		exampid, tag, conn.Session(), senv.Nmsgs())
+		exampid, tag, conn.Session(), cfg.Nmsgs)
 	// Put
-	qname := sngecomm.Dest()
+	qname := cfg.Destination()
 	sh := stompngo.Headers{"destination", qname}
 	amsg := "A message from putget"
+	var pg sngecomm.PayloadGenerator // Optional message bodies
+	if cfg.Payload != "" {
+		pg, e = cfg.NewPayloadGenerator("", "putget")
+		if e != nil {
+			return quit(e)
+		}
+		amsg = "payload " + pg.Spec()
+	}
 	// Status message
 	ll.Printf("%stag:%s connsess:%s will PUT: %s, count: %d\n",
-		exampid, tag, conn.Session(), amsg, senv.Nmsgs())
-	for i := 0; i < senv.Nmsgs(); i++ {
-		e = conn.Send(sh, amsg)
+		exampid, tag, conn.Session(), amsg, cfg.Nmsgs)
+	for i := 0; i < cfg.Nmsgs; i++ {
+		if pg != nil {
+			e = conn.SendBytes(sh, pg.Next())
+		} else {
+			e = conn.Send(sh, amsg)
+		}
 		if e != nil {
-			ll.Fatalln("Send error:", e)
+			return fail(e)
 		}
+		r.Sent++
 	}
 	// Possible 2nd connection
 	if u2 {
 		// Standard example disconnect sequence
-		e = sngecomm.CommonDisconnect(n, conn, exampid, tag, ll)
+		e = cfg.Disconnect(ctx, n, conn, exampid, tag, ll)
 		if e != nil {
-			ll.Fatalf("%stag:%s connsess:%s main_on_disconnect1 error:%v",
-				exampid, tag, conn.Session(),
-				e.Error()) // Handle this ......
+			return r, e
 		}
 		if wns > 0 {
 			time.Sleep(wd)
 		}
 		//
-		n, conn, e = sngecomm.CommonConnect(exampid, tag, ll)
+		cctx, cancel = cfg.OpContext(ctx)
+		n, conn, e = cfg.Connect(cctx, exampid, tag, ll)
+		cancel()
 		if e != nil {
-			ll.Fatalf("%stag:%s connsess:%s main_on_connect1 error:%v",
-				exampid, tag, sngecomm.Lcs,
-				e.Error()) // Handle this ......
+			return r, e
 		}
 	} else if wns > 0 {
 		time.Sleep(wd)
@@ -113,18 +123,24 @@ func main() {
 		exampid, tag, conn.Session())
 	// Get
 	id := "putget-subid1"
-	sc := sngecomm.HandleSubscribe(conn, qname, id, sngecomm.AckMode())
+	sctx, cancel := cfg.OpContext(ctx)
+	sc, e := sngecomm.SubscribeContext(sctx, conn, qname, id, cfg.AckMode)
+	cancel()
+	if e != nil {
+		return fail(e)
+	}
 	ll.Printf("%stag:%s connsess:%s subscribe_complete id:%v dest:%v\n",
 		exampid, tag, conn.Session(),
 		id, qname)
 	//
-	for i := 0; i < senv.Nmsgs(); i++ {
-		md := <-sc
-		if md.Error != nil {
-			ll.Fatalf("%stag:%s connsess:%s recv_error dest:%s error:%v",
-				exampid, tag, conn.Session(),
-				qname, md.Error) // Handle this ......
+	for i := 0; i < cfg.Nmsgs; i++ {
+		rctx, cancel := cfg.OpContext(ctx)
+		md, e := sngecomm.ReceiveContext(rctx, sc) // Do not wait forever
+		cancel()
+		if e != nil {
+			return fail(e)
 		}
+		r.Messages = append(r.Messages, md.Message)
 		ll.Printf("%stag:%s connsess:%s message is:%s\n",
 			exampid, tag, conn.Session(),
 			md.Message.BodyString())
@@ -133,13 +149,28 @@ func main() {
 	ll.Printf("%stag:%s connsess:%s GET is done\n",
 		exampid, tag, conn.Session())
 	// Standard example disconnect sequence
-	e = sngecomm.CommonDisconnect(n, conn, exampid, tag, ll)
+	e = cfg.Disconnect(ctx, n, conn, exampid, tag, ll)
 	if e != nil {
-		ll.Fatalf("%stag:%s connsess:%s main_on_disconnect error:%v",
-			exampid, tag, conn.Session(),
-			e.Error()) // Handle this ......
+		return r, e
 	}
+	r.Elapsed = time.Now().Sub(st)
 	ll.Printf("%stag:%s connsess:%s main_elapsed:%v\n",
 		exampid, tag, conn.Session(),
-		time.Now().Sub(st))
+		r.Elapsed)
+	return r, nil
+}
+
+func main() {
+	cfg, e := sngecomm.LoadConfig(flag.CommandLine, os.Args[1:])
+	if e != nil {
+		ll.Fatalf("%stag:%s connsess:%s main_config error:%v",
+			exampid, tag, sngecomm.Lcs,
+			e.Error()) // Handle this ......
+	}
+	r, e := Run(context.Background(), cfg, ll)
+	if e != nil {
+		ll.Fatalf("%stag:%s connsess:%s main_run sent:%d received:%d error:%v",
+			exampid, tag, sngecomm.Lcs,
+			r.Sent, len(r.Messages), e) // Handle this ......
+	}
 }
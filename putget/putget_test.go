@@ -0,0 +1,137 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/gmallard/stompngo_examples/sngecomm/testbroker"
+	"github.com/gmallard/stompngo_examples/sngecomm/testbroker/brokertest"
+)
+
+/*
+Test putget against a test broker, with one and two connections.
+*/
+func TestRun(t *testing.T) {
+	lg := log.New(ioutil.Discard, "", 0)
+	for _, u2 := range []bool{false, true} {
+		b, cfg, done := brokertest.Start(t, testbroker.Options{})
+		//
+		cfg.Dest = fmt.Sprintf("/queue/putget.test.%t", u2)
+		cfg.Nmsgs = 5
+		cfg.TwoConn, cfg.WTime = u2, 10
+		r, e := Run(context.Background(), cfg, lg)
+		done()
+		if e != nil {
+			t.Fatalf("%t, expected no error, got [%v]\n", u2, e)
+		}
+		if r.Sent != 5 || len(r.Messages) != 5 {
+			t.Fatalf("%t, expected 5 sent and received, got [%+v]\n", u2, r)
+		}
+		for _, m := range r.Messages {
+			if string(m.Body) != "A message from putget" ||
+				m.Headers.Value("destination") != cfg.Dest ||
+				m.Headers.Value("subscription") != "putget-subid1" {
+				t.Errorf("%t, got [%v] [%s]\n", u2, m.Headers, m.Body)
+			}
+		}
+		wc := 1
+		if u2 {
+			wc = 2
+		}
+		s := b.Stats()
+		if s.Connections != wc || s.Frames["SEND"] != 5 || s.Delivered != 5 ||
+			b.Depth(cfg.Dest) != 0 {
+			t.Errorf("%t, expected %d connections, 5 sent and delivered, got [%+v]\n",
+				u2, wc, s)
+		}
+		// All SENDs come before the SUBSCRIBE
+		fs := b.Frames("")
+		for i, f := range fs {
+			if f.Command == "SUBSCRIBE" {
+				if n := len(b.Frames("SEND")); i < n {
+					t.Errorf("%t, expected SUBSCRIBE after %d SENDs, at %d\n", u2, n, i)
+				}
+			}
+		}
+	}
+}
+
+/*
+Test putget against a broker that misbehaves.
+*/
+func TestRunFaults(t *testing.T) {
+	lg := log.New(ioutil.Discard, "", 0)
+	tests := []struct {
+		script string
+		got    int    // Messages received
+		err    string // Part of the error
+	}{
+		{"error cmd=SUBSCRIBE", 0, "EOF"},
+		{"drop cmd=MESSAGE after=2", 2, "EOF"},
+		{"delay cmd=MESSAGE after=3 for=2s", 3, "receive"},
+		{"malformed cmd=MESSAGE after=4", 4, "header"},
+		{"noreceipt cmd=DISCONNECT", 5, "disconnect timed out"},
+	}
+	for _, tc := range tests {
+		fs, e := testbroker.ParseFaults(tc.script)
+		if e != nil {
+			t.Fatal(e)
+		}
+		b, cfg, done := brokertest.Start(t, testbroker.Options{Faults: fs})
+		//
+		cfg.Dest = "/queue/putget.faults"
+		cfg.Nmsgs = 5
+		cfg.Timeout = "250ms"
+		cfg.DiscReceipt = true // Bound the DISCONNECT receipt wait
+		r, e := Run(context.Background(), cfg, lg)
+		done()
+		if e == nil || !strings.Contains(e.Error(), tc.err) {
+			t.Errorf("%q, expected an error with %q, got [%v]\n", tc.script, tc.err, e)
+		}
+		if r.Sent != 5 || len(r.Messages) != tc.got {
+			t.Errorf("%q, expected 5 sent and %d received, got %d and %d\n", tc.script,
+				tc.got, r.Sent, len(r.Messages))
+		}
+		if s := b.Stats(); s.Faults == 0 {
+			t.Errorf("%q, expected a fault, got [%+v]\n", tc.script, s)
+		}
+	}
+}
+
+/*
+Test that a bad payload ends putget with a DISCONNECT, the connection still
+working.
+*/
+func TestRunPayloadError(t *testing.T) {
+	b, cfg, done := brokertest.Start(t, testbroker.Options{})
+	defer done()
+	cfg.Dest = "/queue/putget.payload"
+	cfg.Payload = "nosuch:1"
+	r, e := Run(context.Background(), cfg, log.New(ioutil.Discard, "", 0))
+	if e == nil || r.Sent != 0 {
+		t.Fatalf("Run, expected an error and none sent, got [%+v] [%v]\n", r, e)
+	}
+	if s := b.Stats(); s.Frames["DISCONNECT"] != 1 {
+		t.Errorf("Stats, expected a DISCONNECT, got [%+v]\n", s)
+	}
+}
@@ -40,13 +40,14 @@ Show receiving a RECIPT, requested from an ACK.
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"log"
 	"os"
 	"time"
 	//
 	"github.com/gmallard/stompngo"
-	// senv methods could be used in general by stompngo clients.
-	"github.com/gmallard/stompngo/senv"
 	// sngecomm methods are used specifically for these example clients.
 	"github.com/gmallard/stompngo_examples/sngecomm"
 )
@@ -58,7 +59,20 @@ var (
 	tag = "onackmain"
 )
 
-func main() {
+// Result is the outcome of a Run.
+type Result struct {
+	Message   stompngo.Message // The message received and acked
+	ReceiptID string           // Asked for on the ACK
+	Receipt   stompngo.Message // The RECEIPT frame
+	Elapsed   time.Duration
+}
+
+/*
+Run sends one message, and then receives and ACKs it on a second connection,
+asking for a RECEIPT for the ACK.  Connects are bounded by the timeout run
+parameter, as are the message and RECEIPT waits, together.
+*/
+func Run(ctx context.Context, cfg *sngecomm.Config, ll *log.Logger) (Result, error) {
 
 	// Make sure that the queue used by this example do not exist, or are
 	// empty.
@@ -87,29 +101,30 @@ func main() {
 	// Start
 
 	st := time.Now()
+	r := Result{ReceiptID: "receipt-001"}
 
 	// **************************************** Phase 1
 	// Set up the connection.
 	// Standard example connect sequence
-	n, conn, e := sngecomm.CommonConnect(exampid, tag, ll)
+	cctx, cancel := cfg.OpContext(ctx)
+	n, conn, e := cfg.Connect(cctx, exampid, tag, ll)
+	cancel()
 	if e != nil {
-		ll.Fatalf("%stag:%s connsess:%s main_on_connect error:%v",
-			exampid, tag, sngecomm.Lcs,
-			e.Error()) // Handle this ......
+		return r, e
 	}
 
 	// ****************************************
 	// App logic here .....
 
-	d := sngecomm.Dest()
+	d := cfg.Destination()
 	ll.Printf("%stag:%s connsess:%s destination:%v\n",
 		exampid, tag, conn.Session(),
 		d)
 
 	// ****************************************
 	// Send exactly one message.
-	sh := stompngo.Headers{"destination", sngecomm.Dest()}
-	if senv.Persistent() {
+	sh := stompngo.Headers{"destination", d}
+	if cfg.Persistent {
 		sh = sh.Add("persistent", "true")
 	}
 	m := exampid + " message: "
@@ -119,9 +134,8 @@ func main() {
 		t)
 	e = conn.Send(sh, t)
 	if e != nil {
-		ll.Fatalf("%stag:%s connsess:%s main_bad_send error:%v",
-			exampid, tag, conn.Session(),
-			e.Error()) // Handle this ......
+		_ = n.Close()
+		return r, e
 	}
 	ll.Printf("%stag:%s connsess:%s send_complete body:%v\n",
 		exampid, tag, conn.Session(),
@@ -130,41 +144,51 @@ func main() {
 	// ****************************************
 	// Disconnect from the Stomp server
 	// Standard example disconnect sequence
-	e = sngecomm.CommonDisconnect(n, conn, exampid, tag, ll)
+	e = cfg.Disconnect(ctx, n, conn, exampid, tag, ll)
 	if e != nil {
-		ll.Fatalf("%stag:%s connsess:%s main_disconnect error:%v",
-			exampid, tag, conn.Session(),
-			e.Error()) // Handle this ......
+		return r, e
 	}
 
 	// **************************************** Phase 2
 
 	// Standard example connect sequence
-	n, conn, e = sngecomm.CommonConnect(exampid, tag, ll)
+	cctx, cancel = cfg.OpContext(ctx)
+	n, conn, e = cfg.Connect(cctx, exampid, tag, ll)
+	cancel()
 	if e != nil {
-		ll.Fatalf("%stag:%s connsess:%s main_on_connect error:%v",
-			exampid, tag, sngecomm.Lcs,
-			e.Error()) // Handle this ......
+		return r, e
+	}
+	fail := func(e error) (Result, error) {
+		_ = n.Close()
+		return r, e
 	}
 
 	// ****************************************
 	// Subscribe here
 	id := stompngo.Uuid()
 	// Get the "subscribe channel"
-	sc := sngecomm.HandleSubscribe(conn, d, id, "client-individual")
+	sctx, cancel := cfg.OpContext(ctx)
+	sc, e := sngecomm.SubscribeContext(sctx, conn, d, id, "client-individual")
+	cancel()
+	if e != nil {
+		return fail(e)
+	}
 	ll.Printf("%stag:%s connsess:%s stomp_subscribe_complete\n",
 		exampid, tag, conn.Session())
 
 	// Get data from the broker
 	var md stompngo.MessageData // A message data instance
+	rctx, cancel := cfg.OpContext(ctx)
+	defer cancel()
 	select {
 	case md = <-sc:
 	case md = <-conn.MessageData:
 		// This would be contain an ERROR or RECEIPT frame.  Both are unexpected
 		// in this example.
-		ll.Fatalf("%stag:%s connsess:%s bad_frame md:%v",
-			exampid, tag, conn.Session(),
-			md) // Handle this ......
+		return fail(fmt.Errorf("unexpected %s frame: %s", md.Message.Command,
+			md.Message.Headers.Value("message")))
+	case <-rctx.Done():
+		return fail(rctx.Err())
 	}
 	ll.Printf("%stag:%s connsess:%s channel_read_complete\n",
 		exampid, tag, conn.Session())
@@ -173,10 +197,9 @@ func main() {
 	// a) a Message struct
 	// b) an Error value.  Check the error value as usual
 	if md.Error != nil {
-		ll.Fatalf("%stag:%s connsess:%s message_error md:%v",
-			exampid, tag, conn.Session(),
-			md.Error) // Handle this ......
+		return fail(md.Error)
 	}
+	r.Message = md.Message
 
 	ll.Printf("%stag:%s connsess:%s read_message_COMMAND command:%s\n",
 		exampid, tag, conn.Session(),
@@ -198,7 +221,7 @@ func main() {
 		ah = ah.Add("id", md.Message.Headers.Value("ack"))
 	}
 	// We are also going to ask for a RECEIPT for the ACK
-	rid := "receipt-001"
+	rid := r.ReceiptID
 	ah = ah.Add("receipt", rid)
 	//
 	ll.Printf("%stag:%s connsess:%s ACK_receipt_headers headers:%v\n",
@@ -206,9 +229,7 @@ func main() {
 		ah)
 	e = conn.Ack(ah)
 	if e != nil {
-		ll.Fatalf("%stag:%s connsess:%s ack_error error:%v",
-			exampid, tag, conn.Session(),
-			e.Error()) // Handle this ......
+		return fail(e)
 	}
 
 	// ****************************************
@@ -228,17 +249,18 @@ func main() {
 	case rd = <-sc:
 		// This would contain a MESSAGE frame.  It is unexpected here
 		// in this example.
-		ll.Fatalf("%stag:%s connsess:%s bad_frame_channel rd:%v\n",
-			exampid, tag, conn.Session(),
-			rd) // Handle this ......
+		return fail(fmt.Errorf("unexpected %s frame on the subscription",
+			rd.Message.Command))
 	case rd = <-conn.MessageData: // RECEIPT frame s/b in the MessageData
 		// Step 1 of Verify
 		if rd.Message.Command != stompngo.RECEIPT {
-			ll.Fatalf("%stag:%s connsess:%s bad_frame_command rd:%v\n",
-				exampid, tag, conn.Session(),
-				rd) // Handle this ......
+			return fail(fmt.Errorf("expected %s, got %s: %s", stompngo.RECEIPT,
+				rd.Message.Command, rd.Message.Headers.Value("message")))
 		}
+	case <-rctx.Done():
+		return fail(rctx.Err())
 	}
+	r.Receipt = rd.Message
 	ll.Printf("%stag:%s connsess:%s end_receipt_read\n",
 		exampid, tag, conn.Session())
 
@@ -257,9 +279,8 @@ func main() {
 	// Step 2 of Verify
 	// Verify that the receipt has the id we asked for
 	if rd.Message.Headers.Value("receipt-id") != rid {
-		ll.Fatalf("%stag:%s connsess:%s bad_receipt_id wanted:%v got:%v\n",
-			exampid, tag, conn.Session(),
-			rid, rd.Message.Headers.Value("receipt-id")) // Handle this ......
+		return fail(fmt.Errorf("expected receipt-id %s, got %s", rid,
+			rd.Message.Headers.Value("receipt-id")))
 	}
 	ll.Printf("%stag:%s connsess:%s receipt_id_verified rid:%s\n",
 		exampid, tag, conn.Session(),
@@ -268,15 +289,32 @@ func main() {
 	// ****************************************
 	// Disconnect from the Stomp server
 	// Standard example disconnect sequence
-	e = sngecomm.CommonDisconnect(n, conn, exampid, tag, ll)
+	e = cfg.Disconnect(ctx, n, conn, exampid, tag, ll)
 	if e != nil {
-		ll.Fatalf("%stag:%s connsess:%s main_disconnect error:%v",
-			exampid, tag, sngecomm.Lcs,
-			e.Error()) // Handle this ......
+		return r, e
 	}
 
+	r.Elapsed = time.Now().Sub(st)
 	ll.Printf("%stag:%s connsess:%s main_elapsed:%v\n",
 		exampid, tag, conn.Session(),
-		time.Now().Sub(st))
+		r.Elapsed)
+	return r, nil
+}
+
+func main() {
+
+	cfg, e := sngecomm.LoadConfig(flag.CommandLine, os.Args[1:])
+	if e != nil {
+		ll.Fatalf("%stag:%s connsess:%s main_config error:%v",
+			exampid, tag, sngecomm.Lcs,
+			e.Error()) // Handle this ......
+	}
+
+	_, e = Run(context.Background(), cfg, ll)
+	if e != nil {
+		ll.Fatalf("%stag:%s connsess:%s main_run error:%v",
+			exampid, tag, sngecomm.Lcs,
+			e.Error()) // Handle this ......
+	}
 
 }
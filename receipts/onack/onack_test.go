@@ -0,0 +1,71 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"testing"
+
+	"github.com/gmallard/stompngo"
+	"github.com/gmallard/stompngo_examples/sngecomm/testbroker"
+	"github.com/gmallard/stompngo_examples/sngecomm/testbroker/brokertest"
+)
+
+/*
+Test onack against a test broker.
+*/
+func TestRun(t *testing.T) {
+	b, cfg, done := brokertest.Start(t, testbroker.Options{})
+	defer done()
+	//
+	cfg.Dest = "/queue/onack.test"
+	r, e := Run(context.Background(), cfg, log.New(ioutil.Discard, "", 0))
+	if e != nil {
+		t.Fatalf("Run, expected no error, got [%v]\n", e)
+	}
+	if string(r.Message.Body) != exampid+" message: 1" ||
+		r.Message.Headers.Value("destination") != cfg.Dest {
+		t.Errorf("Run, got message [%v] [%s]\n", r.Message.Headers, r.Message.Body)
+	}
+	if r.Receipt.Command != stompngo.RECEIPT ||
+		r.Receipt.Headers.Value("receipt-id") != r.ReceiptID {
+		t.Errorf("Run, expected RECEIPT %s, got [%+v]\n", r.ReceiptID, r.Receipt)
+	}
+	// Two connections: SEND on the first, SUBSCRIBE and ACK on the second
+	var cmds []string
+	for _, f := range b.Frames("") {
+		cmds = append(cmds, f.Command)
+	}
+	want := []string{"CONNECT", "SEND", "DISCONNECT", "CONNECT", "SUBSCRIBE", "ACK",
+		"DISCONNECT"}
+	if len(cmds) != len(want) {
+		t.Fatalf("Frames, expected %v, got %v\n", want, cmds)
+	}
+	for i := range want {
+		if cmds[i] != want[i] && !(want[i] == "CONNECT" && cmds[i] == "STOMP") {
+			t.Fatalf("Frames, expected %v, got %v\n", want, cmds)
+		}
+	}
+	if a := b.Frames("ACK")[0]; a.Value("receipt") != r.ReceiptID {
+		t.Errorf("ACK, expected a receipt request, got [%v]\n", a.Headers)
+	}
+	if s := b.Stats(); s.Acked != 1 || b.Unacked(cfg.Dest) != 0 || b.Depth(cfg.Dest) != 0 {
+		t.Errorf("Stats, expected 1 acked and none left, got [%+v]\n", s)
+	}
+}
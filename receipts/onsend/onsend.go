@@ -36,17 +36,20 @@ Show receiving a RECIPT, requested from a SEND.
 		# Publish to a broker using a custom login and passcode:
 		STOMP_LOGIN="userid" STOMP_PASSCODE="t0ps3cr3t" go run onsend.go
 
+		# Give up if the RECEIPT does not arrive within 10 seconds:
+		STOMP_TIMEOUT=10s go run onsend.go
+
 */
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
 	"os"
 	"time"
 	//
 	"github.com/gmallard/stompngo"
-	// senv methods could be used in general by stompngo clients.
-	"github.com/gmallard/stompngo/senv"
 	// sngecomm methods are used specifically for these example clients.
 	"github.com/gmallard/stompngo_examples/sngecomm"
 )
@@ -58,33 +61,46 @@ var (
 	tag = "onsendmain"
 )
 
-func main() {
+// Result is the outcome of a Run.
+type Result struct {
+	ReceiptID string           // Asked for on the SEND
+	Receipt   stompngo.Message // The RECEIPT frame
+	Elapsed   time.Duration
+}
+
+/*
+Run connects to a STOMP broker, sends one message asking for a RECEIPT, waits
+for the RECEIPT, and disconnects.  The receipt wait is bounded by the timeout
+run parameter.
+*/
+func Run(ctx context.Context, cfg *sngecomm.Config, ll *log.Logger) (Result, error) {
 
 	st := time.Now()
+	r := Result{ReceiptID: "recipt-002"} // The receipt ID
 
 	// ****************************************
 	// Set up the connection.
 	// Standard example connect sequence
-	n, conn, e := sngecomm.CommonConnect(exampid, tag, ll)
+	cctx, cancel := cfg.OpContext(ctx)
+	n, conn, e := cfg.Connect(cctx, exampid, tag, ll)
+	cancel()
 	if e != nil {
-		ll.Fatalf("%stag:%s connsess:%s main_on_connect error:%v",
-			exampid, tag, sngecomm.Lcs,
-			e.Error()) // Handle this ......
+		return r, e
 	}
 
 	// ****************************************
 	// App logic here .....
 	// Send exactly one message.  Ask for a receipt.
 
-	d := sngecomm.Dest()
+	d := cfg.Destination()
 	ll.Printf("%stag:%s connsess:%s destination:%v\n",
 		exampid, tag, conn.Session(),
 		d)
 
-	rid := "recipt-002" // The receipt ID
+	rid := r.ReceiptID
 	sh := stompngo.Headers{"destination", d,
 		"receipt", rid} // send headers
-	if senv.Persistent() {
+	if cfg.Persistent {
 		sh = sh.Add("persistent", "true")
 	}
 	ms := exampid + " message: "
@@ -94,9 +110,8 @@ func main() {
 		t)
 	e = conn.Send(sh, t)
 	if e != nil {
-		ll.Fatalf("%stag:%s connsess:%s main_bad_send error:%v",
-			exampid, tag, conn.Session(),
-			e.Error()) // Handle this ......
+		_ = n.Close()
+		return r, e
 	}
 	ll.Printf("%stag:%s connsess:%s send_complete body:%v\n",
 		exampid, tag, conn.Session(),
@@ -105,11 +120,15 @@ func main() {
 	// Look for the receipt
 	ll.Printf("%stag:%s connsess:%s start_receipt_read\n",
 		exampid, tag, conn.Session())
-	rd := <-conn.MessageData // The RECEIPT frame should be on this channel
-	if rd.Message.Command != stompngo.RECEIPT {
-		ll.Fatalf("%stag:%s connsess:%s bad_frame_command rd:%v\n",
-			exampid, tag, conn.Session(),
-			rd) // Handle this ......
+	// The RECEIPT frame should be on conn.MessageData.  Do not wait forever.
+	// A RECEIPT with another id is an error.
+	rctx, cancel := cfg.OpContext(ctx)
+	rd, e := sngecomm.AwaitReceiptContext(rctx, conn, rid)
+	cancel()
+	r.Receipt = rd.Message
+	if e != nil {
+		_ = n.Close()
+		return r, e
 	}
 	ll.Printf("%stag:%s connsess:%s end_receipt_read\n",
 		exampid, tag, conn.Session())
@@ -125,27 +144,36 @@ func main() {
 	ll.Printf("%stag:%s connsess:%s receipt_BODY body:%s\n",
 		exampid, tag, conn.Session(),
 		string(rd.Message.Body))
-
-	// Step 2 of Verify
-	// Verify that the receipt has the id we asked for
-	if rd.Message.Headers.Value("receipt-id") != rid {
-		ll.Fatalf("%stag:%s connsess:%s bad_receipt_id wanted:%v got:%v\n",
-			exampid, tag, conn.Session(),
-			rid, rd.Message.Headers.Value("receipt-id")) // Handle this ......
-	}
 	ll.Printf("%stag:%s connsess:%s receipt_id_verified rid:%s headers:%+v\n",
 		exampid, tag, conn.Session(),
 		rid, rd.Message.Headers)
 
-	e = sngecomm.CommonDisconnect(n, conn, exampid, tag, ll)
+	e = cfg.Disconnect(ctx, n, conn, exampid, tag, ll)
 	if e != nil {
-		ll.Fatalf("%stag:%s connsess:%s main_disconnect error:%v",
-			exampid, tag, sngecomm.Lcs,
-			e.Error()) // Handle this ......
+		return r, e
 	}
 
+	r.Elapsed = time.Now().Sub(st)
 	ll.Printf("%stag:%s connsess:%s main_elapsed:%v\n",
 		exampid, tag, conn.Session(),
-		time.Now().Sub(st))
+		r.Elapsed)
+	return r, nil
+}
+
+func main() {
+
+	cfg, e := sngecomm.LoadConfig(flag.CommandLine, os.Args[1:])
+	if e != nil {
+		ll.Fatalf("%stag:%s connsess:%s main_config error:%v",
+			exampid, tag, sngecomm.Lcs,
+			e.Error()) // Handle this ......
+	}
+
+	_, e = Run(context.Background(), cfg, ll)
+	if e != nil {
+		ll.Fatalf("%stag:%s connsess:%s main_run error:%v",
+			exampid, tag, sngecomm.Lcs,
+			e.Error()) // Handle this ......
+	}
 
 }
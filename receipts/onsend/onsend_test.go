@@ -0,0 +1,59 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"testing"
+
+	"github.com/gmallard/stompngo"
+	"github.com/gmallard/stompngo_examples/sngecomm/testbroker"
+	"github.com/gmallard/stompngo_examples/sngecomm/testbroker/brokertest"
+)
+
+/*
+Test onsend against a test broker.
+*/
+func TestRun(t *testing.T) {
+	b, cfg, done := brokertest.Start(t, testbroker.Options{})
+	defer done()
+	//
+	cfg.Dest = "/queue/onsend.test"
+	cfg.Persistent = true
+	r, e := Run(context.Background(), cfg, log.New(ioutil.Discard, "", 0))
+	if e != nil {
+		t.Fatalf("Run, expected no error, got [%v]\n", e)
+	}
+	if r.Receipt.Command != stompngo.RECEIPT ||
+		r.Receipt.Headers.Value("receipt-id") != r.ReceiptID {
+		t.Errorf("Run, expected RECEIPT %s, got [%+v]\n", r.ReceiptID, r.Receipt)
+	}
+	fs := b.Frames("SEND")
+	if len(fs) != 1 {
+		t.Fatalf("SEND, expected 1, got %d\n", len(fs))
+	}
+	f := fs[0]
+	if f.Value("receipt") != r.ReceiptID || f.Value("persistent") != "true" ||
+		f.Value("destination") != cfg.Dest || string(f.Body) != exampid+" message: "+r.ReceiptID {
+		t.Errorf("SEND, got [%v] [%s]\n", f.Headers, f.Body)
+	}
+	if b.Depth(cfg.Dest) != 1 {
+		t.Errorf("Depth, expected 1, got %d\n", b.Depth(cfg.Dest))
+	}
+}
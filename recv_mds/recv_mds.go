@@ -32,23 +32,36 @@ Prime the queue for this demonstration using publish.go.
 		# Prime a queue with messages:
 		STOMP_PORT=61613 STOMP_NMSGS=10 go run publish.go
 		# Review ActiveMQ balancing characteristics.  Note:
-		# this will eventually block, and the program will have to be
-		# forcibly stopped.
+		# this will eventually block.  Stop it with ^C.
 		STOMP_PORT=61613 STOMP_ACKMODE="client-individual" go run recv_mds.go
 
 		# Prime a queue with messages again:
 		STOMP_PORT=62613 STOMP_NMSGS=10 go run publish.go
 		# Review Apollo balancing characteristics.  Note:
-		# this will eventually block, and the program will have to be
-		# forcibly stopped.
+		# this will eventually block.  Stop it with ^C.
 		STOMP_PORT=62613 STOMP_ACKMODE="client-individual" go run recv_mds.go
 
+		# The same, using named broker profiles from stomp_profiles.yaml:
+		STOMP_PROFILE=activemq STOMP_NMSGS=10 go run publish.go
+		STOMP_PROFILE=activemq STOMP_ACKMODE="client-individual" go run recv_mds.go
+		STOMP_PROFILE=apollo STOMP_NMSGS=10 go run publish.go
+		STOMP_PROFILE=apollo STOMP_ACKMODE="client-individual" go run recv_mds.go
+
+		# Survive broker restarts, failing over between two brokers:
+		STOMP_FAILOVER="failover:(tcp://a:61613,tcp://b:61613)" go run recv_mds.go
+
+On SIGINT or SIGTERM each receiver finishes the message in hand, NACKs any
+it has not started, and unsubscribes.  The connection is then disconnected,
+and statistics shown.  The exit code is 0 for a clean shutdown, see
+sngecomm.Shutdown.
+
 */
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
-	"net"
 	"os"
 	"runtime"
 	"time"
@@ -63,17 +76,19 @@ import (
 var (
 	exampid = "recv_mds: "
 	ns      = 4                           // Number of subscriptions
-	n       net.Conn                      // Network Connection
+	rc      *sngecomm.Resilient           // Reconnecting Connection
 	conn    *stompngo.Connection          // Stomp Connection
 	ackMode string               = "auto" // ackMode control
 	port    string
+	cfg     *sngecomm.Config
 	ll      = log.New(os.Stdout, "EMDS ", log.Ldate|log.Lmicroseconds|log.Lshortfile)
 
 	tag = "recvmdsmain"
 )
 
-func recv(conn *stompngo.Connection, s int) {
+func recv(ctx context.Context, rc *sngecomm.Resilient, s int) error {
 	ltag := tag + "-recv"
+	conn := rc.Conn()
 
 	ll.Printf("%stag:%s connsess:%s receiver_starts s:%d\n",
 		exampid, ltag, conn.Session(),
@@ -81,19 +96,21 @@ func recv(conn *stompngo.Connection, s int) {
 
 	// Setup Headers ...
 	id := stompngo.Uuid() // Use package convenience function for unique ID
-	d := sngecomm.Dest()
-	ackMode = sngecomm.AckMode() // get ack mode
+	d := cfg.Destination()
+	ackMode = cfg.AckMode // get ack mode
 
-	pbc := sngecomm.Pbc() // Print byte count
+	pbc := cfg.Pbc // Print byte count
 
 	sc := sngecomm.HandleSubscribe(conn, d, id, ackMode)
 	// Receive loop.
 	mc := 0
 	var md stompngo.MessageData
-	for {
+	for ctx.Err() == nil { // Until shutdown
 		select {
+		case <-ctx.Done():
+			continue
 		case md = <-sc: // Read a messagedata struct, with a MESSAGE frame
-		case md = <-conn.MessageData: // Read a messagedata struct, with a ERROR/RECEIPT frame
+		case md = <-rc.MessageData: // Read a messagedata struct, with a ERROR/RECEIPT frame
 			// Frames RECEIPT or ERROR not expected here
 			ll.Fatalf("%stag:%s connsess:%s bad_frame md:%v",
 				exampid, ltag, conn.Session(),
@@ -101,6 +118,7 @@ func recv(conn *stompngo.Connection, s int) {
 		}
 		//
 		mc++
+		conn = rc.Conn() // Possibly reconnected
 		if md.Error != nil {
 			ll.Fatalf("%stag:%s connsess:%s error_read error:%v",
 				exampid, ltag, conn.Session(),
@@ -133,26 +151,55 @@ func recv(conn *stompngo.Connection, s int) {
 		}
 		runtime.Gosched()
 	}
+	// Shutting down
+	nn, e := sngecomm.StopConsumer(conn, sc, d, id, ackMode)
+	ll.Printf("%stag:%s connsess:%s receiver_stopped s:%d id:%s mc:%d nacked:%d\n",
+		exampid, ltag, conn.Session(),
+		s, id, mc, nn)
+	return e
 }
 
 // Connect to a STOMP broker, receive and ackMode some messages.
-// Disconnect never occurs, kill via ^C.
+// Stop via ^C.
 func main() {
 
-	// Standard example connect sequence
-	_, conn, e := sngecomm.CommonConnect(exampid, tag, ll)
+	var e error
+	cfg, e = sngecomm.LoadConfig(flag.CommandLine, os.Args[1:])
+	if e != nil {
+		ll.Fatalf("%stag:%s connsess:%s main_config error:%v",
+			exampid, tag, sngecomm.Lcs,
+			e.Error()) // Handle this ......
+	}
+
+	// Connect, and reconnect when the broker goes away
+	rc, e = sngecomm.ResilientConnect(exampid, tag, ll)
 	if e != nil {
 		ll.Fatalf("%stag:%s connsess:%s main_on_connect error:%v",
 			exampid, tag, sngecomm.Lcs,
 			e.Error()) // Handle this ......
 	}
+	conn = rc.Conn()
 
+	sd := sngecomm.NewShutdown(exampid, tag, ll)
 	for i := 1; i <= ns; i++ {
-		go recv(conn, i)
+		s := i
+		sd.Go(func(ctx context.Context) error { return recv(ctx, rc, s) })
 	}
 	ll.Printf("%stag:%s connsess:%s receivers_started\n",
 		exampid, tag, conn.Session())
 
-	select {} // This will never complete, use ^C to cancel
-
+	sd.Wait() // Until ^C
+	conn = rc.Conn()
+	if e = rc.Disconnect(); e != nil {
+		sd.Fail("disconnect", e)
+	} else {
+		ll.Printf("%stag:%s connsess:%s disconnect_receipt:%v\n",
+			exampid, tag, conn.Session(),
+			conn.DisconnectReceipt.Message.Headers)
+	}
+	sngecomm.ShowStats(exampid, tag, conn)
+	ll.Printf("%stag:%s connsess:%s main_exit code:%d\n",
+		exampid, tag, conn.Session(),
+		sd.Code())
+	os.Exit(sd.Code())
 }
@@ -0,0 +1,233 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package sngecomm
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+CertReloader is a client certificate source that follows its files, for
+long running clients whose certificates are renewed in place.  Use
+GetClientCertificate as tls.Config.GetClientCertificate: each handshake, and
+so each reconnect, checks the files and loads renewed material.
+
+A failed reload, e.g. a certificate and key written separately and not yet
+matching, is logged and the previous certificate kept.  Rotations are
+logged, and a warning when the certificate is near expiry.
+*/
+type CertReloader struct {
+	Warn   time.Duration // Warn at this time to expiry, default a fifth of the validity
+	Logger *log.Logger   // Default llu
+	//
+	t      ProfileTLS
+	mu     sync.Mutex
+	cert   *tls.Certificate
+	stamp  string // File modification times and sizes
+	warned bool   // Expiry warning logged for cert
+}
+
+// NewCertReloader returns a CertReloader for the CertFile and KeyFile, or
+// PKCS12File, of t, with the certificate loaded.
+func NewCertReloader(t *ProfileTLS) (*CertReloader, error) {
+	if t.CertFile == "" && t.PKCS12File == "" {
+		return nil, fmt.Errorf("certificate reload needs a certfile or pkcs12file")
+	}
+	r := &CertReloader{t: *t}
+	if t.CertWarn != "" {
+		d, e := time.ParseDuration(t.CertWarn)
+		if e != nil {
+			return nil, fmt.Errorf("certwarn: %v", e)
+		}
+		r.Warn = d
+	}
+	if _, e := r.Reload(); e != nil {
+		return nil, e
+	}
+	return r, nil
+}
+
+var (
+	reloaders     = map[ProfileTLS]*CertReloader{} // By the settings they follow
+	reloadersLock sync.Mutex                       // reloaders variable lock
+)
+
+// certReloader returns the CertReloader for t, creating it on first use.
+// apply runs for every dial, and reconnects must share one, to keep its
+// current certificate and expiry warning state.
+func certReloader(t *ProfileTLS) (*CertReloader, error) {
+	reloadersLock.Lock()
+	defer reloadersLock.Unlock()
+	if r, ok := reloaders[*t]; ok {
+		return r, nil
+	}
+	r, e := NewCertReloader(t)
+	if e != nil {
+		return nil, e
+	}
+	reloaders[*t] = r
+	return r, nil
+}
+
+// files returns the watched files.
+func (r *CertReloader) files() []string {
+	if r.t.PKCS12File != "" {
+		return []string{r.t.PKCS12File}
+	}
+	return []string{r.t.CertFile, r.t.KeyFile}
+}
+
+// logger returns the logger.
+func (r *CertReloader) logger() *log.Logger {
+	if r.Logger != nil {
+		return r.Logger
+	}
+	return llu
+}
+
+/*
+Reload loads the certificate if its files have changed, returning whether a
+new certificate was loaded.  On an error the current certificate is kept.
+GetClientCertificate and Watch call Reload.
+*/
+func (r *CertReloader) Reload() (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fs := r.files()
+	var st string
+	for _, f := range fs {
+		fi, e := os.Stat(f)
+		if e != nil {
+			return false, r.reloadError(e)
+		}
+		st += fmt.Sprintf("%s:%d:%d ", f, fi.ModTime().UnixNano(), fi.Size())
+	}
+	if st == r.stamp {
+		r.checkExpiry(time.Now())
+		return false, nil
+	}
+	c, e := r.t.loadCert()
+	if e != nil {
+		return false, r.reloadError(e)
+	}
+	r.stamp = st
+	old := r.cert
+	if old != nil && bytes.Equal(old.Certificate[0], c.Certificate[0]) {
+		r.checkExpiry(time.Now()) // Rewritten, not renewed
+		return false, nil
+	}
+	r.cert, r.warned = &c, false
+	x := c.Leaf
+	if old == nil {
+		r.logger().Printf("tls_cert_loaded file:%s subject:%s serial:%s notafter:%s\n",
+			fs[0], x.Subject, x.SerialNumber, x.NotAfter.Format(time.RFC3339))
+	} else {
+		r.logger().Printf("tls_cert_rotated file:%s subject:%s serial:%s notafter:%s previous_serial:%s previous_notafter:%s\n",
+			fs[0], x.Subject, x.SerialNumber, x.NotAfter.Format(time.RFC3339),
+			old.Leaf.SerialNumber, old.Leaf.NotAfter.Format(time.RFC3339))
+	}
+	r.checkExpiry(time.Now())
+	return true, nil
+}
+
+// reloadError logs and returns a reload error.
+func (r *CertReloader) reloadError(e error) error {
+	if r.cert != nil {
+		r.logger().Printf("tls_cert_reload_error file:%s error:%v, keeping serial:%s\n",
+			r.files()[0], e, r.cert.Leaf.SerialNumber)
+	}
+	return e
+}
+
+// checkExpiry logs a warning, once per certificate, when it is near expiry.
+func (r *CertReloader) checkExpiry(now time.Time) {
+	x := r.cert.Leaf
+	w := r.Warn
+	if w <= 0 {
+		w = x.NotAfter.Sub(x.NotBefore) / 5
+	}
+	left := x.NotAfter.Sub(now)
+	if r.warned || left > w {
+		return
+	}
+	r.warned = true
+	r.logger().Printf("tls_cert_expiry_warning file:%s subject:%s serial:%s notafter:%s remaining:%s\n",
+		r.files()[0], x.Subject, x.SerialNumber, x.NotAfter.Format(time.RFC3339),
+		left.Truncate(time.Second))
+}
+
+// Certificate returns the current certificate.
+func (r *CertReloader) Certificate() *tls.Certificate {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cert
+}
+
+// GetClientCertificate reloads the certificate if changed, and returns it.
+// Reload errors are logged, and the current certificate returned.
+func (r *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	_, _ = r.Reload()
+	return r.Certificate(), nil
+}
+
+// Watch calls Reload every d until ctx is done, so that rotations and
+// expiry warnings are logged between handshakes.
+func (r *CertReloader) Watch(ctx context.Context, d time.Duration) {
+	tk := time.NewTicker(d)
+	defer tk.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tk.C:
+			_, _ = r.Reload()
+		}
+	}
+}
+
+// loadCert loads the client certificate and key, from the PKCS#12 file or
+// else the PEM files, with Leaf set.
+func (t *ProfileTLS) loadCert() (tls.Certificate, error) {
+	var c tls.Certificate
+	var e error
+	if t.PKCS12File != "" {
+		d, e := ioutil.ReadFile(t.PKCS12File)
+		if e != nil {
+			return c, e
+		}
+		if c, e = DecodePKCS12(d, t.PKCS12Password); e != nil {
+			return c, fmt.Errorf("%s: %v", t.PKCS12File, e)
+		}
+	} else if c, e = tls.LoadX509KeyPair(t.CertFile, t.KeyFile); e != nil {
+		return c, e
+	}
+	if c.Leaf == nil {
+		if c.Leaf, e = x509.ParseCertificate(c.Certificate[0]); e != nil {
+			return c, e
+		}
+	}
+	return c, nil
+}
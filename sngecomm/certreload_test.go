@@ -0,0 +1,192 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package sngecomm
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+Test client certificate reload: rotation, a failed reload, the expiry
+warning, and a handshake with a reloaded certificate.
+*/
+// certFiles writes a PKI with clients alice and bob to a new directory.  It
+// returns the PKI, the directory, the client.crt and client.key paths, and
+// install, which copies a client's files to those paths with a new
+// modification time.
+func certFiles(t *testing.T) (*PKI, string, string, string, func(cert, key string)) {
+	p, e := GeneratePKI(PKIOptions{KeyType: "ecdsa", Clients: []string{"alice", "bob"}})
+	if e != nil {
+		t.Fatal(e)
+	}
+	d, e := ioutil.TempDir("", "sngecomm")
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e = p.Write(d, "changeit"); e != nil {
+		os.RemoveAll(d)
+		t.Fatal(e)
+	}
+	cf, kf := filepath.Join(d, "client.crt"), filepath.Join(d, "client.key")
+	bump := time.Now()
+	install := func(cert, key string) {
+		for _, f := range [][2]string{{cert + ".crt", cf}, {key + ".key", kf}} {
+			b, e := ioutil.ReadFile(filepath.Join(d, f[0]))
+			if e != nil {
+				t.Fatal(e)
+			}
+			if e = ioutil.WriteFile(f[1], b, 0600); e != nil {
+				t.Fatal(e)
+			}
+			bump = bump.Add(time.Second)
+			if e = os.Chtimes(f[1], bump, bump); e != nil {
+				t.Fatal(e)
+			}
+		}
+	}
+	return p, d, cf, kf, install
+}
+
+func TestCertReload(t *testing.T) {
+	p, d, cf, kf, install := certFiles(t)
+	defer os.RemoveAll(d)
+	install("alice", "alice")
+	var e error
+	if _, e = NewCertReloader(&ProfileTLS{}); e == nil {
+		t.Error("NewCertReloader with no files, expected an error")
+	}
+	r, e := NewCertReloader(&ProfileTLS{CertFile: cf, KeyFile: kf})
+	if e != nil {
+		t.Fatalf("NewCertReloader, expected no error, got [%v]\n", e)
+	}
+	var lb bytes.Buffer
+	r.Logger = log.New(&lb, "", 0)
+	cn := func() string {
+		c, e := r.GetClientCertificate(nil)
+		if e != nil || c == nil {
+			t.Fatalf("GetClientCertificate, got [%v]\n", e)
+		}
+		return c.Leaf.Subject.CommonName
+	}
+	if n := cn(); n != "alice" {
+		t.Errorf("GetClientCertificate, expected alice, got %s\n", n)
+	}
+	install("bob", "bob")
+	if n := cn(); n != "bob" || !strings.Contains(lb.String(), "tls_cert_rotated") {
+		t.Errorf("Rotation, expected bob, got %s [%s]\n", n, lb.String())
+	}
+	// A certificate and key that do not match keep the current certificate
+	install("alice", "bob")
+	if n := cn(); n != "bob" || !strings.Contains(lb.String(), "tls_cert_reload_error") {
+		t.Errorf("Mismatch, expected bob, got %s [%s]\n", n, lb.String())
+	}
+	if strings.Contains(lb.String(), "tls_cert_expiry_warning") {
+		t.Errorf("Expected no expiry warning, got [%s]\n", lb.String())
+	}
+	r.Warn = 400 * 24 * time.Hour
+	install("alice", "alice")
+	if n := cn(); n != "alice" || strings.Count(lb.String(), "tls_cert_expiry_warning") != 1 {
+		t.Errorf("Expiry warning, expected alice, got %s [%s]\n", n, lb.String())
+	}
+	cn() // Warned once per certificate
+	if strings.Count(lb.String(), "tls_cert_expiry_warning") != 1 {
+		t.Errorf("Expected one expiry warning, got [%s]\n", lb.String())
+	}
+	//
+	c, e := (&ProfileTLS{CertFile: cf, KeyFile: kf, CertReload: true,
+		CertWarn: "72h"}).Config()
+	if e != nil || len(c.Certificates) != 0 || c.GetClientCertificate == nil {
+		t.Fatalf("Config certreload, expected GetClientCertificate, got [%v]\n", e)
+	}
+	if _, e = (&ProfileTLS{CertReload: true}).Config(); e == nil {
+		t.Error("Config certreload with no files, expected an error")
+	}
+	if _, e = (&ProfileTLS{CertWarn: "3 days"}).Config(); e == nil {
+		t.Error("Config certwarn 3 days, expected an error")
+	}
+	c.RootCAs, c.ServerName = p.Pool(), "localhost"
+	install("bob", "bob")
+	if e = pkiHandshake(t, &tls.Config{Certificates: []tls.Certificate{p.Broker},
+		ClientCAs: p.Pool(), ClientAuth: tls.RequireAndVerifyClientCert}, c); e != nil {
+		t.Errorf("Handshake, expected no error, got [%v]\n", e)
+	}
+}
+
+/*
+Test that reconnects share one CertReloader: a Resilient dials, the client
+certificate is rotated, and the reconnect presents the new certificate,
+with the rotation logged.
+*/
+func TestCertReloadReconnect(t *testing.T) {
+	p, d, cf, kf, install := certFiles(t)
+	defer os.RemoveAll(d)
+	install("alice", "alice")
+	l, e := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{p.Broker},
+		ClientCAs:    p.Pool(), ClientAuth: tls.RequireAndVerifyClientCert})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer l.Close()
+	fc := serveTestBroker(l)
+	//
+	defer setTestEnv("STOMP_PROTOCOL", "1.2")()
+	b := resolveBroker(nil, nil).at(l.Addr().String())
+	b.UseTLS = true
+	b.TLS = &ProfileTLS{CAFile: filepath.Join(d, "ca.crt"), CertFile: cf, KeyFile: kf,
+		CertReload: true}
+	r, e := certReloader(b.TLS)
+	if e != nil {
+		t.Fatal(e)
+	}
+	var lb bytes.Buffer
+	r.Logger = log.New(&lb, "", 0)
+	f := &Failover{Brokers: []string{l.Addr().String()},
+		Initial: 10 * time.Millisecond, Max: 50 * time.Millisecond, Multiplier: 2.0}
+	rc, e := NewResilient("test: ", "certreload", log.New(ioutil.Discard, "", 0), b, f)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer rc.Disconnect()
+	// cn returns the client certificate name for a frame's connection
+	cn := func(f testFrame) string {
+		return f.c.(*tls.Conn).ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+	if n := cn(nextFrame(t, fc, "CONNECT")); n != "alice" {
+		t.Errorf("first connect, expected alice, got %s\n", n)
+	}
+	if _, e = rc.Subscribe("/queue/certreload", "s1", "auto"); e != nil {
+		t.Fatal(e)
+	}
+	install("bob", "bob")
+	nextFrame(t, fc, "SUBSCRIBE").c.Close() // Bounce
+	if n := cn(nextFrame(t, fc, "CONNECT")); n != "bob" {
+		t.Errorf("reconnect, expected bob, got %s\n", n)
+	}
+	nextFrame(t, fc, "SUBSCRIBE")
+	if strings.Count(lb.String(), "tls_cert_rotated") != 1 {
+		t.Errorf("expected one rotation, got [%s]\n", lb.String())
+	}
+}
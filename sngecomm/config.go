@@ -0,0 +1,612 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package sngecomm
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+/*
+Config holds the run parameters used by the example programs.
+
+A Config is loaded once, in layers.  Each layer overrides the one before it:
+
+ 1. built in defaults
+ 2. an optional JSON or YAML file (-config flag, or STOMP_CONFIG)
+ 3. STOMP_* environment variables, options in STOMP_URL first
+ 4. command line flags
+
+Unlike the individual environment getters, LoadConfig reports every value
+that fails to parse or validate, and every invalid combination of values.
+*/
+type Config struct {
+	Nqs              int     // Number of queues
+	Ngors            int     // Number of go routines
+	Mdml             int     // Max data message length
+	Pbc              int     // Print byte count
+	AckMode          string  // auto, client, or client-individual
+	SendFactor       float64 // Send sleep time factor
+	RecvFactor       float64 // Receive sleep time factor
+	SendWait         bool    // Wait in sends to simulate processing
+	RecvWait         bool    // Wait in receives to simulate processing
+	SetMaxProcs      bool    // Set GOMAXPROCS to the number of CPUs
+	Pprof            bool    // Do profiling
+	Memprof          string  // Memory profile file name
+	Cpuprof          string  // CPU profile file name
+	Gorsleep         string  // If non-empty, go routines sleep
+	UseEOF           bool    // Send / expect an EOF message
+	UseCustomCiphers bool    // Use the custom cipher suite list
+	Logger           string  // stompngo connection logger prefix
+	LogFile          string  // Example log file name
+	//
+	Dest        string // Destination
+	Nmsgs       int    // Number of messages
+	SubChanCap  int    // Subscription channel capacity
+	Persistent  bool   // Send persistent messages
+	Payload     string // Payload generator specification
+	SendDelay   string // Send stagger Delay specification
+	RecvDelay   string // Receive stagger Delay specification
+	Seed        int    // Random seed, 0 seeds from the clock
+	Failover    string // Broker list for reconnects, see ParseFailover
+	Timeout     string // Operation timeout duration, empty is none
+	DiscReceipt bool   // Wait for a DISCONNECT receipt
+	DiscTimeout string // DISCONNECT receipt wait, empty uses Timeout, set implies DiscReceipt
+	Pool        string // Connection pool specification, see ParsePool
+	HBMonitor   string // Heartbeat monitor specification, see ParseMonitor
+	// Used by individual examples
+	VarMsl      bool // Random message lengths (publish)
+	FxMsLen     int  // Fixed message length (publish)
+	DoSleep     bool // Sleep between sends (publish)
+	FixSleep    bool // Sleep a fixed time, not a random time (publish)
+	SleepMs     int  // Fixed sleep time, milliseconds (publish)
+	GorNStr     int  // First destination number (publish)
+	RecvConns   int  // Receiver connections, 0 is one per queue (srmgor_1smrconn)
+	Conn2Buffer int  // Receive buffer size, -1 is unbuffered (srmgor_2conn)
+	TwoConn     bool // Use two connections (putget)
+	WTime       int  // Wait time, milliseconds (putget)
+	TrackElt    bool // Show elapsed time tracking (srmgor_1conn)
+	VmgNoUnsub  bool // Skip UNSUBSCRIBE (varmGetter)
+	VmgNoDisc   bool // Skip DISCONNECT (varmGetter)
+	VmgGetAR    bool // Request ACK receipts (varmGetter)
+	//
+	Broker    *BrokerParms // Resolved broker parameters
+	Conflicts []Conflict   // Questionable or invalid combinations
+	src       map[string]string
+	sendDS    *delaySpec
+	recvDS    *delaySpec
+}
+
+// ConfigErrors holds all problems found while loading a Config.
+type ConfigErrors []error
+
+func (ce ConfigErrors) Error() string {
+	s := make([]string, 0, len(ce))
+	for _, e := range ce {
+		s = append(s, e.Error())
+	}
+	return "config: " + strings.Join(s, "; ")
+}
+
+// Knob presence semantics for environment variables.
+const (
+	envValue    = iota // The variable value is parsed
+	envPresent         // Any non-empty value means true
+	envNotFalse        // Any non-empty value means false
+)
+
+// Value sources, in increasing order of precedence.
+const (
+	SrcDefault = "default"
+	SrcProfile = "profile"
+	SrcFile    = "file"
+	SrcURL     = "url"
+	SrcEnv     = "env"
+	SrcFlag    = "flag"
+)
+
+// knob describes a single configuration value.
+type knob struct {
+	name     string // file key and flag name
+	env      string // environment variable name
+	presence int    // environment presence semantics
+	usage    string
+	set      func(c *Config, s string) error
+	get      func(c *Config) interface{}
+}
+
+// intKnob describes an integer value with a minimum.
+func intKnob(name, env, usage string, min int, f func(*Config) *int) knob {
+	return knob{name, env, envValue, usage,
+		func(c *Config, s string) error { return setInt(f(c), s, min) },
+		func(c *Config) interface{} { return *f(c) }}
+}
+
+// floatKnob describes a non-negative floating point value.
+func floatKnob(name, env, usage string, f func(*Config) *float64) knob {
+	return knob{name, env, envValue, usage,
+		func(c *Config, s string) error { return setFloat(f(c), s) },
+		func(c *Config) interface{} { return *f(c) }}
+}
+
+// boolKnob describes a boolean value.
+func boolKnob(name, env string, presence int, usage string,
+	f func(*Config) *bool) knob {
+	return knob{name, env, presence, usage,
+		func(c *Config, s string) error { return setBool(f(c), s) },
+		func(c *Config) interface{} { return *f(c) }}
+}
+
+// strKnob describes a string value, with optional validation.
+func strKnob(name, env, usage string, f func(*Config) *string,
+	valid func(string) error) knob {
+	return knob{name, env, envValue, usage,
+		func(c *Config, s string) error {
+			if valid != nil {
+				if e := valid(s); e != nil {
+					return e
+				}
+			}
+			*f(c) = s
+			return nil
+		},
+		func(c *Config) interface{} { return *f(c) }}
+}
+
+var knobs = []knob{
+	intKnob("nqs", "STOMP_NQS", "number of queues", 1,
+		func(c *Config) *int { return &c.Nqs }),
+	intKnob("ngors", "STOMP_NGORS", "number of go routines", 1,
+		func(c *Config) *int { return &c.Ngors }),
+	intKnob("mdml", "STOMP_MDML", "max data message length", 16,
+		func(c *Config) *int { return &c.Mdml }),
+	intKnob("pbc", "STOMP_PBC", "message body byte count to log", 0,
+		func(c *Config) *int { return &c.Pbc }),
+	strKnob("ackmode", "STOMP_ACKMODE", "auto, client, or client-individual",
+		func(c *Config) *string { return &c.AckMode },
+		func(s string) error {
+			switch s {
+			case "auto", "client", "client-individual":
+				return nil
+			}
+			return fmt.Errorf("invalid ack mode %q", s)
+		}),
+	floatKnob("sendfact", "STOMP_SENDFACT", "send sleep time factor",
+		func(c *Config) *float64 { return &c.SendFactor }),
+	floatKnob("recvfact", "STOMP_RECVFACT", "receive sleep time factor",
+		func(c *Config) *float64 { return &c.RecvFactor }),
+	boolKnob("sendwait", "STOMP_SENDWAIT", envNotFalse, "wait in sends",
+		func(c *Config) *bool { return &c.SendWait }),
+	boolKnob("recvwait", "STOMP_RECVWAIT", envNotFalse, "wait in receives",
+		func(c *Config) *bool { return &c.RecvWait }),
+	boolKnob("setmaxprocs", "STOMP_SETMAXPROCS", envPresent, "set GOMAXPROCS",
+		func(c *Config) *bool { return &c.SetMaxProcs }),
+	boolKnob("pprof", "STOMP_PPROF", envPresent, "do profiling",
+		func(c *Config) *bool { return &c.Pprof }),
+	strKnob("memprof", "STOMP_MEMPROF", "memory profile file",
+		func(c *Config) *string { return &c.Memprof }, nil),
+	strKnob("cpuprof", "STOMP_CPUPROF", "cpu profile file",
+		func(c *Config) *string { return &c.Cpuprof }, nil),
+	strKnob("gorsleep", "STOMP_GORSLEEP", "go routine sleep indicator",
+		func(c *Config) *string { return &c.Gorsleep }, nil),
+	boolKnob("useeof", "STOMP_USEEOF", envPresent, "use an EOF message",
+		func(c *Config) *bool { return &c.UseEOF }),
+	boolKnob("usecustomciphers", "STOMP_USECUSTOMCIPHERS", envPresent, "use custom ciphers",
+		func(c *Config) *bool { return &c.UseCustomCiphers }),
+	strKnob("logger", "STOMP_LOGGER", "stompngo logger prefix",
+		func(c *Config) *string { return &c.Logger }, nil),
+	strKnob("logfile", "STOMP_LOGFILE", "log file name",
+		func(c *Config) *string { return &c.LogFile }, nil),
+	//
+	strKnob("dest", "STOMP_DEST", "destination",
+		func(c *Config) *string { return &c.Dest },
+		func(s string) error {
+			if s == "" {
+				return fmt.Errorf("empty destination")
+			}
+			return nil
+		}),
+	intKnob("nmsgs", "STOMP_NMSGS", "number of messages", 1,
+		func(c *Config) *int { return &c.Nmsgs }),
+	intKnob("subchancap", "STOMP_SUBCHANCAP", "subscription channel capacity", 1,
+		func(c *Config) *int { return &c.SubChanCap }),
+	boolKnob("persistent", "STOMP_PERSISTENT", envPresent, "send persistent messages",
+		func(c *Config) *bool { return &c.Persistent }),
+	strKnob("payload", "STOMP_PAYLOAD", "payload generator, e.g. uniform:64,4K",
+		func(c *Config) *string { return &c.Payload }, nil),
+	strKnob("senddelay", "STOMP_SENDDELAY", "send stagger, e.g. exp:500ms",
+		func(c *Config) *string { return &c.SendDelay }, nil),
+	strKnob("recvdelay", "STOMP_RECVDELAY", "receive stagger, e.g. normal:500ms,100ms",
+		func(c *Config) *string { return &c.RecvDelay }, nil),
+	intKnob("seed", "STOMP_SEED", "random seed, 0 seeds from the clock", 0,
+		func(c *Config) *int { return &c.Seed }),
+	strKnob("failover", "STOMP_FAILOVER", "brokers, e.g. failover:(tcp://a:61613,tcp://b:61613)",
+		func(c *Config) *string { return &c.Failover },
+		func(s string) error {
+			if s == "" {
+				return nil
+			}
+			_, e := ParseFailover(s)
+			return e
+		}),
+	strKnob("timeout", "STOMP_TIMEOUT", "operation timeout, e.g. 30s, empty is none",
+		func(c *Config) *string { return &c.Timeout },
+		func(s string) error {
+			if s == "" {
+				return nil
+			}
+			_, e := time.ParseDuration(s)
+			return e
+		}),
+	boolKnob("discreceipt", "STOMP_DISCRECEIPT", envPresent, "wait for a DISCONNECT receipt",
+		func(c *Config) *bool { return &c.DiscReceipt }),
+	strKnob("disctimeout", "STOMP_DISCTIMEOUT", "DISCONNECT receipt wait, e.g. 10s, implies discreceipt, empty uses timeout, else 10s",
+		func(c *Config) *string { return &c.DiscTimeout },
+		func(s string) error {
+			if s == "" {
+				return nil
+			}
+			_, e := time.ParseDuration(s)
+			return e
+		}),
+	strKnob("pool", "STOMP_POOL", "connection pool, e.g. leastloaded:1,8",
+		func(c *Config) *string { return &c.Pool },
+		func(s string) error {
+			if s == "" {
+				return nil
+			}
+			_, e := ParsePool(s)
+			return e
+		}),
+	strKnob("hbmonitor", "STOMP_HBMONITOR", "heartbeat monitor tolerance[,deadafter], e.g. 1.5,3",
+		func(c *Config) *string { return &c.HBMonitor },
+		func(s string) error {
+			if s == "" {
+				return nil
+			}
+			_, e := ParseMonitor(s)
+			return e
+		}),
+	//
+	boolKnob("varmsl", "STOMP_VARMSL", envPresent, "random message lengths",
+		func(c *Config) *bool { return &c.VarMsl }),
+	intKnob("fxmslen", "STOMP_FXMSLEN", "fixed message length", 0,
+		func(c *Config) *int { return &c.FxMsLen }),
+	boolKnob("dosleep", "STOMP_DOSLEEP", envPresent, "sleep between sends",
+		func(c *Config) *bool { return &c.DoSleep }),
+	boolKnob("fixsleep", "STOMP_FIXSLEEP", envPresent, "sleep a fixed time",
+		func(c *Config) *bool { return &c.FixSleep }),
+	intKnob("sleepms", "STOMP_SLEEPMS", "fixed sleep milliseconds", 0,
+		func(c *Config) *int { return &c.SleepMs }),
+	intKnob("gornstr", "STOMP_GORNSTR", "first destination number", 0,
+		func(c *Config) *int { return &c.GorNStr }),
+	intKnob("recvconns", "STOMP_RECVCONNS", "receiver connections, 0 is one per queue", 0,
+		func(c *Config) *int { return &c.RecvConns }),
+	intKnob("conn2buffer", "STOMP_CONN2BUFFER", "receive buffer size, -1 is unbuffered", -1,
+		func(c *Config) *int { return &c.Conn2Buffer }),
+	boolKnob("2conn", "STOMP_2CONN", envPresent, "use two connections",
+		func(c *Config) *bool { return &c.TwoConn }),
+	intKnob("wtime", "STOMP_WTIME", "wait time milliseconds", 0,
+		func(c *Config) *int { return &c.WTime }),
+	boolKnob("trackelt", "STOMP_TRACKELT", envPresent, "show elapsed time tracking",
+		func(c *Config) *bool { return &c.TrackElt }),
+	boolKnob("vmg_nounsub", "VMG_NOUNSUB", envPresent, "skip UNSUBSCRIBE",
+		func(c *Config) *bool { return &c.VmgNoUnsub }),
+	boolKnob("vmg_nodisc", "VMG_NODISC", envPresent, "skip DISCONNECT",
+		func(c *Config) *bool { return &c.VmgNoDisc }),
+	boolKnob("vmg_getar", "VMG_GETAR", envPresent, "request ACK receipts",
+		func(c *Config) *bool { return &c.VmgGetAR }),
+}
+
+// DefaultConfig returns a Config with all built in default values.
+func DefaultConfig() *Config {
+	return &Config{
+		Nqs:        1,
+		Ngors:      1,
+		Mdml:       1024 * 32,
+		Pbc:        64,
+		AckMode:    "auto",
+		SendFactor: 1.0,
+		RecvFactor: 1.0,
+		SendWait:   true,
+		RecvWait:   true,
+		Dest:       "/queue/sng.sample.stomp.destination",
+		Nmsgs:      1,
+		SubChanCap: 1,
+		SendDelay:  DefaultDelay,
+		RecvDelay:  DefaultDelay,
+		//
+		FxMsLen:     1024,
+		SleepMs:     250,
+		GorNStr:     1,
+		Conn2Buffer: -1,
+		//
+		src: map[string]string{},
+	}
+}
+
+/*
+LoadConfig builds a Config from defaults, an optional file, the environment
+and command line flags.
+
+All configuration flags, plus -config, are registered on fs, and fs is
+parsed using args.  Programs with their own flags should register them on
+the same FlagSet before calling LoadConfig.
+
+The broker parameters are resolved, and the result is checked for
+conflicting values, before LoadConfig returns.
+
+	Example:
+		cfg, e := sngecomm.LoadConfig(flag.CommandLine, os.Args[1:])
+		if e != nil {
+			// Do something sane ...
+		}
+*/
+func LoadConfig(fs *flag.FlagSet, args []string) (*Config, error) {
+	c := DefaultConfig()
+	fv := map[string]*string{}
+	for _, k := range knobs {
+		fv[k.name] = fs.String(k.name, "", k.usage+" ("+k.env+")")
+	}
+	cf := fs.String("config", "", "JSON or YAML configuration file (STOMP_CONFIG)")
+	if e := fs.Parse(args); e != nil {
+		return nil, e
+	}
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	var ce ConfigErrors
+	// File
+	fn := *cf
+	if fn == "" {
+		fn = os.Getenv("STOMP_CONFIG")
+	}
+	if fn != "" {
+		fm, e := readConfigFile(fn)
+		if e != nil {
+			return nil, e
+		}
+		for _, k := range knobs {
+			if v, ok := fm[k.name]; ok {
+				ce = ce.add(c.apply(k, fmt.Sprint(v), SrcFile), "file "+fn, k.name)
+				delete(fm, k.name)
+			}
+		}
+		for n := range fm {
+			ce = append(ce, fmt.Errorf("file %s: unknown key %q", fn, n))
+		}
+	}
+	// Environment
+	ce = append(ce, c.applyEnv()...)
+	// Flags
+	for _, k := range knobs {
+		if set[k.name] {
+			ce = ce.add(c.apply(k, *fv[k.name], SrcFlag), "flag", "-"+k.name)
+		}
+	}
+	// Random streams
+	SetSeed(int64(c.Seed))
+	// Delays
+	var e error
+	if c.sendDS, e = parseDelay(c.SendDelay); e != nil {
+		ce = append(ce, e)
+	}
+	if c.recvDS, e = parseDelay(c.RecvDelay); e != nil {
+		ce = append(ce, e)
+	}
+	// Payload generator
+	if c.Payload != "" {
+		if _, e := NewPayloadGenerator(c.Payload); e != nil {
+			ce = append(ce, e)
+		}
+	}
+	// Broker, and combinations
+	b, e := ResolveBroker()
+	if e != nil {
+		ce = append(ce, e)
+	} else {
+		c.Broker = b
+		c.Conflicts = c.checkConflicts()
+		for _, cf := range c.Conflicts {
+			if cf.Fatal {
+				ce = append(ce, cf)
+			}
+		}
+	}
+	if len(ce) > 0 {
+		return nil, ce
+	}
+	mdmlLock.Lock()
+	mdml = c.Mdml
+	mdmlLock.Unlock()
+	lastConfigLock.Lock()
+	lastConfig = c
+	lastConfigLock.Unlock()
+	return c, nil
+}
+
+// apply sets a knob value, and records where it came from.
+func (c *Config) apply(k knob, s, src string) error {
+	if e := k.set(c, s); e != nil {
+		return e
+	}
+	c.src[k.name] = src
+	return nil
+}
+
+// applyEnv sets all knobs present in the environment.  Options in STOMP_URL
+// come first, so individual variables override them.
+func (c *Config) applyEnv() ConfigErrors {
+	var ce ConfigErrors
+	if u, e := URIFromEnv(); e == nil && u != nil && u.AckMode != "" {
+		for _, k := range knobs {
+			if k.name == "ackmode" {
+				ce = ce.add(c.apply(k, u.AckMode, SrcURL), "env", "STOMP_URL")
+			}
+		}
+	}
+	for _, k := range knobs {
+		if s := os.Getenv(k.env); s != "" {
+			switch k.presence {
+			case envPresent:
+				s = "true"
+			case envNotFalse:
+				s = "false"
+			}
+			ce = ce.add(c.apply(k, s, SrcEnv), "env", k.env)
+		}
+	}
+	return ce
+}
+
+// Source returns where a value came from: default, file, url, env or flag.  The
+// name is the flag name of the value.
+func (c *Config) Source(name string) string {
+	if s, ok := c.src[name]; ok {
+		return s
+	}
+	return SrcDefault
+}
+
+// add appends e, if any, with the source of the failing value.
+func (ce ConfigErrors) add(e error, src, name string) ConfigErrors {
+	if e == nil {
+		return ce
+	}
+	return append(ce, fmt.Errorf("%s %s: %v", src, name, e))
+}
+
+// readConfigFile reads a JSON (.json) or YAML file into a key/value map.
+func readConfigFile(fn string) (map[string]interface{}, error) {
+	b, e := ioutil.ReadFile(fn)
+	if e != nil {
+		return nil, e
+	}
+	m := map[string]interface{}{}
+	switch strings.ToLower(filepath.Ext(fn)) {
+	case ".json":
+		e = json.Unmarshal(b, &m)
+	default:
+		e = yaml.Unmarshal(b, &m)
+	}
+	if e != nil {
+		return nil, fmt.Errorf("config file %s: %v", fn, e)
+	}
+	return m, nil
+}
+
+func setInt(p *int, s string, min int) error {
+	i, e := strconv.ParseInt(s, 10, 32)
+	if e != nil {
+		return fmt.Errorf("not an integer: %q", s)
+	}
+	if int(i) < min {
+		return fmt.Errorf("value %d is less than %d", i, min)
+	}
+	*p = int(i)
+	return nil
+}
+
+func setFloat(p *float64, s string) error {
+	f, e := strconv.ParseFloat(s, 64)
+	if e != nil {
+		return fmt.Errorf("not a number: %q", s)
+	}
+	if f < 0 {
+		return fmt.Errorf("value %v is negative", f)
+	}
+	*p = f
+	return nil
+}
+
+func setBool(p *bool, s string) error {
+	b, e := strconv.ParseBool(s)
+	if e != nil {
+		return fmt.Errorf("not a boolean: %q", s)
+	}
+	*p = b
+	return nil
+}
+
+// Destination returns the configured destination, in Artemis form if requested.
+func (c *Config) Destination() string {
+	return artemisDest(c.Dest)
+}
+
+/*
+NewPayloadGenerator returns a payload generator for one sender, built from
+the configured payload specification, or def, the example's default.  The
+stream name should identify the sender, as for NewSendDelay, so seeded runs
+are reproducible with any number of senders.
+*/
+func (c *Config) NewPayloadGenerator(def, stream string) (PayloadGenerator, error) {
+	if c.Payload != "" {
+		def = c.Payload
+	}
+	return newPayloadGenerator(def, "payload/"+stream)
+}
+
+// VariablePayload is the default specification for variable length
+// payloads: uniform lengths up to Mdml.
+func (c *Config) VariablePayload() string {
+	return fmt.Sprintf("uniform:1,%d", c.Mdml-1)
+}
+
+/*
+PoolOptions returns the configured connection pool options.  If no pool is
+configured, options are built from def, the example's default
+specification.
+*/
+func (c *Config) PoolOptions(def string) (PoolOptions, error) {
+	if c.Pool != "" {
+		return ParsePool(c.Pool)
+	}
+	return ParsePool(def)
+}
+
+// NewSendDelay returns a send stagger Delay for one sender, scaled by
+// SendFactor.  The stream name should identify the sender, e.g. a queue
+// number.
+func (c *Config) NewSendDelay(stream string) Delay {
+	return newScaledDelay(c.sendDS, c.SendDelay, "send/"+stream, c.SendFactor)
+}
+
+// NewRecvDelay returns a receive stagger Delay for one receiver, scaled by
+// RecvFactor.
+func (c *Config) NewRecvDelay(stream string) Delay {
+	return newScaledDelay(c.recvDS, c.RecvDelay, "recv/"+stream, c.RecvFactor)
+}
+
+func newScaledDelay(ds *delaySpec, spec, stream string, f float64) Delay {
+	if ds == nil { // Not from LoadConfig
+		var e error
+		if ds, e = parseDelay(spec); e != nil {
+			llu.Printf("delay_error error:%v, using %s\n", e, DefaultDelay)
+			ds, _ = parseDelay(DefaultDelay)
+		}
+	}
+	return ScaleDelay(ds.delay(stream), f)
+}
@@ -0,0 +1,168 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package sngecomm
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Set environment variables, returning a function that unsets them.
+func setTestEnv(kv ...string) func() {
+	for i := 0; i < len(kv)-1; i += 2 {
+		_ = os.Setenv(kv[i], kv[i+1])
+	}
+	return func() {
+		for i := 0; i < len(kv)-1; i += 2 {
+			_ = os.Unsetenv(kv[i])
+		}
+	}
+}
+
+// Unset all STOMP_* environment variables, returning a function that
+// restores them.
+func clearTestEnv() func() {
+	var saved []string
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, "STOMP_") {
+			saved = append(saved, kv)
+			_ = os.Unsetenv(kv[:strings.Index(kv, "=")])
+		}
+	}
+	return func() {
+		for _, kv := range saved {
+			i := strings.Index(kv, "=")
+			_ = os.Setenv(kv[:i], kv[i+1:])
+		}
+	}
+}
+
+func testFlagSet() *flag.FlagSet {
+	return flag.NewFlagSet("test", flag.ContinueOnError)
+}
+
+// loadTestConfig loads a Config from test arguments, leaving the package
+// helpers with the Config they had.
+func loadTestConfig(args ...string) (*Config, error) {
+	lastConfigLock.Lock()
+	lc := lastConfig
+	lastConfigLock.Unlock()
+	defer func() {
+		lastConfigLock.Lock()
+		lastConfig = lc
+		lastConfigLock.Unlock()
+	}()
+	return LoadConfig(testFlagSet(), args)
+}
+
+/*
+Test Config defaults, with no STOMP_* environment variables set.
+*/
+func TestConfigDefaults(t *testing.T) {
+	defer clearTestEnv()()
+	c, e := loadTestConfig()
+	if e != nil {
+		t.Fatalf("LoadConfig, expected no error, got [%v]\n", e)
+	}
+	if c.Nqs != 1 {
+		t.Errorf("Config Nqs, expected [%d], got [%d]\n", 1, c.Nqs)
+	}
+	if c.Mdml != 1024*32 {
+		t.Errorf("Config Mdml, expected [%d], got [%d]\n", 1024*32, c.Mdml)
+	}
+	if c.AckMode != "auto" {
+		t.Errorf("Config AckMode, expected [%s], got [%s]\n", "auto", c.AckMode)
+	}
+	if !c.SendWait || !c.RecvWait {
+		t.Errorf("Config waits, expected [%t], got [%t,%t]\n", true,
+			c.SendWait, c.RecvWait)
+	}
+}
+
+/*
+Test that bad values are errors, and that all are reported.
+*/
+func TestConfigErrors(t *testing.T) {
+	defer setTestEnv("STOMP_NQS", "five", "STOMP_ACKMODE", "sometimes")()
+	_, e := loadTestConfig("-sendfact", "-1")
+	if e == nil {
+		t.Fatalf("LoadConfig, expected an error, got none\n")
+	}
+	ce, ok := e.(ConfigErrors)
+	if !ok {
+		t.Fatalf("LoadConfig, expected ConfigErrors, got [%T]\n", e)
+	}
+	if len(ce) != 3 {
+		t.Errorf("LoadConfig, expected [%d] errors, got [%d]: %v\n", 3, len(ce), ce)
+	}
+}
+
+/*
+Test layering: file, then environment, then flags.
+*/
+func TestConfigLayers(t *testing.T) {
+	d, e := ioutil.TempDir("", "sngecomm")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(d)
+	fn := filepath.Join(d, "run.yaml")
+	fd := "nqs: 3\nngors: 4\nnmsgs: 5\nsendwait: false\n"
+	if e = ioutil.WriteFile(fn, []byte(fd), 0644); e != nil {
+		t.Fatal(e)
+	}
+	defer setTestEnv("STOMP_CONFIG", fn, "STOMP_NGORS", "6")()
+	c, e := loadTestConfig("-nmsgs", "7")
+	if e != nil {
+		t.Fatalf("LoadConfig, expected no error, got [%v]\n", e)
+	}
+	if c.Nqs != 3 {
+		t.Errorf("Config Nqs from file, expected [%d], got [%d]\n", 3, c.Nqs)
+	}
+	if c.Ngors != 6 {
+		t.Errorf("Config Ngors from env, expected [%d], got [%d]\n", 6, c.Ngors)
+	}
+	if c.Nmsgs != 7 {
+		t.Errorf("Config Nmsgs from flag, expected [%d], got [%d]\n", 7, c.Nmsgs)
+	}
+	if c.SendWait {
+		t.Errorf("Config SendWait from file, expected [%t], got [%t]\n", false, c.SendWait)
+	}
+}
+
+/*
+Test that unknown file keys are reported.
+*/
+func TestConfigFileUnknownKey(t *testing.T) {
+	d, e := ioutil.TempDir("", "sngecomm")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(d)
+	fn := filepath.Join(d, "run.json")
+	if e = ioutil.WriteFile(fn, []byte(`{"nqs": 2, "nsq": 2}`), 0644); e != nil {
+		t.Fatal(e)
+	}
+	_, e = loadTestConfig("-config", fn)
+	if e == nil {
+		t.Fatalf("LoadConfig, expected an error, got none\n")
+	}
+}
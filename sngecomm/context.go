@@ -0,0 +1,217 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package sngecomm
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/gmallard/stompngo"
+)
+
+const (
+	// DefaultDiscTimeout is the DISCONNECT receipt wait when neither the
+	// disctimeout nor the timeout run parameter is set.
+	DefaultDiscTimeout = 10 * time.Second
+)
+
+/*
+TimeoutError is returned when a context deadline expires during an
+operation.  It implements net.Error, and unwraps to the context error.
+*/
+type TimeoutError struct {
+	Op  string // connect, subscribe, receive, receipt or disconnect
+	Err error  // context.DeadlineExceeded
+}
+
+func (t *TimeoutError) Error() string {
+	return fmt.Sprintf("%s timed out: %v", t.Op, t.Err)
+}
+
+func (t *TimeoutError) Timeout() bool   { return true }
+func (t *TimeoutError) Temporary() bool { return true }
+func (t *TimeoutError) Unwrap() error   { return t.Err }
+
+// ctxErr returns the error for a done context: a *TimeoutError for an
+// expired deadline, else the context error.
+func ctxErr(op string, ctx context.Context) error {
+	if e := ctx.Err(); e != context.DeadlineExceeded {
+		return e
+	}
+	return &TimeoutError{op, context.DeadlineExceeded}
+}
+
+// ctxErrOr returns ctxErr if the context is done, otherwise e.  The network
+// deadline can expire just before the context reports it, so a passed
+// deadline is a timeout too.
+func ctxErrOr(op string, ctx context.Context, e error) error {
+	if ctx.Err() != nil {
+		return ctxErr(op, ctx)
+	}
+	if d, ok := ctx.Deadline(); ok && !time.Now().Before(d) {
+		return &TimeoutError{op, context.DeadlineExceeded}
+	}
+	return e
+}
+
+// ctxDeadline applies the context deadline, and cancellation, to network
+// I/O until the returned function is called.
+func ctxDeadline(ctx context.Context, n net.Conn) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	if d, ok := ctx.Deadline(); ok {
+		_ = n.SetDeadline(d)
+	}
+	done, exited := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			_ = n.SetDeadline(time.Now()) // Unblock any I/O
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+		_ = n.SetDeadline(time.Time{})
+	}
+}
+
+// OpContext returns a context for one operation, with the timeout run
+// parameter as its deadline.
+func (c *Config) OpContext(parent context.Context) (context.Context,
+	context.CancelFunc) {
+	if d, e := time.ParseDuration(c.Timeout); e == nil && d > 0 {
+		return context.WithTimeout(parent, d)
+	}
+	return context.WithCancel(parent)
+}
+
+// DisconnectContext returns a context for a DISCONNECT receipt wait, with
+// the disctimeout run parameter, else timeout, else DefaultDiscTimeout, as
+// its deadline.  A broker that never sends the receipt does not hang the
+// disconnect.
+func (c *Config) DisconnectContext(parent context.Context) (context.Context,
+	context.CancelFunc) {
+	for _, s := range []string{c.DiscTimeout, c.Timeout} {
+		if d, e := time.ParseDuration(s); e == nil && d > 0 {
+			return context.WithTimeout(parent, d)
+		}
+	}
+	return context.WithTimeout(parent, DefaultDiscTimeout)
+}
+
+// OpContext returns a context for one operation, using the current run
+// parameters.
+func OpContext(parent context.Context) (context.Context, context.CancelFunc) {
+	return runConfig().OpContext(parent)
+}
+
+/*
+SubscribeContext is HandleSubscribe, returning errors, and giving up when the
+context is done.  A SUBSCRIBE that is stuck in the network may still
+complete after the timeout.  Nobody reads that subscription, and a full
+subscription channel blocks every subscription on the connection, so it is
+drained and unsubscribed.
+*/
+func SubscribeContext(ctx context.Context, c *stompngo.Connection,
+	d, i, a string) (<-chan stompngo.MessageData, error) {
+	type result struct {
+		sc <-chan stompngo.MessageData
+		e  error
+	}
+	rc := make(chan result)
+	go func() {
+		var r result
+		if mc := managed(c); mc != nil {
+			r.sc, r.e = mc.Subscribe(d, i, a)
+		} else {
+			r.sc, r.e = subscribe(c, d, i, a)
+		}
+		select {
+		case rc <- r:
+		case <-ctx.Done(): // The caller has gone
+			if r.e == nil {
+				go Drain(r.sc)
+				_ = Unsubscribe(c, d, i)
+			}
+		}
+	}()
+	select {
+	case r := <-rc:
+		return r.sc, r.e
+	case <-ctx.Done():
+		return nil, ctxErr("subscribe", ctx)
+	}
+}
+
+// ReceiveContext receives one message from a subscription, or returns when
+// the context is done.
+func ReceiveContext(ctx context.Context,
+	sc <-chan stompngo.MessageData) (stompngo.MessageData, error) {
+	select {
+	case md, ok := <-sc:
+		if !ok {
+			return md, stompngo.ECONBAD
+		}
+		return md, md.Error
+	case <-ctx.Done():
+		return stompngo.MessageData{}, ctxErr("receive", ctx)
+	}
+}
+
+/*
+AwaitReceiptContext waits for the RECEIPT with a given receipt-id, or returns
+when the context is done.  An ERROR frame, or a RECEIPT with another id, is
+returned with an error.
+*/
+func AwaitReceiptContext(ctx context.Context, c *stompngo.Connection,
+	rid string) (stompngo.MessageData, error) {
+	in := c.MessageData
+	if mc := managed(c); mc != nil {
+		in = mc.MessageData
+	}
+	select {
+	case md, ok := <-in:
+		if !ok {
+			return md, stompngo.ECONBAD
+		}
+		return md, checkReceipt(md, rid)
+	case <-ctx.Done():
+		return stompngo.MessageData{}, ctxErr("receipt", ctx)
+	}
+}
+
+// checkReceipt checks for the RECEIPT with a given receipt-id.  An ERROR
+// frame, or a RECEIPT with another id, is an error.
+func checkReceipt(md stompngo.MessageData, rid string) error {
+	switch {
+	case md.Error != nil:
+		return md.Error
+	case md.Message.Command != stompngo.RECEIPT:
+		return fmt.Errorf("expected %s, got %s: %s", stompngo.RECEIPT,
+			md.Message.Command, md.Message.Headers.Value("message"))
+	case md.Message.Headers.Value("receipt-id") != rid:
+		return fmt.Errorf("expected receipt-id %s, got %s", rid,
+			md.Message.Headers.Value("receipt-id"))
+	}
+	return nil
+}
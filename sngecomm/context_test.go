@@ -0,0 +1,221 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package sngecomm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gmallard/stompngo"
+	"github.com/gmallard/stompngo_examples/sngecomm/testbroker"
+)
+
+// checkTimeout checks for a *TimeoutError from an operation.
+func checkTimeout(t *testing.T, e error, op string) {
+	te, ok := e.(*TimeoutError)
+	if !ok {
+		t.Fatalf("%s, expected a *TimeoutError, got [%v]\n", op, e)
+	}
+	if te.Op != op || !te.Timeout() || !errors.Is(e, context.DeadlineExceeded) {
+		t.Errorf("%s, bad TimeoutError [%+v]\n", op, te)
+	}
+}
+
+/*
+Test receive deadlines and cancellation.
+*/
+func TestContextReceive(t *testing.T) {
+	sc := make(chan stompngo.MessageData)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, e := ReceiveContext(ctx, sc)
+	checkTimeout(t, e, "receive")
+	//
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, e = ReceiveContext(ctx, sc); e != context.Canceled {
+		t.Errorf("ReceiveContext canceled, got [%v]\n", e)
+	}
+}
+
+/*
+Test that a broker that accepts, but never answers CONNECT, times out.
+*/
+func TestContextConnect(t *testing.T) {
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, e := l.Accept()
+			if e != nil {
+				return
+			}
+			defer c.Close() // Say nothing
+		}
+	}()
+	defer setTestEnv("STOMP_URL", "stomp://"+l.Addr().String())()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	st := time.Now()
+	_, _, e = CommonConnectContext(ctx, "test: ", "context", log.New(ioutil.Discard, "", 0))
+	checkTimeout(t, e, "connect")
+	if el := time.Since(st); el > 2*time.Second {
+		t.Errorf("CommonConnectContext took %v\n", el)
+	}
+}
+
+/*
+Test waiting for a RECEIPT, with a timeout.
+*/
+func TestContextReceipt(t *testing.T) {
+	l, fc := testBroker(t)
+	defer l.Close()
+	defer setTestEnv("STOMP_URL", "stomp://"+l.Addr().String(),
+		"STOMP_PROTOCOL", "1.2")()
+	n, conn, e := CommonConnectContext(context.Background(), "test: ", "context",
+		log.New(ioutil.Discard, "", 0))
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer n.Close()
+	c := nextFrame(t, fc, "CONNECT").c
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, e = AwaitReceiptContext(ctx, conn, "r1")
+	checkTimeout(t, e, "receipt")
+	//
+	fmt.Fprintf(c, "RECEIPT\nreceipt-id:r1\n\n\x00")
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, e = AwaitReceiptContext(ctx, conn, "r1"); e != nil {
+		t.Errorf("AwaitReceiptContext, expected no error, got [%v]\n", e)
+	}
+}
+
+/*
+Test that a SUBSCRIBE that completes after its timeout is unsubscribed, and
+does not block the other subscriptions on the connection.
+*/
+func TestContextSubscribeLate(t *testing.T) {
+	fs, e := testbroker.ParseFaults("delay cmd=SEND dest=/queue/sngecomm.slow for=1s")
+	if e != nil {
+		t.Fatal(e)
+	}
+	b, e := testbroker.Start(testbroker.Options{Faults: fs})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer b.Close()
+	SetDialFunc(b.Dial)
+	defer SetDialFunc(nil)
+	n, conn, e := CommonConnect("test: ", "context", log.New(ioutil.Discard, "", 0))
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer n.Close()
+	conn.SetSubChanCap(1)
+	live, late := "/queue/sngecomm.live", "/queue/sngecomm.late"
+	sc, e := SubscribeContext(context.Background(), conn, live, "live", "auto")
+	if e != nil {
+		t.Fatal(e)
+	}
+	for i := 0; i < 3; i++ {
+		b.Publish(late, []byte("late"))
+	}
+	// The broker stops reading, and a large SEND fills the network buffers,
+	// so the SUBSCRIBE waits behind it.
+	if e = conn.Send(stompngo.Headers{"destination", "/queue/sngecomm.slow"}, ""); e != nil {
+		t.Fatal(e)
+	}
+	go func() {
+		_ = conn.SendBytes(stompngo.Headers{"destination", "/queue/sngecomm.big"},
+			make([]byte, 32*1024*1024))
+	}()
+	time.Sleep(100 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, e = SubscribeContext(ctx, conn, late, "late", "auto")
+	checkTimeout(t, e, "subscribe")
+	// Once through, the late subscription is unsubscribed ...
+	if !b.WaitFor(10*time.Second, func() bool {
+		for _, f := range b.Frames("UNSUBSCRIBE") {
+			if f.Value("id") == "late" {
+				return true
+			}
+		}
+		return false
+	}) {
+		t.Fatalf("expected an UNSUBSCRIBE for the late subscription\n")
+	}
+	// ... and the live subscription still gets messages
+	b.Publish(live, []byte("live"))
+	select {
+	case md := <-sc:
+		if md.Error != nil || string(md.Message.Body) != "live" {
+			t.Errorf("live receive, got [%v] [%s]\n", md.Error, md.Message.Body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("live receive, timed out\n")
+	}
+}
+
+/*
+Test that a DISCONNECT the broker never confirms times out, by default too.
+*/
+func TestContextDisconnectNoReceipt(t *testing.T) {
+	cfg := DefaultConfig()
+	ctx, cancel := cfg.DisconnectContext(context.Background())
+	dl, ok := ctx.Deadline()
+	cancel()
+	if !ok || time.Until(dl) > DefaultDiscTimeout {
+		t.Errorf("DisconnectContext default, got deadline [%v] [%t]\n", dl, ok)
+	}
+	//
+	fs, e := testbroker.ParseFaults("noreceipt cmd=DISCONNECT")
+	if e != nil {
+		t.Fatal(e)
+	}
+	b, e := testbroker.Start(testbroker.Options{Faults: fs})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer b.Close()
+	SetDialFunc(b.Dial)
+	defer SetDialFunc(nil)
+	lg := log.New(ioutil.Discard, "", 0)
+	n, conn, e := CommonConnect("test: ", "context", lg)
+	if e != nil {
+		t.Fatal(e)
+	}
+	cfg.DiscTimeout = "100ms"
+	ctx, cancel = cfg.DisconnectContext(context.Background())
+	defer cancel()
+	e = CommonDisconnectContext(ctx, n, conn, "test: ", "context", lg)
+	checkTimeout(t, e, "disconnect")
+	if s := b.Stats(); s.Faults != 1 {
+		t.Errorf("expected a fault, got [%+v]\n", s)
+	}
+}
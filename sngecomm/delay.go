@@ -0,0 +1,220 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package sngecomm
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultDelay is the historical example stagger: uniform, 0.1 to 1
+	// second.
+	DefaultDelay = "uniform:100ms,1s"
+)
+
+/*
+Delay produces the time to wait between message sends or receives.
+
+A Delay is used by a single go routine.  Use one Delay per sender or
+receiver.
+*/
+type Delay interface {
+	// Next returns the next wait time.
+	Next() time.Duration
+	// Spec returns the specification the delay was built from.
+	Spec() string
+}
+
+/*
+NewDelay builds a Delay from a specification string of the form
+name:parameters.  Times are go durations, e.g. 250ms or 1.5s.
+
+	fixed:250ms          always 250ms
+	uniform:100ms,1s     uniformly distributed in [100ms, 1s]
+	exp:500ms            exponential, mean 500ms (Poisson arrivals)
+	normal:500ms,100ms   normal, mean 500ms, standard deviation 100ms
+	trace:/path/file     times read from a file, one per line, repeated
+
+Trace file lines are durations, or integer milliseconds.  Blank lines and
+lines starting with # are ignored.
+
+The stream name seeds the random number generator, see SetSeed.
+*/
+func NewDelay(spec, stream string) (Delay, error) {
+	ds, e := parseDelay(spec)
+	if e != nil {
+		return nil, e
+	}
+	return ds.delay(stream), nil
+}
+
+// delaySpec is a parsed Delay specification.
+type delaySpec struct {
+	spec string
+	name string
+	a, b time.Duration   // Parameters
+	tr   []time.Duration // Trace times
+}
+
+func parseDelay(spec string) (*delaySpec, error) {
+	ds := &delaySpec{spec: spec, name: spec}
+	p := ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		ds.name, p = spec[:i], spec[i+1:]
+	}
+	var e error
+	var v []time.Duration
+	switch ds.name {
+	case "fixed", "exp":
+		v, e = parseDurations(p, 1)
+	case "uniform", "normal":
+		v, e = parseDurations(p, 2)
+	case "trace":
+		ds.tr, e = readTrace(p)
+	default:
+		e = fmt.Errorf("unknown delay %q", ds.name)
+	}
+	if len(v) > 0 {
+		ds.a, ds.b = v[0], v[len(v)-1]
+	}
+	if e == nil && ds.name == "uniform" && ds.b < ds.a {
+		e = fmt.Errorf("max %v is less than min %v", ds.b, ds.a)
+	}
+	if e != nil {
+		return nil, fmt.Errorf("delay %q: %v", spec, e)
+	}
+	return ds, nil
+}
+
+// parseDurations parses exactly n comma separated durations.
+func parseDurations(p string, n int) ([]time.Duration, error) {
+	f := strings.Split(p, ",")
+	if len(f) != n {
+		return nil, fmt.Errorf("expected %d duration(s), got %q", n, p)
+	}
+	r := make([]time.Duration, 0, n)
+	for _, s := range f {
+		d, e := time.ParseDuration(s)
+		if e != nil {
+			return nil, e
+		}
+		if d < 0 {
+			return nil, fmt.Errorf("negative duration %v", d)
+		}
+		r = append(r, d)
+	}
+	return r, nil
+}
+
+func readTrace(fn string) ([]time.Duration, error) {
+	f, e := os.Open(fn)
+	if e != nil {
+		return nil, e
+	}
+	defer f.Close()
+	var tr []time.Duration
+	s := bufio.NewScanner(f)
+	for ln := 1; s.Scan(); ln++ {
+		t := strings.TrimSpace(s.Text())
+		if t == "" || strings.HasPrefix(t, "#") {
+			continue
+		}
+		d, e := time.ParseDuration(t)
+		if e != nil {
+			ms, ie := strconv.ParseInt(t, 10, 64)
+			if ie != nil {
+				return nil, fmt.Errorf("%s:%d: %v", fn, ln, e)
+			}
+			d = time.Duration(ms) * time.Millisecond
+		}
+		if d < 0 {
+			return nil, fmt.Errorf("%s:%d: negative duration %v", fn, ln, d)
+		}
+		tr = append(tr, d)
+	}
+	if e = s.Err(); e != nil {
+		return nil, e
+	}
+	if len(tr) == 0 {
+		return nil, fmt.Errorf("no times in trace file %s", fn)
+	}
+	return tr, nil
+}
+
+// delay builds a new Delay for a stream.
+func (ds *delaySpec) delay(stream string) Delay {
+	return &distDelay{ds: ds, r: newRand(ds.spec + "/" + stream)}
+}
+
+// distDelay implements all the Delay distributions.
+type distDelay struct {
+	ds *delaySpec
+	r  *rand.Rand
+	i  int // Next trace index
+}
+
+func (d *distDelay) Next() time.Duration {
+	ds := d.ds
+	switch ds.name {
+	case "fixed":
+		return ds.a
+	case "uniform":
+		return ds.a + time.Duration(d.r.Int63n(int64(ds.b-ds.a)+1))
+	case "exp":
+		return time.Duration(d.r.ExpFloat64() * float64(ds.a))
+	case "normal":
+		v := time.Duration(d.r.NormFloat64()*float64(ds.b)) + ds.a
+		if v < 0 {
+			v = 0
+		}
+		return v
+	}
+	// trace
+	v := ds.tr[d.i]
+	d.i = (d.i + 1) % len(ds.tr)
+	return v
+}
+
+func (d *distDelay) Spec() string { return d.ds.spec }
+
+// scaledDelay multiplies another Delay by a factor.
+type scaledDelay struct {
+	d Delay
+	f float64
+}
+
+func (s *scaledDelay) Next() time.Duration {
+	return time.Duration(s.f * float64(s.d.Next()))
+}
+
+func (s *scaledDelay) Spec() string {
+	return fmt.Sprintf("%s*%v", s.d.Spec(), s.f)
+}
+
+// ScaleDelay returns a Delay that multiplies d by f.
+func ScaleDelay(d Delay, f float64) Delay {
+	if f == 1.0 {
+		return d
+	}
+	return &scaledDelay{d, f}
+}
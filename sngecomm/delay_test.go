@@ -0,0 +1,95 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package sngecomm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+/*
+Test the Delay distributions.
+*/
+func TestDelayDistributions(t *testing.T) {
+	d, e := NewDelay("fixed:250ms", "t")
+	if e != nil {
+		t.Fatalf("NewDelay, expected no error, got [%v]\n", e)
+	}
+	if v := d.Next(); v != 250*time.Millisecond {
+		t.Errorf("fixed delay, expected [%v], got [%v]\n", 250*time.Millisecond, v)
+	}
+	d, _ = NewDelay("uniform:10ms,20ms", "t")
+	for i := 0; i < 100; i++ {
+		if v := d.Next(); v < 10*time.Millisecond || v > 20*time.Millisecond {
+			t.Fatalf("uniform delay, got [%v]\n", v)
+		}
+	}
+	for _, s := range []string{"exp:10ms", "normal:10ms,50ms"} {
+		d, e = NewDelay(s, "t")
+		if e != nil {
+			t.Fatalf("NewDelay %s, expected no error, got [%v]\n", s, e)
+		}
+		for i := 0; i < 100; i++ {
+			if v := d.Next(); v < 0 {
+				t.Fatalf("%s delay, got negative [%v]\n", s, v)
+			}
+		}
+	}
+	for _, s := range []string{"nosuch:1s", "fixed:x", "uniform:2s,1s",
+		"normal:1s", "trace:/nonexistent/file"} {
+		if _, e = NewDelay(s, "t"); e == nil {
+			t.Errorf("NewDelay %s, expected an error\n", s)
+		}
+	}
+}
+
+/*
+Test trace delays, and that a seed makes delays repeatable.
+*/
+func TestDelayTraceAndSeed(t *testing.T) {
+	dn, e := ioutil.TempDir("", "sngecomm")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dn)
+	fn := filepath.Join(dn, "trace")
+	if e = ioutil.WriteFile(fn, []byte("# times\n5ms\n\n7\n"), 0644); e != nil {
+		t.Fatal(e)
+	}
+	d, e := NewDelay("trace:"+fn, "t")
+	if e != nil {
+		t.Fatalf("NewDelay, expected no error, got [%v]\n", e)
+	}
+	for _, w := range []time.Duration{5, 7, 5} {
+		if v := d.Next(); v != w*time.Millisecond {
+			t.Errorf("trace delay, expected [%v], got [%v]\n", w*time.Millisecond, v)
+		}
+	}
+	//
+	SetSeed(42)
+	defer SetSeed(0)
+	d1, _ := NewDelay("exp:100ms", "q1")
+	d2, _ := NewDelay("exp:100ms", "q1")
+	for i := 0; i < 10; i++ {
+		if v1, v2 := d1.Next(), d2.Next(); v1 != v2 {
+			t.Fatalf("seeded delays, expected equal, got [%v] [%v]\n", v1, v2)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package sngecomm
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/gmallard/stompngo"
+)
+
+/*
+DialFunc opens a network connection.  network is tcp or unix.  A DialFunc
+may return any net.Conn, for example one end of a net.Pipe.
+*/
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+var (
+	dialFunc     DialFunc // Set by SetDialFunc
+	dialFuncLock sync.Mutex
+)
+
+// SetDialFunc sets the DialFunc used when DialOptions.DialFunc is nil.  This
+// includes CommonConnect, pools and failover connections.  nil restores
+// net.Dialer.
+func SetDialFunc(f DialFunc) {
+	dialFuncLock.Lock()
+	defer dialFuncLock.Unlock()
+	dialFunc = f
+}
+
+// dialFor returns the DialFunc for a dial.
+func dialFor(o DialOptions) DialFunc {
+	if o.DialFunc != nil {
+		return o.DialFunc
+	}
+	dialFuncLock.Lock()
+	defer dialFuncLock.Unlock()
+	if dialFunc != nil {
+		return dialFunc
+	}
+	var nd net.Dialer
+	return nd.DialContext
+}
+
+// DialOptions controls Dial.  Only Broker is needed, and it may be nil.
+type DialOptions struct {
+	Exampid  string           // Log line prefix
+	Tag      string           // Log line tag
+	Logger   *log.Logger      // nil uses the sngecomm utility logger
+	Broker   *BrokerParms     // nil uses ResolveBroker
+	TLS      *tls.Config      // Non-nil connects with TLS
+	Headers  stompngo.Headers // nil uses Broker.ConnectHeaders
+	Monitor  *MonitorOptions  // Non-nil adds a HeartbeatMonitor
+	DialFunc DialFunc         // nil uses SetDialFunc, or net.Dialer
+}
+
+/*
+DialError is a failure to connect to a broker.
+
+Op is dial, proxy, tls, websocket or connect.  For a refused CONNECT, Response is the
+broker's ERROR frame, if any.
+*/
+type DialError struct {
+	Op       string
+	Addr     string // host:port, or unix:///path
+	Err      error
+	Response *stompngo.Message
+}
+
+func (d *DialError) Error() string {
+	return fmt.Sprintf("%s %s: %v", d.Op, d.Addr, d.Err)
+}
+
+func (d *DialError) Unwrap() error { return d.Err }
+
+// Dial connects to a broker.  See DialContext.
+func Dial(o DialOptions) (net.Conn, *stompngo.Connection, error) {
+	return DialContext(context.Background(), o)
+}
+
+/*
+DialContext connects to a broker, and sends the CONNECT frame.
+
+With a TLS config, or a broker from a stomp+ssl URI, the connection uses
+TLS.  Broker TLS material and SNI are added to the config, see
+BrokerParms.ApplyTLS.  Broker public key pins are checked after the
+handshake, see CheckPins.  A broker with a Unix socket path dials that, see
+BrokerParms.Addr.  With a broker proxy, TLS runs through the proxy
+tunnel.  With a broker WebSocket path, STOMP runs over a WebSocket, after
+any TLS.  With a Monitor, the returned net.Conn is the
+HeartbeatMonitor.
+
+Dial never ends the process.  Failures are returned as a *DialError, or a
+*TimeoutError when the context deadline expires.
+*/
+func DialContext(ctx context.Context, o DialOptions) (net.Conn,
+	*stompngo.Connection, error) {
+	l, b, c := o.Logger, o.Broker, o.TLS
+	if l == nil {
+		l = llu
+	}
+	if b == nil {
+		var e error
+		if b, e = ResolveBroker(); e != nil {
+			return nil, nil, e
+		}
+	}
+	if c == nil && b.UseTLS {
+		c = &tls.Config{}
+	}
+	lp := "common_connect" // Log line prefix
+	if c != nil {
+		lp = "common_tls_connect"
+	}
+	h, p := b.Host, b.Port
+	hap := net.JoinHostPort(h, p)
+	addr := b.Addr()
+
+	// Set up the connection, possibly through a proxy.
+	df := dialFor(o)
+	var n net.Conn
+	var e error
+	if b.Proxy != "" {
+		u, pe := ParseProxy(b.Proxy)
+		if pe == nil && b.Unix != "" {
+			pe = fmt.Errorf("proxy: cannot reach a unix socket")
+		}
+		if pe != nil {
+			return nil, nil, &DialError{"proxy", addr, pe, nil}
+		}
+		l.Printf("%stag:%s connsess:%s %s_proxy proxy:%s\n",
+			o.Exampid, o.Tag, Lcs,
+			lp, redactURI(u))
+		if n, e = dialProxy(ctx, df, u, hap); e != nil {
+			return nil, nil, ctxErrOr("connect", ctx, &DialError{"proxy", addr, e, nil})
+		}
+	} else if b.Unix != "" {
+		if n, e = df(ctx, "unix", b.Unix); e != nil {
+			return nil, nil, ctxErrOr("connect", ctx, &DialError{"dial", addr, e, nil})
+		}
+	} else if n, e = df(ctx, "tcp", hap); e != nil {
+		return nil, nil, ctxErrOr("connect", ctx, &DialError{"dial", addr, e, nil})
+	}
+	done := ctxDeadline(ctx, n)
+	if c != nil {
+		// Profile TLS material, and SNI
+		if e = b.ApplyTLS(c); e != nil {
+			done()
+			_ = n.Close()
+			return nil, nil, &DialError{"tls", addr, e, nil}
+		}
+		nc := tls.Client(n, c) // Returns: *tls.Conn : implements net.Conn
+		if e = nc.Handshake(); e != nil {
+			done()
+			_ = n.Close()
+			if e == io.EOF {
+				l.Printf("%stag:%s consess:%s common_tls_handshake_EOF_Is_the_broker_port_TLS_enabled? port:%s\n",
+					o.Exampid, o.Tag, Lcs,
+					p)
+			}
+			return nil, nil, ctxErrOr("connect", ctx, &DialError{"tls", addr, e, nil})
+		}
+		l.Printf("%stag:%s consess:%s common_tls_handshake_complete\n",
+			o.Exampid, o.Tag, Lcs)
+		// Public key pins, after CA validation
+		pin, report, pe := b.TLS.checkPins(nc.ConnectionState())
+		switch {
+		case pe != nil && report:
+			l.Printf("%stag:%s connsess:%s common_tls_pin_mismatch mode:report error:%v\n",
+				o.Exampid, o.Tag, Lcs,
+				pe)
+		case pe != nil:
+			done()
+			_ = nc.Close()
+			return nil, nil, &DialError{"tls", addr, pe, nil}
+		case pin != "":
+			l.Printf("%stag:%s connsess:%s common_tls_pin_match pin:%s\n",
+				o.Exampid, o.Tag, Lcs,
+				pin)
+		}
+		n = nc
+	}
+
+	if b.WebSocket != "" {
+		wc, we := wsHandshake(n, c != nil, hap, b.WebSocket)
+		if we != nil {
+			done()
+			_ = n.Close()
+			return nil, nil, ctxErrOr("connect", ctx, &DialError{"websocket", addr, we, nil})
+		}
+		l.Printf("%stag:%s connsess:%s %s_websocket path:%s subprotocol:%s\n",
+			o.Exampid, o.Tag, Lcs,
+			lp, b.WebSocket, wc.protocol)
+		n = wc
+	}
+
+	var m *HeartbeatMonitor
+	if o.Monitor != nil {
+		m = newHeartbeatMonitor(n, *o.Monitor, o, l)
+		n = m
+	}
+
+	l.Printf("%stag:%s connsess:%s %s_host_and_port:%v\n",
+		o.Exampid, o.Tag, Lcs,
+		lp, addr)
+
+	// Create connect headers and connect to stompngo
+	ch := o.Headers
+	if ch == nil {
+		ch = b.ConnectHeaders()
+	}
+	l.Printf("%stag:%s connsess:%s %s_headers headers:%v\n",
+		o.Exampid, o.Tag, Lcs,
+		lp, ch)
+	conn, e := stompngo.Connect(n, ch)
+	done()
+	if e != nil {
+		_ = n.Close() // The broker refused us
+		de := &DialError{"connect", addr, e, nil}
+		if conn != nil && conn.ConnectResponse != nil {
+			de.Response = conn.ConnectResponse
+		}
+		return nil, conn, ctxErrOr("connect", ctx, de)
+	}
+	SetLogger(conn) // Maybe set a connection logger
+	if m != nil {
+		m.start(conn)
+	}
+	l.Printf("%stag:%s connsess:%s %s_complete host:%s port:%s vhost:%s protocol:%s server:%s\n",
+		o.Exampid, o.Tag, conn.Session(),
+		lp, h, p, b.Vhost, conn.Protocol(), ServerIdent(conn))
+
+	// Show connect response
+	l.Printf("%stag:%s connsess:%s %s_response connresp:%v\n",
+		o.Exampid, o.Tag, conn.Session(),
+		lp, conn.ConnectResponse)
+
+	// Heartbeat Data
+	l.Printf("%stag:%s connsess:%s %s_heart_beat_send hbsend:%d\n",
+		o.Exampid, o.Tag, conn.Session(),
+		lp, conn.SendTickerInterval())
+	l.Printf("%stag:%s connsess:%s %s_heart_beat_recv hbrecv:%d\n",
+		o.Exampid, o.Tag, conn.Session(),
+		lp, conn.ReceiveTickerInterval())
+
+	l.Printf("%stag:%s connsess:%s %s_local_addr:%s\n",
+		o.Exampid, o.Tag, conn.Session(),
+		lp, n.LocalAddr().String())
+	l.Printf("%stag:%s connsess:%s %s_remote_addr:%s\n",
+		o.Exampid, o.Tag, conn.Session(),
+		lp, n.RemoteAddr().String())
+
+	//
+	return n, conn, nil
+}
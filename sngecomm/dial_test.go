@@ -0,0 +1,174 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package sngecomm
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gmallard/stompngo"
+)
+
+// testServer accepts connections, and runs f on each.
+func testServer(t *testing.T, f func(net.Conn)) net.Listener {
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	go func() {
+		for {
+			c, e := l.Accept()
+			if e != nil {
+				return
+			}
+			go f(c)
+		}
+	}()
+	return l
+}
+
+// dialOpts returns options for a test broker address.
+func dialOpts(hap string) DialOptions {
+	defer setTestEnv("STOMP_PROTOCOL", "1.2")()
+	return DialOptions{Exampid: "test: ", Tag: "dial",
+		Logger: log.New(ioutil.Discard, "", 0),
+		Broker: resolveBroker(nil, nil).at(hap)}
+}
+
+// dialErr checks for a *DialError from a failed Dial.
+func dialErr(t *testing.T, e error, op string) *DialError {
+	de, ok := e.(*DialError)
+	if !ok {
+		t.Fatalf("Dial %s, expected a *DialError, got [%v]\n", op, e)
+	}
+	if de.Op != op {
+		t.Errorf("Dial, expected op [%s], got [%s]\n", op, de.Op)
+	}
+	return de
+}
+
+/*
+Test that dial, TLS handshake and CONNECT failures are returned, not fatal.
+*/
+func TestDialErrors(t *testing.T) {
+	dl, _ := net.Listen("tcp", "127.0.0.1:0")
+	down := dl.Addr().String()
+	dl.Close()
+	_, _, e := Dial(dialOpts(down))
+	dialErr(t, e, "dial")
+	//
+	hl := testServer(t, func(c net.Conn) { c.Close() }) // Not TLS
+	defer hl.Close()
+	o := dialOpts(hl.Addr().String())
+	o.TLS = &tls.Config{InsecureSkipVerify: true}
+	_, _, e = Dial(o)
+	dialErr(t, e, "tls")
+	//
+	rl := testServer(t, func(c net.Conn) {
+		defer c.Close()
+		_, _ = bufio.NewReader(c).ReadString(0)
+		fmt.Fprintf(c, "ERROR\nmessage:bad credentials\n\n\x00")
+	})
+	defer rl.Close()
+	_, _, e = Dial(dialOpts(rl.Addr().String()))
+	de := dialErr(t, e, "connect")
+	if de.Response == nil || de.Response.Command != stompngo.ERROR {
+		t.Errorf("Dial connect, expected an ERROR response, got [%v]\n", de.Response)
+	}
+}
+
+/*
+Test a successful Dial, with custom CONNECT headers.
+*/
+func TestDialConnect(t *testing.T) {
+	l, fc := testBroker(t)
+	defer l.Close()
+	o := dialOpts(l.Addr().String())
+	o.Headers = stompngo.Headers{"accept-version", "1.2", "host", "custom"}
+	n, conn, e := Dial(o)
+	if e != nil {
+		t.Fatalf("Dial, expected no error, got [%v]\n", e)
+	}
+	defer n.Close()
+	if f := nextFrame(t, fc, "CONNECT"); f.h["host"] != "custom" {
+		t.Errorf("Dial headers, got [%v]\n", f.h)
+	}
+	if conn.Protocol() != stompngo.SPL_12 {
+		t.Errorf("Dial protocol, got [%s]\n", conn.Protocol())
+	}
+}
+
+/*
+Test dialing a Unix socket, an injected DialFunc, and the package DialFunc.
+*/
+func TestDialTransports(t *testing.T) {
+	d, e := ioutil.TempDir("", "sngecomm")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(d)
+	ul, e := net.Listen("unix", filepath.Join(d, "stomp.sock"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer ul.Close()
+	fc := serveTestBroker(ul)
+	o := dialOpts("localhost:61613")
+	o.Broker = o.Broker.at("unix://" + ul.Addr().String())
+	n, _, e := Dial(o)
+	if e != nil {
+		t.Fatalf("Dial unix, expected no error, got [%v]\n", e)
+	}
+	n.Close()
+	nextFrame(t, fc, "CONNECT")
+	if n.RemoteAddr().Network() != "unix" {
+		t.Errorf("Dial unix, got network [%s]\n", n.RemoteAddr().Network())
+	}
+	//
+	pl := NewPipeListener()
+	defer pl.Close()
+	fc = serveTestBroker(pl)
+	o = dialOpts("localhost:61613")
+	o.DialFunc = pl.Dial
+	if n, _, e = Dial(o); e != nil {
+		t.Fatalf("Dial pipe, expected no error, got [%v]\n", e)
+	}
+	n.Close()
+	nextFrame(t, fc, "CONNECT")
+	SetDialFunc(pl.Dial)
+	defer SetDialFunc(nil)
+	n, conn, e := CommonConnect("test: ", "pipe", o.Logger)
+	if e != nil {
+		t.Fatalf("CommonConnect pipe, expected no error, got [%v]\n", e)
+	}
+	nextFrame(t, fc, "CONNECT")
+	if e = CommonDisconnect(n, conn, "test: ", "pipe", o.Logger); e != nil {
+		t.Errorf("CommonDisconnect pipe, got [%v]\n", e)
+	}
+	pl.Close()
+	_, _, e = Dial(o)
+	if de := dialErr(t, e, "dial"); de.Err != ErrListenerClosed {
+		t.Errorf("Dial closed pipe, got [%v]\n", de.Err)
+	}
+}
@@ -21,7 +21,6 @@ project.
 package sngecomm
 
 import (
-	"bytes"
 	"log"
 	"os"
 	"strconv"
@@ -32,11 +31,11 @@ import (
 
 var (
 	//
-	nqs     = 1               // Default number of queues for multi-queue demo(s)
-	nqsLock sync.Mutex        // nqs variable lock
-	mdml    = 1024 * 32       // Message data max length of variable message, 32K
-	md      = make([]byte, 1) // Additional message data, primed during init()
-	pbc     = 64              // Number of bytes to print (used in some examples that receive).
+	nqs      = 1         // Default number of queues for multi-queue demo(s)
+	nqsLock  sync.Mutex  // nqs variable lock
+	mdml     = 1024 * 32 // Message data max length of variable message, 32K
+	mdmlLock sync.Mutex  // mdml variable lock
+	pbc      = 64        // Number of bytes to print (used in some examples that receive).
 
 	ngors    = 1  // Number of go routines to use (publish)
 	gorsleep = "" // If non-empty, go routines will sleep (publish)
@@ -71,11 +70,7 @@ const (
 
 // Initialization
 func init() {
-	p := "_123456789ABCDEF"
-	// c := mdml / len(p)
-	c := Mdml() / len(p)
-	b := []byte(p)
-	md = bytes.Repeat(b, c) // A long string
+	Mdml() // Possibly set from the environment
 	//
 	memprof = os.Getenv("STOMP_MEMPROF")
 	cpuprof = os.Getenv("STOMP_CPUPROF")
@@ -113,23 +108,23 @@ func Nqs() int {
 
 // Mdml sets the Max Data Message Length
 func Mdml() int {
+	mdmlLock.Lock()
+	defer mdmlLock.Unlock()
 	if s := os.Getenv("STOMP_MDML"); s != "" {
 		i, e := strconv.ParseInt(s, 10, 32)
 		if nil != e {
 			log.Printf("v1:%v v2:%v\n", "MDML conversion error", e)
 		} else {
 			mdml = int(i)
-			p := "_123456789ABCDEF"
-			c := mdml / len(p)
-			b := []byte(p)
-			md = bytes.Repeat(b, c) // A long string
 		}
 	}
 	return mdml
 }
 
-// Mdml sets the Max Data Message Length
+// GetMdml returns the Max Data Message Length
 func GetMdml() int {
+	mdmlLock.Lock()
+	defer mdmlLock.Unlock()
 	return mdml
 }
 
@@ -191,13 +186,13 @@ func RecvFactor() float64 {
 
 // Partial returns the partial byte slice for logging, random length
 func Partial() []byte {
-	r := int(ValueBetween(1, int64(mdml-1), 1.0))
-	return md[0:r]
+	r := int(ValueBetween(1, int64(GetMdml()-1), 1.0))
+	return pattern(r)
 }
 
 // PartialSubstr returns the partial string for logging, fixed length
 func PartialSubstr(l int) []byte {
-	return md[0:l]
+	return pattern(l)
 }
 
 // Pbc returns the byte count to log
@@ -264,6 +259,11 @@ func CustomCiphers() []uint16 {
 	return []uint16{}
 }
 
+// TLSReportFile returns a TLS report file name or the empty string
+func TLSReportFile() string {
+	return os.Getenv("STOMP_TLS_REPORTFILE")
+}
+
 // Logger returns an indication of whether to do logging
 func Logger() string {
 	return os.Getenv("STOMP_LOGGER")
@@ -0,0 +1,682 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package sngecomm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gmallard/stompngo"
+)
+
+// Reconnect event kinds.
+const (
+	EventLost        = "lost"        // The connection failed
+	EventDialFailed  = "dial_failed" // One broker could not be reached
+	EventReconnected = "reconnected" // A new connection is ready
+	EventGaveUp      = "gave_up"     // All attempts failed
+)
+
+var (
+	errClosed = errors.New("failover: connection closed")
+)
+
+/*
+Failover is an ordered broker list, and the policy for retrying it.
+
+Each attempt tries every broker in order.  Between attempts the delay starts
+at Initial, and grows by Multiplier up to Max.  Jitter randomizes each delay
+by up to that fraction, so many clients do not retry in step.
+*/
+type Failover struct {
+	Brokers     []string      // host:port or unix:///path, in preference order
+	Initial     time.Duration // First delay between attempts
+	Max         time.Duration // Largest delay between attempts
+	Multiplier  float64       // Delay growth per attempt
+	Jitter      float64       // Random fraction of each delay, 0 to 1
+	MaxAttempts int           // Attempts before giving up, 0 retries forever
+}
+
+/*
+ParseFailover parses a broker list, in ActiveMQ style:
+
+	failover:(tcp://a:61613,tcp://b:61613)?initialReconnectDelay=100ms
+	tcp://a:61613,b:61613
+	unix:///run/broker/stomp.sock,tcp://b:61613
+
+Options are initialReconnectDelay, maxReconnectDelay, backOffMultiplier,
+jitter and maxReconnectAttempts.  Delays are go durations, or integer
+milliseconds.
+*/
+func ParseFailover(s string) (*Failover, error) {
+	f := &Failover{Initial: 100 * time.Millisecond, Max: 30 * time.Second,
+		Multiplier: 2.0, Jitter: 0.2}
+	l, q := s, ""
+	if strings.HasPrefix(l, "failover:") {
+		l = strings.TrimPrefix(l, "failover:")
+		if strings.HasPrefix(l, "(") {
+			i := strings.Index(l, ")")
+			if i < 0 {
+				return nil, fmt.Errorf("failover %q: missing )", s)
+			}
+			l, q = l[1:i], l[i+1:]
+			if q != "" && !strings.HasPrefix(q, "?") {
+				return nil, fmt.Errorf("failover %q: unexpected %q", s, q)
+			}
+			q = strings.TrimPrefix(q, "?")
+		} else if i := strings.Index(l, "?"); i >= 0 {
+			l, q = l[:i], l[i+1:]
+		}
+	}
+	for _, u := range strings.Split(l, ",") {
+		hap := strings.TrimPrefix(strings.TrimSpace(u), "tcp://")
+		if strings.HasPrefix(hap, "unix:///") {
+			f.Brokers = append(f.Brokers, hap)
+			continue
+		}
+		if strings.Contains(hap, "://") {
+			return nil, fmt.Errorf("failover %q: unsupported broker %q", s, u)
+		}
+		if _, _, e := net.SplitHostPort(hap); e != nil {
+			return nil, fmt.Errorf("failover %q: %v", s, e)
+		}
+		f.Brokers = append(f.Brokers, hap)
+	}
+	o, e := url.ParseQuery(q)
+	if e != nil {
+		return nil, fmt.Errorf("failover %q: %v", s, e)
+	}
+	for k, v := range o {
+		switch k {
+		case "initialReconnectDelay":
+			f.Initial, e = parseMillis(v[0])
+		case "maxReconnectDelay":
+			f.Max, e = parseMillis(v[0])
+		case "backOffMultiplier":
+			f.Multiplier, e = strconv.ParseFloat(v[0], 64)
+			if e == nil && f.Multiplier < 1.0 {
+				e = fmt.Errorf("multiplier %v is less than 1", f.Multiplier)
+			}
+		case "jitter":
+			f.Jitter, e = strconv.ParseFloat(v[0], 64)
+			if e == nil && (f.Jitter < 0 || f.Jitter > 1) {
+				e = fmt.Errorf("jitter %v is not between 0 and 1", f.Jitter)
+			}
+		case "maxReconnectAttempts":
+			f.MaxAttempts, e = strconv.Atoi(v[0])
+			if e == nil && f.MaxAttempts < 0 {
+				f.MaxAttempts = 0 // ActiveMQ uses -1 for forever
+			}
+		default:
+			e = fmt.Errorf("unknown option %q", k)
+		}
+		if e != nil {
+			return nil, fmt.Errorf("failover %q: %s: %v", s, k, e)
+		}
+	}
+	return f, nil
+}
+
+// parseMillis parses a duration, or integer milliseconds.
+func parseMillis(s string) (time.Duration, error) {
+	if ms, e := strconv.ParseInt(s, 10, 64); e == nil {
+		return time.Duration(ms) * time.Millisecond, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// backoff returns the delay after a number of failed attempts, starting at 1.
+func (f *Failover) backoff(attempt int, r *lockedRand) time.Duration {
+	d := float64(f.Initial) * math.Pow(f.Multiplier, float64(attempt-1))
+	if d > float64(f.Max) {
+		d = float64(f.Max)
+	}
+	if f.Jitter > 0 && r != nil {
+		d *= 1 + f.Jitter*(2*r.float64()-1)
+	}
+	return time.Duration(d)
+}
+
+// failover returns the configured broker list, or just the broker b.
+func (c *Config) failover(b *BrokerParms) (*Failover, error) {
+	if c.Failover != "" {
+		return ParseFailover(c.Failover)
+	}
+	return ParseFailover(b.Addr())
+}
+
+// at returns a copy of b for another broker address, host:port or
+// unix:///path.
+func (b *BrokerParms) at(hap string) *BrokerParms {
+	nb := *b
+	if strings.HasPrefix(hap, "unix://") {
+		nb.Unix = strings.TrimPrefix(hap, "unix://")
+		return &nb
+	}
+	h, p, _ := net.SplitHostPort(hap)
+	nb.Host, nb.Port, nb.Unix = h, p, ""
+	if b.Source("vhost") == SrcDefault {
+		nb.Vhost = h
+	}
+	return &nb
+}
+
+// ReconnectEvent reports a change in a failover connection.
+type ReconnectEvent struct {
+	Time     time.Time
+	Kind     string // EventLost, EventDialFailed, ...
+	Broker   string // host:port
+	Attempt  int
+	Restored int // Subscriptions restored, EventReconnected only
+	Err      error
+}
+
+// dialer connects to the first broker of a Failover that answers.
+type dialer struct {
+	exampid, tag string
+	l            *log.Logger
+	o            DialOptions // Broker is the template for each address
+	f            *Failover
+	r            *lockedRand
+	notify       func(ReconnectEvent)
+}
+
+func newFailoverDialer(o DialOptions, f *Failover) *dialer {
+	if o.Logger == nil {
+		o.Logger = llu
+	}
+	return &dialer{o.Exampid, o.Tag, o.Logger, o, f, newLockedRand("failover"), nil}
+}
+
+// event logs a ReconnectEvent, and passes it on.
+func (d *dialer) event(ev ReconnectEvent) {
+	ev.Time = time.Now()
+	d.l.Printf("%stag:%s connsess:%s failover_%s broker:%s attempt:%d restored:%d error:%v\n",
+		d.exampid, d.tag, Lcs,
+		ev.Kind, ev.Broker, ev.Attempt, ev.Restored, ev.Err)
+	if d.notify != nil {
+		d.notify(ev)
+	}
+}
+
+// dial tries the brokers until one answers, the attempts are used up, or
+// the context is done.
+func (d *dialer) dial(ctx context.Context) (net.Conn, *stompngo.Connection,
+	string, error) {
+	var le error
+	for a := 1; d.f.MaxAttempts == 0 || a <= d.f.MaxAttempts; a++ {
+		if a > 1 {
+			t := time.NewTimer(d.f.backoff(a-1, d.r))
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				return nil, nil, "", ctxErr("connect", ctx)
+			}
+		}
+		for _, hap := range d.f.Brokers {
+			if ctx.Err() != nil {
+				return nil, nil, "", ctxErr("connect", ctx)
+			}
+			o := d.o
+			o.Broker = d.o.Broker.at(hap)
+			if o.TLS != nil {
+				o.TLS = o.TLS.Clone() // SNI differs per broker
+			}
+			n, conn, e := DialContext(ctx, o)
+			if e == nil {
+				return n, conn, hap, nil
+			}
+			le = e
+			d.event(ReconnectEvent{Kind: EventDialFailed, Broker: hap,
+				Attempt: a, Err: e})
+		}
+	}
+	e := fmt.Errorf("failover: %d attempts failed, last error: %v",
+		d.f.MaxAttempts, le)
+	d.event(ReconnectEvent{Kind: EventGaveUp, Attempt: d.f.MaxAttempts, Err: e})
+	return nil, nil, "", e
+}
+
+var (
+	resilients sync.Map // *stompngo.Connection to *Resilient
+)
+
+// managed returns the Resilient that owns a connection, if any.
+func managed(c *stompngo.Connection) *Resilient {
+	if r, ok := resilients.Load(c); ok {
+		return r.(*Resilient)
+	}
+	return nil
+}
+
+/*
+Resilient is a connection that reconnects when the broker goes away.
+
+Subscriptions made with Subscribe, or with HandleSubscribe on any connection
+returned by Conn, are restored after a reconnect.  Their channels stay the
+same.  HandleAck and HandleUnsubscribe are also routed to the current
+connection.  Acknowledgements for messages from a lost connection are
+dropped: the broker redelivers those messages.
+
+When every attempt fails, each subscription channel, and MessageData,
+receive a MessageData with the error.
+*/
+type Resilient struct {
+	// ERROR and RECEIPT frames, from the current connection.
+	MessageData <-chan stompngo.MessageData
+	//
+	d       *dialer
+	md      chan stompngo.MessageData
+	events  chan ReconnectEvent
+	ctx     context.Context // Canceled by Disconnect
+	cancel  context.CancelFunc
+	stop    <-chan struct{}
+	cpd     chan struct{} // Connection level pump done
+	mu      sync.Mutex
+	n       net.Conn
+	conn    *stompngo.Connection
+	conns   []*stompngo.Connection // All connections, for the registry
+	hap     string
+	gen     int  // Connection generation
+	busy    bool // Reconnecting
+	closed  bool
+	subs    map[string]*rsub
+	pending map[string]pendingAck // Ack keys delivered from the current connection
+	seq     int                   // Delivery order, for pending
+}
+
+// pendingAck is a delivered message, waiting for an ACK or NACK.
+type pendingAck struct {
+	sub    string // Subscription key
+	seq    int
+	client bool // Client ack mode: an ACK also covers earlier messages
+}
+
+// rsub is a subscription to restore.
+type rsub struct {
+	d, id, ack string
+	out        chan stompngo.MessageData
+	done       chan struct{} // Closed on unsubscribe
+}
+
+// ResilientConnect connects to the configured brokers, using the current run
+// parameters.  See Config.ResilientConnect.
+func ResilientConnect(exampid, tag string, l *log.Logger) (*Resilient, error) {
+	return runConfig().ResilientConnect(exampid, tag, l)
+}
+
+// ResilientConnect connects to the brokers in c, see the failover run
+// parameter.  With no list the broker is retried.
+func (c *Config) ResilientConnect(exampid, tag string,
+	l *log.Logger) (*Resilient, error) {
+	o := c.DialOptions(exampid, tag, l)
+	if o.Broker == nil {
+		b, e := ResolveBroker()
+		if e != nil {
+			return nil, e
+		}
+		o.Broker = b
+	}
+	f, e := c.failover(o.Broker)
+	if e != nil {
+		return nil, e
+	}
+	return newResilient(o, f)
+}
+
+// NewResilient connects to the first of a list of brokers that answers.
+func NewResilient(exampid, tag string, l *log.Logger, b *BrokerParms,
+	f *Failover) (*Resilient, error) {
+	o := runConfig().DialOptions(exampid, tag, l)
+	o.Broker = b
+	return newResilient(o, f)
+}
+
+func newResilient(o DialOptions, f *Failover) (*Resilient, error) {
+	r := &Resilient{
+		d:       newFailoverDialer(o, f),
+		md:      make(chan stompngo.MessageData),
+		events:  make(chan ReconnectEvent, 64),
+		subs:    map[string]*rsub{},
+		pending: map[string]pendingAck{},
+	}
+	r.MessageData = r.md
+	r.d.notify = r.notify
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	r.stop = r.ctx.Done()
+	n, conn, hap, e := r.d.dial(r.ctx)
+	if e != nil {
+		r.cancel()
+		return nil, e
+	}
+	r.install(n, conn, hap)
+	return r, nil
+}
+
+// Events returns the reconnect events.  Events are dropped if not read.
+func (r *Resilient) Events() <-chan ReconnectEvent {
+	return r.events
+}
+
+func (r *Resilient) notify(ev ReconnectEvent) {
+	select {
+	case r.events <- ev:
+	default:
+	}
+}
+
+// Conn returns the current stompngo connection.
+func (r *Resilient) Conn() *stompngo.Connection {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.conn
+}
+
+// NetConn returns the current network connection.
+func (r *Resilient) NetConn() net.Conn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.n
+}
+
+// install makes a new connection current.  Caller holds r.mu, or is the
+// constructor.
+func (r *Resilient) install(n net.Conn, conn *stompngo.Connection, hap string) {
+	r.n, r.conn, r.hap = n, conn, hap
+	r.gen++
+	r.pending = map[string]pendingAck{}
+	r.conns = append(r.conns, conn)
+	resilients.Store(conn, r)
+	r.cpd = make(chan struct{})
+	go r.pumpConn(r.gen, conn.MessageData, r.cpd)
+}
+
+// Subscribe subscribes on the current connection.  The channel is kept
+// across reconnects.
+func (r *Resilient) Subscribe(d, id, a string) (<-chan stompngo.MessageData, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil, errClosed
+	}
+	sc, e := subscribe(r.conn, d, id, a)
+	if e != nil {
+		return nil, e
+	}
+	s := &rsub{d, id, a, make(chan stompngo.MessageData, r.conn.SubChanCap()),
+		make(chan struct{})}
+	r.subs[subKey(d, id)] = s
+	go r.pump(r.gen, s, sc)
+	return s.out, nil
+}
+
+// Unsubscribe unsubscribes on the current connection.
+func (r *Resilient) Unsubscribe(d, id string) error {
+	r.mu.Lock()
+	k := subKey(d, id)
+	if s, ok := r.subs[k]; ok {
+		close(s.done)
+		delete(r.subs, k)
+	}
+	for ak, p := range r.pending {
+		if p.sub == k {
+			delete(r.pending, ak)
+		}
+	}
+	conn := r.conn
+	r.mu.Unlock()
+	return unsubscribe(conn, d, id)
+}
+
+// Ack acknowledges a message, if it came from the current connection.  In
+// client ack mode the broker takes the ACK for every earlier message of the
+// subscription too, so they are no longer pending.
+func (r *Resilient) Ack(h stompngo.Headers, id string) error {
+	k := ackKey(h)
+	r.mu.Lock()
+	conn := r.conn
+	p, ok := r.pending[k]
+	delete(r.pending, k)
+	if ok && p.client {
+		for ak, q := range r.pending {
+			if q.sub == p.sub && q.seq < p.seq {
+				delete(r.pending, ak)
+			}
+		}
+	}
+	r.mu.Unlock()
+	if !ok {
+		r.d.l.Printf("%stag:%s connsess:%s failover_ack_dropped key:%s\n",
+			r.d.exampid, r.d.tag, conn.Session(),
+			k)
+		return nil
+	}
+	return ack(conn, h, id)
+}
+
+// Nack negatively acknowledges a message, if it came from the current
+// connection.  Messages from an earlier connection are redelivered anyway.
+func (r *Resilient) Nack(h stompngo.Headers, id string) error {
+	k := ackKey(h)
+	r.mu.Lock()
+	conn := r.conn
+	_, ok := r.pending[k]
+	delete(r.pending, k)
+	r.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return nack(conn, h, id)
+}
+
+// Disconnect stops reconnecting, and disconnects the current connection.
+func (r *Resilient) Disconnect() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return errClosed
+	}
+	r.closed = true
+	r.cancel()
+	n, conn, cpd := r.n, r.conn, r.cpd
+	r.mu.Unlock()
+	// The connection level pump must not take the DISCONNECT receipt.
+	<-cpd
+	e := CommonDisconnect(n, conn, r.d.exampid, r.d.tag, r.d.l)
+	r.mu.Lock()
+	for _, c := range r.conns {
+		resilients.Delete(c)
+	}
+	r.mu.Unlock()
+	return e
+}
+
+func subKey(d, id string) string {
+	if id == "" {
+		return d
+	}
+	return id
+}
+
+// ackKey identifies a message for acknowledgement.
+func ackKey(h stompngo.Headers) string {
+	if k := h.Value("ack"); k != "" {
+		return k
+	}
+	return h.Value("message-id")
+}
+
+// pump passes messages from one connection to a subscription channel.
+func (r *Resilient) pump(g int, s *rsub, sc <-chan stompngo.MessageData) {
+	for {
+		var md stompngo.MessageData
+		var ok bool
+		select {
+		case md, ok = <-sc:
+		case <-s.done:
+			Drain(sc)
+			return
+		case <-r.stop:
+			Drain(sc)
+			return
+		}
+		if !ok {
+			return
+		}
+		if md.Error != nil {
+			go r.reconnect(g, md.Error)
+			return
+		}
+		if s.ack != stompngo.AckModeAuto {
+			r.mu.Lock()
+			if g == r.gen {
+				r.seq++
+				r.pending[ackKey(md.Message.Headers)] = pendingAck{
+					subKey(s.d, s.id), r.seq, s.ack == stompngo.AckModeClient}
+			}
+			r.mu.Unlock()
+		}
+		select {
+		case s.out <- md:
+		case <-s.done:
+			Drain(sc)
+			return
+		case <-r.stop:
+			Drain(sc)
+			return
+		}
+	}
+}
+
+/*
+Drain discards messages so the stompngo reader is never blocked, until the
+subscription is closed or goes quiet.  The reader delivers to every
+subscription on a connection in turn, so a receiver that stops reading
+early must drain its subscription, or all the others stall with it.
+*/
+func Drain(sc <-chan stompngo.MessageData) {
+	for {
+		select {
+		case _, ok := <-sc:
+			if !ok {
+				return
+			}
+		case <-time.After(time.Second):
+			return
+		}
+	}
+}
+
+// pumpConn passes connection level frames to MessageData.
+func (r *Resilient) pumpConn(g int, in <-chan stompngo.MessageData,
+	done chan struct{}) {
+	defer close(done)
+	for {
+		var md stompngo.MessageData
+		var ok bool
+		select {
+		case md, ok = <-in:
+		case <-r.stop:
+			return
+		}
+		if !ok {
+			go r.reconnect(g, io.EOF)
+			return
+		}
+		if md.Error != nil {
+			go r.reconnect(g, md.Error)
+			return
+		}
+		select {
+		case r.md <- md:
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// reconnect replaces a failed connection, and restores the subscriptions.
+func (r *Resilient) reconnect(g int, cause error) {
+	r.mu.Lock()
+	if r.closed || r.busy || g != r.gen {
+		r.mu.Unlock()
+		return
+	}
+	r.busy = true
+	on, hap := r.n, r.hap
+	r.mu.Unlock()
+	_ = on.Close()
+	r.d.event(ReconnectEvent{Kind: EventLost, Broker: hap, Err: cause})
+	//
+	n, conn, hap, e := r.d.dial(r.ctx)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.busy = false
+	if r.closed { // Disconnect while dialing
+		if e == nil {
+			_ = n.Close()
+		}
+		return
+	}
+	if e != nil {
+		r.fail(e)
+		return
+	}
+	r.install(n, conn, hap)
+	rc := 0
+	for k, s := range r.subs {
+		sc, e := subscribe(conn, s.d, s.id, s.ack)
+		if e != nil {
+			r.d.l.Printf("%stag:%s connsess:%s failover_restore_failed sub:%s error:%v\n",
+				r.d.exampid, r.d.tag, conn.Session(),
+				k, e)
+			continue
+		}
+		go r.pump(r.gen, s, sc)
+		rc++
+	}
+	r.d.event(ReconnectEvent{Kind: EventReconnected, Broker: hap,
+		Restored: rc})
+}
+
+// fail passes a final error to every reader.  Caller holds r.mu.
+func (r *Resilient) fail(e error) {
+	md := stompngo.MessageData{Error: e}
+	chs := []chan stompngo.MessageData{r.md}
+	for _, s := range r.subs {
+		chs = append(chs, s.out)
+	}
+	for _, ch := range chs {
+		go func(ch chan stompngo.MessageData) {
+			select {
+			case ch <- md:
+			case <-r.stop:
+			}
+		}(ch)
+	}
+}
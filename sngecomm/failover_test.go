@@ -0,0 +1,293 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package sngecomm
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gmallard/stompngo"
+	"github.com/gmallard/stompngo_examples/sngecomm/testbroker"
+)
+
+/*
+Test broker list parsing.
+*/
+func TestFailoverParse(t *testing.T) {
+	f, e := ParseFailover("failover:(tcp://a:61613,b:61614)?initialReconnectDelay=50&maxReconnectDelay=2s&maxReconnectAttempts=3")
+	if e != nil {
+		t.Fatal(e)
+	}
+	if strings.Join(f.Brokers, ",") != "a:61613,b:61614" {
+		t.Errorf("brokers %v", f.Brokers)
+	}
+	if f.Initial != 50*time.Millisecond || f.Max != 2*time.Second ||
+		f.MaxAttempts != 3 {
+		t.Errorf("options %+v", f)
+	}
+	f, e = ParseFailover("tcp://a:61613")
+	if e != nil || len(f.Brokers) != 1 {
+		t.Errorf("single broker %v %v", f, e)
+	}
+	f, e = ParseFailover("unix:///run/stomp.sock,b:61614")
+	if e != nil || f.Brokers[0] != "unix:///run/stomp.sock" {
+		t.Errorf("unix broker %v %v", f, e)
+	}
+	for _, s := range []string{"failover:(a:1", "a", "ssl://a:1",
+		"failover:(a:1)?jitter=2", "failover:(a:1)?bogus=1"} {
+		if _, e := ParseFailover(s); e == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
+
+/*
+Test that backoff grows, is capped, and is jittered within bounds.
+*/
+func TestFailoverBackoff(t *testing.T) {
+	f := &Failover{Initial: 100 * time.Millisecond, Max: time.Second,
+		Multiplier: 2.0}
+	for a, w := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		if d := f.backoff(a+1, nil); d != w*time.Millisecond {
+			t.Errorf("attempt %d: %v, expected %v", a+1, d, w*time.Millisecond)
+		}
+	}
+	f.Jitter = 0.5
+	r := newLockedRand("test")
+	for i := 0; i < 100; i++ {
+		if d := f.backoff(1, r); d < 50*time.Millisecond || d > 150*time.Millisecond {
+			t.Fatalf("jittered delay %v out of range", d)
+		}
+	}
+}
+
+// testFrame is a frame received by testBroker.
+type testFrame struct {
+	cmd string
+	h   map[string]string
+	c   net.Conn
+}
+
+// testBroker answers CONNECT and DISCONNECT, and passes all frames on.
+func testBroker(t *testing.T) (net.Listener, chan testFrame) {
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	return l, serveTestBroker(l)
+}
+
+// serveTestBroker runs a test broker on a listener.
+func serveTestBroker(l net.Listener) chan testFrame {
+	fc := make(chan testFrame, 16)
+	go func() {
+		for {
+			c, e := l.Accept()
+			if e != nil {
+				return
+			}
+			go func(c net.Conn) {
+				r := bufio.NewReader(c)
+				for {
+					b, e := r.ReadString(0)
+					if e != nil {
+						return
+					}
+					ls := strings.Split(strings.TrimLeft(b, "\n"), "\n")
+					f := testFrame{ls[0], map[string]string{}, c}
+					for _, h := range ls[1:] {
+						if kv := strings.SplitN(h, ":", 2); len(kv) == 2 {
+							f.h[kv[0]] = kv[1]
+						}
+					}
+					switch f.cmd {
+					case "CONNECT", "STOMP":
+						fmt.Fprintf(c, "CONNECTED\nversion:1.2\nheart-beat:0,0\n\n\x00")
+					case "DISCONNECT":
+						fmt.Fprintf(c, "RECEIPT\nreceipt-id:%s\n\n\x00", f.h["receipt"])
+					}
+					fc <- f
+				}
+			}(c)
+		}
+	}()
+	return fc
+}
+
+// nextFrame waits for a frame with a given command.
+func nextFrame(t *testing.T, fc chan testFrame, cmd string) testFrame {
+	for {
+		select {
+		case f := <-fc:
+			if f.cmd == cmd {
+				return f
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %s frame", cmd)
+		}
+	}
+}
+
+/*
+Test that a subscription survives a broker bounce: the first broker in the
+list is down, the connection is dropped, and a message arrives on the
+original channel after the reconnect.
+*/
+func TestFailoverReconnect(t *testing.T) {
+	dl, _ := net.Listen("tcp", "127.0.0.1:0")
+	down := dl.Addr().String()
+	dl.Close()
+	l, fc := testBroker(t)
+	defer l.Close()
+	//
+	defer setTestEnv("STOMP_PROTOCOL", "1.2")()
+	b := resolveBroker(nil, nil)
+	f := &Failover{Brokers: []string{down, l.Addr().String()},
+		Initial: 10 * time.Millisecond, Max: 50 * time.Millisecond, Multiplier: 2.0}
+	rc, e := NewResilient("test: ", "failover", log.New(ioutil.Discard, "", 0), b, f)
+	if e != nil {
+		t.Fatal(e)
+	}
+	nextFrame(t, fc, "CONNECT")
+	sc, e := rc.Subscribe("/queue/failover", "s1", "client-individual")
+	if e != nil {
+		t.Fatal(e)
+	}
+	nextFrame(t, fc, "SUBSCRIBE").c.Close() // Bounce
+	//
+	nextFrame(t, fc, "CONNECT")
+	sf := nextFrame(t, fc, "SUBSCRIBE")
+	if sf.h["id"] != "s1" || sf.h["destination"] != "/queue/failover" {
+		t.Fatalf("restored subscription headers %v", sf.h)
+	}
+	fmt.Fprintf(sf.c, "MESSAGE\nsubscription:s1\nmessage-id:m1\nack:a1\ndestination:/queue/failover\n\nhello\x00")
+	select {
+	case md := <-sc:
+		if md.Error != nil || string(md.Message.Body) != "hello" {
+			t.Fatalf("message %v", md)
+		}
+		HandleAck(rc.Conn(), md.Message.Headers, "s1")
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message after reconnect")
+	}
+	if af := nextFrame(t, fc, "ACK"); af.h["id"] != "a1" {
+		t.Errorf("ack headers %v", af.h)
+	}
+	//
+	var kinds []string
+	for ev := range rc.Events() {
+		kinds = append(kinds, ev.Kind)
+		if ev.Kind == EventReconnected {
+			if ev.Restored != 1 {
+				t.Errorf("restored %d subscriptions, expected 1", ev.Restored)
+			}
+			break
+		}
+	}
+	w := "dial_failed,lost,dial_failed,reconnected"
+	if strings.Join(kinds, ",") != w {
+		t.Errorf("events %v, expected %s", kinds, w)
+	}
+	if e = rc.Disconnect(); e != nil {
+		t.Fatal(e)
+	}
+	nextFrame(t, fc, "DISCONNECT")
+}
+
+/*
+Test that acknowledged messages are no longer pending: an ACK in client ack
+mode covers the earlier messages of its subscription, and client-individual
+ACKs only their own message.
+*/
+func TestFailoverPendingAcks(t *testing.T) {
+	tb, e := testbroker.Start(testbroker.Options{})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer tb.Close()
+	defer setTestEnv("STOMP_PROTOCOL", "1.2")()
+	b := resolveBroker(nil, nil)
+	f := &Failover{Brokers: []string{tb.Addr()},
+		Initial: 10 * time.Millisecond, Max: 50 * time.Millisecond, Multiplier: 2.0}
+	rc, e := NewResilient("test: ", "failover", log.New(ioutil.Discard, "", 0), b, f)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer rc.Disconnect()
+	recv := func(sc <-chan stompngo.MessageData) stompngo.Headers {
+		select {
+		case md := <-sc:
+			if md.Error != nil {
+				t.Fatal(md.Error)
+			}
+			return md.Message.Headers
+		case <-time.After(5 * time.Second):
+			t.Fatal("no message")
+		}
+		return nil
+	}
+	npending := func() int {
+		rc.mu.Lock()
+		defer rc.mu.Unlock()
+		return len(rc.pending)
+	}
+	for _, d := range []string{"/queue/failover.client", "/queue/failover.individual"} {
+		for i := 0; i < 3; i++ {
+			tb.Publish(d, []byte("body"))
+		}
+	}
+	cs, e := rc.Subscribe("/queue/failover.client", "c", stompngo.AckModeClient)
+	if e != nil {
+		t.Fatal(e)
+	}
+	is, e := rc.Subscribe("/queue/failover.individual", "i", stompngo.AckModeClientIndividual)
+	if e != nil {
+		t.Fatal(e)
+	}
+	var ch, ih []stompngo.Headers
+	for i := 0; i < 3; i++ {
+		ch = append(ch, recv(cs))
+		ih = append(ih, recv(is))
+	}
+	if n := npending(); n != 6 {
+		t.Fatalf("expected 6 pending, got %d\n", n)
+	}
+	if e = rc.Ack(ch[2], "c"); e != nil {
+		t.Fatal(e)
+	}
+	if n := npending(); n != 3 {
+		t.Errorf("client ACK, expected 3 pending, got %d\n", n)
+	}
+	if e = rc.Ack(ih[2], "i"); e != nil {
+		t.Fatal(e)
+	}
+	if n := npending(); n != 2 {
+		t.Errorf("client-individual ACK, expected 2 pending, got %d\n", n)
+	}
+	if e = rc.Unsubscribe("/queue/failover.individual", "i"); e != nil {
+		t.Fatal(e)
+	}
+	if n := npending(); n != 0 {
+		t.Errorf("unsubscribe, expected no pending, got %d\n", n)
+	}
+}
@@ -0,0 +1,301 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package sngecomm
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gmallard/stompngo"
+)
+
+// Heartbeat health states.
+const (
+	Healthy  = "healthy"  // Data arrives within the receive interval
+	Degraded = "degraded" // Some beats have been missed
+	Dead     = "dead"     // Too many beats missed, or a read failed
+)
+
+// Monitor defaults.
+const (
+	DefaultTolerance = 1.5
+	DefaultDeadAfter = 3
+)
+
+/*
+MonitorOptions controls a HeartbeatMonitor.
+*/
+type MonitorOptions struct {
+	Tolerance   float64           // Allowed gap, a multiple of the receive interval
+	DeadAfter   int               // Consecutive missed beats before Dead
+	CloseOnDead bool              // Close the network connection when Dead
+	OnChange    func(HealthEvent) // Called on each state change
+}
+
+/*
+ParseMonitor parses a monitor specification of the form
+tolerance[,deadafter].  The connection is closed when it is dead.
+
+	1.5        a beat is missed 1.5 intervals after the last data, dead after 3
+	2,5        missed after 2 intervals, dead after 5
+*/
+func ParseMonitor(spec string) (*MonitorOptions, error) {
+	o := &MonitorOptions{Tolerance: DefaultTolerance,
+		DeadAfter: DefaultDeadAfter, CloseOnDead: true}
+	f := strings.Split(spec, ",")
+	var e error
+	if len(f) > 2 {
+		e = fmt.Errorf("expected tolerance[,deadafter]")
+	}
+	if e == nil {
+		o.Tolerance, e = strconv.ParseFloat(f[0], 64)
+	}
+	if e == nil && o.Tolerance < 1 {
+		e = fmt.Errorf("tolerance %v is less than 1", o.Tolerance)
+	}
+	if e == nil && len(f) > 1 {
+		o.DeadAfter, e = strconv.Atoi(f[1])
+		if e == nil && o.DeadAfter < 1 {
+			e = fmt.Errorf("deadafter %d is less than 1", o.DeadAfter)
+		}
+	}
+	if e != nil {
+		return nil, fmt.Errorf("monitor %q: %v", spec, e)
+	}
+	return o, nil
+}
+
+// monitor returns the configured monitor options, or nil.
+func (c *Config) monitor() *MonitorOptions {
+	if c.HBMonitor == "" {
+		return nil
+	}
+	o, e := ParseMonitor(c.HBMonitor)
+	if e != nil {
+		llu.Printf("monitor_error error:%v\n", e)
+		return nil
+	}
+	return o
+}
+
+// HealthEvent is a heartbeat health state change.
+type HealthEvent struct {
+	Time   time.Time
+	State  string        // The new state
+	Prev   string        // The old state
+	Gap    time.Duration // Time since data last arrived
+	Missed int           // Consecutive missed beats
+	Err    error         // A read error, for Dead
+}
+
+// MonitorStats are heartbeat monitor counts.
+type MonitorStats struct {
+	State    string
+	Interval time.Duration // Negotiated receive interval, 0 is none
+	Beats    int64         // Heartbeat only reads
+	Frames   int64         // Reads with frame data
+	Late     int64         // Beats that arrived after being missed
+	Missed   int64         // Total missed beats
+	Last     time.Time     // Data last arrived
+}
+
+/*
+HeartbeatMonitor watches a connection for inbound heartbeats and frames.
+
+A beat is missed when nothing arrives within the negotiated receive
+interval times Tolerance.  Missed beats make the connection Degraded, and
+DeadAfter consecutive missed beats make it Dead.  A read error is Dead at
+once.  When data arrives again the connection is Healthy.
+
+The monitor wraps the network connection.  Use DialOptions.Monitor, and
+MonitorOf to find a connection's monitor.
+*/
+type HeartbeatMonitor struct {
+	net.Conn
+	o       MonitorOptions
+	exampid string
+	tag     string
+	l       *log.Logger
+	last    int64 // Unix nanoseconds, atomic
+	beats   int64 // atomic
+	frames  int64 // atomic
+	rerr    atomic.Value
+	mu      sync.Mutex
+	conn    *stompngo.Connection
+	ri      time.Duration
+	state   string
+	missed  int // Consecutive
+	late    int64
+	tmissed int64
+	stop    chan struct{}
+	once    sync.Once
+}
+
+// readErr holds a read error.  atomic.Value needs one concrete type.
+type readErr struct{ e error }
+
+var monitors sync.Map // *stompngo.Connection -> *HeartbeatMonitor
+
+// MonitorOf returns the monitor for a connection, or nil.
+func MonitorOf(c *stompngo.Connection) *HeartbeatMonitor {
+	if m, ok := monitors.Load(c); ok {
+		return m.(*HeartbeatMonitor)
+	}
+	return nil
+}
+
+func newHeartbeatMonitor(n net.Conn, o MonitorOptions, d DialOptions,
+	l *log.Logger) *HeartbeatMonitor {
+	if o.Tolerance < 1 {
+		o.Tolerance = DefaultTolerance
+	}
+	if o.DeadAfter < 1 {
+		o.DeadAfter = DefaultDeadAfter
+	}
+	return &HeartbeatMonitor{Conn: n, o: o, exampid: d.Exampid, tag: d.Tag, l: l,
+		last: time.Now().UnixNano(), state: Healthy, stop: make(chan struct{})}
+}
+
+// Read counts inbound data.  A read of only EOLs is a heartbeat.
+func (m *HeartbeatMonitor) Read(b []byte) (int, error) {
+	n, e := m.Conn.Read(b)
+	if n > 0 {
+		atomic.StoreInt64(&m.last, time.Now().UnixNano())
+		if len(strings.Trim(string(b[:n]), "\r\n")) == 0 {
+			atomic.AddInt64(&m.beats, 1)
+		} else {
+			atomic.AddInt64(&m.frames, 1)
+		}
+	}
+	if e != nil {
+		m.rerr.Store(readErr{e})
+	}
+	return n, e
+}
+
+// Close stops the monitor, and closes the network connection.
+func (m *HeartbeatMonitor) Close() error {
+	m.once.Do(func() {
+		close(m.stop)
+		m.mu.Lock()
+		if m.conn != nil {
+			monitors.Delete(m.conn)
+		}
+		m.mu.Unlock()
+	})
+	return m.Conn.Close()
+}
+
+// start begins checking, once the receive interval is negotiated.
+func (m *HeartbeatMonitor) start(c *stompngo.Connection) {
+	m.mu.Lock()
+	m.conn = c
+	m.ri = time.Duration(c.ReceiveTickerInterval()) * time.Millisecond
+	m.mu.Unlock()
+	monitors.Store(c, m)
+	m.l.Printf("%stag:%s connsess:%s heart_beat_monitor_starts interval:%v tolerance:%v dead_after:%d\n",
+		m.exampid, m.tag, c.Session(),
+		m.ri, m.o.Tolerance, m.o.DeadAfter)
+	p := m.ri / 4
+	if m.ri == 0 {
+		p = time.Second // Read errors only
+	}
+	go m.run(p)
+}
+
+func (m *HeartbeatMonitor) run(p time.Duration) {
+	t := time.NewTicker(p)
+	defer t.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case now := <-t.C:
+			if !m.check(now) {
+				return
+			}
+		}
+	}
+}
+
+// check updates the state.  It returns false once a read has failed.
+func (m *HeartbeatMonitor) check(now time.Time) bool {
+	gap := now.Sub(time.Unix(0, atomic.LoadInt64(&m.last)))
+	m.mu.Lock()
+	ev := HealthEvent{Time: now, Prev: m.state, Gap: gap}
+	if re, ok := m.rerr.Load().(readErr); ok {
+		ev.State, ev.Err = Dead, re.e
+	} else if m.ri > 0 {
+		mb := int(float64(gap) / (float64(m.ri) * m.o.Tolerance))
+		switch {
+		case mb > m.missed:
+			m.tmissed += int64(mb - m.missed)
+		case mb < m.missed: // Data arrived, after being missed
+			m.late++
+		}
+		m.missed = mb
+		switch {
+		case mb == 0:
+			ev.State = Healthy
+		case mb < m.o.DeadAfter:
+			ev.State = Degraded
+		default:
+			ev.State = Dead
+		}
+	} else {
+		ev.State = Healthy
+	}
+	ev.Missed = m.missed
+	m.state = ev.State
+	session := m.conn.Session()
+	m.mu.Unlock()
+	if ev.State != ev.Prev {
+		m.l.Printf("%stag:%s connsess:%s heart_beat_health state:%s prev:%s gap:%v missed:%d error:%v\n",
+			m.exampid, m.tag, session,
+			ev.State, ev.Prev, ev.Gap, ev.Missed, ev.Err)
+		if ev.State == Dead && m.o.CloseOnDead {
+			_ = m.Close() // The reader fails, and a Resilient reconnects
+		}
+		if m.o.OnChange != nil {
+			m.o.OnChange(ev)
+		}
+	}
+	return ev.Err == nil
+}
+
+// State returns the current health state.
+func (m *HeartbeatMonitor) State() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+// Stats returns the monitor counts.
+func (m *HeartbeatMonitor) Stats() MonitorStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return MonitorStats{State: m.state, Interval: m.ri,
+		Beats: atomic.LoadInt64(&m.beats), Frames: atomic.LoadInt64(&m.frames),
+		Late: m.late, Missed: m.tmissed,
+		Last: time.Unix(0, atomic.LoadInt64(&m.last))}
+}
@@ -0,0 +1,96 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package sngecomm
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gmallard/stompngo"
+)
+
+/*
+Test monitor specification parsing.
+*/
+func TestMonitorParse(t *testing.T) {
+	o, e := ParseMonitor("2,5")
+	if e != nil || o.Tolerance != 2 || o.DeadAfter != 5 || !o.CloseOnDead {
+		t.Errorf("ParseMonitor, got [%+v] [%v]\n", o, e)
+	}
+	for _, s := range []string{"", "x", "0.5", "1.5,0", "1,2,3"} {
+		if _, e := ParseMonitor(s); e == nil {
+			t.Errorf("ParseMonitor [%s], expected an error\n", s)
+		}
+	}
+}
+
+/*
+Test that beats which stop arriving make a connection degraded, then dead.
+*/
+func TestMonitorStates(t *testing.T) {
+	l := testServer(t, func(c net.Conn) {
+		defer c.Close()
+		r := bufio.NewReader(c)
+		if _, e := r.ReadString(0); e != nil {
+			return
+		}
+		fmt.Fprintf(c, "CONNECTED\nversion:1.2\nheart-beat:50,0\n\n\x00")
+		for i := 0; i < 3; i++ {
+			time.Sleep(50 * time.Millisecond)
+			fmt.Fprintf(c, "\n")
+		}
+		_, _ = r.ReadString(0) // Then silence
+	})
+	defer l.Close()
+	ec := make(chan HealthEvent, 8)
+	o := dialOpts(l.Addr().String())
+	o.Headers = stompngo.Headers{"accept-version", "1.2", "host", "localhost",
+		"heart-beat", "0,50"}
+	o.Monitor = &MonitorOptions{Tolerance: 1.5, DeadAfter: 2, CloseOnDead: true,
+		OnChange: func(ev HealthEvent) { ec <- ev }}
+	n, conn, e := Dial(o)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer n.Close()
+	m := MonitorOf(conn)
+	if m == nil || n != net.Conn(m) {
+		t.Fatalf("MonitorOf, got [%v]\n", m)
+	}
+	var got []string
+	for len(got) < 2 {
+		select {
+		case ev := <-ec:
+			got = append(got, ev.State)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("monitor states, got %v\n", got)
+		}
+	}
+	if fmt.Sprint(got) != "[degraded dead]" {
+		t.Errorf("monitor states, got %v\n", got)
+	}
+	s := m.Stats()
+	if s.State != Dead || s.Beats < 1 || s.Missed < 2 || s.Interval != 50*time.Millisecond {
+		t.Errorf("monitor stats, got [%+v]\n", s)
+	}
+	if MonitorOf(conn) != nil {
+		t.Errorf("MonitorOf, expected nil after close\n")
+	}
+}
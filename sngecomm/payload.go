@@ -0,0 +1,347 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package sngecomm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/gmallard/stompngo"
+)
+
+/*
+PayloadGenerator produces message bodies.
+
+Implementations are safe for concurrent use by multiple sender go routines.
+The returned slice must not be modified by the caller.
+*/
+type PayloadGenerator interface {
+	// Next returns the next message body.
+	Next() []byte
+	// Spec returns the specification the generator was built from.
+	Spec() string
+}
+
+/*
+NewPayloadGenerator builds a PayloadGenerator from a specification string of
+the form name:parameters.  Sizes are bytes, with an optional K or M suffix.
+
+	fixed:1024                   all bodies 1024 bytes
+	uniform:64,32K               sizes uniformly distributed in [64, 32K]
+	histogram:64=50,1K=30,32K=20 sizes chosen by weight
+	json:/path/template.json     JSON documents from a text/template file
+	random:1K or random:64,4K    random (incompressible) bytes
+	corpus:/path/dir             bodies read from files in a directory
+
+The fixed, uniform and histogram generators use the same repeating
+"_123456789ABCDEF" pattern as Partial.  JSON templates may use these
+functions: seq, uuid, now, randInt min max, randString n, and pad n.
+
+All users of one generator share its random stream, so with several sender
+go routines a seeded run is not reproducible.  Config.NewPayloadGenerator
+gives each sender its own stream.
+*/
+func NewPayloadGenerator(spec string) (PayloadGenerator, error) {
+	return newPayloadGenerator(spec, "")
+}
+
+// newPayloadGenerator builds a PayloadGenerator with a named random stream.
+func newPayloadGenerator(spec, stream string) (PayloadGenerator, error) {
+	n, p := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		n, p = spec[:i], spec[i+1:]
+	}
+	var g PayloadGenerator
+	var e error
+	switch n {
+	case "fixed":
+		g, e = newFixedPayload(p)
+	case "uniform":
+		g, e = newUniformPayload(p, stream, false)
+	case "histogram":
+		g, e = newHistogramPayload(p, stream)
+	case "json":
+		g, e = newJSONPayload(p, stream)
+	case "random":
+		g, e = newUniformPayload(p, stream, true)
+	case "corpus":
+		g, e = newCorpusPayload(p)
+	default:
+		return nil, fmt.Errorf("payload %q: unknown generator %q", spec, n)
+	}
+	if e != nil {
+		return nil, fmt.Errorf("payload %q: %v", spec, e)
+	}
+	return g, nil
+}
+
+var (
+	patLock sync.Mutex
+	pat     []byte
+)
+
+// pattern returns l bytes of the repeating "_123456789ABCDEF" pattern.
+func pattern(l int) []byte {
+	patLock.Lock()
+	defer patLock.Unlock()
+	if l > len(pat) {
+		pat = bytes.Repeat([]byte("_123456789ABCDEF"), l/16+1)
+	}
+	return pat[:l:l]
+}
+
+// parseSize parses a byte count, with an optional K or M suffix.
+func parseSize(s string) (int, error) {
+	m := 1
+	switch {
+	case strings.HasSuffix(s, "K"):
+		m, s = 1024, strings.TrimSuffix(s, "K")
+	case strings.HasSuffix(s, "M"):
+		m, s = 1024*1024, strings.TrimSuffix(s, "M")
+	}
+	i, e := strconv.Atoi(s)
+	if e != nil || i < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return i * m, nil
+}
+
+// parseRange parses "n" or "min,max".
+func parseRange(p string) (int, int, error) {
+	f := strings.Split(p, ",")
+	if len(f) > 2 {
+		return 0, 0, fmt.Errorf("expected size or min,max, got %q", p)
+	}
+	min, e := parseSize(f[0])
+	if e != nil {
+		return 0, 0, e
+	}
+	max := min
+	if len(f) == 2 {
+		if max, e = parseSize(f[1]); e != nil {
+			return 0, 0, e
+		}
+	}
+	if max < min {
+		return 0, 0, fmt.Errorf("max %d is less than min %d", max, min)
+	}
+	return min, max, nil
+}
+
+// fixedPayload is the same pattern body every time.
+type fixedPayload struct {
+	spec string
+	b    []byte
+}
+
+func newFixedPayload(p string) (*fixedPayload, error) {
+	l, e := parseSize(p)
+	if e != nil {
+		return nil, e
+	}
+	return &fixedPayload{"fixed:" + p, pattern(l)}, nil
+}
+
+func (f *fixedPayload) Next() []byte { return f.b }
+func (f *fixedPayload) Spec() string { return f.spec }
+
+// uniformPayload is a pattern or random body, with a uniformly distributed
+// length.
+type uniformPayload struct {
+	spec     string
+	min, max int
+	random   bool
+	r        *lockedRand
+}
+
+func newUniformPayload(p, stream string, random bool) (*uniformPayload, error) {
+	min, max, e := parseRange(p)
+	if e != nil {
+		return nil, e
+	}
+	n := "uniform:"
+	if random {
+		n = "random:"
+	}
+	return &uniformPayload{n + p, min, max, random,
+		newLockedRand(n + p + "/" + stream)}, nil
+}
+
+func (u *uniformPayload) Next() []byte {
+	l := int(u.r.between(int64(u.min), int64(u.max)))
+	if !u.random {
+		return pattern(l)
+	}
+	b := make([]byte, l)
+	u.r.read(b)
+	return b
+}
+
+func (u *uniformPayload) Spec() string { return u.spec }
+
+// histogramPayload is a pattern body, with a length chosen by weight.
+type histogramPayload struct {
+	spec  string
+	sizes []int
+	cum   []float64 // Cumulative weights, normalized to 1.0
+	r     *lockedRand
+}
+
+func newHistogramPayload(p, stream string) (*histogramPayload, error) {
+	h := &histogramPayload{spec: "histogram:" + p,
+		r: newLockedRand("histogram:" + p + "/" + stream)}
+	t := 0.0
+	for _, b := range strings.Split(p, ",") {
+		f := strings.Split(b, "=")
+		if len(f) != 2 {
+			return nil, fmt.Errorf("expected size=weight, got %q", b)
+		}
+		l, e := parseSize(f[0])
+		if e != nil {
+			return nil, e
+		}
+		w, e := strconv.ParseFloat(f[1], 64)
+		if e != nil || w <= 0 {
+			return nil, fmt.Errorf("invalid weight %q", f[1])
+		}
+		t += w
+		h.sizes = append(h.sizes, l)
+		h.cum = append(h.cum, t)
+	}
+	for i := range h.cum {
+		h.cum[i] /= t
+	}
+	return h, nil
+}
+
+func (h *histogramPayload) Next() []byte {
+	i := sort.SearchFloat64s(h.cum, h.r.float64())
+	if i >= len(h.sizes) {
+		i = len(h.sizes) - 1
+	}
+	return pattern(h.sizes[i])
+}
+
+func (h *histogramPayload) Spec() string { return h.spec }
+
+// jsonPayload is a JSON document rendered from a template.
+type jsonPayload struct {
+	spec string
+	t    *template.Template
+	seq  int64
+	r    *lockedRand
+}
+
+func newJSONPayload(fn, stream string) (*jsonPayload, error) {
+	b, e := ioutil.ReadFile(fn)
+	if e != nil {
+		return nil, e
+	}
+	j := &jsonPayload{spec: "json:" + fn, r: newLockedRand("json:" + fn + "/" + stream)}
+	j.t, e = template.New(filepath.Base(fn)).Funcs(template.FuncMap{
+		"seq":  func() int64 { return atomic.AddInt64(&j.seq, 1) },
+		"uuid": stompngo.Uuid,
+		"now":  func() string { return time.Now().Format(time.RFC3339Nano) },
+		"randInt": func(min, max int) int {
+			return int(j.r.between(int64(min), int64(max)))
+		},
+		"randString": func(l int) string {
+			const a = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+			s := make([]byte, l)
+			for i := range s {
+				s[i] = a[j.r.between(0, int64(len(a)-1))]
+			}
+			return string(s)
+		},
+		"pad": func(l int) string { return string(pattern(l)) },
+	}).Parse(string(b))
+	if e != nil {
+		return nil, e
+	}
+	// Check the template once, before use
+	d, e := j.render()
+	if e != nil {
+		return nil, e
+	}
+	if !json.Valid(d) {
+		return nil, fmt.Errorf("template %s does not produce valid JSON", fn)
+	}
+	j.seq = 0
+	return j, nil
+}
+
+func (j *jsonPayload) render() ([]byte, error) {
+	var b bytes.Buffer
+	e := j.t.Execute(&b, nil)
+	return b.Bytes(), e
+}
+
+func (j *jsonPayload) Next() []byte {
+	b, e := j.render()
+	if e != nil { // Checked when built, should not happen
+		llu.Printf("payload_json_error spec:%s error:%v\n", j.spec, e)
+	}
+	return b
+}
+
+func (j *jsonPayload) Spec() string { return j.spec }
+
+// corpusPayload cycles through bodies read from the files in a directory.
+type corpusPayload struct {
+	spec   string
+	bodies [][]byte
+	next   uint64
+}
+
+func newCorpusPayload(dn string) (*corpusPayload, error) {
+	fis, e := ioutil.ReadDir(dn)
+	if e != nil {
+		return nil, e
+	}
+	c := &corpusPayload{spec: "corpus:" + dn}
+	for _, fi := range fis { // Sorted by name
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		b, e := ioutil.ReadFile(filepath.Join(dn, fi.Name()))
+		if e != nil {
+			return nil, e
+		}
+		c.bodies = append(c.bodies, b)
+	}
+	if len(c.bodies) == 0 {
+		return nil, fmt.Errorf("no files in corpus directory %s", dn)
+	}
+	return c, nil
+}
+
+func (c *corpusPayload) Next() []byte {
+	i := atomic.AddUint64(&c.next, 1) - 1
+	return c.bodies[i%uint64(len(c.bodies))]
+}
+
+func (c *corpusPayload) Spec() string { return c.spec }
@@ -0,0 +1,146 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package sngecomm
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+/*
+Test the size based payload generators.
+*/
+func TestPayloadSizes(t *testing.T) {
+	g, e := NewPayloadGenerator("fixed:1K")
+	if e != nil {
+		t.Fatalf("NewPayloadGenerator, expected no error, got [%v]\n", e)
+	}
+	if l := len(g.Next()); l != 1024 {
+		t.Errorf("fixed payload, expected [%d], got [%d]\n", 1024, l)
+	}
+	for _, s := range []string{"uniform:10,20", "random:10,20"} {
+		g, e = NewPayloadGenerator(s)
+		if e != nil {
+			t.Fatalf("NewPayloadGenerator %s, expected no error, got [%v]\n", s, e)
+		}
+		for i := 0; i < 100; i++ {
+			if l := len(g.Next()); l < 10 || l > 20 {
+				t.Fatalf("%s payload, got length [%d]\n", s, l)
+			}
+		}
+	}
+	g, e = NewPayloadGenerator("histogram:3=1,5=1")
+	if e != nil {
+		t.Fatalf("NewPayloadGenerator, expected no error, got [%v]\n", e)
+	}
+	for i := 0; i < 100; i++ {
+		if l := len(g.Next()); l != 3 && l != 5 {
+			t.Fatalf("histogram payload, got length [%d]\n", l)
+		}
+	}
+	for _, s := range []string{"nosuch:1", "fixed:x", "uniform:20,10",
+		"histogram:3"} {
+		if _, e = NewPayloadGenerator(s); e == nil {
+			t.Errorf("NewPayloadGenerator %s, expected an error\n", s)
+		}
+	}
+}
+
+/*
+Test that seeded per sender generators repeat, whatever the interleaving of
+senders.
+*/
+func TestPayloadStreams(t *testing.T) {
+	SetSeed(42)
+	defer SetSeed(0)
+	c := DefaultConfig()
+	c.Payload = "random:1,64"
+	lens := func(q1, q2 PayloadGenerator, order string) (r [2][]int) {
+		for _, o := range order {
+			g, i := q1, 0
+			if o == '2' {
+				g, i = q2, 1
+			}
+			r[i] = append(r[i], len(g.Next()))
+		}
+		return r
+	}
+	gen := func(stream string) PayloadGenerator {
+		g, e := c.NewPayloadGenerator("", stream)
+		if e != nil {
+			t.Fatal(e)
+		}
+		return g
+	}
+	a := lens(gen("1"), gen("2"), "1122112")
+	b := lens(gen("1"), gen("2"), "2121211")
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("seeded streams, expected [%v], got [%v]\n", a, b)
+	}
+	if reflect.DeepEqual(a[0][:len(a[1])], a[1]) {
+		t.Errorf("seeded streams, expected different streams, got [%v]\n", a)
+	}
+}
+
+/*
+Test the file based payload generators.
+*/
+func TestPayloadFiles(t *testing.T) {
+	d, e := ioutil.TempDir("", "sngecomm")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(d)
+	tf := filepath.Join(d, "doc.json")
+	td := `{"seq": {{seq}}, "id": "{{uuid}}", "n": {{randInt 1 9}}, "s": "{{randString 8}}"}`
+	if e = ioutil.WriteFile(tf, []byte(td), 0644); e != nil {
+		t.Fatal(e)
+	}
+	g, e := NewPayloadGenerator("json:" + tf)
+	if e != nil {
+		t.Fatalf("NewPayloadGenerator, expected no error, got [%v]\n", e)
+	}
+	var m struct{ Seq int }
+	for i := 1; i <= 2; i++ {
+		if e = json.Unmarshal(g.Next(), &m); e != nil || m.Seq != i {
+			t.Errorf("json payload, expected seq [%d], got [%d] [%v]\n", i, m.Seq, e)
+		}
+	}
+	//
+	cd := filepath.Join(d, "corpus")
+	if e = os.Mkdir(cd, 0755); e != nil {
+		t.Fatal(e)
+	}
+	for _, n := range []string{"a", "b"} {
+		if e = ioutil.WriteFile(filepath.Join(cd, n), []byte(n), 0644); e != nil {
+			t.Fatal(e)
+		}
+	}
+	g, e = NewPayloadGenerator("corpus:" + cd)
+	if e != nil {
+		t.Fatalf("NewPayloadGenerator, expected no error, got [%v]\n", e)
+	}
+	for _, w := range []string{"a", "b", "a"} {
+		if b := string(g.Next()); b != w {
+			t.Errorf("corpus payload, expected [%s], got [%s]\n", w, b)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package sngecomm
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// Pin modes.  Enforce fails the connection on a pin mismatch, report only
+// logs it.
+const (
+	PinModeEnforce = "enforce"
+	PinModeReport  = "report"
+)
+
+// pinPrefix is the pin hash name, as in RFC 7469.
+const pinPrefix = "sha256/"
+
+/*
+PinError is a broker public key pin mismatch: no certificate in the verified
+broker chain has one of the configured pins.  Observed are the chain pins,
+leaf first.
+*/
+type PinError struct {
+	Subject  string // Broker (leaf) certificate subject
+	Observed []string
+	Pins     []string
+}
+
+func (p *PinError) Error() string {
+	return fmt.Sprintf("pin mismatch: broker %q presented %s, expected one of %s",
+		p.Subject, strings.Join(p.Observed, ","), strings.Join(p.Pins, ","))
+}
+
+// SPKIPin returns the pin for a certificate: sha256/ and the base64 SHA-256
+// of its public key (SubjectPublicKeyInfo).  TLSReport shows the same value.
+func SPKIPin(x *x509.Certificate) string {
+	h := sha256.Sum256(x.RawSubjectPublicKeyInfo)
+	return pinPrefix + base64.StdEncoding.EncodeToString(h[:])
+}
+
+// ParsePins parses a comma separated list of pins.  The sha256/ prefix is
+// optional.  Pins are returned with the prefix.
+func ParsePins(s string) ([]string, error) {
+	var r []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		// A URI query decodes an unescaped + as a space
+		b := strings.Replace(strings.TrimPrefix(p, pinPrefix), " ", "+", -1)
+		if d, e := base64.StdEncoding.DecodeString(b); e != nil || len(d) != sha256.Size {
+			return nil, fmt.Errorf("bad pin %q, expected sha256/ and a base64 SHA-256", p)
+		}
+		r = append(r, pinPrefix+b)
+	}
+	if len(r) == 0 {
+		return nil, fmt.Errorf("no pins in %q", s)
+	}
+	return r, nil
+}
+
+/*
+CheckPins checks a TLS session against pins.  It matches when any
+certificate in a verified chain (the broker certificate up to its CA) has one
+of the pins.  Other certificates the broker sends prove nothing, since anyone
+can send them.  Without verification (InsecureSkipVerify) only the broker
+certificate is checked.  List more than one pin to allow key rotation.  The
+matching pin is returned, or a *PinError.
+*/
+func CheckPins(cs tls.ConnectionState, pins []string) (string, error) {
+	pe := &PinError{Pins: pins}
+	seen := map[string]bool{}
+	check := func(x *x509.Certificate) string {
+		p := SPKIPin(x)
+		if !seen[p] {
+			seen[p] = true
+			pe.Observed = append(pe.Observed, p)
+		}
+		for _, w := range pins {
+			if p == w {
+				return p
+			}
+		}
+		return ""
+	}
+	if len(cs.VerifiedChains) == 0 && len(cs.PeerCertificates) > 0 {
+		if p := check(cs.PeerCertificates[0]); p != "" {
+			return p, nil
+		}
+	}
+	for _, vc := range cs.VerifiedChains {
+		for _, x := range vc {
+			if p := check(x); p != "" {
+				return p, nil
+			}
+		}
+	}
+	if len(cs.PeerCertificates) > 0 {
+		pe.Subject = cs.PeerCertificates[0].Subject.String()
+	}
+	return "", pe
+}
+
+// checkPins checks a TLS session against the configured pins, if any.  It
+// returns the matching pin, or an error, and whether the mode is report only.
+func (t *ProfileTLS) checkPins(cs tls.ConnectionState) (string, bool, error) {
+	if t == nil || t.Pins == "" {
+		return "", false, nil
+	}
+	pins, e := ParsePins(t.Pins)
+	if e != nil {
+		return "", false, e
+	}
+	p, e := CheckPins(cs, pins)
+	return p, t.PinMode == PinModeReport, e
+}
+
+// checkPinMode checks a pin mode.
+func checkPinMode(m string) error {
+	switch m {
+	case "", PinModeEnforce, PinModeReport:
+		return nil
+	}
+	return fmt.Errorf("unknown pin mode %q, expected enforce or report", m)
+}
@@ -0,0 +1,141 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package sngecomm
+
+import (
+	"bytes"
+	"crypto/tls"
+	"log"
+	"strings"
+	"testing"
+)
+
+// A pin that matches nothing.
+const testPin = "sha256/AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="
+
+/*
+Test pin and pin mode parsing, including from a URI.
+*/
+func TestPinParse(t *testing.T) {
+	b := strings.TrimPrefix(testPin, "sha256/")
+	ps, e := ParsePins(b + ", " + testPin)
+	if e != nil || len(ps) != 2 || ps[0] != testPin || ps[1] != testPin {
+		t.Errorf("ParsePins, got [%v] [%v]\n", ps, e)
+	}
+	for _, s := range []string{"", "sha256/abc", "sha1/" + b, b + "AAAA"} {
+		if _, e = ParsePins(s); e == nil {
+			t.Errorf("ParsePins %q, expected an error\n", s)
+		}
+	}
+	if e = checkPinMode("audit"); e == nil {
+		t.Error("checkPinMode audit, expected an error")
+	}
+	// An unescaped + in a query is a space
+	pin := "sha256/+AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="
+	c, e := ParseURI("stomp+ssl://broker:61612/?pins=" + pin + "&pinmode=report")
+	if e != nil || c.TLS.PinMode != PinModeReport {
+		t.Fatalf("ParseURI, got [%v]\n", e)
+	}
+	if ps, e = ParsePins(c.TLS.Pins); e != nil || ps[0] != pin {
+		t.Errorf("ParsePins from a URI, got [%v] [%v]\n", ps, e)
+	}
+	if _, e = ParseURI("stomp+ssl://broker:61612/?pinmode=audit"); e == nil {
+		t.Error("ParseURI pinmode=audit, expected an error")
+	}
+}
+
+/*
+Test pins on a TLS dial: the leaf, the CA for rotation, a mismatch, and
+report only mode.  A pinned certificate sent after an unrelated leaf does not
+match.
+*/
+func TestPinDial(t *testing.T) {
+	p, e := GeneratePKI(PKIOptions{KeyType: "ecdsa"})
+	if e != nil {
+		t.Fatal(e)
+	}
+	l, e := tls.Listen("tcp", "127.0.0.1:0",
+		&tls.Config{Certificates: []tls.Certificate{p.Broker}})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer l.Close()
+	serveTestBroker(l)
+	leaf := SPKIPin(p.Broker.Leaf)
+	tests := []struct {
+		pins, mode string
+		log        string // Expected in the log
+		fail       bool
+	}{
+		{leaf, "", "common_tls_pin_match pin:" + leaf, false},
+		{testPin + "," + SPKIPin(p.CA), PinModeEnforce, "common_tls_pin_match", false},
+		{testPin, "", "", true},
+		{testPin, PinModeReport, "common_tls_pin_mismatch mode:report", false},
+	}
+	for _, tc := range tests {
+		var lb bytes.Buffer
+		o := dialOpts(l.Addr().String())
+		o.Logger = log.New(&lb, "", 0)
+		o.Broker.TLS = &ProfileTLS{Pins: tc.pins, PinMode: tc.mode}
+		o.TLS = &tls.Config{RootCAs: p.Pool()}
+		n, _, e := Dial(o)
+		if tc.fail {
+			de := dialErr(t, e, "tls")
+			pe, ok := de.Err.(*PinError)
+			if !ok || len(pe.Observed) != 2 || pe.Observed[0] != leaf ||
+				!strings.Contains(e.Error(), leaf) {
+				t.Errorf("Dial %s, expected a *PinError showing [%s], got [%v]\n",
+					tc.pins, leaf, e)
+			}
+			continue
+		}
+		if e != nil {
+			t.Errorf("Dial %s %s, expected no error, got [%v]\n", tc.pins, tc.mode, e)
+			continue
+		}
+		n.Close()
+		if !strings.Contains(lb.String(), tc.log) {
+			t.Errorf("Dial %s %s, expected log [%s], got [%s]\n", tc.pins, tc.mode,
+				tc.log, lb.String())
+		}
+	}
+	// Another trusted broker, that sends the pinned certificate after its own
+	q, e := GeneratePKI(PKIOptions{KeyType: "ecdsa"})
+	if e != nil {
+		t.Fatal(e)
+	}
+	qc := q.Broker
+	qc.Certificate = append(append([][]byte{}, qc.Certificate...), p.Broker.Certificate[0])
+	ql, e := tls.Listen("tcp", "127.0.0.1:0",
+		&tls.Config{Certificates: []tls.Certificate{qc}})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer ql.Close()
+	serveTestBroker(ql)
+	for _, tc := range []*tls.Config{{RootCAs: q.Pool()}, {InsecureSkipVerify: true}} {
+		o := dialOpts(ql.Addr().String())
+		o.Broker.TLS = &ProfileTLS{Pins: leaf}
+		o.TLS = tc
+		_, _, e := Dial(o)
+		de := dialErr(t, e, "tls")
+		if pe, ok := de.Err.(*PinError); !ok || pe.Observed[0] != SPKIPin(q.Broker.Leaf) {
+			t.Errorf("Dial insecure:%v, expected a *PinError for the unrelated leaf, got [%v]\n",
+				tc.InsecureSkipVerify, e)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package sngecomm
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+)
+
+// ErrListenerClosed is returned by a closed PipeListener.
+var ErrListenerClosed = errors.New("pipe listener closed")
+
+/*
+PipeListener is an in-process net.Listener, with no network.  Its Dial
+method is a DialFunc, returning one end of a net.Pipe.  Accept returns the
+other end.
+
+	pl := sngecomm.NewPipeListener()
+	go serve(pl) // An in-process broker
+	sngecomm.SetDialFunc(pl.Dial)
+*/
+type PipeListener struct {
+	c    chan net.Conn
+	done chan struct{}
+	once sync.Once
+}
+
+// pipeAddr is the address of a PipeListener.
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+// NewPipeListener returns a PipeListener.
+func NewPipeListener() *PipeListener {
+	return &PipeListener{c: make(chan net.Conn), done: make(chan struct{})}
+}
+
+// Accept waits for a Dial.
+func (p *PipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-p.c:
+		return c, nil
+	case <-p.done:
+		return nil, ErrListenerClosed
+	}
+}
+
+// Close stops the listener.  Connections already accepted stay open.
+func (p *PipeListener) Close() error {
+	p.once.Do(func() { close(p.done) })
+	return nil
+}
+
+// Addr returns the listener address.
+func (p *PipeListener) Addr() net.Addr { return pipeAddr{} }
+
+// Dial returns a connection to the listener.  The network and address are
+// ignored.
+func (p *PipeListener) Dial(ctx context.Context, network,
+	addr string) (net.Conn, error) {
+	c, s := net.Pipe()
+	select {
+	case p.c <- s:
+		return c, nil
+	case <-p.done:
+		return nil, ErrListenerClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
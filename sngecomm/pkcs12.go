@@ -0,0 +1,110 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package sngecomm
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// ErrPKCS12Password is a PKCS#12 integrity check failure, usually a wrong
+// password.
+var ErrPKCS12Password = pkcs12.ErrIncorrectPassword
+
+/*
+DecodePKCS12 returns the certificate chain and private key in a PKCS#12
+(.p12, .pfx) file.
+
+The legacy SHA1 3DES and RC2 encryption, and PBES2 with PBKDF2 and AES, are
+supported.  The leaf certificate is the one that matches the key, and the
+remaining certificates follow it.
+*/
+func DecodePKCS12(data []byte, password string) (tls.Certificate, error) {
+	var c tls.Certificate
+	k, x, cas, e := pkcs12.DecodeChain(data, password)
+	if e != nil {
+		return c, e
+	}
+	c.PrivateKey = k
+	certs := append([]*x509.Certificate{x}, cas...)
+	// The leaf first
+	pk, ok := k.(interface{ Public() crypto.PublicKey })
+	if !ok {
+		return c, fmt.Errorf("pkcs12: unsupported private key %T", k)
+	}
+	kb, e := x509.MarshalPKIXPublicKey(pk.Public())
+	if e != nil {
+		return c, fmt.Errorf("pkcs12: %v", e)
+	}
+	for i, x := range certs {
+		if bytes.Equal(x.RawSubjectPublicKeyInfo, kb) {
+			certs[0], certs[i] = certs[i], certs[0]
+			c.Leaf = x
+			break
+		}
+	}
+	if c.Leaf == nil {
+		return c, fmt.Errorf("pkcs12: no certificate matches the private key")
+	}
+	for _, x := range certs {
+		c.Certificate = append(c.Certificate, x.Raw)
+	}
+	return c, nil
+}
+
+/*
+EncodePKCS12 returns a PKCS#12 keystore holding a certificate chain and its
+private key.  The key is encrypted with PBES2 and AES-256, and the file has a
+SHA256 MAC.  OpenSSL 1.1.1 and later, Java 8u301 and later, and
+DecodePKCS12 read it.
+*/
+func EncodePKCS12(c tls.Certificate, password string) ([]byte, error) {
+	if len(c.Certificate) == 0 || c.PrivateKey == nil {
+		return nil, fmt.Errorf("pkcs12: expected a private key and a certificate")
+	}
+	var certs []*x509.Certificate
+	for _, d := range c.Certificate {
+		x, e := x509.ParseCertificate(d)
+		if e != nil {
+			return nil, fmt.Errorf("pkcs12: %v", e)
+		}
+		certs = append(certs, x)
+	}
+	return pkcs12.Modern.Encode(c.PrivateKey, certs[0], certs[1:], password)
+}
+
+/*
+EncodePKCS12Trust returns a PKCS#12 trust store holding certificates only,
+e.g. CAs for a Java broker's truststore.  The certificates are marked as
+trusted for Java, and their aliases are name, name-1, ...
+*/
+func EncodePKCS12Trust(certs []*x509.Certificate, name, password string) ([]byte, error) {
+	var es []pkcs12.TrustStoreEntry
+	for i, x := range certs {
+		n := name
+		if i > 0 {
+			n = fmt.Sprintf("%s-%d", name, i)
+		}
+		es = append(es, pkcs12.TrustStoreEntry{Cert: x, FriendlyName: n})
+	}
+	return pkcs12.Modern.EncodeTrustStoreEntries(es, password)
+}
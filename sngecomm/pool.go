@@ -0,0 +1,472 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package sngecomm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gmallard/stompngo"
+)
+
+// Pool connection selection strategies.
+const (
+	RoundRobin  = "roundrobin"  // Connections are used in turn
+	LeastLoaded = "leastloaded" // The connection with fewest checkouts
+)
+
+const (
+	// DefaultPoolHealth is the health check interval when a pool
+	// specification does not give one.
+	DefaultPoolHealth = 5 * time.Second
+)
+
+var errPoolClosed = errors.New("pool is closed")
+
+/*
+PoolOptions controls a Pool.  See ParsePool.
+*/
+type PoolOptions struct {
+	Strategy string        // RoundRobin or LeastLoaded
+	Min      int           // Connections opened by NewPool, and kept open
+	Max      int           // Maximum connections
+	Health   time.Duration // Health check interval, 0 is no checks
+	Dial     DialOptions   // How each connection is made
+}
+
+/*
+ParsePool parses a pool specification of the form
+strategy:min[,max[,health]].  max defaults to min, and health to
+DefaultPoolHealth.
+
+	roundrobin:1             one shared connection
+	roundrobin:4             four connections, used in turn
+	leastloaded:1,8          grow to 8 connections as load requires
+	leastloaded:2,8,0        no health checks
+*/
+func ParsePool(spec string) (PoolOptions, error) {
+	o := PoolOptions{Strategy: spec, Min: 1, Health: DefaultPoolHealth}
+	p := ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		o.Strategy, p = spec[:i], spec[i+1:]
+	}
+	var e error
+	switch o.Strategy {
+	case RoundRobin, LeastLoaded:
+	default:
+		e = fmt.Errorf("unknown strategy %q", o.Strategy)
+	}
+	f := strings.Split(p, ",")
+	if e == nil && p != "" {
+		if len(f) > 3 {
+			e = fmt.Errorf("expected min[,max[,health]], got %q", p)
+		}
+		if e == nil {
+			o.Min, e = strconv.Atoi(f[0])
+		}
+	}
+	o.Max = o.Min
+	if e == nil && len(f) > 1 {
+		o.Max, e = strconv.Atoi(f[1])
+	}
+	if e == nil && len(f) > 2 {
+		if f[2] == "0" {
+			o.Health = 0
+		} else {
+			o.Health, e = time.ParseDuration(f[2])
+		}
+	}
+	if e == nil {
+		e = o.check()
+	}
+	if e != nil {
+		return o, fmt.Errorf("pool %q: %v", spec, e)
+	}
+	return o, nil
+}
+
+func (o PoolOptions) check() error {
+	switch {
+	case o.Min < 0:
+		return fmt.Errorf("negative min %d", o.Min)
+	case o.Max < 1:
+		return fmt.Errorf("max %d is less than 1", o.Max)
+	case o.Max < o.Min:
+		return fmt.Errorf("max %d is less than min %d", o.Max, o.Min)
+	case o.Health < 0:
+		return fmt.Errorf("negative health interval %v", o.Health)
+	}
+	return nil
+}
+
+/*
+PooledConn is a connection owned by a Pool.  Use it between Checkout and
+Return.
+*/
+type PooledConn struct {
+	n    net.Conn
+	conn *stompngo.Connection
+	id   int // 1..n, in open order
+	load int // Current checkouts
+	bad  bool
+	m    *HeartbeatMonitor
+}
+
+// Conn returns the STOMP connection.
+func (pc *PooledConn) Conn() *stompngo.Connection { return pc.conn }
+
+// NetConn returns the network connection.
+func (pc *PooledConn) NetConn() net.Conn { return pc.n }
+
+// ID returns the connection number within the pool, starting at 1.
+func (pc *PooledConn) ID() int { return pc.id }
+
+/*
+PoolStats are aggregate statistics for a Pool.  Frame and byte counts
+include connections that have been closed.
+*/
+type PoolStats struct {
+	Size          int   // Open connections
+	Opened        int   // Connections ever opened
+	Replaced      int   // Connections closed by health checks
+	Checkouts     int64 // Total checkouts
+	FramesRead    int64
+	BytesRead     int64
+	FramesWritten int64
+	BytesWritten  int64
+	Loads         []int // Current checkouts, per open connection
+}
+
+/*
+Pool shares STOMP connections among go routines.
+
+Checkout selects a connection using the pool strategy.  A connection may be
+checked out by any number of go routines at once; the load of a connection
+is its number of current checkouts.  When every open connection is in use,
+and the pool is below Max, Checkout opens another one.
+
+Health checks close connections that their HeartbeatMonitor finds Dead:
+network reads have failed, or broker heartbeats have stopped arriving.  Connections still checked out
+are closed when they are returned.  The pool is refilled to Min.
+*/
+type Pool struct {
+	o       PoolOptions
+	l       *log.Logger
+	mu      sync.Mutex
+	conns   []*PooledConn
+	dialing int
+	next    int // Round robin position
+	opened  int
+	closed  bool
+	st      PoolStats // Counts from closed connections, and totals
+	stop    chan struct{}
+	hcd     chan struct{} // Health check go routine is done
+}
+
+/*
+NewPool opens o.Min connections, and starts health checks.  On error, any
+connections already opened are closed.
+*/
+func NewPool(ctx context.Context, o PoolOptions) (*Pool, error) {
+	if o.Strategy == "" {
+		o.Strategy = RoundRobin
+	}
+	if o.Max == 0 {
+		o.Max = o.Min
+	}
+	if e := o.check(); e != nil {
+		return nil, fmt.Errorf("pool: %v", e)
+	}
+	if o.Dial.Logger == nil {
+		o.Dial.Logger = llu
+	}
+	if o.Dial.Broker == nil {
+		b, e := ResolveBroker()
+		if e != nil {
+			return nil, e
+		}
+		o.Dial.Broker = b
+	}
+	p := &Pool{o: o, l: o.Dial.Logger,
+		stop: make(chan struct{}), hcd: make(chan struct{})}
+	p.l.Printf("%stag:%s connsess:%s pool_starts strategy:%s min:%d max:%d health:%v\n",
+		o.Dial.Exampid, o.Dial.Tag, Lcs,
+		o.Strategy, o.Min, o.Max, o.Health)
+	p.dialing = o.Min
+	go p.health()
+	for i := 0; i < o.Min; i++ {
+		if _, e := p.open(ctx); e != nil {
+			p.mu.Lock()
+			p.dialing -= o.Min - i - 1
+			p.mu.Unlock()
+			p.Close()
+			return nil, e
+		}
+	}
+	return p, nil
+}
+
+// Options returns the pool options.
+func (p *Pool) Options() PoolOptions { return p.o }
+
+// open dials one connection, and adds it to the pool.  The caller has
+// counted it in p.dialing.
+func (p *Pool) open(ctx context.Context) (*PooledConn, error) {
+	o := p.o.Dial
+	if o.Monitor == nil {
+		o.Monitor = &MonitorOptions{}
+	}
+	n, conn, e := DialContext(ctx, o)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dialing--
+	if e != nil {
+		p.l.Printf("%stag:%s connsess:%s pool_dial_failed error:%v\n",
+			p.o.Dial.Exampid, p.o.Dial.Tag, Lcs,
+			e)
+		return nil, e
+	}
+	p.opened++
+	pc := &PooledConn{n: n, conn: conn, id: p.opened, m: MonitorOf(conn)}
+	if p.closed { // Close raced with us
+		go p.retire(pc)
+		return nil, errPoolClosed
+	}
+	p.conns = append(p.conns, pc)
+	p.l.Printf("%stag:%s connsess:%s pool_open id:%d size:%d\n",
+		p.o.Dial.Exampid, p.o.Dial.Tag, conn.Session(),
+		pc.id, len(p.conns))
+	return pc, nil
+}
+
+// Checkout returns a connection.  See CheckoutContext.
+func (p *Pool) Checkout() (*PooledConn, error) {
+	return p.CheckoutContext(context.Background())
+}
+
+/*
+CheckoutContext returns a connection, selected by the pool strategy.  The
+context limits any new connection that is needed.  Each checkout must be
+followed by a Return.
+*/
+func (p *Pool) CheckoutContext(ctx context.Context) (*PooledConn, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, errPoolClosed
+	}
+	busy := true
+	for _, pc := range p.conns {
+		if pc.load == 0 {
+			busy = false
+			break
+		}
+	}
+	if busy && len(p.conns)+p.dialing < p.o.Max {
+		p.dialing++
+		p.mu.Unlock()
+		pc, e := p.open(ctx)
+		if e != nil {
+			return nil, e
+		}
+		p.mu.Lock()
+		pc.load++
+		p.st.Checkouts++
+		p.mu.Unlock()
+		return pc, nil
+	}
+	defer p.mu.Unlock()
+	if len(p.conns) == 0 { // Replacements are being dialed
+		return nil, fmt.Errorf("pool: no connections available")
+	}
+	var pc *PooledConn
+	switch p.o.Strategy {
+	case LeastLoaded:
+		for _, c := range p.conns {
+			if pc == nil || c.load < pc.load {
+				pc = c
+			}
+		}
+	default:
+		pc = p.conns[p.next%len(p.conns)]
+		p.next++
+	}
+	pc.load++
+	p.st.Checkouts++
+	return pc, nil
+}
+
+// Return gives back a checked out connection.
+func (p *Pool) Return(pc *PooledConn) {
+	p.mu.Lock()
+	pc.load--
+	r := pc.bad && pc.load == 0
+	p.mu.Unlock()
+	if r {
+		p.retire(pc)
+	}
+}
+
+// healthy checks a connection, using its heartbeat monitor.
+func (pc *PooledConn) healthy() (bool, string) {
+	if st := pc.m.State(); st == Dead {
+		return false, "heart_beat_" + st
+	}
+	return true, ""
+}
+
+// health runs the health checks.
+func (p *Pool) health() {
+	defer close(p.hcd)
+	if p.o.Health == 0 {
+		<-p.stop
+		return
+	}
+	t := time.NewTicker(p.o.Health)
+	defer t.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-t.C:
+			p.check()
+		}
+	}
+}
+
+// check closes unhealthy connections, and refills the pool to Min.
+func (p *Pool) check() {
+	var rl []*PooledConn
+	p.mu.Lock()
+	live := p.conns[:0]
+	for _, pc := range p.conns {
+		if ok, why := pc.healthy(); !ok {
+			p.l.Printf("%stag:%s connsess:%s pool_unhealthy id:%d reason:%s load:%d\n",
+				p.o.Dial.Exampid, p.o.Dial.Tag, pc.conn.Session(),
+				pc.id, why, pc.load)
+			pc.bad = true
+			p.st.Replaced++
+			if pc.load == 0 {
+				rl = append(rl, pc)
+			}
+			continue
+		}
+		live = append(live, pc)
+	}
+	for i := len(live); i < len(p.conns); i++ {
+		p.conns[i] = nil
+	}
+	p.conns = live
+	nd := p.o.Min - len(p.conns) - p.dialing
+	if nd < 0 { // Above Min, from checkouts
+		nd = 0
+	}
+	p.dialing += nd
+	p.mu.Unlock()
+	for _, pc := range rl {
+		p.retire(pc)
+	}
+	for ; nd > 0; nd-- {
+		_, _ = p.open(context.Background()) // Logged, retried next check
+	}
+}
+
+// retire closes a connection, and keeps its statistics.  Unhealthy
+// connections are not sent a DISCONNECT.
+func (p *Pool) retire(pc *PooledConn) {
+	c := pc.conn
+	if pc.bad {
+		_ = pc.n.Close()
+	} else if e := CommonDisconnect(pc.n, c, p.o.Dial.Exampid, p.o.Dial.Tag,
+		p.l); e != nil {
+		p.l.Printf("%stag:%s connsess:%s pool_disconnect_error id:%d error:%v\n",
+			p.o.Dial.Exampid, p.o.Dial.Tag, c.Session(),
+			pc.id, e)
+		_ = pc.n.Close()
+	}
+	p.mu.Lock()
+	p.st.FramesRead += c.FramesRead()
+	p.st.BytesRead += c.BytesRead()
+	p.st.FramesWritten += c.FramesWritten()
+	p.st.BytesWritten += c.BytesWritten()
+	p.mu.Unlock()
+}
+
+// Stats returns aggregate pool statistics.
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.st
+	s.Size = len(p.conns)
+	s.Opened = p.opened
+	s.Loads = make([]int, 0, len(p.conns))
+	for _, pc := range p.conns {
+		c := pc.conn
+		s.FramesRead += c.FramesRead()
+		s.BytesRead += c.BytesRead()
+		s.FramesWritten += c.FramesWritten()
+		s.BytesWritten += c.BytesWritten()
+		s.Loads = append(s.Loads, pc.load)
+	}
+	return s
+}
+
+/*
+Close stops health checks, and disconnects all connections.  Connections
+should be returned first.
+*/
+func (p *Pool) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	cl := p.conns
+	p.conns = nil
+	p.mu.Unlock()
+	close(p.stop)
+	<-p.hcd
+	for _, pc := range cl {
+		p.retire(pc)
+	}
+	p.l.Printf("%stag:%s connsess:%s pool_closed opened:%d\n",
+		p.o.Dial.Exampid, p.o.Dial.Tag, Lcs,
+		p.opened)
+}
+
+// ShowPoolStats shows aggregate pool statistics.
+func ShowPoolStats(exampid, tag string, p *Pool) {
+	s := p.Stats()
+	llu.Printf("%stag:%s pool_strategy:%s\n", exampid, tag, p.o.Strategy)
+	llu.Printf("%stag:%s pool_size:%v\n", exampid, tag, s.Size)
+	llu.Printf("%stag:%s pool_opened:%v\n", exampid, tag, s.Opened)
+	llu.Printf("%stag:%s pool_replaced:%v\n", exampid, tag, s.Replaced)
+	llu.Printf("%stag:%s pool_checkouts:%v\n", exampid, tag, s.Checkouts)
+	llu.Printf("%stag:%s pool_loads:%v\n", exampid, tag, s.Loads)
+	llu.Printf("%stag:%s frame_read_count:%v\n", exampid, tag, s.FramesRead)
+	llu.Printf("%stag:%s bytes_read:%v\n", exampid, tag, s.BytesRead)
+	llu.Printf("%stag:%s frame_write_count:%v\n", exampid, tag, s.FramesWritten)
+	llu.Printf("%stag:%s bytes_written:%v\n", exampid, tag, s.BytesWritten)
+}
@@ -0,0 +1,180 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package sngecomm
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+Test pool specification parsing.
+*/
+func TestPoolParse(t *testing.T) {
+	o, e := ParsePool("leastloaded:2,8,1s")
+	if e != nil {
+		t.Fatalf("ParsePool, expected no error, got [%v]\n", e)
+	}
+	if o.Strategy != LeastLoaded || o.Min != 2 || o.Max != 8 || o.Health != time.Second {
+		t.Errorf("ParsePool, got [%+v]\n", o)
+	}
+	o, e = ParsePool("roundrobin:4")
+	if e != nil || o.Min != 4 || o.Max != 4 || o.Health != DefaultPoolHealth {
+		t.Errorf("ParsePool defaults, got [%+v] [%v]\n", o, e)
+	}
+	for _, s := range []string{"random:1", "roundrobin:x", "roundrobin:4,2",
+		"roundrobin:0,0", "leastloaded:1,2,-1s", "leastloaded:1,2,3,4"} {
+		if _, e := ParsePool(s); e == nil {
+			t.Errorf("ParsePool [%s], expected an error\n", s)
+		}
+	}
+}
+
+/*
+Test checkout selection, growth and statistics.
+*/
+func TestPoolCheckout(t *testing.T) {
+	l, _ := testBroker(t)
+	defer l.Close()
+	o, _ := ParsePool("roundrobin:2,2,0")
+	o.Dial = dialOpts(l.Addr().String())
+	p, e := NewPool(context.Background(), o)
+	if e != nil {
+		t.Fatalf("NewPool, expected no error, got [%v]\n", e)
+	}
+	var ids []int
+	for i := 0; i < 4; i++ {
+		pc, e := p.Checkout()
+		if e != nil {
+			t.Fatal(e)
+		}
+		ids = append(ids, pc.ID())
+		p.Return(pc)
+	}
+	if fmt.Sprint(ids) != "[1 2 1 2]" {
+		t.Errorf("roundrobin, got ids %v\n", ids)
+	}
+	p.Close()
+	if _, e = p.Checkout(); e == nil {
+		t.Errorf("Checkout after Close, expected an error\n")
+	}
+	s := p.Stats()
+	if s.Size != 0 || s.Opened != 2 || s.Checkouts != 4 || s.FramesWritten != 4 {
+		t.Errorf("roundrobin stats, got [%+v]\n", s)
+	}
+	//
+	o, _ = ParsePool("leastloaded:1,3,0")
+	o.Dial = dialOpts(l.Addr().String())
+	if p, e = NewPool(context.Background(), o); e != nil {
+		t.Fatal(e)
+	}
+	defer p.Close()
+	a, _ := p.Checkout() // Uses the idle connection
+	b, _ := p.Checkout() // Grows
+	p.Return(a)
+	c, _ := p.Checkout() // a is now least loaded
+	if a.ID() != 1 || b.ID() != 2 || c.ID() != 1 {
+		t.Errorf("leastloaded, got ids %d %d %d\n", a.ID(), b.ID(), c.ID())
+	}
+	if s := p.Stats(); s.Size != 2 || fmt.Sprint(s.Loads) != "[1 1]" {
+		t.Errorf("leastloaded stats, got [%+v]\n", s)
+	}
+	p.Return(b)
+	p.Return(c)
+}
+
+/*
+Test that a health check replaces a connection the broker dropped.
+*/
+func TestPoolHealth(t *testing.T) {
+	var nc int32
+	l := testServer(t, func(c net.Conn) {
+		defer c.Close()
+		r := bufio.NewReader(c)
+		if _, e := r.ReadString(0); e != nil {
+			return
+		}
+		fmt.Fprintf(c, "CONNECTED\nversion:1.2\nheart-beat:0,0\n\n\x00")
+		if atomic.AddInt32(&nc, 1) == 1 {
+			return // Drop the first connection
+		}
+		for {
+			b, e := r.ReadString(0)
+			if e != nil {
+				return
+			}
+			if i := strings.Index(b, "\nreceipt:"); i >= 0 {
+				rid := strings.SplitN(b[i+9:], "\n", 2)[0]
+				fmt.Fprintf(c, "RECEIPT\nreceipt-id:%s\n\n\x00", rid)
+			}
+		}
+	})
+	defer l.Close()
+	o, _ := ParsePool("roundrobin:1,1,20ms")
+	o.Dial = dialOpts(l.Addr().String())
+	p, e := NewPool(context.Background(), o)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer p.Close()
+	for st := time.Now(); time.Since(st) < 5*time.Second; {
+		if s := p.Stats(); s.Replaced == 1 && s.Size == 1 {
+			pc, e := p.Checkout()
+			if e != nil || pc.ID() != 2 {
+				t.Errorf("Checkout after replace, got [%v] [%v]\n", pc, e)
+			}
+			p.Return(pc)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("no replacement, got [%+v]\n", p.Stats())
+}
+
+/*
+Test that a health check does not let a pool above Min grow past Max.
+*/
+func TestPoolCheckAboveMin(t *testing.T) {
+	l, _ := testBroker(t)
+	defer l.Close()
+	o, _ := ParsePool("leastloaded:1,2,0")
+	o.Dial = dialOpts(l.Addr().String())
+	p, e := NewPool(context.Background(), o)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer p.Close()
+	a, _ := p.Checkout()
+	b, _ := p.Checkout() // Grows to Max
+	p.check()
+	c, e := p.Checkout() // Both busy, at Max
+	if e != nil {
+		t.Fatal(e)
+	}
+	if s := p.Stats(); s.Opened != 2 || s.Size != 2 {
+		t.Errorf("check above min, got [%+v]\n", s)
+	}
+	p.Return(a)
+	p.Return(b)
+	p.Return(c)
+}
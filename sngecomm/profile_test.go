@@ -0,0 +1,146 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package sngecomm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testProfiles = `
+apollo:
+  port: 62613
+  vhost: apollohost
+  protocol: "1.1"
+  login: admin
+  passcode: password
+artemis:
+  dialect: artemis
+`
+
+// Write a profiles file, returning its name and a cleanup function.
+func testProfilesFile(t *testing.T, d string) (string, func()) {
+	dn, e := ioutil.TempDir("", "sngecomm")
+	if e != nil {
+		t.Fatal(e)
+	}
+	fn := filepath.Join(dn, "profiles.yaml")
+	if e = ioutil.WriteFile(fn, []byte(d), 0644); e != nil {
+		t.Fatal(e)
+	}
+	return fn, func() { os.RemoveAll(dn) }
+}
+
+/*
+Test profile selection, and environment overrides.  Note that senv values
+set from the environment persist, so the override here uses a default.
+*/
+func TestProfileResolve(t *testing.T) {
+	fn, rm := testProfilesFile(t, testProfiles)
+	defer rm()
+	defer setTestEnv("STOMP_PROFILES", fn, "STOMP_PROFILE", "apollo",
+		"STOMP_PROTOCOL", "1.2")()
+	b, e := ResolveBroker()
+	if e != nil {
+		t.Fatalf("ResolveBroker, expected no error, got [%v]\n", e)
+	}
+	if b.Port != "62613" {
+		t.Errorf("Profile port, expected [%s], got [%s]\n", "62613", b.Port)
+	}
+	if b.Host != "localhost" {
+		t.Errorf("Profile host default, expected [%s], got [%s]\n", "localhost", b.Host)
+	}
+	if b.Vhost != "apollohost" {
+		t.Errorf("Profile vhost, expected [%s], got [%s]\n", "apollohost", b.Vhost)
+	}
+	if b.Protocol != "1.2" {
+		t.Errorf("Profile protocol override, expected [%s], got [%s]\n", "1.2", b.Protocol)
+	}
+	h := b.ConnectHeaders()
+	if v := h.Value("passcode"); v != "password" {
+		t.Errorf("Profile passcode header, expected [%s], got [%s]\n", "password", v)
+	}
+}
+
+/*
+Test the destination dialect, and unknown profile names.
+*/
+func TestProfileDialect(t *testing.T) {
+	fn, rm := testProfilesFile(t, testProfiles)
+	defer rm()
+	defer setTestEnv("STOMP_PROFILES", fn, "STOMP_PROFILE", "artemis")()
+	d := Dest()
+	if d != "jms.queue.queue.sng.sample.stomp.destination" {
+		t.Errorf("Artemis Dest, got [%s]\n", d)
+	}
+	_ = os.Setenv("STOMP_PROFILE", "nosuch")
+	if _, e := ResolveBroker(); e == nil {
+		t.Errorf("ResolveBroker, expected an error for an unknown profile\n")
+	}
+}
+
+/*
+Test that the default profiles file is found from a subdirectory, as when
+an example is run from its own directory, then in $HOME.
+*/
+func TestProfilesFileSearch(t *testing.T) {
+	dn, e := ioutil.TempDir("", "sngecomm")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dn)
+	if dn, e = filepath.EvalSymlinks(dn); e != nil {
+		t.Fatal(e)
+	}
+	wd, e := os.Getwd()
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.Chdir(wd)
+	mod, home := filepath.Join(dn, "module"), filepath.Join(dn, "home")
+	for _, d := range []string{filepath.Join(mod, "publish"), home} {
+		if e = os.MkdirAll(d, 0755); e != nil {
+			t.Fatal(e)
+		}
+	}
+	for _, fn := range []string{filepath.Join(mod, "go.mod"),
+		filepath.Join(home, DefaultProfilesFile)} {
+		if e = ioutil.WriteFile(fn, nil, 0644); e != nil {
+			t.Fatal(e)
+		}
+	}
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	_ = os.Setenv("HOME", home)
+	defer clearTestEnv()()
+	if e = os.Chdir(filepath.Join(mod, "publish")); e != nil {
+		t.Fatal(e)
+	}
+	// Not in the module, so $HOME
+	if f := ProfilesFile(); f != filepath.Join(home, DefaultProfilesFile) {
+		t.Errorf("ProfilesFile, expected the $HOME file, got [%s]\n", f)
+	}
+	// The module root
+	fn := filepath.Join(mod, DefaultProfilesFile)
+	if e = ioutil.WriteFile(fn, nil, 0644); e != nil {
+		t.Fatal(e)
+	}
+	if f := ProfilesFile(); f != fn {
+		t.Errorf("ProfilesFile, expected [%s], got [%s]\n", fn, f)
+	}
+}
@@ -0,0 +1,248 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package sngecomm
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// tunnel copies data both ways, until either side closes.
+func tunnel(a, b net.Conn) {
+	go func() {
+		_, _ = io.Copy(a, b)
+		a.Close()
+	}()
+	_, _ = io.Copy(b, a)
+	b.Close()
+}
+
+// testSocks5 is a SOCKS5 proxy stand-in.  A non-empty user requires
+// user/password authentication.  Requested hosts are sent to a non-nil hc.
+func testSocks5(t *testing.T, user, pass string, hc chan string) net.Listener {
+	return testServer(t, func(c net.Conn) {
+		defer c.Close()
+		b := make([]byte, 262)
+		if _, e := io.ReadFull(c, b[:2]); e != nil {
+			return
+		}
+		if _, e := io.ReadFull(c, b[:b[1]]); e != nil {
+			return
+		}
+		if user == "" {
+			c.Write([]byte{5, 0})
+		} else {
+			c.Write([]byte{5, 2})
+			io.ReadFull(c, b[:2])
+			un := make([]byte, b[1])
+			io.ReadFull(c, un)
+			io.ReadFull(c, b[:1])
+			pw := make([]byte, b[0])
+			io.ReadFull(c, pw)
+			if string(un) != user || string(pw) != pass {
+				c.Write([]byte{1, 1})
+				return
+			}
+			c.Write([]byte{1, 0})
+		}
+		io.ReadFull(c, b[:4])
+		h := ""
+		switch b[3] {
+		case 1:
+			io.ReadFull(c, b[:4])
+			h = net.IP(b[:4]).String()
+		case 3:
+			io.ReadFull(c, b[:1])
+			n := make([]byte, b[0])
+			io.ReadFull(c, n)
+			h = string(n)
+		}
+		if hc != nil {
+			hc <- h
+		}
+		io.ReadFull(c, b[:2])
+		p := binary.BigEndian.Uint16(b[:2])
+		bc, e := net.Dial("tcp", net.JoinHostPort(h, strconv.Itoa(int(p))))
+		if e != nil {
+			c.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		c.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+		tunnel(c, bc)
+	})
+}
+
+// testHTTPProxy is an HTTP CONNECT proxy stand-in.  A non-empty auth is the
+// required Proxy-Authorization value.
+func testHTTPProxy(t *testing.T, auth string) net.Listener {
+	return testServer(t, func(c net.Conn) {
+		defer c.Close()
+		rq, e := http.ReadRequest(bufio.NewReader(c))
+		if e != nil || rq.Method != "CONNECT" {
+			return
+		}
+		if auth != "" && rq.Header.Get("Proxy-Authorization") != auth {
+			fmt.Fprintf(c, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+			return
+		}
+		bc, e := net.Dial("tcp", rq.Host)
+		if e != nil {
+			fmt.Fprintf(c, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+			return
+		}
+		fmt.Fprintf(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+		tunnel(c, bc)
+	})
+}
+
+// testCert returns a self signed certificate for 127.0.0.1.
+func testCert(t *testing.T) tls.Certificate {
+	k, e := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if e != nil {
+		t.Fatal(e)
+	}
+	tp := &x509.Certificate{SerialNumber: big.NewInt(1),
+		Subject:     pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:   time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+	d, e := x509.CreateCertificate(rand.Reader, tp, tp, &k.PublicKey, k)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return tls.Certificate{Certificate: [][]byte{d}, PrivateKey: k}
+}
+
+/*
+Test proxy URL parsing.
+*/
+func TestProxyParse(t *testing.T) {
+	u, e := ParseProxy("socks5://u:p@proxy")
+	if e != nil || u.Host != "proxy:1080" {
+		t.Errorf("ParseProxy, got [%v] [%v]\n", u, e)
+	}
+	if u, e = ParseProxy("http://proxy"); e != nil || u.Host != "proxy:80" {
+		t.Errorf("ParseProxy http, got [%v] [%v]\n", u, e)
+	}
+	for _, s := range []string{"ftp://proxy", "socks5://", "proxy:1080"} {
+		if _, e := ParseProxy(s); e == nil {
+			t.Errorf("ParseProxy [%s], expected an error\n", s)
+		}
+	}
+}
+
+/*
+Test connecting through SOCKS5 and HTTP CONNECT proxies, with and without
+authentication.
+*/
+func TestProxyDial(t *testing.T) {
+	bl, fc := testBroker(t)
+	defer bl.Close()
+	sp := testSocks5(t, "user", "pw", nil)
+	defer sp.Close()
+	hp := testHTTPProxy(t, "Basic dXNlcjpwdw==") // user:pw
+	defer hp.Close()
+	for _, px := range []string{"socks5://user:pw@" + sp.Addr().String(),
+		"http://user:pw@" + hp.Addr().String()} {
+		o := dialOpts(bl.Addr().String())
+		o.Broker.Proxy = px
+		n, conn, e := Dial(o)
+		if e != nil {
+			t.Errorf("Dial %s, expected no error, got [%v]\n", px, e)
+			continue
+		}
+		nextFrame(t, fc, "CONNECT")
+		if e = CommonDisconnect(n, conn, "test: ", "proxy", o.Logger); e != nil {
+			t.Errorf("Disconnect %s, got [%v]\n", px, e)
+		}
+	}
+	//
+	for _, px := range []string{"socks5://user:bad@" + sp.Addr().String(),
+		"socks5://" + sp.Addr().String(), "http://" + hp.Addr().String()} {
+		o := dialOpts(bl.Addr().String())
+		o.Broker.Proxy = px
+		_, _, e := Dial(o)
+		dialErr(t, e, "proxy")
+	}
+}
+
+/*
+Test that socks5 resolves the broker host name locally, and socks5h leaves it
+to the proxy.
+*/
+func TestProxyResolve(t *testing.T) {
+	bl, fc := testBroker(t)
+	defer bl.Close()
+	hc := make(chan string, 1)
+	sp := testSocks5(t, "", "", hc)
+	defer sp.Close()
+	_, p, _ := net.SplitHostPort(bl.Addr().String())
+	for _, tc := range [][2]string{{"socks5", "127.0.0.1"}, {"socks5h", "localhost"}} {
+		o := dialOpts(net.JoinHostPort("localhost", p))
+		o.Broker.Proxy = tc[0] + "://" + sp.Addr().String()
+		n, _, e := Dial(o)
+		if e != nil {
+			t.Errorf("Dial %s, expected no error, got [%v]\n", tc[0], e)
+			continue
+		}
+		n.Close()
+		nextFrame(t, fc, "CONNECT")
+		if h := <-hc; h != tc[1] {
+			t.Errorf("Dial %s, expected the proxy to get %s, got %s\n", tc[0], tc[1], h)
+		}
+	}
+}
+
+/*
+Test TLS through a proxy tunnel.
+*/
+func TestProxyTLS(t *testing.T) {
+	l, e := tls.Listen("tcp", "127.0.0.1:0",
+		&tls.Config{Certificates: []tls.Certificate{testCert(t)}})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer l.Close()
+	fc := serveTestBroker(l)
+	sp := testSocks5(t, "", "", nil)
+	defer sp.Close()
+	o := dialOpts(l.Addr().String())
+	o.Broker.Proxy = "socks5://" + sp.Addr().String()
+	o.TLS = &tls.Config{InsecureSkipVerify: true}
+	n, _, e := Dial(o)
+	if e != nil {
+		t.Fatalf("Dial, expected no error, got [%v]\n", e)
+	}
+	defer n.Close()
+	nextFrame(t, fc, "CONNECT")
+	if _, ok := n.(*tls.Conn); !ok {
+		t.Errorf("Dial, expected a *tls.Conn, got [%T]\n", n)
+	}
+}
@@ -0,0 +1,84 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package sngecomm
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	randSeed int64 // 0: seed from the clock
+)
+
+/*
+SetSeed sets the seed used by random payloads and delays.  Zero, the default,
+seeds from the clock.
+
+With a non-zero seed, each random stream is seeded from the seed and the
+stream name, so runs are reproducible regardless of go routine start order,
+as long as each go routine uses its own streams.
+*/
+func SetSeed(s int64) {
+	atomic.StoreInt64(&randSeed, s)
+}
+
+// newRand returns a generator for a named stream.
+func newRand(stream string) *rand.Rand {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(stream))
+	s := atomic.LoadInt64(&randSeed)
+	if s == 0 {
+		s = time.Now().UnixNano()
+	}
+	return rand.New(rand.NewSource(s ^ int64(h.Sum64())))
+}
+
+// lockedRand is a math/rand generator that is safe for concurrent use.
+type lockedRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+func newLockedRand(stream string) *lockedRand {
+	return &lockedRand{r: newRand(stream)}
+}
+
+// between returns a value in [min, max].
+func (l *lockedRand) between(min, max int64) int64 {
+	if max <= min {
+		return min
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return min + l.r.Int63n(max-min+1)
+}
+
+func (l *lockedRand) float64() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Float64()
+}
+
+func (l *lockedRand) read(b []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = l.r.Read(b)
+}
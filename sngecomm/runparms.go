@@ -0,0 +1,171 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package sngecomm
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/gmallard/stompngo"
+)
+
+var (
+	lastConfig     *Config    // Most recent successful LoadConfig
+	lastConfigLock sync.Mutex // lastConfig variable lock
+)
+
+// RunParm is a single run parameter, for reporting.
+type RunParm struct {
+	Name   string // Upper case, e.g. NQS or VMG_GETAR
+	Value  interface{}
+	Source string // default, profile, file, url, env or flag
+}
+
+/*
+Conflict is a questionable or invalid combination of run parameters.
+
+Fatal conflicts cause LoadConfig to fail.  Others are reported as warnings.
+*/
+type Conflict struct {
+	Fatal bool
+	Msg   string
+}
+
+func (cf Conflict) Error() string {
+	return "conflict: " + cf.Msg
+}
+
+// RunParms returns every run parameter, broker parameters first.
+func (c *Config) RunParms() []RunParm {
+	var r []RunParm
+	if b := c.Broker; b != nil {
+		r = append(r, RunParm{"PROFILE", b.Profile, SrcEnv})
+		if b.Profile == "" {
+			r[0].Source = SrcDefault
+		}
+		ps := ""
+		if b.Passcode != "" {
+			ps = "********"
+		}
+		px := b.Proxy
+		if u, e := ParseProxy(px); e == nil {
+			px = redactURI(u)
+		}
+		for _, p := range []struct {
+			n string
+			v interface{}
+		}{{"host", b.Host}, {"port", b.Port}, {"vhost", b.Vhost},
+			{"protocol", b.Protocol}, {"heartbeats", b.Heartbeats},
+			{"login", b.Login}, {"passcode", ps}, {"dialect", b.Dialect},
+			{"proxy", px}, {"websocket", b.WebSocket},
+			{"unix", b.Unix}} {
+			r = append(r, RunParm{strings.ToUpper(p.n), p.v, b.Source(p.n)})
+		}
+	}
+	for _, k := range knobs {
+		r = append(r, RunParm{strings.TrimPrefix(k.env, "STOMP_"), k.get(c),
+			c.Source(k.name)})
+	}
+	return r
+}
+
+// ShowRunParms logs every run parameter with its source, and any conflicts.
+func (c *Config) ShowRunParms(exampid string, lgr *log.Logger) {
+	for _, p := range c.RunParms() {
+		lgr.Printf("%s%s:%v source:%s\n", exampid, p.Name, p.Value, p.Source)
+	}
+	for _, cf := range c.Conflicts {
+		lgr.Printf("%sWARNING:%s\n", exampid, cf.Msg)
+	}
+}
+
+// checkConflicts finds combinations of values that are invalid, or that
+// will not do what the user probably expects.
+func (c *Config) checkConflicts() []Conflict {
+	var r []Conflict
+	fatal := func(f string, v ...interface{}) {
+		r = append(r, Conflict{true, fmt.Sprintf(f, v...)})
+	}
+	warn := func(f string, v ...interface{}) {
+		r = append(r, Conflict{false, fmt.Sprintf(f, v...)})
+	}
+	set := func(n string) bool { return c.Source(n) != SrcDefault }
+	//
+	b := c.Broker
+	switch b.Protocol {
+	case stompngo.SPL_10, stompngo.SPL_11, stompngo.SPL_12:
+	default:
+		fatal("protocol %q is not supported", b.Protocol)
+	}
+	if b.Protocol == stompngo.SPL_10 {
+		if c.AckMode == stompngo.AckModeClientIndividual {
+			fatal("ack mode %s requires protocol 1.1 or later", c.AckMode)
+		}
+		if b.Source("heartbeats") != SrcDefault {
+			warn("heartbeats are ignored with protocol %s", b.Protocol)
+		}
+	}
+	if c.VarMsl && set("fxmslen") {
+		warn("fxmslen is ignored when varmsl is set")
+	}
+	if !c.DoSleep && (c.FixSleep || set("sleepms")) {
+		warn("fixsleep and sleepms are ignored unless dosleep is set")
+	}
+	if c.DoSleep && set("sleepms") && !c.FixSleep {
+		warn("sleepms is ignored unless fixsleep is set")
+	}
+	if set("payload") && (c.VarMsl || set("fxmslen")) {
+		warn("varmsl and fxmslen are ignored when payload is set")
+	}
+	if !c.SendWait && set("senddelay") {
+		warn("senddelay is ignored when sendwait is false")
+	}
+	if !c.RecvWait && set("recvdelay") {
+		warn("recvdelay is ignored when recvwait is false")
+	}
+	if c.VmgGetAR && c.AckMode == stompngo.AckModeAuto {
+		warn("vmg_getar is ignored with ack mode %s", c.AckMode)
+	}
+	if c.Pool != "" && set("recvconns") {
+		warn("recvconns is ignored when pool is set")
+	}
+	if c.RecvConns > c.Nqs {
+		warn("recvconns %d is limited to nqs %d", c.RecvConns, c.Nqs)
+	}
+	return r
+}
+
+// runConfig returns the most recently loaded Config, or one built from
+// defaults and the environment.  It serves the package level helpers, e.g.
+// CommonConnect, that have no Config.
+func runConfig() *Config {
+	lastConfigLock.Lock()
+	lc := lastConfig
+	lastConfigLock.Unlock()
+	if lc != nil {
+		return lc
+	}
+	c := DefaultConfig()
+	for _, e := range c.applyEnv() {
+		llu.Printf("run_parms_error error:%v\n", e)
+	}
+	c.Broker = brokerOrEnv()
+	c.Conflicts = c.checkConflicts()
+	return c
+}
@@ -0,0 +1,71 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package sngecomm
+
+import (
+	"testing"
+)
+
+/*
+Test that value sources are recorded, and that all knobs are reported.
+*/
+func TestRunParmsSources(t *testing.T) {
+	defer setTestEnv("STOMP_NQS", "2", "VMG_GETAR", "y")()
+	c, e := loadTestConfig("-nmsgs", "3", "-ackmode", "client")
+	if e != nil {
+		t.Fatalf("LoadConfig, expected no error, got [%v]\n", e)
+	}
+	for n, w := range map[string]string{"nqs": SrcEnv, "nmsgs": SrcFlag,
+		"ngors": SrcDefault, "vmg_getar": SrcEnv} {
+		if s := c.Source(n); s != w {
+			t.Errorf("Source %s, expected [%s], got [%s]\n", n, w, s)
+		}
+	}
+	rp := map[string]RunParm{}
+	for _, p := range c.RunParms() {
+		rp[p.Name] = p
+	}
+	if len(rp) != len(knobs)+12 {
+		t.Errorf("RunParms, expected [%d] values, got [%d]\n", len(knobs)+12, len(rp))
+	}
+	if p := rp["VMG_GETAR"]; p.Value != true || p.Source != SrcEnv {
+		t.Errorf("RunParms VMG_GETAR, got [%v]\n", p)
+	}
+	if p := rp["HOST"]; p.Value != "localhost" || p.Source != SrcDefault {
+		t.Errorf("RunParms HOST, got [%v]\n", p)
+	}
+}
+
+/*
+Test that invalid combinations fail, and questionable ones warn.
+*/
+func TestRunParmsConflicts(t *testing.T) {
+	fn, rm := testProfilesFile(t, "stomp10:\n  protocol: \"1.0\"\n")
+	defer rm()
+	defer setTestEnv("STOMP_PROFILES", fn, "STOMP_PROFILE", "stomp10")()
+	_, e := loadTestConfig("-ackmode", "client-individual")
+	if e == nil {
+		t.Fatalf("LoadConfig, expected an error for client-individual on 1.0\n")
+	}
+	c, e := loadTestConfig("-fixsleep", "true")
+	if e != nil {
+		t.Fatalf("LoadConfig, expected no error, got [%v]\n", e)
+	}
+	if len(c.Conflicts) != 1 || c.Conflicts[0].Fatal {
+		t.Errorf("Conflicts, expected one warning, got [%v]\n", c.Conflicts)
+	}
+}
@@ -0,0 +1,258 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package sngecomm
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gmallard/stompngo"
+)
+
+// Process exit codes, see Shutdown.Code.  A second signal exits at once
+// with 128 plus the signal number, as a shell would report it.
+const (
+	ExitClean   = 0 // All shutdown steps succeeded
+	ExitUnclean = 1 // A shutdown step failed
+	ExitGrace   = 2 // Consumers did not stop within the grace period
+)
+
+const (
+	// DefaultGrace is how long consumers have to stop after a signal.
+	DefaultGrace = 30 * time.Second
+)
+
+/*
+Shutdown coordinates the orderly stop of long running consumers on SIGINT
+or SIGTERM.
+
+Consumers started with Go receive a context that is done when a signal
+arrives.  They finish the message in hand, and return, normally after
+calling StopConsumer.  Wait returns once they have all returned, or the
+grace period has passed.  The program then disconnects, shows statistics,
+and exits with Code.  A second signal exits at once.
+
+	Example:
+		sd := sngecomm.NewShutdown(exampid, tag, ll)
+		sd.Go(func(ctx context.Context) error { return consume(ctx, conn) })
+		sd.Wait()
+		if e := sngecomm.CommonDisconnect(n, conn, exampid, tag, ll); e != nil {
+			sd.Fail("disconnect", e)
+		}
+		sngecomm.ShowStats(exampid, tag, conn)
+		os.Exit(sd.Code())
+*/
+type Shutdown struct {
+	Grace   time.Duration // Consumer stop limit, 0 is DefaultGrace
+	exampid string
+	tag     string
+	l       *log.Logger
+	ctx     context.Context
+	cancel  context.CancelFunc
+	sigc    chan os.Signal
+	done    chan struct{} // Closed by Wait, ends signal handling
+	sgd     chan struct{} // Signal go routine is done
+	wg      sync.WaitGroup
+	once    sync.Once // Closes done
+	mu      sync.Mutex
+	sig     os.Signal
+	code    int
+}
+
+// NewShutdown starts catching SIGINT and SIGTERM.
+func NewShutdown(exampid, tag string, l *log.Logger) *Shutdown {
+	if l == nil {
+		l = llu
+	}
+	s := &Shutdown{exampid: exampid, tag: tag, l: l,
+		sigc: make(chan os.Signal, 2),
+		done: make(chan struct{}), sgd: make(chan struct{})}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	signal.Notify(s.sigc, os.Interrupt, syscall.SIGTERM)
+	go s.signals()
+	return s
+}
+
+// signals handles delivered signals.
+func (s *Shutdown) signals() {
+	defer close(s.sgd)
+	var sig os.Signal
+	select {
+	case sig = <-s.sigc:
+	case <-s.done:
+		return
+	}
+	s.mu.Lock()
+	s.sig = sig
+	s.mu.Unlock()
+	s.l.Printf("%stag:%s connsess:%s shutdown_signal signal:%v\n",
+		s.exampid, s.tag, Lcs,
+		sig)
+	s.cancel()
+	select {
+	case sig = <-s.sigc:
+	case <-s.done:
+		return
+	}
+	s.l.Printf("%stag:%s connsess:%s shutdown_forced signal:%v\n",
+		s.exampid, s.tag, Lcs,
+		sig)
+	os.Exit(128 + signum(sig))
+}
+
+func signum(sig os.Signal) int {
+	if n, ok := sig.(syscall.Signal); ok {
+		return int(n)
+	}
+	return 1
+}
+
+// Stop starts a shutdown without a signal.
+func (s *Shutdown) Stop() {
+	s.cancel()
+}
+
+// Context returns the context that is done at shutdown.
+func (s *Shutdown) Context() context.Context { return s.ctx }
+
+// Signal returns the signal that started shutdown, or nil.
+func (s *Shutdown) Signal() os.Signal {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sig
+}
+
+// Go runs a consumer.  A returned error is recorded with Fail.
+func (s *Shutdown) Go(f func(ctx context.Context) error) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if e := f(s.ctx); e != nil {
+			s.Fail("consumer", e)
+		}
+	}()
+}
+
+/*
+Wait waits until all consumers have returned.  After shutdown starts,
+consumers have the grace period to return.  Wait stops catching signals, and
+ends the signal handling go routine, before returning, so a later signal has
+its default effect.
+*/
+func (s *Shutdown) Wait() {
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-s.ctx.Done():
+		g := s.Grace
+		if g == 0 {
+			g = DefaultGrace
+		}
+		t := time.NewTimer(g)
+		defer t.Stop()
+		select {
+		case <-done:
+		case <-t.C:
+			s.l.Printf("%stag:%s connsess:%s shutdown_grace_expired grace:%v\n",
+				s.exampid, s.tag, Lcs,
+				g)
+			s.setCode(ExitGrace)
+		}
+	}
+	signal.Stop(s.sigc)
+	s.once.Do(func() { close(s.done) })
+	<-s.sgd
+	s.cancel()
+	s.l.Printf("%stag:%s connsess:%s shutdown_consumers_done\n",
+		s.exampid, s.tag, Lcs)
+}
+
+// Fail records a failed shutdown step.
+func (s *Shutdown) Fail(step string, e error) {
+	s.l.Printf("%stag:%s connsess:%s shutdown_step_failed step:%s error:%v\n",
+		s.exampid, s.tag, Lcs,
+		step, e)
+	s.setCode(ExitUnclean)
+}
+
+func (s *Shutdown) setCode(c int) {
+	s.mu.Lock()
+	if c > s.code {
+		s.code = c
+	}
+	s.mu.Unlock()
+}
+
+// Code returns the process exit code: ExitClean, ExitUnclean or ExitGrace.
+func (s *Shutdown) Code() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.code
+}
+
+/*
+StopConsumer ends a subscription at shutdown.
+
+Messages already delivered to sc, but not yet processed, are NACKed so the
+broker can redeliver them at once.  That needs a client ack mode and
+protocol 1.1 or later; otherwise they are redelivered after the DISCONNECT.
+The subscription is then unsubscribed.  StopConsumer returns the number of
+messages NACKed.
+*/
+func StopConsumer(c *stompngo.Connection, sc <-chan stompngo.MessageData,
+	d, id, a string) (int, error) {
+	nak := a != stompngo.AckModeAuto && c.Protocol() != stompngo.SPL_10
+	rc := managed(c)
+	nn := 0
+	for {
+		var md stompngo.MessageData
+		var ok bool
+		select {
+		case md, ok = <-sc:
+		default:
+		}
+		if !ok || md.Error != nil || md.Message.Command != stompngo.MESSAGE {
+			break
+		}
+		if !nak {
+			continue
+		}
+		var e error
+		if rc != nil {
+			e = rc.Nack(md.Message.Headers, id)
+		} else {
+			e = nack(c, md.Message.Headers, id)
+		}
+		if e != nil {
+			return nn, e
+		}
+		nn++
+	}
+	if rc != nil {
+		return nn, rc.Unsubscribe(d, id)
+	}
+	return nn, unsubscribe(c, d, id)
+}
@@ -0,0 +1,122 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package sngecomm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gmallard/stompngo"
+)
+
+/*
+Test that a signal stops consumers, and the resulting exit codes.
+*/
+func TestShutdownSignal(t *testing.T) {
+	sd := NewShutdown("test: ", "shutdown", log.New(ioutil.Discard, "", 0))
+	sd.Go(func(ctx context.Context) error {
+		<-ctx.Done()
+		return nil
+	})
+	sd.sigc <- os.Interrupt
+	sd.Wait()
+	if sd.Signal() != os.Interrupt || sd.Code() != ExitClean {
+		t.Errorf("Shutdown, got signal [%v] code [%d]\n", sd.Signal(), sd.Code())
+	}
+	//
+	sd = NewShutdown("test: ", "shutdown", log.New(ioutil.Discard, "", 0))
+	sd.Grace = 20 * time.Millisecond
+	sd.Go(func(ctx context.Context) error { return errors.New("failed") })
+	sd.Go(func(ctx context.Context) error {
+		time.Sleep(5 * time.Second) // Ignores shutdown
+		return nil
+	})
+	sd.Stop()
+	sd.Wait()
+	if sd.Code() != ExitGrace {
+		t.Errorf("Shutdown grace, expected code [%d], got [%d]\n", ExitGrace, sd.Code())
+	}
+}
+
+/*
+Test that Wait ends the signal go routine, with or without a signal.
+*/
+func TestShutdownWaitEndsSignals(t *testing.T) {
+	for _, sig := range []os.Signal{nil, os.Interrupt} {
+		sd := NewShutdown("test: ", "shutdown", log.New(ioutil.Discard, "", 0))
+		if sig != nil {
+			sd.sigc <- sig
+			<-sd.Context().Done()
+		}
+		wd := make(chan struct{})
+		go func() {
+			sd.Wait()
+			close(wd)
+		}()
+		select {
+		case <-wd:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Wait, signal [%v], did not return\n", sig)
+		}
+		select {
+		case <-sd.sgd:
+		default:
+			t.Errorf("Wait, signal [%v], signal go routine still running\n", sig)
+		}
+	}
+}
+
+/*
+Test that unprocessed messages are NACKed, and the subscription ended.
+*/
+func TestShutdownStopConsumer(t *testing.T) {
+	l, fc := testBroker(t)
+	defer l.Close()
+	n, conn, e := Dial(dialOpts(l.Addr().String()))
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer n.Close()
+	c := nextFrame(t, fc, "CONNECT").c
+	sc, e := subscribe(conn, "/queue/a", "s1", stompngo.AckModeClientIndividual)
+	if e != nil {
+		t.Fatal(e)
+	}
+	nextFrame(t, fc, "SUBSCRIBE")
+	fmt.Fprintf(c, "MESSAGE\nsubscription:s1\nmessage-id:m1\nack:a1\ndestination:/queue/a\n\nbody\x00")
+	for st := time.Now(); len(sc) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(st) > 5*time.Second {
+			t.Fatal("no MESSAGE")
+		}
+	}
+	nn, e := StopConsumer(conn, sc, "/queue/a", "s1", stompngo.AckModeClientIndividual)
+	if nn != 1 || e != nil {
+		t.Errorf("StopConsumer, got [%d] [%v]\n", nn, e)
+	}
+	if f := nextFrame(t, fc, "NACK"); f.h["id"] != "a1" {
+		t.Errorf("StopConsumer NACK, got [%v]\n", f.h)
+	}
+	if f := nextFrame(t, fc, "UNSUBSCRIBE"); f.h["id"] != "s1" {
+		t.Errorf("StopConsumer UNSUBSCRIBE, got [%v]\n", f.h)
+	}
+}
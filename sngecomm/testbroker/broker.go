@@ -0,0 +1,396 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+/*
+Package testbroker is an in-process STOMP 1.0, 1.1 and 1.2 broker, for
+tests and offline runs of the examples.
+
+It supports CONNECT and STOMP, SEND, SUBSCRIBE, UNSUBSCRIBE, ACK and NACK
+(auto, client and client-individual ack modes), BEGIN, COMMIT and ABORT,
+RECEIPT, ERROR, and heartbeats.  Queues deliver each message to one
+subscriber, round robin, and hold messages until there is one.  Topics
+deliver to every current subscriber.  A destination is a topic if it starts
+with /topic/, jms.topic. or topic://.  Messages nacked, or unacked when a
+subscription ends, are redelivered with a redelivered:true header.
+
+Protocol errors are answered with an ERROR frame, and the connection is
+closed, as STOMP specifies.
+
+	b, e := testbroker.Start(testbroker.Options{})
+	if e != nil {
+		// Handle this ......
+	}
+	defer b.Close()
+	n, e := net.Dial("tcp", b.Addr())
+
+Broker.Dial is a sngecomm.DialFunc, for the examples' connect helpers:
+
+	sngecomm.SetDialFunc(b.Dial)
+	defer sngecomm.SetDialFunc(nil)
+
+Faults, such as dropped connections, ERROR frames and lost RECEIPTs, can be
+scripted for each broker, see Fault and ParseFaults:
+
+	fs, e := testbroker.ParseFaults(`
+		drop cmd=MESSAGE after=2
+		noreceipt cmd=DISCONNECT`)
+	if e != nil {
+		// Handle this ......
+	}
+	b, e := testbroker.Start(testbroker.Options{Faults: fs})
+
+Nothing is persisted, and there is no flow control.
+*/
+package testbroker
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Options configures a Broker.  The zero value is a plain TCP broker on
+// an ephemeral 127.0.0.1 port.
+type Options struct {
+	Addr       string      // Listen address, default 127.0.0.1:0
+	TLS        *tls.Config // Non-nil listens with TLS
+	Versions   []string    // Supported versions, default 1.0, 1.1 and 1.2
+	Login      string      // Non-empty requires this login ...
+	Passcode   string      // ... and passcode
+	HeartBeats string      // Broker heart-beat offer, sx,sy in ms, default 0,0
+	Server     string      // CONNECTED server header, default testbroker
+	Logger     *log.Logger // nil logs nothing
+	Faults     []Fault     // See ParseFaults
+}
+
+// Stats are broker counters.
+type Stats struct {
+	Connections int            // Accepted, in total
+	Frames      map[string]int // Received, by command
+	Delivered   int            // MESSAGE frames sent
+	Redelivered int            // ... that were redeliveries
+	Acked       int            // Messages acked, explicitly or cumulatively
+	Nacked      int
+	Errors      int // ERROR frames sent
+	Faults      int // Faults applied
+}
+
+// A message held by the broker.
+type message struct {
+	id          string
+	dest        string
+	headers     []string // From the SEND, without broker headers
+	body        []byte
+	redelivered bool
+}
+
+// A destination: a queue or a topic.
+type destination struct {
+	name  string
+	topic bool
+	queue []*message // Undelivered, queues only
+	subs  []*subscription
+	next  int // Round robin position
+}
+
+/*
+Broker is an in-process STOMP broker.  Start one with Start, or NewBroker
+and Serve.
+*/
+type Broker struct {
+	o Options
+	l net.Listener
+
+	mu     sync.Mutex
+	dests  map[string]*destination
+	conns  map[*conn]bool
+	frames []*Frame
+	faults []*fault
+	stats  Stats
+	seq    int // Message and connection IDs
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// NewBroker returns a broker that is not listening.  See Serve.
+func NewBroker(o Options) *Broker {
+	if len(o.Versions) == 0 {
+		o.Versions = []string{"1.0", "1.1", "1.2"}
+	}
+	if o.HeartBeats == "" {
+		o.HeartBeats = "0,0"
+	}
+	if o.Server == "" {
+		o.Server = "testbroker"
+	}
+	if o.Logger == nil {
+		o.Logger = log.New(ioutil.Discard, "", 0)
+	}
+	b := &Broker{o: o, dests: map[string]*destination{}, conns: map[*conn]bool{},
+		stats: Stats{Frames: map[string]int{}}}
+	b.SetFaults(o.Faults...)
+	return b
+}
+
+// Start returns a broker listening on Options.Addr.
+func Start(o Options) (*Broker, error) {
+	b := NewBroker(o)
+	a := b.o.Addr
+	if a == "" {
+		a = "127.0.0.1:0"
+	}
+	var l net.Listener
+	var e error
+	if b.o.TLS != nil {
+		l, e = tls.Listen("tcp", a, b.o.TLS)
+	} else {
+		l, e = net.Listen("tcp", a)
+	}
+	if e != nil {
+		return nil, e
+	}
+	b.l = l
+	go b.Serve(l)
+	return b, nil
+}
+
+// Serve accepts connections on l until it is closed.  l may be any
+// listener, e.g. a sngecomm.PipeListener or a Unix socket.
+func (b *Broker) Serve(l net.Listener) {
+	for {
+		n, e := l.Accept()
+		if e != nil {
+			return
+		}
+		b.mu.Lock()
+		if b.closed {
+			b.mu.Unlock()
+			_ = n.Close()
+			return
+		}
+		b.seq++
+		b.stats.Connections++
+		c := newConn(b, n, b.seq)
+		c.num = b.stats.Connections
+		b.conns[c] = true
+		b.wg.Add(1)
+		b.mu.Unlock()
+		go func() {
+			defer b.wg.Done()
+			c.run()
+		}()
+	}
+}
+
+// Addr returns the Start listener address, host:port.
+func (b *Broker) Addr() string {
+	return b.l.Addr().String()
+}
+
+// HostPort returns the Start listener host and port, e.g. for
+// sngecomm.BrokerParms.
+func (b *Broker) HostPort() (string, string) {
+	h, p, _ := net.SplitHostPort(b.Addr())
+	return h, p
+}
+
+// Dial connects to the Start listener, whatever address is asked for.  It
+// is a sngecomm.DialFunc, so sngecomm.SetDialFunc(b.Dial) points the
+// examples' connects at the broker.  TLS, if any, is up to the caller.
+func (b *Broker) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", b.Addr())
+}
+
+// Close stops the Start listener, closes all connections, and waits for
+// them to end.
+func (b *Broker) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	var cs []*conn
+	for c := range b.conns {
+		cs = append(cs, c)
+	}
+	b.mu.Unlock()
+	var e error
+	if b.l != nil {
+		e = b.l.Close()
+	}
+	for _, c := range cs {
+		c.close()
+	}
+	b.wg.Wait()
+	return e
+}
+
+// Stats returns the broker counters.
+func (b *Broker) Stats() Stats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := b.stats
+	s.Frames = map[string]int{}
+	for k, v := range b.stats.Frames {
+		s.Frames[k] = v
+	}
+	return s
+}
+
+// Frames returns the frames received with a command, or all frames for "",
+// in order.  Heartbeats are not frames.
+func (b *Broker) Frames(cmd string) []*Frame {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var r []*Frame
+	for _, f := range b.frames {
+		if cmd == "" || f.Command == cmd {
+			r = append(r, f)
+		}
+	}
+	return r
+}
+
+// Depth returns the number of queued, undelivered, messages for a
+// destination.
+func (b *Broker) Depth(dest string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if d, ok := b.dests[dest]; ok {
+		return len(d.queue)
+	}
+	return 0
+}
+
+// Unacked returns the number of messages delivered but not yet acked for a
+// destination.
+func (b *Broker) Unacked(dest string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := 0
+	if d, ok := b.dests[dest]; ok {
+		for _, s := range d.subs {
+			n += len(s.unacked)
+		}
+	}
+	return n
+}
+
+// Publish sends a message to a destination, as if from a client.  h are
+// header key, value pairs.
+func (b *Broker) Publish(dest string, body []byte, h ...string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.publish(dest, h, body)
+}
+
+// WaitFor polls f, with the broker unlocked, until it is true or d passes.
+// It returns the last result of f.
+func (b *Broker) WaitFor(d time.Duration, f func() bool) bool {
+	end := time.Now().Add(d)
+	for !f() {
+		if time.Now().After(end) {
+			return false
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return true
+}
+
+// destination returns a destination, created on first use.  b.mu is held.
+func (b *Broker) destination(name string) *destination {
+	d, ok := b.dests[name]
+	if !ok {
+		d = &destination{name: name, topic: isTopic(name)}
+		b.dests[name] = d
+	}
+	return d
+}
+
+// isTopic returns whether a destination is a topic.
+func isTopic(d string) bool {
+	for _, p := range []string{"/topic/", "jms.topic.", "topic://"} {
+		if strings.HasPrefix(d, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// publish stores and dispatches a message.  b.mu is held.
+func (b *Broker) publish(dest string, h []string, body []byte) {
+	b.seq++
+	m := &message{id: "tb-" + strconv.Itoa(b.seq), dest: dest, body: body}
+	for i := 0; i+1 < len(h); i += 2 {
+		switch h[i] {
+		case "destination", "receipt", "transaction", "content-length",
+			"message-id", "subscription", "ack":
+		default:
+			m.headers = append(m.headers, h[i], h[i+1])
+		}
+	}
+	d := b.destination(dest)
+	if d.topic {
+		for _, s := range d.subs {
+			s.deliver(m)
+		}
+		return
+	}
+	d.queue = append(d.queue, m)
+	b.dispatch(d)
+}
+
+// dispatch delivers queued messages, round robin.  b.mu is held.
+func (b *Broker) dispatch(d *destination) {
+	for len(d.queue) > 0 && len(d.subs) > 0 {
+		m := d.queue[0]
+		d.queue = d.queue[1:]
+		d.next = d.next % len(d.subs)
+		d.subs[d.next].deliver(m)
+		d.next++
+	}
+}
+
+// requeue returns messages to the front of their queue, marked as
+// redelivered, and dispatches them.  Topic messages are dropped.  b.mu is
+// held.
+func (b *Broker) requeue(ms []*message) {
+	if len(ms) == 0 {
+		return
+	}
+	d := b.destination(ms[0].dest)
+	if d.topic {
+		return
+	}
+	var q []*message
+	for _, m := range ms {
+		nm := *m
+		nm.redelivered = true
+		q = append(q, &nm)
+	}
+	d.queue = append(q, d.queue...)
+	b.dispatch(d)
+}
+
+// logf logs a broker event.
+func (b *Broker) logf(f string, a ...interface{}) {
+	b.o.Logger.Output(2, fmt.Sprintf("testbroker "+f, a...))
+}
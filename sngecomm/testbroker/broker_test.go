@@ -0,0 +1,278 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package testbroker
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gmallard/stompngo"
+)
+
+// connect connects to b with a protocol version, "" for STOMP 1.0 with no
+// accept-version.
+func connect(t *testing.T, b *Broker, v string, h ...string) (net.Conn, *stompngo.Connection) {
+	n, e := net.Dial("tcp", b.Addr())
+	if e != nil {
+		t.Fatal(e)
+	}
+	ch := stompngo.Headers{"login", "guest", "passcode", "guest"}
+	if v != "" {
+		ch = ch.Add("accept-version", v).Add("host", "localhost")
+	}
+	c, e := stompngo.Connect(n, append(ch, h...))
+	if e != nil {
+		t.Fatalf("Connect %s, expected no error, got [%v]\n", v, e)
+	}
+	return n, c
+}
+
+// receive waits for a MESSAGE.
+func receive(t *testing.T, r <-chan stompngo.MessageData) stompngo.Message {
+	select {
+	case md := <-r:
+		if md.Error != nil || md.Message.Command != stompngo.MESSAGE {
+			t.Fatalf("receive, got [%v] [%v]\n", md.Message.Command, md.Error)
+		}
+		return md.Message
+	case <-time.After(5 * time.Second):
+		t.Fatal("receive, timed out")
+	}
+	return stompngo.Message{}
+}
+
+// disconnect disconnects, with a receipt.
+func disconnect(t *testing.T, n net.Conn, c *stompngo.Connection) {
+	if e := c.Disconnect(stompngo.Headers{"receipt", "bye"}); e != nil {
+		t.Errorf("Disconnect, expected no error, got [%v]\n", e)
+	}
+	_ = n.Close()
+}
+
+/*
+Test send and receive for each protocol version, with client acks, NACK
+redelivery, and header escapes.
+*/
+func TestBrokerVersions(t *testing.T) {
+	b, e := Start(Options{})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer b.Close()
+	for _, v := range []string{"", "1.0", "1.1", "1.2", "1.0,1.1,1.2"} {
+		q := "/queue/versions" + v
+		n, c := connect(t, b, v)
+		want := map[string]string{"": "1.0", "1.0,1.1,1.2": "1.2"}[v]
+		if want == "" {
+			want = v
+		}
+		if c.Protocol() != want || c.Session() == "" {
+			t.Errorf("%s, expected protocol %s and a session, got %s [%s]\n", v, want,
+				c.Protocol(), c.Session())
+		}
+		sh := stompngo.Headers{"destination", q, "ack", "client", "id", "s1"}
+		r, e := c.Subscribe(sh)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if e = c.Send(stompngo.Headers{"destination", q, "k", "a:b"}, "one"); e != nil {
+			t.Fatal(e)
+		}
+		m := receive(t, r)
+		if string(m.Body) != "one" || m.Headers.Value("k") != "a:b" ||
+			m.Headers.Value("subscription") != "s1" {
+			t.Errorf("%s, got [%s] [%v]\n", v, m.Body, m.Headers)
+		}
+		ah := stompngo.Headers{"message-id", m.Headers.Value("message-id"),
+			"subscription", "s1"}
+		if want == "1.2" {
+			ah = stompngo.Headers{"id", m.Headers.Value("ack")}
+		}
+		if want != "1.0" {
+			if e = c.Nack(ah); e != nil {
+				t.Fatal(e)
+			}
+			m = receive(t, r)
+			if m.Headers.Value("redelivered") != "true" {
+				t.Errorf("%s, expected a redelivery, got [%v]\n", v, m.Headers)
+			}
+			if want == "1.2" {
+				ah = stompngo.Headers{"id", m.Headers.Value("ack")}
+			}
+		}
+		if e = c.Ack(ah.Add("receipt", "ack-"+v)); e != nil {
+			t.Fatal(e)
+		}
+		if rd := <-c.MessageData; rd.Message.Command != stompngo.RECEIPT {
+			t.Errorf("%s, expected a RECEIPT, got [%v]\n", v, rd.Message.Command)
+		}
+		if b.Unacked(q) != 0 || b.Depth(q) != 0 {
+			t.Errorf("%s, expected all acked, got %d unacked, %d queued\n", v,
+				b.Unacked(q), b.Depth(q))
+		}
+		disconnect(t, n, c)
+	}
+	s := b.Stats()
+	if s.Connections != 5 || s.Acked != 5 || s.Nacked != 3 || s.Redelivered != 3 ||
+		s.Frames["DISCONNECT"] != 5 {
+		t.Errorf("Stats, got [%+v]\n", s)
+	}
+}
+
+/*
+Test queue and topic semantics, transactions, and redelivery of unacked
+messages when a subscriber goes.
+*/
+func TestBrokerDestinations(t *testing.T) {
+	b, e := Start(Options{})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer b.Close()
+	// Held until there is a subscriber
+	b.Publish("/queue/q", []byte("early"))
+	n1, c1 := connect(t, b, "1.2")
+	n2, c2 := connect(t, b, "1.2")
+	defer disconnect(t, n2, c2)
+	r1, _ := c1.Subscribe(stompngo.Headers{"destination", "/queue/q", "id", "q",
+		"ack", "client-individual"})
+	if m := receive(t, r1); string(m.Body) != "early" {
+		t.Errorf("Queue, expected early, got [%s]\n", m.Body)
+	}
+	r2, _ := c2.Subscribe(stompngo.Headers{"destination", "/queue/q", "id", "q"})
+	// Round robin
+	_ = c2.Send(stompngo.Headers{"destination", "/queue/q"}, "to r2")
+	_ = c2.Send(stompngo.Headers{"destination", "/queue/q"}, "to r1")
+	if m := receive(t, r2); string(m.Body) != "to r2" {
+		t.Errorf("Round robin, expected to r2, got [%s]\n", m.Body)
+	}
+	if m := receive(t, r1); string(m.Body) != "to r1" {
+		t.Errorf("Round robin, expected to r1, got [%s]\n", m.Body)
+	}
+	// Unacked messages go to the remaining subscriber
+	disconnect(t, n1, c1)
+	for _, w := range []string{"early", "to r1"} {
+		if m := receive(t, r2); string(m.Body) != w || m.Headers.Value("redelivered") != "true" {
+			t.Errorf("Redelivery, expected %s, got [%s] [%v]\n", w, m.Body, m.Headers)
+		}
+	}
+	// Topics go to every subscriber
+	t1, _ := c2.Subscribe(stompngo.Headers{"destination", "/topic/t", "id", "t1"})
+	t2, _ := c2.Subscribe(stompngo.Headers{"destination", "/topic/t", "id", "t2"})
+	_ = c2.Begin(stompngo.Headers{"transaction", "tx1"})
+	_ = c2.Send(stompngo.Headers{"destination", "/topic/t", "transaction", "tx1"}, "tx")
+	if b.Stats().Delivered != 5 {
+		t.Errorf("Transaction, expected nothing delivered before COMMIT\n")
+	}
+	_ = c2.Commit(stompngo.Headers{"transaction", "tx1"})
+	for _, r := range []<-chan stompngo.MessageData{t1, t2} {
+		if m := receive(t, r); string(m.Body) != "tx" {
+			t.Errorf("Topic, expected tx, got [%s]\n", m.Body)
+		}
+	}
+	_ = c2.Begin(stompngo.Headers{"transaction", "tx2"})
+	_ = c2.Send(stompngo.Headers{"destination", "/queue/q", "transaction", "tx2"}, "gone")
+	_ = c2.Abort(stompngo.Headers{"transaction", "tx2", "receipt", "abort"})
+	if rd := <-c2.MessageData; rd.Message.Command != stompngo.RECEIPT {
+		t.Errorf("Abort, expected a RECEIPT, got [%v]\n", rd.Message.Command)
+	}
+	if s := b.Stats(); s.Delivered != 7 || b.Depth("/queue/q") != 0 {
+		t.Errorf("Abort, expected nothing sent, got [%+v]\n", s)
+	}
+}
+
+/*
+Test ERROR frames, and broker heartbeats.
+*/
+func TestBrokerErrors(t *testing.T) {
+	b, e := Start(Options{Login: "guest", Passcode: "guest", Versions: []string{"1.1", "1.2"},
+		HeartBeats: "50,50"})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer b.Close()
+	raw := func(frames ...string) string {
+		n, e := net.Dial("tcp", b.Addr())
+		if e != nil {
+			t.Fatal(e)
+		}
+		defer n.Close()
+		for _, f := range frames {
+			_, _ = n.Write([]byte(f + "\x00"))
+		}
+		_ = n.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var r []string
+		br := bufio.NewReader(n)
+		for {
+			f, e := br.ReadString(0)
+			if e != nil {
+				return strings.Join(r, "|")
+			}
+			r = append(r, strings.SplitN(strings.TrimLeft(f, "\n"), "\n", 2)[0])
+			if strings.HasPrefix(f, "ERROR") {
+				r = append(r, strings.Split(f, "\n")[1])
+			}
+		}
+	}
+	cf := "CONNECT\naccept-version:1.2\nlogin:guest\npasscode:guest\n\n"
+	tests := []struct {
+		frames []string
+		want   string
+	}{
+		{[]string{"CONNECT\naccept-version:1.0\n\n"}, "ERROR|message:unsupported protocol version"},
+		{[]string{"CONNECT\naccept-version:1.2\nlogin:x\n\n"}, "ERROR|message:access refused"},
+		{[]string{"SEND\ndestination:/queue/q\n\n"}, "ERROR|message:not connected"},
+		{[]string{cf, "SUBSCRIBE\ndestination:/queue/q\n\n"},
+			"CONNECTED|ERROR|message:missing id"},
+		{[]string{cf, "ACK\nid:nope\nreceipt:r1\n\n"}, "CONNECTED|ERROR|message:unknown message"},
+		{[]string{cf, "COMMIT\ntransaction:nope\n\n"}, "CONNECTED|ERROR|message:unknown transaction"},
+		{[]string{cf, "SEND\ndestination:/queue/q\nbad:\\t\n\n"},
+			"CONNECTED|ERROR|message:malformed frame"},
+		{[]string{cf, "FLY\n\n"}, "CONNECTED|ERROR|message:unknown command"},
+		{[]string{cf, "DISCONNECT\nreceipt:bye\n\n"}, "CONNECTED|RECEIPT"},
+	}
+	for _, tc := range tests {
+		if got := raw(tc.frames...); got != tc.want {
+			t.Errorf("%q, expected [%s], got [%s]\n", tc.frames, tc.want, got)
+		}
+	}
+	// Heartbeats: the broker sends them, and drops a client that sends none
+	n, e := net.Dial("tcp", b.Addr())
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer n.Close()
+	_, _ = n.Write([]byte("CONNECT\naccept-version:1.2\nlogin:guest\npasscode:guest\nheart-beat:20,20\n\n\x00"))
+	_ = n.SetReadDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(n)
+	if f, e := br.ReadString(0); e != nil || !strings.Contains(f, "heart-beat:50,50") {
+		t.Fatalf("CONNECTED, got [%s] [%v]\n", f, e)
+	}
+	if hb, e := br.ReadByte(); e != nil || hb != '\n' {
+		t.Errorf("Expected a broker heartbeat, got [%q] [%v]\n", hb, e)
+	}
+	st := time.Now()
+	for e == nil {
+		_, e = br.ReadByte()
+	}
+	if d := time.Since(st); d > 2*time.Second {
+		t.Errorf("Expected the broker to drop a silent client, waited %v\n", d)
+	}
+}
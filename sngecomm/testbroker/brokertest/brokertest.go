@@ -0,0 +1,59 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+/*
+Package brokertest sets up the examples' tests against a testbroker.Broker.
+
+	b, cfg, done := brokertest.Start(t, testbroker.Options{})
+	defer done()
+	cfg.Dest = "/queue/publish.test"
+	r, e := Run(context.Background(), cfg, ll)
+
+It is separate from testbroker, because the sngecomm tests use testbroker.
+*/
+package brokertest
+
+import (
+	"testing"
+
+	"github.com/gmallard/stompngo_examples/sngecomm"
+	"github.com/gmallard/stompngo_examples/sngecomm/testbroker"
+)
+
+// Timeout is the operation timeout of the Config returned by Start.
+const Timeout = "10s"
+
+/*
+Start starts a test broker, and makes it the broker for every sngecomm
+connection.  It returns the broker, a default Config with a Timeout, and a
+function that closes the broker and restores the default dial.  A failed
+start ends the test.
+*/
+func Start(t testing.TB, o testbroker.Options) (*testbroker.Broker,
+	*sngecomm.Config, func()) {
+	t.Helper()
+	b, e := testbroker.Start(o)
+	if e != nil {
+		t.Fatal(e)
+	}
+	sngecomm.SetDialFunc(b.Dial)
+	cfg := sngecomm.DefaultConfig()
+	cfg.Timeout = Timeout
+	return b, cfg, func() {
+		sngecomm.SetDialFunc(nil)
+		b.Close()
+	}
+}
@@ -0,0 +1,615 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package testbroker
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A subscription.
+type subscription struct {
+	c       *conn
+	id      string // The id header, or for STOMP 1.0 possibly the destination
+	hasID   bool
+	dest    *destination
+	ack     string // auto, client or client-individual
+	unacked []*delivery
+}
+
+// A delivered message awaiting an ACK or NACK.
+type delivery struct {
+	m     *message
+	ackID string // The STOMP 1.2 ack header
+}
+
+// A client connection.
+type conn struct {
+	b       *Broker
+	n       net.Conn
+	id      int
+	num     int    // Accept order, from 1
+	version string // Negotiated, "" before CONNECT
+	session string
+	subs    map[string]*subscription
+	txs     map[string][]*Frame
+	acks    int
+	//
+	mu       sync.Mutex // Protects the fields below
+	out      []outFrame // Frames to write
+	fin      bool       // Close after writing out
+	sendBeat time.Duration
+	noBeat   bool // Heartbeats stopped by a fault
+	wake     chan struct{}
+	done     chan struct{}
+	once     sync.Once
+}
+
+// A frame to write.
+type outFrame struct {
+	b     []byte
+	delay time.Duration // Wait before writing
+}
+
+// errorFrame is a protocol error, answered with an ERROR frame.
+type errorFrame struct {
+	message string
+	detail  string
+}
+
+func newConn(b *Broker, n net.Conn, id int) *conn {
+	return &conn{b: b, n: n, id: id, subs: map[string]*subscription{},
+		txs: map[string][]*Frame{}, wake: make(chan struct{}, 1),
+		done: make(chan struct{})}
+}
+
+// run reads and handles frames until the connection ends.
+func (c *conn) run() {
+	go c.writer()
+	defer c.end()
+	r := bufio.NewReader(c.n)
+	var recvBeat time.Duration
+	beat := func() {
+		if recvBeat > 0 {
+			_ = c.n.SetReadDeadline(time.Now().Add(2 * recvBeat))
+		}
+	}
+	for {
+		beat()
+		f, e := readFrame(r, c.version, beat)
+		if e != nil {
+			c.b.logf("conn:%d read_end error:%v", c.id, e)
+			if _, ok := e.(malformed); ok {
+				c.b.mu.Lock()
+				c.sendError(nil, &errorFrame{"malformed frame", e.Error()})
+				c.b.mu.Unlock()
+			}
+			return
+		}
+		c.b.mu.Lock()
+		c.b.frames = append(c.b.frames, f)
+		c.b.stats.Frames[f.Command]++
+		c.b.logf("conn:%d frame:%s headers:%v", c.id, f.Command, f.Headers)
+		fs := c.b.inject(c, atReceive, f.Command, f.Headers)
+		c.b.mu.Unlock()
+		var ef *errorFrame
+		nr := false // No RECEIPT
+		for _, ft := range fs {
+			switch ft.Action {
+			case Drop:
+				c.finish()
+				return
+			case Delay:
+				if !c.wait(ft.For) {
+					return
+				}
+			case Fail:
+				ef = &errorFrame{ft.message(), "injected for " + f.Command}
+			case NoReceipt:
+				nr = true
+			case NoHeartbeat:
+				c.stopBeats()
+			}
+		}
+		c.b.mu.Lock()
+		if ef == nil {
+			ef = c.handle(f)
+		}
+		switch {
+		case ef != nil:
+			c.sendError(f, ef)
+		case f.Command == "CONNECT" || f.Command == "STOMP":
+			recvBeat = c.heartBeats(f)
+		default:
+			if rid, ok := f.Header("receipt"); ok && !nr {
+				c.send("RECEIPT", "receipt-id", rid)
+			}
+			if f.Command == "DISCONNECT" && !nr {
+				c.finish()
+			}
+		}
+		c.b.mu.Unlock()
+		if ef != nil || f.Command == "DISCONNECT" && !nr {
+			return
+		}
+	}
+}
+
+// handle handles a frame.  b.mu is held.
+func (c *conn) handle(f *Frame) *errorFrame {
+	if c.version == "" && f.Command != "CONNECT" && f.Command != "STOMP" {
+		return &errorFrame{"not connected", f.Command + " before CONNECT"}
+	}
+	switch f.Command {
+	case "CONNECT", "STOMP":
+		return c.connect(f)
+	case "SEND", "ACK", "NACK":
+		if f.Command == "NACK" && c.version == "1.0" {
+			return &errorFrame{"unknown command", "NACK is not STOMP 1.0"}
+		}
+		if tx, ok := f.Header("transaction"); ok {
+			if _, ok = c.txs[tx]; !ok {
+				return &errorFrame{"unknown transaction", tx}
+			}
+			c.txs[tx] = append(c.txs[tx], f)
+			return nil
+		}
+		return c.apply(f)
+	case "SUBSCRIBE":
+		return c.subscribe(f)
+	case "UNSUBSCRIBE":
+		return c.unsubscribe(f)
+	case "BEGIN", "COMMIT", "ABORT":
+		return c.transaction(f)
+	case "DISCONNECT":
+		return nil
+	}
+	return &errorFrame{"unknown command", f.Command}
+}
+
+// connect handles CONNECT and STOMP.  b.mu is held.
+func (c *conn) connect(f *Frame) *errorFrame {
+	o := c.b.o
+	if c.version != "" {
+		return &errorFrame{"already connected", ""}
+	}
+	av, given := f.Header("accept-version")
+	if !given {
+		av = "1.0"
+	}
+	for _, v := range o.Versions {
+		for _, w := range strings.Split(av, ",") {
+			if strings.TrimSpace(w) == v && v > c.version {
+				c.version = v
+			}
+		}
+	}
+	if c.version == "" {
+		c.version = "1.0" // For the ERROR frame
+		return &errorFrame{"unsupported protocol version",
+			"Supported protocol versions are " + strings.Join(o.Versions, ",")}
+	}
+	if o.Login != "" && (f.Value("login") != o.Login || f.Value("passcode") != o.Passcode) {
+		return &errorFrame{"access refused", "bad login or passcode"}
+	}
+	c.session = "tb-session-" + strconv.Itoa(c.id)
+	h := []string{"session", c.session, "server", o.Server}
+	if given {
+		h = append([]string{"version", c.version}, h...)
+	}
+	if c.version != "1.0" {
+		h = append(h, "heart-beat", o.HeartBeats)
+	}
+	c.send("CONNECTED", h...)
+	return nil
+}
+
+// heartBeats sets up heartbeats after CONNECT, returning the client
+// heartbeat interval expected.  b.mu is held.
+func (c *conn) heartBeats(f *Frame) time.Duration {
+	if c.version == "1.0" {
+		return 0
+	}
+	cx, cy := beats(f.Value("heart-beat"))
+	sx, sy := beats(c.b.o.HeartBeats)
+	c.mu.Lock()
+	if sx > 0 && cy > 0 && !c.noBeat {
+		c.sendBeat = max(sx, cy)
+	}
+	c.mu.Unlock()
+	if cx > 0 && sy > 0 {
+		return max(cx, sy)
+	}
+	return 0
+}
+
+// beats parses a heart-beat header.
+func beats(s string) (time.Duration, time.Duration) {
+	p := strings.Split(s, ",")
+	if len(p) != 2 {
+		return 0, 0
+	}
+	x, _ := strconv.Atoi(strings.TrimSpace(p[0]))
+	y, _ := strconv.Atoi(strings.TrimSpace(p[1]))
+	return time.Duration(x) * time.Millisecond, time.Duration(y) * time.Millisecond
+}
+
+func max(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// apply applies a SEND, ACK or NACK, now or at COMMIT.  b.mu is held.
+func (c *conn) apply(f *Frame) *errorFrame {
+	if f.Command == "SEND" {
+		d := f.Value("destination")
+		if d == "" {
+			return &errorFrame{"missing destination", "SEND needs a destination header"}
+		}
+		c.b.publish(d, f.Headers, f.Body)
+		return nil
+	}
+	s, i := c.findDelivery(f)
+	if s == nil {
+		return &errorFrame{"unknown message", f.Command + " for no unacked message"}
+	}
+	var ds []*delivery
+	if s.ack == "client" { // Cumulative
+		ds, s.unacked = s.unacked[:i+1], append([]*delivery{}, s.unacked[i+1:]...)
+	} else {
+		ds = []*delivery{s.unacked[i]}
+		s.unacked = append(s.unacked[:i:i], s.unacked[i+1:]...)
+	}
+	if f.Command == "ACK" {
+		c.b.stats.Acked += len(ds)
+		return nil
+	}
+	c.b.stats.Nacked += len(ds)
+	var ms []*message
+	for _, d := range ds {
+		ms = append(ms, d.m)
+	}
+	c.b.requeue(ms)
+	return nil
+}
+
+// findDelivery finds the subscription and unacked index for an ACK or
+// NACK, by protocol version.  b.mu is held.
+func (c *conn) findDelivery(f *Frame) (*subscription, int) {
+	for _, s := range c.subs {
+		if c.version == "1.1" && f.Value("subscription") != s.id {
+			continue
+		}
+		for i, d := range s.unacked {
+			if c.version == "1.2" && d.ackID == f.Value("id") ||
+				c.version != "1.2" && d.m.id == f.Value("message-id") {
+				return s, i
+			}
+		}
+	}
+	return nil, 0
+}
+
+// subscribe handles SUBSCRIBE.  b.mu is held.
+func (c *conn) subscribe(f *Frame) *errorFrame {
+	d := f.Value("destination")
+	if d == "" {
+		return &errorFrame{"missing destination", "SUBSCRIBE needs a destination header"}
+	}
+	id, hasID := f.Header("id")
+	if !hasID {
+		if c.version != "1.0" {
+			return &errorFrame{"missing id", "SUBSCRIBE needs an id header"}
+		}
+		id = d
+	}
+	if _, ok := c.subs[id]; ok {
+		return &errorFrame{"duplicate subscription", id}
+	}
+	a := f.Value("ack")
+	switch a {
+	case "":
+		a = "auto"
+	case "auto", "client":
+	case "client-individual":
+		if c.version == "1.0" {
+			return &errorFrame{"bad ack mode", a}
+		}
+	default:
+		return &errorFrame{"bad ack mode", a}
+	}
+	s := &subscription{c: c, id: id, hasID: hasID, dest: c.b.destination(d), ack: a}
+	c.subs[id] = s
+	s.dest.subs = append(s.dest.subs, s)
+	c.b.dispatch(s.dest)
+	return nil
+}
+
+// unsubscribe handles UNSUBSCRIBE.  b.mu is held.
+func (c *conn) unsubscribe(f *Frame) *errorFrame {
+	id, ok := f.Header("id")
+	if !ok && c.version == "1.0" {
+		id, ok = f.Header("destination")
+	}
+	if !ok {
+		return &errorFrame{"missing id", "UNSUBSCRIBE needs an id header"}
+	}
+	s, ok := c.subs[id]
+	if !ok {
+		return &errorFrame{"unknown subscription", id}
+	}
+	c.drop(s)
+	return nil
+}
+
+// drop ends a subscription, requeuing its unacked messages.  b.mu is held.
+func (c *conn) drop(s *subscription) {
+	delete(c.subs, s.id)
+	d := s.dest
+	for i, ds := range d.subs {
+		if ds == s {
+			d.subs = append(d.subs[:i:i], d.subs[i+1:]...)
+			break
+		}
+	}
+	var ms []*message
+	for _, u := range s.unacked {
+		ms = append(ms, u.m)
+	}
+	s.unacked = nil
+	c.b.requeue(ms)
+}
+
+// transaction handles BEGIN, COMMIT and ABORT.  b.mu is held.
+func (c *conn) transaction(f *Frame) *errorFrame {
+	tx, ok := f.Header("transaction")
+	if !ok {
+		return &errorFrame{"missing transaction", f.Command + " needs a transaction header"}
+	}
+	fs, ok := c.txs[tx]
+	if f.Command == "BEGIN" {
+		if ok {
+			return &errorFrame{"duplicate transaction", tx}
+		}
+		c.txs[tx] = nil
+		return nil
+	}
+	if !ok {
+		return &errorFrame{"unknown transaction", tx}
+	}
+	delete(c.txs, tx)
+	if f.Command == "ABORT" {
+		return nil
+	}
+	for _, tf := range fs {
+		if ef := c.apply(tf); ef != nil {
+			return ef
+		}
+	}
+	return nil
+}
+
+// deliver sends a message to a subscriber.  b.mu is held.
+func (s *subscription) deliver(m *message) {
+	c := s.c
+	h := []string{"destination", m.dest, "message-id", m.id}
+	if s.hasID {
+		h = append(h, "subscription", s.id)
+	}
+	if s.ack != "auto" {
+		c.acks++
+		d := &delivery{m: m, ackID: c.session + "-" + strconv.Itoa(c.acks)}
+		s.unacked = append(s.unacked, d)
+		if c.version == "1.2" {
+			h = append(h, "ack", d.ackID)
+		}
+	}
+	c.b.stats.Delivered++
+	if m.redelivered {
+		h = append(h, "redelivered", "true")
+		c.b.stats.Redelivered++
+	}
+	h = append(h, m.headers...)
+	c.sendBody("MESSAGE", m.body, h...)
+	if m.redelivered {
+		return
+	}
+	for range c.b.inject(c, atDeliver, "MESSAGE", h) {
+		nm := *m
+		nm.redelivered = true
+		s.deliver(&nm)
+	}
+}
+
+// sendError sends an ERROR frame for a frame, possibly nil, and closes the
+// connection after it.  b.mu is held.
+func (c *conn) sendError(f *Frame, ef *errorFrame) {
+	h := []string{"message", ef.message}
+	if f != nil {
+		if rid, ok := f.Header("receipt"); ok {
+			h = append(h, "receipt-id", rid)
+		}
+	}
+	if ef.message == "unsupported protocol version" {
+		h = append(h, "version", strings.Join(c.b.o.Versions, ","))
+	}
+	h = append(h, "content-type", "text/plain")
+	c.b.stats.Errors++
+	c.b.logf("conn:%d error:%s detail:%s", c.id, ef.message, ef.detail)
+	c.sendBody("ERROR", []byte(ef.detail), h...)
+	c.finish()
+}
+
+// send queues a frame with no body.
+func (c *conn) send(cmd string, h ...string) {
+	c.sendBody(cmd, nil, h...)
+}
+
+// sendBody queues a frame, applying any faults.  b.mu is held.
+func (c *conn) sendBody(cmd string, body []byte, h ...string) {
+	of := outFrame{b: encode(c.version, cmd, h, body)}
+	for _, ft := range c.b.inject(c, atSend, cmd, h) {
+		switch ft.Action {
+		case Drop:
+			c.finish()
+			return
+		case Delay:
+			of.delay += ft.For
+		case Fail:
+			c.b.stats.Errors++
+			c.queue(outFrame{b: encode(c.version, "ERROR",
+				[]string{"message", ft.message(), "content-type", "text/plain"},
+				[]byte("injected for "+cmd))})
+			c.finish()
+			return
+		case Malformed:
+			of.b = malformedFrame(cmd)
+		case NoHeartbeat:
+			c.stopBeats()
+		}
+	}
+	c.queue(of)
+}
+
+// queue queues a frame to write.  Nothing is queued after finish.
+func (c *conn) queue(of outFrame) {
+	c.mu.Lock()
+	if !c.fin {
+		c.out = append(c.out, of)
+	}
+	c.mu.Unlock()
+	c.poke()
+}
+
+// stopBeats stops broker heartbeats.
+func (c *conn) stopBeats() {
+	c.mu.Lock()
+	c.noBeat = true
+	c.sendBeat = 0
+	c.mu.Unlock()
+	c.poke()
+}
+
+// wait waits for a delay, returning false if the connection closes first.
+func (c *conn) wait(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+// finish closes the connection once queued frames are written.
+func (c *conn) finish() {
+	c.mu.Lock()
+	c.fin = true
+	c.mu.Unlock()
+	c.poke()
+}
+
+func (c *conn) poke() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// writer writes queued frames and heartbeats.
+func (c *conn) writer() {
+	var tk *time.Ticker
+	var beat <-chan time.Time
+	defer func() {
+		if tk != nil {
+			tk.Stop()
+		}
+	}()
+	for {
+		c.mu.Lock()
+		q, fin, sb := c.out, c.fin, c.sendBeat
+		c.out = nil
+		c.mu.Unlock()
+		for _, of := range q {
+			if of.delay > 0 && !c.wait(of.delay) {
+				return
+			}
+			if _, e := c.n.Write(of.b); e != nil {
+				c.close()
+				return
+			}
+		}
+		if len(q) > 0 {
+			continue
+		}
+		if fin {
+			c.close()
+			return
+		}
+		if sb > 0 && tk == nil {
+			tk = time.NewTicker(sb)
+			beat = tk.C
+		}
+		if sb == 0 && tk != nil {
+			tk.Stop()
+			tk, beat = nil, nil
+		}
+		select {
+		case <-c.wake:
+		case <-c.done:
+			return
+		case <-beat:
+			if _, e := c.n.Write([]byte("\n")); e != nil {
+				c.close()
+				return
+			}
+		}
+	}
+}
+
+// close closes the network connection.
+func (c *conn) close() {
+	c.once.Do(func() {
+		close(c.done)
+		_ = c.n.Close()
+	})
+}
+
+// end cleans up after the reader ends.
+func (c *conn) end() {
+	c.b.mu.Lock()
+	delete(c.b.conns, c)
+	for _, s := range c.subs {
+		c.drop(s)
+	}
+	c.b.mu.Unlock()
+	c.mu.Lock()
+	fin := c.fin
+	c.mu.Unlock()
+	if !fin {
+		c.close()
+	}
+	// Else the writer closes after the last frame
+	<-c.done
+}
@@ -0,0 +1,238 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package testbroker
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Fault actions.
+const (
+	Drop        = "drop"        // Close the connection instead of the frame
+	Delay       = "delay"       // Hold the frame for Fault.For
+	Fail        = "error"       // An ERROR frame instead of the frame, then close
+	NoReceipt   = "noreceipt"   // No RECEIPT for a client frame
+	Malformed   = "malformed"   // Send a broker frame that does not parse
+	NoHeartbeat = "noheartbeat" // Stop sending heartbeats
+	Redeliver   = "redeliver"   // Deliver a MESSAGE again, as redelivered
+)
+
+// Where faults apply.
+const (
+	atReceive = iota // Client frames, as received
+	atSend           // Broker frames, as queued
+	atDeliver        // MESSAGE deliveries
+)
+
+// hooks are where each action applies.
+var hooks = map[string][]int{
+	Drop:        {atReceive, atSend},
+	Delay:       {atReceive, atSend},
+	Fail:        {atReceive, atSend},
+	NoReceipt:   {atReceive},
+	Malformed:   {atSend},
+	NoHeartbeat: {atReceive, atSend},
+	Redeliver:   {atDeliver},
+}
+
+/*
+Fault is a scripted broker misbehaviour.
+
+A fault matches frames with command Cmd and destination Dest, on the Conn'th
+connection accepted, each "" or 0 for any.  Client and broker commands
+differ, so Cmd also picks a direction; with no Cmd, frames both ways are
+matched.  The first After matching frames pass, then the fault applies to
+the next Count, 0 for all.  Counts are across connections.
+
+	drop        the connection is closed, once earlier broker frames are
+	            written, instead of handling or sending the frame
+	delay       the frame is held for For; later frames on the connection wait
+	error       an ERROR frame, with Message, replaces the frame, and the
+	            connection is closed
+	noreceipt   a client frame with a receipt header gets no RECEIPT; after
+	            a DISCONNECT the connection stays open, until the client
+	            closes it
+	malformed   a broker frame is sent with a header line that does not parse
+	noheartbeat the broker stops sending heartbeats on the connection
+	redeliver   a MESSAGE is delivered a second time, redelivered:true
+*/
+type Fault struct {
+	Action  string
+	Cmd     string
+	Dest    string
+	Conn    int
+	After   int
+	Count   int
+	For     time.Duration // For delay
+	Message string        // For error, default "injected fault"
+}
+
+// A fault in use.
+type fault struct {
+	Fault
+	seen int // Matching frames
+}
+
+/*
+ParseFaults parses a fault script.  Each line is an action, then key=value
+settings: cmd, dest, conn, after, count, for and message.  Blank lines, and
+text after #, are ignored.
+
+	# Two messages, then the connection drops
+	drop cmd=MESSAGE after=2
+	delay cmd=RECEIPT for=200ms
+	error cmd=SUBSCRIBE dest=/queue/secret message=access_refused
+	redeliver dest=/queue/q after=4 count=1
+*/
+func ParseFaults(script string) ([]Fault, error) {
+	var r []Fault
+	for i, l := range strings.Split(script, "\n") {
+		if j := strings.Index(l, "#"); j >= 0 {
+			l = l[:j]
+		}
+		w := strings.Fields(l)
+		if len(w) == 0 {
+			continue
+		}
+		f, e := parseFault(w)
+		if e != nil {
+			return nil, fmt.Errorf("fault line %d %q: %v", i+1, strings.TrimSpace(l), e)
+		}
+		r = append(r, f)
+	}
+	return r, nil
+}
+
+// parseFault parses the words of one script line.
+func parseFault(w []string) (Fault, error) {
+	f := Fault{Action: w[0]}
+	if _, ok := hooks[f.Action]; !ok {
+		return f, fmt.Errorf("unknown action %q", f.Action)
+	}
+	for _, kv := range w[1:] {
+		p := strings.SplitN(kv, "=", 2)
+		if len(p) != 2 {
+			return f, fmt.Errorf("expected key=value, got %q", kv)
+		}
+		var e error
+		switch p[0] {
+		case "cmd":
+			f.Cmd = strings.ToUpper(p[1])
+		case "dest":
+			f.Dest = p[1]
+		case "conn":
+			f.Conn, e = count(p[1])
+		case "after":
+			f.After, e = count(p[1])
+		case "count":
+			f.Count, e = count(p[1])
+		case "for":
+			f.For, e = time.ParseDuration(p[1])
+		case "message":
+			f.Message = p[1]
+		default:
+			e = fmt.Errorf("unknown key %q", p[0])
+		}
+		if e != nil {
+			return f, e
+		}
+	}
+	if f.Action == Delay && f.For <= 0 {
+		return f, fmt.Errorf("delay needs a positive for")
+	}
+	return f, nil
+}
+
+// count parses a non-negative integer.
+func count(s string) (int, error) {
+	n, e := strconv.Atoi(s)
+	if e == nil && n < 0 {
+		e = fmt.Errorf("negative count %d", n)
+	}
+	return n, e
+}
+
+/*
+SetFaults replaces the faults, e.g. once a test is set up.  Frame counts
+start again.
+*/
+func (b *Broker) SetFaults(fs ...Fault) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.faults = nil
+	for _, f := range fs {
+		b.faults = append(b.faults, &fault{Fault: f})
+	}
+}
+
+// inject returns the faults that apply to a frame at a hook, and counts
+// them.  b.mu is held.
+func (b *Broker) inject(c *conn, hook int, cmd string, h []string) []Fault {
+	var r []Fault
+	for _, f := range b.faults {
+		if !f.at(hook) || !f.matches(c, cmd, h) {
+			continue
+		}
+		f.seen++
+		if f.seen <= f.After || f.Count > 0 && f.seen > f.After+f.Count {
+			continue
+		}
+		b.stats.Faults++
+		b.logf("conn:%d fault:%s frame:%s seen:%d", c.id, f.Action, cmd, f.seen)
+		r = append(r, f.Fault)
+	}
+	return r
+}
+
+// at returns whether a fault applies at a hook.
+func (f *fault) at(hook int) bool {
+	for _, k := range hooks[f.Action] {
+		if k == hook {
+			return true
+		}
+	}
+	return false
+}
+
+// matches returns whether a frame matches a fault.
+func (f *fault) matches(c *conn, cmd string, h []string) bool {
+	fr := Frame{Command: cmd, Headers: h}
+	if f.Action == NoReceipt {
+		if _, ok := fr.Header("receipt"); !ok {
+			return false
+		}
+	}
+	return (f.Cmd == "" || f.Cmd == cmd) &&
+		(f.Dest == "" || f.Dest == fr.Value("destination")) &&
+		(f.Conn == 0 || f.Conn == c.num)
+}
+
+// message returns the ERROR message header for a fault.
+func (f Fault) message() string {
+	if f.Message == "" {
+		return "injected fault"
+	}
+	return f.Message
+}
+
+// malformedFrame returns a frame with a header line that has no colon.
+func malformedFrame(cmd string) []byte {
+	return []byte(cmd + "\nno header here\n\n\x00")
+}
@@ -0,0 +1,186 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package testbroker
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rawFrames writes frames to b, and returns the frames read back until the
+// connection closes: commands, with the first header of RECEIPT and ERROR
+// frames.
+func rawFrames(t *testing.T, b *Broker, frames ...string) string {
+	n, e := net.Dial("tcp", b.Addr())
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer n.Close()
+	for _, f := range frames {
+		_, _ = n.Write([]byte(f + "\x00"))
+	}
+	_ = n.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var r []string
+	br := bufio.NewReader(n)
+	for {
+		f, e := br.ReadString(0)
+		if e != nil {
+			return strings.Join(r, "|")
+		}
+		l := strings.Split(strings.TrimLeft(f, "\n"), "\n")
+		r = append(r, l[0])
+		if l[0] == "RECEIPT" || l[0] == "ERROR" {
+			r = append(r, l[1])
+		}
+	}
+}
+
+/*
+Test fault script parsing.
+*/
+func TestParseFaults(t *testing.T) {
+	fs, e := ParseFaults(`
+		# Comment
+		drop cmd=message after=2    # Two messages
+		delay cmd=RECEIPT for=200ms count=1
+
+		error dest=/queue/q conn=2 message=refused
+		noreceipt
+		`)
+	if e != nil {
+		t.Fatalf("ParseFaults, expected no error, got [%v]\n", e)
+	}
+	want := []Fault{
+		{Action: Drop, Cmd: "MESSAGE", After: 2},
+		{Action: Delay, Cmd: "RECEIPT", For: 200 * time.Millisecond, Count: 1},
+		{Action: Fail, Dest: "/queue/q", Conn: 2, Message: "refused"},
+		{Action: NoReceipt},
+	}
+	if !reflect.DeepEqual(fs, want) {
+		t.Errorf("ParseFaults, expected [%+v], got [%+v]\n", want, fs)
+	}
+	for _, s := range []string{"fly", "drop cmd", "drop after=-1", "drop count=x",
+		"drop size=3", "delay", "delay for=soon", "noheartbeat\nredeliver after=1 x"} {
+		if _, e := ParseFaults(s); e == nil {
+			t.Errorf("%q, expected an error\n", s)
+		}
+	}
+}
+
+/*
+Test each fault action.
+*/
+func TestFaults(t *testing.T) {
+	cf := "CONNECT\naccept-version:1.2\n\n"
+	send := func(d, h string) string {
+		return "SEND\ndestination:" + d + "\n" + h + "\nbody"
+	}
+	sub := "SUBSCRIBE\ndestination:/queue/q\nid:s1\n\n"
+	bye := "DISCONNECT\nreceipt:bye\n\n"
+	tests := []struct {
+		script string
+		frames []string
+		want   string
+	}{
+		{"drop cmd=SUBSCRIBE", []string{cf, send("/queue/q", ""), sub, bye},
+			"CONNECTED"},
+		{"drop cmd=MESSAGE after=1", []string{cf, send("/queue/q", ""),
+			send("/queue/q", ""), sub, bye}, "CONNECTED|MESSAGE"},
+		{"error cmd=SEND dest=/queue/bad message=refused", []string{cf,
+			send("/queue/q", "receipt:r1\n"), send("/queue/bad", "receipt:r2\n"), bye},
+			"CONNECTED|RECEIPT|receipt-id:r1|ERROR|message:refused"},
+		{"error cmd=MESSAGE", []string{cf, send("/queue/q", ""), sub, bye},
+			"CONNECTED|ERROR|message:injected fault"},
+		{"noreceipt cmd=SEND count=1", []string{cf, send("/queue/q", "receipt:r1\n"),
+			send("/queue/q", "receipt:r2\n"), bye},
+			"CONNECTED|RECEIPT|receipt-id:r2|RECEIPT|receipt-id:bye"},
+		{"malformed cmd=RECEIPT", []string{cf, bye},
+			"CONNECTED|RECEIPT|no header here"},
+		{"redeliver dest=/queue/q count=1", []string{cf, send("/queue/q", ""),
+			send("/queue/q", ""), sub, bye},
+			"CONNECTED|MESSAGE|MESSAGE|MESSAGE|RECEIPT|receipt-id:bye"},
+		{"drop conn=2", []string{cf, bye}, "CONNECTED|RECEIPT|receipt-id:bye"},
+	}
+	for _, tc := range tests {
+		fs, e := ParseFaults(tc.script)
+		if e != nil {
+			t.Fatal(e)
+		}
+		b, e := Start(Options{Faults: fs})
+		if e != nil {
+			t.Fatal(e)
+		}
+		if got := rawFrames(t, b, tc.frames...); got != tc.want {
+			t.Errorf("%q, expected [%s], got [%s]\n", tc.script, tc.want, got)
+		}
+		s := b.Stats()
+		if s.Faults != 1 && !strings.HasPrefix(tc.script, "drop conn") {
+			t.Errorf("%q, expected 1 fault applied, got [%+v]\n", tc.script, s)
+		}
+		if strings.HasPrefix(tc.script, "redeliver") && s.Redelivered != 1 {
+			t.Errorf("%q, expected 1 redelivery, got [%+v]\n", tc.script, s)
+		}
+		if strings.HasPrefix(tc.script, "drop conn") {
+			// The second connection is dropped as it connects
+			if got := rawFrames(t, b, cf); got != "" {
+				t.Errorf("%q, expected no frames, got [%s]\n", tc.script, got)
+			}
+		}
+		b.Close()
+	}
+}
+
+/*
+Test delays, and stopped heartbeats.
+*/
+func TestFaultTiming(t *testing.T) {
+	fs, e := ParseFaults("delay cmd=RECEIPT for=200ms\nnoheartbeat cmd=CONNECTED")
+	if e != nil {
+		t.Fatal(e)
+	}
+	b, e := Start(Options{HeartBeats: "20,20", Faults: fs})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer b.Close()
+	st := time.Now()
+	got := rawFrames(t, b, "CONNECT\naccept-version:1.2\nheart-beat:0,20\n\n",
+		"DISCONNECT\nreceipt:bye\n\n")
+	if got != "CONNECTED|RECEIPT|receipt-id:bye" || time.Since(st) < 200*time.Millisecond {
+		t.Errorf("delay, got [%s] after %v\n", got, time.Since(st))
+	}
+	// No heartbeat arrives
+	n, e := net.Dial("tcp", b.Addr())
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer n.Close()
+	_, _ = n.Write([]byte("CONNECT\naccept-version:1.2\nheart-beat:0,20\n\n\x00"))
+	br := bufio.NewReader(n)
+	_ = n.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, e = br.ReadString(0); e != nil {
+		t.Fatal(e)
+	}
+	_ = n.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if hb, e := br.ReadByte(); e == nil {
+		t.Errorf("noheartbeat, expected no heartbeat, got [%q]\n", hb)
+	}
+}
@@ -0,0 +1,184 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package testbroker
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Frame is a STOMP frame, as received by the broker.  Headers are key,
+// value pairs, decoded, in wire order.
+type Frame struct {
+	Command string
+	Headers []string
+	Body    []byte
+}
+
+// Header returns the first value of a header, and whether it is present.
+func (f *Frame) Header(k string) (string, bool) {
+	for i := 0; i+1 < len(f.Headers); i += 2 {
+		if f.Headers[i] == k {
+			return f.Headers[i+1], true
+		}
+	}
+	return "", false
+}
+
+// Value returns the first value of a header, or "".
+func (f *Frame) Value(k string) string {
+	v, _ := f.Header(k)
+	return v
+}
+
+// escapes are the STOMP 1.1 header escapes, and the 1.2 addition.
+var (
+	escapes11 = strings.NewReplacer("\\", "\\\\", "\n", "\\n", ":", "\\c")
+	escapes12 = strings.NewReplacer("\\", "\\\\", "\n", "\\n", ":", "\\c", "\r", "\\r")
+)
+
+// malformed is a frame that does not parse.
+type malformed struct{ error }
+
+func malformedf(f string, a ...interface{}) error {
+	return malformed{fmt.Errorf(f, a...)}
+}
+
+// unescape decodes a header value.  An undefined escape is an error.
+func unescape(s, v string) (string, error) {
+	if v == "1.0" || !strings.Contains(s, "\\") {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i++; i == len(s) {
+			return "", malformedf("bad header escape in %q", s)
+		}
+		switch s[i] {
+		case '\\':
+			b.WriteByte('\\')
+		case 'n':
+			b.WriteByte('\n')
+		case 'c':
+			b.WriteByte(':')
+		case 'r':
+			if v == "1.1" {
+				return "", malformedf("bad header escape in %q", s)
+			}
+			b.WriteByte('\r')
+		default:
+			return "", malformedf("bad header escape in %q", s)
+		}
+	}
+	return b.String(), nil
+}
+
+// encode returns the wire form of a frame for a protocol version.  The
+// CONNECTED frame headers are not escaped.
+func encode(v, cmd string, h []string, body []byte) []byte {
+	var b bytes.Buffer
+	b.WriteString(cmd + "\n")
+	for i := 0; i+1 < len(h); i += 2 {
+		k, hv := h[i], h[i+1]
+		switch {
+		case cmd == "CONNECTED" || v == "1.0":
+		case v == "1.1":
+			k, hv = escapes11.Replace(k), escapes11.Replace(hv)
+		default:
+			k, hv = escapes12.Replace(k), escapes12.Replace(hv)
+		}
+		b.WriteString(k + ":" + hv + "\n")
+	}
+	if len(body) > 0 {
+		b.WriteString("content-length:" + strconv.Itoa(len(body)) + "\n")
+	}
+	b.WriteString("\n")
+	b.Write(body)
+	b.WriteByte(0)
+	return b.Bytes()
+}
+
+/*
+readFrame reads a frame for a protocol version, "" before CONNECT.  EOLs
+before the frame are heartbeats, and call beat.  CONNECT and STOMP headers
+are not unescaped.
+*/
+func readFrame(r *bufio.Reader, v string, beat func()) (*Frame, error) {
+	var cmd string
+	for {
+		l, e := r.ReadString('\n')
+		if e != nil {
+			return nil, e
+		}
+		if cmd = strings.TrimSuffix(strings.TrimSuffix(l, "\n"), "\r"); cmd != "" {
+			break
+		}
+		beat()
+	}
+	f := &Frame{Command: cmd}
+	raw := cmd == "CONNECT" || cmd == "STOMP"
+	for {
+		l, e := r.ReadString('\n')
+		if e != nil {
+			return nil, e
+		}
+		if l = strings.TrimSuffix(strings.TrimSuffix(l, "\n"), "\r"); l == "" {
+			break
+		}
+		kv := strings.SplitN(l, ":", 2)
+		if len(kv) != 2 {
+			return nil, malformedf("bad header line %q", l)
+		}
+		if !raw {
+			for i := range kv {
+				if kv[i], e = unescape(kv[i], v); e != nil {
+					return nil, e
+				}
+			}
+		}
+		f.Headers = append(f.Headers, kv[0], kv[1])
+	}
+	if cl, ok := f.Header("content-length"); ok {
+		n, e := strconv.Atoi(cl)
+		if e != nil || n < 0 {
+			return nil, malformedf("bad content-length %q", cl)
+		}
+		f.Body = make([]byte, n+1)
+		if _, e = io.ReadFull(r, f.Body); e != nil {
+			return nil, e
+		}
+		if f.Body[n] != 0 {
+			return nil, malformedf("no NUL after %d content-length bytes", n)
+		}
+		f.Body = f.Body[:n]
+		return f, nil
+	}
+	b, e := r.ReadBytes(0)
+	if e != nil {
+		return nil, e
+	}
+	f.Body = b[:len(b)-1]
+	return f, nil
+}
@@ -0,0 +1,428 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package sngecomm
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PKIOptions are the settings for GeneratePKI.
+type PKIOptions struct {
+	Hosts   []string  // Broker DNS names and IP addresses, default localhost, 127.0.0.1, ::1
+	Clients []string  // Client common names, default client
+	Days    int       // Validity, default 365
+	KeyType string    // rsa (2048 bit, the default) or ecdsa (P-256)
+	Now     time.Time // Validity start, default the current time
+}
+
+/*
+PKI is a throwaway test PKI for the TLS examples: a CA, a broker certificate
+and client certificates signed by it, and deliberately bad variants.
+
+Bad holds, by name:
+
+	expired-broker    broker certificate that has expired
+	wronghost-broker  broker certificate for wrong.invalid only
+	wrongca-broker    broker certificate signed by WrongCA
+	expired-client    client certificate that has expired
+	wrongca-client    client certificate signed by WrongCA
+*/
+type PKI struct {
+	CA         *x509.Certificate
+	CAKey      crypto.Signer
+	WrongCA    *x509.Certificate
+	WrongCAKey crypto.Signer
+	Broker     tls.Certificate
+	Clients    map[string]tls.Certificate
+	Bad        map[string]tls.Certificate
+	opts       PKIOptions
+}
+
+// pkiIssuer is a signing CA.
+type pkiIssuer struct {
+	x *x509.Certificate
+	k crypto.Signer
+}
+
+// GeneratePKI generates a test PKI in memory.  See PKI.Write.
+func GeneratePKI(o PKIOptions) (*PKI, error) {
+	if len(o.Hosts) == 0 {
+		o.Hosts = []string{"localhost", "127.0.0.1", "::1"}
+	}
+	if len(o.Clients) == 0 {
+		o.Clients = []string{"client"}
+	}
+	if o.Days <= 0 {
+		o.Days = 365
+	}
+	if o.KeyType == "" {
+		o.KeyType = "rsa"
+	}
+	if o.Now.IsZero() {
+		o.Now = time.Now()
+	}
+	p := &PKI{Clients: map[string]tls.Certificate{}, Bad: map[string]tls.Certificate{},
+		opts: o}
+	ca, e := o.newCA("stompngo_examples test CA")
+	if e != nil {
+		return nil, e
+	}
+	wca, e := o.newCA("stompngo_examples wrong CA")
+	if e != nil {
+		return nil, e
+	}
+	p.CA, p.CAKey, p.WrongCA, p.WrongCAKey = ca.x, ca.k, wca.x, wca.k
+	//
+	valid := o.Now.Add(time.Duration(o.Days) * 24 * time.Hour)
+	expired := o.Now.Add(-24 * time.Hour)
+	if p.Broker, e = o.newLeaf(ca, o.Hosts, false, valid); e != nil {
+		return nil, e
+	}
+	for _, c := range o.Clients {
+		if p.Clients[c], e = o.newLeaf(ca, []string{c}, true, valid); e != nil {
+			return nil, e
+		}
+	}
+	bad := []struct {
+		n      string
+		ca     pkiIssuer
+		names  []string
+		client bool
+		na     time.Time
+	}{
+		{"expired-broker", ca, o.Hosts, false, expired},
+		{"wronghost-broker", ca, []string{"wrong.invalid"}, false, valid},
+		{"wrongca-broker", wca, o.Hosts, false, valid},
+		{"expired-client", ca, o.Clients[:1], true, expired},
+		{"wrongca-client", wca, o.Clients[:1], true, valid},
+	}
+	for _, b := range bad {
+		if p.Bad[b.n], e = o.newLeaf(b.ca, b.names, b.client, b.na); e != nil {
+			return nil, e
+		}
+	}
+	return p, nil
+}
+
+// newKey returns a new private key of the configured type.
+func (o *PKIOptions) newKey() (crypto.Signer, error) {
+	switch strings.ToLower(o.KeyType) {
+	case "rsa":
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case "ecdsa", "ec":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	return nil, fmt.Errorf("unknown key type %q, expected rsa or ecdsa", o.KeyType)
+}
+
+// template returns a certificate template with a random serial number.
+func (o *PKIOptions) template(cn string, na time.Time) (*x509.Certificate, error) {
+	sn, e := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if e != nil {
+		return nil, e
+	}
+	nb := o.Now.Add(-time.Hour)
+	if na.Before(o.Now) {
+		nb = na.Add(-time.Duration(o.Days) * 24 * time.Hour) // Expired
+	}
+	return &x509.Certificate{SerialNumber: sn,
+		Subject:   pkix.Name{CommonName: cn, Organization: []string{"stompngo_examples"}},
+		NotBefore: nb, NotAfter: na}, nil
+}
+
+// newCA returns a self signed CA.
+func (o *PKIOptions) newCA(cn string) (pkiIssuer, error) {
+	var ca pkiIssuer
+	k, e := o.newKey()
+	if e != nil {
+		return ca, e
+	}
+	t, e := o.template(cn, o.Now.Add(time.Duration(o.Days)*24*time.Hour))
+	if e != nil {
+		return ca, e
+	}
+	t.IsCA, t.BasicConstraintsValid = true, true
+	t.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	if t.SubjectKeyId, e = keyID(k.Public()); e != nil {
+		return ca, e
+	}
+	d, e := x509.CreateCertificate(rand.Reader, t, t, k.Public(), k)
+	if e != nil {
+		return ca, e
+	}
+	ca.x, e = x509.ParseCertificate(d)
+	ca.k = k
+	return ca, e
+}
+
+// newLeaf returns a broker (server) or client certificate, valid until na.
+// Broker names are DNS names or IP addresses, the first is the common name.
+func (o *PKIOptions) newLeaf(ca pkiIssuer, names []string, client bool,
+	na time.Time) (tls.Certificate, error) {
+	var c tls.Certificate
+	k, e := o.newKey()
+	if e != nil {
+		return c, e
+	}
+	t, e := o.template(names[0], na)
+	if e != nil {
+		return c, e
+	}
+	t.KeyUsage = x509.KeyUsageDigitalSignature
+	if _, ok := k.(*rsa.PrivateKey); ok {
+		t.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	t.BasicConstraintsValid = true
+	if client {
+		t.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	} else {
+		t.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		for _, n := range names {
+			if ip := net.ParseIP(n); ip != nil {
+				t.IPAddresses = append(t.IPAddresses, ip)
+			} else {
+				t.DNSNames = append(t.DNSNames, n)
+			}
+		}
+	}
+	d, e := x509.CreateCertificate(rand.Reader, t, ca.x, k.Public(), ca.k)
+	if e != nil {
+		return c, e
+	}
+	c.Certificate = [][]byte{d, ca.x.Raw}
+	c.PrivateKey = k
+	c.Leaf, e = x509.ParseCertificate(d)
+	return c, e
+}
+
+// keyID is the RFC 5280 method 1 key identifier.
+func keyID(pub crypto.PublicKey) ([]byte, error) {
+	b, e := x509.MarshalPKIXPublicKey(pub)
+	if e != nil {
+		return nil, e
+	}
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		Key       asn1.BitString
+	}
+	if _, e = asn1.Unmarshal(b, &spki); e != nil {
+		return nil, e
+	}
+	h := sha1.Sum(spki.Key.Bytes)
+	return h[:], nil
+}
+
+// Pool returns a certificate pool holding the CA.
+func (p *PKI) Pool() *x509.CertPool {
+	cp := x509.NewCertPool()
+	cp.AddCert(p.CA)
+	return cp
+}
+
+/*
+Write writes the PKI to a directory, laid out for the TLS examples and for
+broker keystores.  Keystores are PKCS#12, protected by password.
+
+	ca.crt ca.key                 the test CA
+	broker.crt broker.key         broker certificate (with the CA) and key
+	broker.p12                    broker keystore
+	truststore.p12                broker truststore with the CA, alias ca, to
+	                              require client certificates (subcase B)
+	<client>.crt .key .p12        client certificates
+	bad/wrongca.crt               the wrong CA
+	bad/<name>.crt .key .p12      the bad certificates, see PKI
+	tlsuc1.env ... tlsuc4.env     STOMP_TLS_* settings for each use case
+	README.txt                    how to use it all
+
+Private key files are mode 0600.
+*/
+func (p *PKI) Write(dir, password string) error {
+	dir, e := filepath.Abs(dir)
+	if e != nil {
+		return e
+	}
+	if e = os.MkdirAll(filepath.Join(dir, "bad"), 0755); e != nil {
+		return e
+	}
+	w := func(n string, b []byte, m os.FileMode) {
+		if e == nil {
+			e = ioutil.WriteFile(filepath.Join(dir, n), b, m)
+		}
+	}
+	w("ca.crt", certPEM(p.CA.Raw), 0644)
+	kp, ke := keyPEM(p.CAKey)
+	if ke != nil {
+		return ke
+	}
+	w("ca.key", kp, 0600)
+	w(filepath.Join("bad", "wrongca.crt"), certPEM(p.WrongCA.Raw), 0644)
+	leaves := map[string]tls.Certificate{"broker": p.Broker}
+	for n, c := range p.Clients {
+		leaves[n] = c
+	}
+	for n, c := range p.Bad {
+		leaves[filepath.Join("bad", n)] = c
+	}
+	for n, c := range leaves {
+		kp, ke := keyPEM(c.PrivateKey.(crypto.Signer))
+		if ke != nil {
+			return ke
+		}
+		ks, ke := EncodePKCS12(c, password)
+		if ke != nil {
+			return ke
+		}
+		w(n+".crt", append(certPEM(c.Certificate[0]), certPEM(c.Certificate[1])...), 0644)
+		w(n+".key", kp, 0600)
+		w(n+".p12", ks, 0600)
+	}
+	ts, te := EncodePKCS12Trust([]*x509.Certificate{p.CA}, "ca", password)
+	if te != nil {
+		return te
+	}
+	w("truststore.p12", ts, 0644)
+	//
+	client := p.opts.Clients[0]
+	f := func(n string) string { return filepath.Join(dir, n) }
+	envs := []struct {
+		n, doc string
+		kv     []string
+	}{
+		{"tlsuc1", "client does not authenticate the broker, sends no certificate",
+			nil},
+		{"tlsuc2", "client authenticates the broker, sends no certificate",
+			[]string{"STOMP_TLS_CAFILE", f("ca.crt")}},
+		{"tlsuc3", "client does not authenticate the broker, sends a certificate",
+			[]string{"STOMP_TLS_CERTFILE", f(client + ".crt"),
+				"STOMP_TLS_KEYFILE", f(client + ".key")}},
+		{"tlsuc4", "client authenticates the broker, sends a certificate",
+			[]string{"STOMP_TLS_CAFILE", f("ca.crt"),
+				"STOMP_TLS_CERTFILE", f(client + ".crt"),
+				"STOMP_TLS_KEYFILE", f(client + ".key")}},
+	}
+	for _, v := range envs {
+		s := fmt.Sprintf("# %s: %s\n# Use: . %s\n", v.n, v.doc, f(v.n+".env"))
+		for i := 0; i < len(v.kv); i += 2 {
+			s += fmt.Sprintf("export %s=%s\n", v.kv[i], v.kv[i+1])
+		}
+		w(v.n+".env", []byte(s), 0644)
+	}
+	w("README.txt", []byte(p.readme(dir, client)), 0644)
+	return e
+}
+
+// readme describes a written PKI.
+func (p *PKI) readme(dir, client string) string {
+	var bad []string
+	for n := range p.Bad {
+		bad = append(bad, n)
+	}
+	sort.Strings(bad)
+	return fmt.Sprintf(`Throwaway test PKI for the stompngo_examples TLS examples.  Do not use it
+for anything else.  Generated %s, valid %d days.
+
+Broker names: %s
+Clients:      %s
+CA:           %s
+
+Broker configuration
+--------------------
+
+Configure an SSL/TLS listener with keystore broker.p12 (PKCS12), or
+broker.crt and broker.key.
+
+  Subcase A: the broker does not require client certificates.
+  Subcase B: the broker requires client certificates, and trusts
+             truststore.p12 (PKCS12, alias ca), or ca.crt.
+
+For ActiveMQ, e.g. for subcase B:
+
+  <sslContext>
+    <sslContext keyStore="%s" keyStorePassword="..." keyStoreType="PKCS12"
+        trustStore="%s" trustStorePassword="..." trustStoreType="PKCS12"/>
+  </sslContext>
+  <transportConnector name="stomp+ssl"
+      uri="stomp+ssl://0.0.0.0:61612?needClientAuth=true"/>
+
+Running the examples
+--------------------
+
+  . %s/tlsuc2.env
+  STOMP_PORT=61612 go run tlsexamps/tlsuc2/tlsuc2.go
+
+  Use case  Subcase A  Subcase B
+  tlsuc1    connects   fails, no client certificate
+  tlsuc2    connects   fails, no client certificate
+  tlsuc3    connects   connects
+  tlsuc4    connects   connects
+
+Bad certificates
+----------------
+
+In bad/: %s.
+
+  Broker using           tlsuc1, tlsuc3  tlsuc2, tlsuc4
+  expired-broker         connects        fails, expired
+  wronghost-broker       connects        fails, wrong host name
+  wrongca-broker         connects        fails, unknown authority
+
+  Client using (subcase B, tlsuc3 or tlsuc4)
+  expired-client         broker rejects it, expired
+  wrongca-client         broker rejects it, unknown authority.  Go clients
+                         do not send it, as the broker does not list its CA.
+
+To use a bad client certificate, set STOMP_TLS_CERTFILE and
+STOMP_TLS_KEYFILE to its .crt and .key files.
+`, p.opts.Now.UTC().Format(time.RFC3339), p.opts.Days,
+		strings.Join(p.opts.Hosts, ", "), strings.Join(p.opts.Clients, ", "),
+		p.CA.Subject.CommonName,
+		filepath.Join(dir, "broker.p12"), filepath.Join(dir, "truststore.p12"),
+		dir, strings.Join(bad, ", "))
+}
+
+// certPEM returns a PEM certificate.
+func certPEM(d []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: d})
+}
+
+// keyPEM returns a PEM PKCS#8 private key.
+func keyPEM(k crypto.Signer) ([]byte, error) {
+	d, e := x509.MarshalPKCS8PrivateKey(k)
+	if e != nil {
+		return nil, e
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: d}), nil
+}
@@ -0,0 +1,184 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package sngecomm
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// pkiHandshake runs a handshake between a broker and a client config,
+// returning both errors if either fails.
+func pkiHandshake(t *testing.T, sc, cc *tls.Config) error {
+	l, e := tls.Listen("tcp", "127.0.0.1:0", sc)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer l.Close()
+	se := make(chan error, 1)
+	go func() {
+		s, e := l.Accept()
+		if e != nil {
+			se <- e
+			return
+		}
+		defer s.Close()
+		se <- s.(*tls.Conn).Handshake()
+	}()
+	n, e := net.Dial("tcp", l.Addr().String())
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer n.Close()
+	c := tls.Client(n, cc)
+	if e = c.Handshake(); e == nil {
+		// TLS 1.3 client certificate failures arrive after the handshake
+		if _, e = c.Read(make([]byte, 1)); e == io.EOF {
+			e = nil
+		}
+	}
+	if s := <-se; e != nil || s != nil {
+		return fmt.Errorf("client: %v, broker: %v", e, s)
+	}
+	return nil
+}
+
+/*
+Test the generated PKI in each use case, subcase B (the broker requires a
+client certificate), with the bad variants.
+*/
+func TestPKIUseCases(t *testing.T) {
+	p, e := GeneratePKI(PKIOptions{KeyType: "ecdsa", Clients: []string{"alice"}})
+	if e != nil {
+		t.Fatal(e)
+	}
+	broker := func(c tls.Certificate) *tls.Config {
+		return &tls.Config{Certificates: []tls.Certificate{c}, ClientCAs: p.Pool(),
+			ClientAuth: tls.RequireAndVerifyClientCert}
+	}
+	client := func(verify bool, c ...tls.Certificate) *tls.Config {
+		cc := &tls.Config{ServerName: "localhost", Certificates: c,
+			InsecureSkipVerify: !verify}
+		if verify {
+			cc.RootCAs = p.Pool()
+		}
+		return cc
+	}
+	alice := p.Clients["alice"]
+	tests := []struct {
+		n    string
+		b, c *tls.Config
+		fail string
+	}{
+		{"tlsuc1", broker(p.Broker), client(false), "certificate"},
+		{"tlsuc2", broker(p.Broker), client(true), "certificate"},
+		{"tlsuc3", broker(p.Broker), client(false, alice), ""},
+		{"tlsuc4", broker(p.Broker), client(true, alice), ""},
+		{"tlsuc3 expired-broker", broker(p.Bad["expired-broker"]), client(false, alice), ""},
+		{"tlsuc4 expired-broker", broker(p.Bad["expired-broker"]), client(true, alice), "expired"},
+		{"tlsuc4 wronghost-broker", broker(p.Bad["wronghost-broker"]), client(true, alice),
+			"localhost"},
+		{"tlsuc4 wrongca-broker", broker(p.Bad["wrongca-broker"]), client(true, alice),
+			"unknown authority"},
+		{"tlsuc4 expired-client", broker(p.Broker), client(true, p.Bad["expired-client"]),
+			"expired"},
+		// Not sent, the broker does not list the wrong CA as acceptable
+		{"tlsuc4 wrongca-client", broker(p.Broker), client(true, p.Bad["wrongca-client"]),
+			"didn't provide a certificate"},
+	}
+	for _, tc := range tests {
+		e := pkiHandshake(t, tc.b, tc.c)
+		switch {
+		case tc.fail == "" && e != nil:
+			t.Errorf("%s, expected success, got [%v]\n", tc.n, e)
+		case tc.fail != "" && (e == nil || !strings.Contains(e.Error(), tc.fail)):
+			t.Errorf("%s, expected [%s] failure, got [%v]\n", tc.n, tc.fail, e)
+		}
+	}
+}
+
+/*
+Test the PKI file layout, and the PKCS#12 keystores.
+*/
+func TestPKIWrite(t *testing.T) {
+	p, e := GeneratePKI(PKIOptions{KeyType: "ecdsa", Hosts: []string{"broker.example"}})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, e = GeneratePKI(PKIOptions{KeyType: "dsa"}); e == nil {
+		t.Error("GeneratePKI dsa, expected an error")
+	}
+	d, e := ioutil.TempDir("", "sngecomm")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(d)
+	if e = p.Write(d, "changeit"); e != nil {
+		t.Fatalf("Write, expected no error, got [%v]\n", e)
+	}
+	for _, n := range []string{"broker", "client", "bad/expired-broker", "bad/wrongca-client"} {
+		fn := filepath.Join(d, n)
+		if _, e = tls.LoadX509KeyPair(fn+".crt", fn+".key"); e != nil {
+			t.Errorf("%s, expected a key pair, got [%v]\n", n, e)
+		}
+		ks, e := ioutil.ReadFile(fn + ".p12")
+		if e != nil {
+			t.Fatal(e)
+		}
+		c, e := DecodePKCS12(ks, "changeit")
+		if e != nil || len(c.Certificate) != 2 {
+			t.Errorf("%s.p12, expected the certificate and CA, got [%v]\n", n, e)
+		}
+	}
+	if fi, e := os.Stat(filepath.Join(d, "ca.key")); e != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("ca.key, expected mode 0600, got [%v]\n", e)
+	}
+	ts, e := ioutil.ReadFile(filepath.Join(d, "truststore.p12"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if cs, e := pkcs12.DecodeTrustStore(ts, "changeit"); e != nil || len(cs) != 1 ||
+		!cs[0].Equal(p.CA) {
+		t.Errorf("truststore.p12, expected the CA, got [%v]\n", e)
+	}
+	//
+	defer setTestEnv("STOMP_TLS_CAFILE", filepath.Join(d, "ca.crt"),
+		"STOMP_TLS_CERTFILE", filepath.Join(d, "client.crt"),
+		"STOMP_TLS_KEYFILE", filepath.Join(d, "client.key"))()
+	env, e := ioutil.ReadFile(filepath.Join(d, "tlsuc4.env"))
+	if e != nil || !strings.Contains(string(env),
+		"export STOMP_TLS_CAFILE="+filepath.Join(d, "ca.crt")) {
+		t.Errorf("tlsuc4.env, got [%s] [%v]\n", env, e)
+	}
+	c, e := TLSConfigFromEnv()
+	if e != nil || c.RootCAs == nil || len(c.Certificates) != 1 {
+		t.Fatalf("TLSConfigFromEnv, got [%v]\n", e)
+	}
+	c.ServerName = "broker.example"
+	if e = pkiHandshake(t, &tls.Config{Certificates: []tls.Certificate{p.Broker}}, c); e != nil {
+		t.Errorf("Handshake, expected no error, got [%v]\n", e)
+	}
+}
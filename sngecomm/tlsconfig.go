@@ -0,0 +1,317 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package sngecomm
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tlsVersions are the TLS versions by name.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsCiphers are the cipher suites by IANA name.  TLS 1.3 suites are not
+// configurable, and are listed so their names are accepted.
+var tlsCiphers = map[string]uint16{
+	"TLS_RSA_WITH_RC4_128_SHA":                      tls.TLS_RSA_WITH_RC4_128_SHA,
+	"TLS_RSA_WITH_3DES_EDE_CBC_SHA":                 tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_CBC_SHA":                  tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":                  tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_CBC_SHA256":               tls.TLS_RSA_WITH_AES_128_CBC_SHA256,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":               tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":               tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_RC4_128_SHA":              tls.TLS_ECDHE_ECDSA_WITH_RC4_128_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_RC4_128_SHA":                tls.TLS_ECDHE_RSA_WITH_RC4_128_SHA,
+	"TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA":           tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256":       tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256":         tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256":       tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384":       tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256":   tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256": tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	"TLS_AES_128_GCM_SHA256":                        tls.TLS_AES_128_GCM_SHA256,
+	"TLS_AES_256_GCM_SHA384":                        tls.TLS_AES_256_GCM_SHA384,
+	"TLS_CHACHA20_POLY1305_SHA256":                  tls.TLS_CHACHA20_POLY1305_SHA256,
+}
+
+// ParseTLSVersion parses a TLS version: 1.0, 1.1, 1.2 or 1.3, optionally
+// with a TLS or TLSv prefix.
+func ParseTLSVersion(s string) (uint16, error) {
+	v := strings.TrimPrefix(strings.TrimPrefix(strings.ToUpper(s), "TLS"), "V")
+	if n, ok := tlsVersions[v]; ok {
+		return n, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q", s)
+}
+
+// ParseCipherSuites parses a comma separated list of cipher suites, by
+// IANA name or hex ID (0xc02f).
+func ParseCipherSuites(s string) ([]uint16, error) {
+	var r []uint16
+	for _, n := range strings.Split(s, ",") {
+		n = strings.TrimSpace(n)
+		if id, ok := tlsCiphers[strings.ToUpper(n)]; ok {
+			r = append(r, id)
+			continue
+		}
+		id, e := strconv.ParseUint(n, 0, 16)
+		if e != nil || !strings.HasPrefix(strings.ToLower(n), "0x") {
+			return nil, fmt.Errorf("unknown cipher suite %q", n)
+		}
+		r = append(r, uint16(id))
+	}
+	return r, nil
+}
+
+/*
+Config returns a new tls.Config for these settings:
+
+	CAFile              PEM CA bundle for verifying the broker
+	CertFile, KeyFile   PEM client certificate and key
+	PKCS12File          PKCS#12 client certificate and key, see DecodePKCS12
+	MinVersion          lowest TLS version, 1.0 to 1.3
+	MaxVersion          highest TLS version
+	CipherSuites        IANA names, STOMP_USECUSTOMCIPHERS is used if empty
+	ServerName          SNI and verification name override
+	InsecureSkipVerify  do not verify the broker
+	KeyLogFile          append session keys, for Wireshark.  Debugging only.
+	Pins                broker SPKI pins, checked by Dial after the handshake
+	PinMode             enforce (the default) or report
+	CertReload          reload the client certificate when its files change
+	CertWarn            warn at this time to certificate expiry, e.g. 72h
+
+A PKCS#12 file is used in place of CertFile and KeyFile.  With CertReload
+the client certificate is set by GetClientCertificate, see CertReloader,
+and Certificates is empty.  One CertReloader serves every Config for the
+same settings, so reconnects share it.  Pins are checked here for syntax
+only.
+*/
+func (t *ProfileTLS) Config() (*tls.Config, error) {
+	c := &tls.Config{}
+	if e := t.apply(c); e != nil {
+		return nil, e
+	}
+	return c, nil
+}
+
+// apply adds the settings to c, without replacing any already present.
+func (t *ProfileTLS) apply(c *tls.Config) error {
+	if t.ServerName != "" {
+		c.ServerName = t.ServerName
+	}
+	if t.InsecureSkipVerify {
+		c.InsecureSkipVerify = true
+	}
+	if t.CAFile != "" && c.RootCAs == nil {
+		pb, e := ioutil.ReadFile(t.CAFile)
+		if e != nil {
+			return e
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pb) {
+			return fmt.Errorf("no certificates in %s", t.CAFile)
+		}
+	}
+	if len(c.Certificates) == 0 && c.GetClientCertificate == nil {
+		switch {
+		case t.CertReload:
+			r, e := certReloader(t)
+			if e != nil {
+				return e
+			}
+			c.GetClientCertificate = r.GetClientCertificate
+		case t.PKCS12File != "" || t.CertFile != "":
+			cc, e := t.loadCert()
+			if e != nil {
+				return e
+			}
+			c.Certificates = append(c.Certificates, cc)
+		}
+	}
+	var e error
+	if t.MinVersion != "" && c.MinVersion == 0 {
+		if c.MinVersion, e = ParseTLSVersion(t.MinVersion); e != nil {
+			return e
+		}
+	}
+	if t.MaxVersion != "" && c.MaxVersion == 0 {
+		if c.MaxVersion, e = ParseTLSVersion(t.MaxVersion); e != nil {
+			return e
+		}
+	}
+	if t.CertWarn != "" {
+		if _, e = time.ParseDuration(t.CertWarn); e != nil {
+			return fmt.Errorf("certwarn: %v", e)
+		}
+	}
+	if t.Pins != "" {
+		if _, e = ParsePins(t.Pins); e != nil {
+			return e
+		}
+	}
+	if e = checkPinMode(t.PinMode); e != nil {
+		return e
+	}
+	if c.MinVersion != 0 && c.MaxVersion != 0 && c.MinVersion > c.MaxVersion {
+		return fmt.Errorf("TLS minversion %s is above maxversion %s",
+			t.MinVersion, t.MaxVersion)
+	}
+	if len(c.CipherSuites) == 0 {
+		if t.CipherSuites != "" {
+			if c.CipherSuites, e = ParseCipherSuites(t.CipherSuites); e != nil {
+				return e
+			}
+		} else if UseCustomCiphers() {
+			c.CipherSuites = CustomCiphers()
+		}
+	}
+	if t.KeyLogFile != "" && c.KeyLogWriter == nil {
+		if c.KeyLogWriter, e = keyLog(t.KeyLogFile); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+var (
+	keyLogs     = map[string]io.Writer{} // Open key log files, by name
+	keyLogsLock sync.Mutex               // keyLogs variable lock
+)
+
+// keyLog returns the writer for a key log file, opening it on first use.
+// apply runs for every dial, e.g. each failover attempt, and all share it.
+func keyLog(fn string) (io.Writer, error) {
+	keyLogsLock.Lock()
+	defer keyLogsLock.Unlock()
+	if w, ok := keyLogs[fn]; ok {
+		return w, nil
+	}
+	f, e := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if e != nil {
+		return nil, e
+	}
+	keyLogs[fn] = f
+	llu.Printf("tls_key_log file:%s WARNING:session keys are written, for debugging only\n",
+		fn)
+	return f, nil
+}
+
+// tlsEnv are the STOMP_TLS_* environment variables, and their settings.
+var tlsEnv = []struct {
+	env string
+	f   func(*ProfileTLS) *string
+}{
+	{"STOMP_TLS_CAFILE", func(t *ProfileTLS) *string { return &t.CAFile }},
+	{"STOMP_TLS_CERTFILE", func(t *ProfileTLS) *string { return &t.CertFile }},
+	{"STOMP_TLS_KEYFILE", func(t *ProfileTLS) *string { return &t.KeyFile }},
+	{"STOMP_TLS_PKCS12FILE", func(t *ProfileTLS) *string { return &t.PKCS12File }},
+	{"STOMP_TLS_PKCS12PASSWORD", func(t *ProfileTLS) *string { return &t.PKCS12Password }},
+	{"STOMP_TLS_MINVERSION", func(t *ProfileTLS) *string { return &t.MinVersion }},
+	{"STOMP_TLS_MAXVERSION", func(t *ProfileTLS) *string { return &t.MaxVersion }},
+	{"STOMP_TLS_CIPHERSUITES", func(t *ProfileTLS) *string { return &t.CipherSuites }},
+	{"STOMP_TLS_SERVERNAME", func(t *ProfileTLS) *string { return &t.ServerName }},
+	{"STOMP_TLS_KEYLOGFILE", func(t *ProfileTLS) *string { return &t.KeyLogFile }},
+	{"STOMP_TLS_PINS", func(t *ProfileTLS) *string { return &t.Pins }},
+	{"STOMP_TLS_PINMODE", func(t *ProfileTLS) *string { return &t.PinMode }},
+	{"STOMP_TLS_CERTWARN", func(t *ProfileTLS) *string { return &t.CertWarn }},
+}
+
+// tlsFromEnv returns t with any STOMP_TLS_* overrides.  t is not changed,
+// and is returned when there are none.
+func tlsFromEnv(t *ProfileTLS) *ProfileTLS {
+	nt := &ProfileTLS{}
+	if t != nil {
+		*nt = *t
+	}
+	set := false
+	for _, v := range tlsEnv {
+		if s := os.Getenv(v.env); s != "" {
+			*v.f(nt), set = s, true
+		}
+	}
+	if s := os.Getenv("STOMP_TLS_INSECURE"); s != "" {
+		nt.InsecureSkipVerify, _ = strconv.ParseBool(s)
+		set = true
+	}
+	if s := os.Getenv("STOMP_TLS_CERTRELOAD"); s != "" {
+		nt.CertReload, _ = strconv.ParseBool(s)
+		set = true
+	}
+	if !set {
+		return t
+	}
+	return nt
+}
+
+/*
+TLSConfigFromEnv returns a tls.Config for the resolved broker: the active
+profile TLS settings, STOMP_URL TLS options, then the STOMP_TLS_*
+environment variables:
+
+	STOMP_TLS_CAFILE, STOMP_TLS_CERTFILE, STOMP_TLS_KEYFILE,
+	STOMP_TLS_PKCS12FILE, STOMP_TLS_PKCS12PASSWORD,
+	STOMP_TLS_MINVERSION, STOMP_TLS_MAXVERSION, STOMP_TLS_CIPHERSUITES,
+	STOMP_TLS_SERVERNAME, STOMP_TLS_INSECURE, STOMP_TLS_KEYLOGFILE,
+	STOMP_TLS_PINS, STOMP_TLS_PINMODE, STOMP_TLS_CERTRELOAD,
+	STOMP_TLS_CERTWARN
+
+The server name is the broker host unless overridden.  See ProfileTLS.Config.
+*/
+func TLSConfigFromEnv() (*tls.Config, error) {
+	b, e := ResolveBroker()
+	if e != nil {
+		return nil, e
+	}
+	c := &tls.Config{}
+	if e = b.ApplyTLS(c); e != nil {
+		return nil, e
+	}
+	return c, nil
+}
+
+// TLSConfigFromProfile returns a tls.Config for a profile, with no
+// environment overrides.  The server name is the profile host unless
+// overridden.
+func TLSConfigFromProfile(p *Profile) (*tls.Config, error) {
+	c := &tls.Config{ServerName: p.Host}
+	if p.TLS == nil {
+		return c, nil
+	}
+	if e := p.TLS.apply(c); e != nil {
+		return nil, fmt.Errorf("profile %s: %v", p.Name, e)
+	}
+	return c, nil
+}
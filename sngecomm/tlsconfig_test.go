@@ -0,0 +1,175 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package sngecomm
+
+import (
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/*
+Test TLS version and cipher suite names.
+*/
+func TestTLSParse(t *testing.T) {
+	for s, v := range map[string]uint16{"1.2": tls.VersionTLS12,
+		"TLS1.3": tls.VersionTLS13, "tlsv1.0": tls.VersionTLS10} {
+		if n, e := ParseTLSVersion(s); e != nil || n != v {
+			t.Errorf("ParseTLSVersion %s, expected [%x], got [%x] [%v]\n", s, v, n, e)
+		}
+	}
+	if _, e := ParseTLSVersion("1.4"); e == nil {
+		t.Error("ParseTLSVersion 1.4, expected an error")
+	}
+	cs, e := ParseCipherSuites("TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, 0xc030")
+	if e != nil || len(cs) != 2 ||
+		cs[0] != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 ||
+		cs[1] != tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384 {
+		t.Errorf("ParseCipherSuites, got [%x] [%v]\n", cs, e)
+	}
+	for _, s := range []string{"TLS_NOT_A_CIPHER", "49200", "0x10000"} {
+		if _, e = ParseCipherSuites(s); e == nil {
+			t.Errorf("ParseCipherSuites %s, expected an error\n", s)
+		}
+	}
+}
+
+/*
+Test PKCS#12 files, from OpenSSL 3 with default (PBES2 and AES) and legacy
+(3DES and RC2) encryption.
+*/
+func TestTLSPKCS12(t *testing.T) {
+	for _, fn := range []string{"testdata/client.p12", "testdata/client_legacy.p12"} {
+		d, e := ioutil.ReadFile(fn)
+		if e != nil {
+			t.Fatal(e)
+		}
+		c, e := DecodePKCS12(d, "secret")
+		if e != nil {
+			t.Fatalf("%s, expected no error, got [%v]\n", fn, e)
+		}
+		if c.Leaf == nil || c.Leaf.Subject.CommonName != "client" || c.PrivateKey == nil {
+			t.Errorf("%s, expected the client certificate and key\n", fn)
+		}
+		if _, e = DecodePKCS12(d, "wrong"); e != ErrPKCS12Password {
+			t.Errorf("%s, expected ErrPKCS12Password, got [%v]\n", fn, e)
+		}
+	}
+	if _, e := DecodePKCS12([]byte("not a p12"), ""); e == nil {
+		t.Error("DecodePKCS12, expected an error")
+	}
+}
+
+/*
+Test a tls.Config from a profile, with environment overrides, in a
+handshake that requires a client certificate.
+*/
+func TestTLSConfigFromEnv(t *testing.T) {
+	fn, rm := testProfilesFile(t, `
+tlsbroker:
+  tls:
+    certfile: nothere.crt
+    keyfile: nothere.key
+    minversion: "1.0"
+    ciphersuites: TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256
+`)
+	defer rm()
+	defer setTestEnv("STOMP_PROFILES", fn, "STOMP_PROFILE", "tlsbroker")()
+	p, e := ActiveProfile()
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, e = TLSConfigFromProfile(p); e == nil {
+		t.Error("TLSConfigFromProfile, expected a missing file error")
+	}
+	//
+	defer setTestEnv("STOMP_TLS_PKCS12FILE", "testdata/client.p12",
+		"STOMP_TLS_PKCS12PASSWORD", "secret", "STOMP_TLS_MINVERSION", "1.2",
+		"STOMP_TLS_SERVERNAME", "broker.example", "STOMP_TLS_INSECURE", "true")()
+	c, e := TLSConfigFromEnv()
+	if e != nil {
+		t.Fatalf("TLSConfigFromEnv, expected no error, got [%v]\n", e)
+	}
+	if c.MinVersion != tls.VersionTLS12 || c.ServerName != "broker.example" ||
+		!c.InsecureSkipVerify || len(c.Certificates) != 1 ||
+		len(c.CipherSuites) != 1 {
+		t.Errorf("TLSConfigFromEnv, got [%d] [%s] [%v] [%d] [%x]\n", c.MinVersion,
+			c.ServerName, c.InsecureSkipVerify, len(c.Certificates), c.CipherSuites)
+	}
+	//
+	cn := make(chan string, 1)
+	l, e := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{testCert(t)},
+		ClientAuth:   tls.RequireAnyClientCert})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer l.Close()
+	go func() {
+		s, e := l.Accept()
+		if e != nil {
+			return
+		}
+		defer s.Close()
+		ts := s.(*tls.Conn)
+		if ts.Handshake() == nil && len(ts.ConnectionState().PeerCertificates) > 0 {
+			cn <- ts.ConnectionState().PeerCertificates[0].Subject.CommonName
+		}
+		close(cn)
+	}()
+	c.CipherSuites = nil // testCert may not be ECDSA
+	n, e := net.Dial("tcp", l.Addr().String())
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer n.Close()
+	if e = tls.Client(n, c).Handshake(); e != nil {
+		t.Fatalf("Handshake, expected no error, got [%v]\n", e)
+	}
+	if s := <-cn; s != "client" {
+		t.Errorf("client certificate, expected [client], got [%s]\n", s)
+	}
+}
+
+/*
+Test that every dial shares one key log file, as failover attempts apply the
+profile to a fresh tls.Config each time.
+*/
+func TestTLSKeyLog(t *testing.T) {
+	d, e := ioutil.TempDir("", "sngecomm")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(d)
+	b := &BrokerParms{Host: "localhost",
+		TLS: &ProfileTLS{KeyLogFile: filepath.Join(d, "keys.log")}}
+	var ws []io.Writer
+	for i := 0; i < 3; i++ {
+		c := &tls.Config{}
+		if e = b.ApplyTLS(c); e != nil {
+			t.Fatal(e)
+		}
+		ws = append(ws, c.KeyLogWriter)
+	}
+	if ws[0] == nil || ws[1] != ws[0] || ws[2] != ws[0] {
+		t.Errorf("ApplyTLS, expected one key log writer, got [%v]\n", ws)
+	}
+}
@@ -0,0 +1,205 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package sngecomm
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+/*
+TLSReport describes a TLS session: what was negotiated, and the broker's
+certificate chain.  It marshals to JSON, for logs and certificate expiry
+alerting.
+
+Verified is true when the chain verifies against the configured roots (the
+system roots if none), whether or not the handshake itself verified.
+DaysToExpiry is the least of the chain.
+*/
+type TLSReport struct {
+	Time         time.Time       `json:"time"`
+	ServerName   string          `json:"servername"`
+	Version      string          `json:"version"`
+	CipherSuite  string          `json:"ciphersuite"`
+	ALPN         string          `json:"alpn"`
+	DidResume    bool            `json:"didresume"`
+	SkipVerify   bool            `json:"insecureskipverify"`
+	Verified     bool            `json:"verified"`
+	VerifyError  string          `json:"verifyerror,omitempty"`
+	DaysToExpiry int             `json:"daystoexpiry"`
+	Chain        []TLSCertReport `json:"chain"`
+}
+
+// TLSCertReport describes one certificate, leaf first.  Fingerprints are
+// hex, and SPKISHA256 is the base64 public key pin.
+type TLSCertReport struct {
+	Subject            string    `json:"subject"`
+	Issuer             string    `json:"issuer"`
+	SerialNumber       string    `json:"serialnumber"`
+	DNSNames           []string  `json:"dnsnames,omitempty"`
+	EmailAddresses     []string  `json:"emailaddresses,omitempty"`
+	IPAddresses        []string  `json:"ipaddresses,omitempty"`
+	URIs               []string  `json:"uris,omitempty"`
+	IsCA               bool      `json:"isca"`
+	NotBefore          time.Time `json:"notbefore"`
+	NotAfter           time.Time `json:"notafter"`
+	DaysToExpiry       int       `json:"daystoexpiry"`
+	KeyType            string    `json:"keytype"`
+	KeyBits            int       `json:"keybits"`
+	SignatureAlgorithm string    `json:"signaturealgorithm"`
+	SHA1               string    `json:"sha1"`
+	SHA256             string    `json:"sha256"`
+	SPKISHA256         string    `json:"spkisha256"`
+}
+
+// TLSVersionName returns the name of a TLS version, e.g. "TLS 1.3".
+func TLSVersionName(v uint16) string {
+	for n, id := range tlsVersions {
+		if id == v {
+			return "TLS " + n
+		}
+	}
+	if v == tls.VersionSSL30 {
+		return "SSL 3.0"
+	}
+	return fmt.Sprintf("0x%04X", v)
+}
+
+// CipherSuiteName returns the IANA name of a cipher suite.
+func CipherSuiteName(id uint16) string {
+	for n, v := range tlsCiphers {
+		if v == id {
+			return n
+		}
+	}
+	return fmt.Sprintf("0x%04X", id)
+}
+
+// NewTLSReport returns a report for a connection that has completed its
+// handshake.  c is the client configuration.
+func NewTLSReport(c *tls.Config, n *tls.Conn) *TLSReport {
+	return tlsReport(c, n.ConnectionState(), time.Now())
+}
+
+// tlsReport returns a report as of now.
+func tlsReport(c *tls.Config, cs tls.ConnectionState, now time.Time) *TLSReport {
+	r := &TLSReport{Time: now,
+		ServerName:  c.ServerName,
+		Version:     TLSVersionName(cs.Version),
+		CipherSuite: CipherSuiteName(cs.CipherSuite),
+		ALPN:        cs.NegotiatedProtocol,
+		DidResume:   cs.DidResume,
+		SkipVerify:  c.InsecureSkipVerify,
+		Chain:       []TLSCertReport{},
+	}
+	for i, x := range cs.PeerCertificates {
+		cr := certReport(x, now)
+		if i == 0 || cr.DaysToExpiry < r.DaysToExpiry {
+			r.DaysToExpiry = cr.DaysToExpiry
+		}
+		r.Chain = append(r.Chain, cr)
+	}
+	switch {
+	case len(cs.VerifiedChains) > 0:
+		r.Verified = true
+	case len(cs.PeerCertificates) == 0:
+		r.VerifyError = "no peer certificates"
+	default:
+		vo := x509.VerifyOptions{Roots: c.RootCAs, DNSName: c.ServerName,
+			CurrentTime: now, Intermediates: x509.NewCertPool()}
+		for _, x := range cs.PeerCertificates[1:] {
+			vo.Intermediates.AddCert(x)
+		}
+		if _, e := cs.PeerCertificates[0].Verify(vo); e != nil {
+			r.VerifyError = e.Error()
+		} else {
+			r.Verified = true
+		}
+	}
+	return r
+}
+
+// certReport describes one certificate as of now.
+func certReport(x *x509.Certificate, now time.Time) TLSCertReport {
+	s1, s256 := sha1.Sum(x.Raw), sha256.Sum256(x.Raw)
+	sp := sha256.Sum256(x.RawSubjectPublicKeyInfo)
+	cr := TLSCertReport{Subject: x.Subject.String(),
+		Issuer:             x.Issuer.String(),
+		SerialNumber:       x.SerialNumber.String(),
+		DNSNames:           x.DNSNames,
+		EmailAddresses:     x.EmailAddresses,
+		IsCA:               x.IsCA,
+		NotBefore:          x.NotBefore.UTC(),
+		NotAfter:           x.NotAfter.UTC(),
+		DaysToExpiry:       daysTo(x.NotAfter, now),
+		SignatureAlgorithm: x.SignatureAlgorithm.String(),
+		SHA1:               hex.EncodeToString(s1[:]),
+		SHA256:             hex.EncodeToString(s256[:]),
+		SPKISHA256:         base64.StdEncoding.EncodeToString(sp[:]),
+	}
+	for _, ip := range x.IPAddresses {
+		cr.IPAddresses = append(cr.IPAddresses, ip.String())
+	}
+	for _, u := range x.URIs {
+		cr.URIs = append(cr.URIs, u.String())
+	}
+	switch k := x.PublicKey.(type) {
+	case *rsa.PublicKey:
+		cr.KeyType, cr.KeyBits = "RSA", k.N.BitLen()
+	case *ecdsa.PublicKey:
+		cr.KeyType = "ECDSA " + k.Curve.Params().Name
+		cr.KeyBits = k.Curve.Params().BitSize
+	case ed25519.PublicKey:
+		cr.KeyType, cr.KeyBits = "Ed25519", 256
+	default:
+		cr.KeyType = x.PublicKeyAlgorithm.String()
+	}
+	return cr
+}
+
+// daysTo returns whole days from now until t, negative once t has passed.
+func daysTo(t, now time.Time) int {
+	d := t.Sub(now)
+	if d < 0 {
+		return -int((-d + 24*time.Hour - 1) / (24 * time.Hour))
+	}
+	return int(d / (24 * time.Hour))
+}
+
+// JSON returns the report as indented JSON.
+func (r *TLSReport) JSON() ([]byte, error) {
+	return json.MarshalIndent(r, "", "  ")
+}
+
+// String returns the report as one line of JSON.
+func (r *TLSReport) String() string {
+	b, e := json.Marshal(r)
+	if e != nil {
+		return fmt.Sprintf("tls_report error:%v", e)
+	}
+	return string(b)
+}
@@ -0,0 +1,113 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package sngecomm
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+Test days to expiry, and version and cipher suite names.
+*/
+func TestTLSReportNames(t *testing.T) {
+	now := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	for d, w := range map[time.Duration]int{time.Hour: 0, 49 * time.Hour: 2,
+		-time.Hour: -1, -48 * time.Hour: -2} {
+		if n := daysTo(now.Add(d), now); n != w {
+			t.Errorf("daysTo %v, expected [%d], got [%d]\n", d, w, n)
+		}
+	}
+	if s := TLSVersionName(0x0304); s != "TLS 1.3" {
+		t.Errorf("TLSVersionName, expected [TLS 1.3], got [%s]\n", s)
+	}
+	if s := CipherSuiteName(0xc02f); s != "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256" {
+		t.Errorf("CipherSuiteName, got [%s]\n", s)
+	}
+	if s := CipherSuiteName(0xfefe); s != "0xFEFE" {
+		t.Errorf("CipherSuiteName unknown, got [%s]\n", s)
+	}
+}
+
+/*
+Test a report for a session with a self signed broker certificate,
+unverified and then verified.
+*/
+func TestTLSReport(t *testing.T) {
+	sc := testCert(t)
+	l, e := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{sc},
+		NextProtos: []string{"stomp"}})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			s, e := l.Accept()
+			if e != nil {
+				return
+			}
+			_ = s.(*tls.Conn).Handshake()
+			s.Close()
+		}
+	}()
+	x, e := x509.ParseCertificate(sc.Certificate[0])
+	if e != nil {
+		t.Fatal(e)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(x)
+	for _, c := range []*tls.Config{
+		{InsecureSkipVerify: true, NextProtos: []string{"stomp"}},
+		{RootCAs: roots, ServerName: "127.0.0.1", NextProtos: []string{"stomp"}},
+	} {
+		n, e := net.Dial("tcp", l.Addr().String())
+		if e != nil {
+			t.Fatal(e)
+		}
+		tc := tls.Client(n, c)
+		if e = tc.Handshake(); e != nil {
+			t.Fatalf("Handshake, expected no error, got [%v]\n", e)
+		}
+		r := NewTLSReport(c, tc)
+		tc.Close()
+		if r.Version != "TLS 1.3" || !strings.HasPrefix(r.CipherSuite, "TLS_") ||
+			r.ALPN != "stomp" || r.DaysToExpiry != 0 || len(r.Chain) != 1 {
+			t.Errorf("TLSReport, got [%s]\n", r)
+		}
+		if r.Verified == c.InsecureSkipVerify || (r.VerifyError == "") != r.Verified {
+			t.Errorf("TLSReport verify, skip [%v], got [%v] [%s]\n", c.InsecureSkipVerify,
+				r.Verified, r.VerifyError)
+		}
+		cr := r.Chain[0]
+		if cr.Subject != "CN=127.0.0.1" || cr.KeyType != "ECDSA P-256" || cr.KeyBits != 256 ||
+			len(cr.IPAddresses) != 1 || cr.IPAddresses[0] != "127.0.0.1" ||
+			len(cr.SHA256) != 64 || len(cr.SPKISHA256) != 44 {
+			t.Errorf("TLSReport certificate, got [%+v]\n", cr)
+		}
+		var m map[string]interface{}
+		b, e := r.JSON()
+		if e != nil || json.Unmarshal(b, &m) != nil || m["ciphersuite"] != r.CipherSuite {
+			t.Errorf("TLSReport JSON, got [%s] [%v]\n", b, e)
+		}
+	}
+}
@@ -21,13 +21,16 @@ project.
 package sngecomm
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/tls"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"math/big"
 	"net"
 	"os"
-	"strings"
+	"time"
 
 	//
 	"github.com/gmallard/stompngo"
@@ -37,32 +40,24 @@ import (
 var (
 	llu = log.New(os.Stdout, "UTIL ", log.Ldate|log.Lmicroseconds|log.Lshortfile)
 	Lcs = "NotAvailable"
-	vs  = ""
+
+	// fatalf ends the run when a Handle* helper fails.  Tests replace it.
+	fatalf = llu.Fatalf
 )
 
-// Provide connect headers
+// Provide connect headers, using the active broker profile if any
 func ConnectHeaders() stompngo.Headers {
-	h := stompngo.Headers{}
-	l := senv.Login()
-	if l != "" {
-		h = h.Add("login", l)
-	}
-	pc := senv.Passcode()
-	if pc != "" {
-		h = h.Add("passcode", pc)
-	}
-	//
-	p := senv.Protocol()
-	if p != stompngo.SPL_10 { // 1.1 and 1.2
-		h = h.Add("accept-version", p).Add("host", senv.Vhost())
-		hb := senv.Heartbeats()
-		if hb != "" {
-			h = h.Add("heart-beat", hb)
-		}
-	}
-	//
+	return brokerOrEnv().ConnectHeaders()
+}
 
-	return h
+// Resolved broker parameters, falling back to the environment on error.
+func brokerOrEnv() *BrokerParms {
+	b, e := ResolveBroker()
+	if e != nil {
+		llu.Printf("broker_profile_error error:%v\n", e)
+		return resolveBroker(nil, nil)
+	}
+	return b
 }
 
 // Show connection metrics.
@@ -113,94 +108,55 @@ func ValueBetween(min, max int64, fact float64) int64 {
 	return int64(fact * float64(min+rt.Int64()))
 }
 
-// Dump a TLS Configuration Struct
+/*
+DumpTLSConfig logs a TLSReport for a connection.
+
+Deprecated: use ReportTLS.
+*/
 func DumpTLSConfig(exampid string, c *tls.Config, n *tls.Conn) {
-	llu.Printf("%s TLSConfig:\n", exampid)
-	llu.Printf("%s Rand:%#v\n", exampid, c.Rand)
-	if c.Time != nil {
-		llu.Printf("%s Time:%v\n", exampid, c.Time())
-	} else {
-		llu.Printf("%s Time:%v\n", exampid, nil)
-	}
-	llu.Printf("%s Certificates:%#v\n", exampid, c.Certificates)
-	llu.Printf("%s NameToCertificate:%#v\n", exampid, c.NameToCertificate)
-	llu.Printf("%s RootCAs:%#v\n", exampid, c.RootCAs)
-	llu.Printf("%s NextProtos:%v\n", exampid, c.NextProtos)
-	llu.Printf("%s ServerName:%v\n", exampid, c.ServerName)
-	llu.Printf("%s ClientAuth:%v\n", exampid, c.ClientAuth)
-	llu.Printf("%s ClientCAs:%v#\n", exampid, c.ClientCAs)
-	llu.Printf("%s CipherSuites:%#v\n", exampid, c.CipherSuites)
-	llu.Printf("%s PreferServerCipherSuites:%v\n", exampid, c.PreferServerCipherSuites)
-	llu.Printf("%s SessionTicketsDisabled:%v\n", exampid, c.SessionTicketsDisabled)
-	llu.Printf("%s SessionTicketKey:%#v\n", exampid, c.SessionTicketKey)
-
-	// Idea Embellished From:
-	// https://groups.google.com/forum/#!topic/golang-nuts/TMNdOxugbTY
-	llu.Println("Connecton State Information:")
-	cs := n.ConnectionState()
-	switch cs.Version {
-	case tls.VersionTLS10:
-		vs = "TLS10"
-	case tls.VersionTLS11:
-		vs = "TLS11"
-	case tls.VersionTLS12:
-		vs = "TLS12"
-	// 1.6 and 1.7 do not have this constant:
-	// case tls.VersionTLS13:
-	case 0x0304: // Hardcoded for now
-		vs = "TLS13"
-	case tls.VersionSSL30:
-		vs = "SSL30"
-	default:
-		vs = "Unknown"
-	}
-	llu.Printf("%s Version:%s\n", exampid, vs)
-	llu.Printf("%s HandshakeComplete:%v\n", exampid, cs.HandshakeComplete)
-	llu.Printf("%s DidResume:%v\n", exampid, cs.DidResume)
-	llu.Printf("%s CipherSuite:%d(0x%X)\n", exampid, cs.CipherSuite, cs.CipherSuite)
-	llu.Printf("%s NegotiatedProtocol:%v\n", exampid, cs.NegotiatedProtocol)
-	llu.Printf("%s NegotiatedProtocolIsMutual:%v\n", exampid, cs.NegotiatedProtocolIsMutual)
-	// llu.Printf("%s ServerName:%v\n", exampid, cs.ServerName) // Server side only
-	// Portions of any Peer Certificates present
-	certs := cs.PeerCertificates
-	if certs == nil || len(certs) < 1 {
-		llu.Printf("Could not get server's certificate from the TLS connection.\n")
-		return
-	}
-	if len(certs) == 1 {
-		llu.Printf("%s There is %d Server Cert:\n", exampid, len(certs))
-	} else {
-		llu.Printf("%s There are %d Server Certs:\n", exampid, len(certs))
-	}
+	ReportTLS(exampid, "tls", llu, c, n)
+}
 
-	for i, cert := range certs {
-		llu.Printf("%s Certificate chain:%d\n", exampid, i)
-		llu.Printf("%s Common Name:%s\n", exampid, cert.Subject.CommonName)
-		//
-		llu.Printf("%s Subject Alternative Names (DNSNames):\n", exampid)
-		for idx, dnsn := range cert.DNSNames {
-			llu.Printf("%s \tNumber:%d, DNS Name:%s\n", exampid, idx+1, dnsn)
-		}
-		//
-		llu.Printf("%s Subject Alternative Names (Emailaddresses):\n", exampid)
-		for idx, enn := range cert.EmailAddresses {
-			llu.Printf("%s \tNumber:%d, DNS Name:%s\n", exampid, idx+1, enn)
+/*
+ReportTLS logs a TLSReport for a connection, as one line of JSON, and
+returns it.  If STOMP_TLS_REPORTFILE is set, the report is also written to
+that file as indented JSON, for certificate expiry alerting.
+*/
+func ReportTLS(exampid, tag string, lgr *log.Logger, c *tls.Config,
+	n *tls.Conn) *TLSReport {
+	r := NewTLSReport(c, n)
+	lgr.Printf("%stag:%s connsess:%s tls_report:%s\n", exampid, tag, Lcs, r)
+	if fn := TLSReportFile(); fn != "" {
+		b, e := r.JSON()
+		if e == nil {
+			e = ioutil.WriteFile(fn, append(b, '\n'), 0644)
 		}
-		//
-		llu.Printf("%s Subject Alternative Names (IPAddresses):\n", exampid)
-		for idx, ipadn := range cert.IPAddresses {
-			llu.Printf("%s \tNumber:%d, DNS Name:%v\n", exampid, idx+1, ipadn)
+		if e != nil {
+			lgr.Printf("%stag:%s connsess:%s tls_report_file:%s error:%v\n",
+				exampid, tag, Lcs, fn, e)
 		}
-		//
-		llu.Printf("%s Valid Not Before:%s\n", exampid, cert.NotBefore.Local().String())
-		llu.Printf("%s Valid Not After:%s\n", exampid, cert.NotAfter.Local().String())
-		llu.Println(strings.Repeat("=", 80))
 	}
-
+	return r
 }
 
 // Handle a subscribe for the different protocol levels.
 func HandleSubscribe(c *stompngo.Connection, d, i, a string) <-chan stompngo.MessageData {
+	if rc := managed(c); rc != nil {
+		r, e := rc.Subscribe(d, i, a)
+		if e != nil {
+			fatalf("v1:%v v2:%v\n", "subscribe failed", e)
+		}
+		return r
+	}
+	r, e := subscribe(c, d, i, a)
+	if e != nil {
+		fatalf("v1:%v v2:%v\n", "subscribe failed", e)
+	}
+	return r
+}
+
+// subscribe is HandleSubscribe, returning any error.
+func subscribe(c *stompngo.Connection, d, i, a string) (<-chan stompngo.MessageData, error) {
 	h := stompngo.Headers{"destination", d, "ack", a}
 	//
 	switch c.Protocol() {
@@ -213,19 +169,31 @@ func HandleSubscribe(c *stompngo.Connection, d, i, a string) <-chan stompngo.Mes
 	case stompngo.SPL_10:
 		// Nothing else to do here
 	default:
-		llu.Fatalf("v1:%v v2:%v\n", "subscribe invalid protocol level, should not happen",
+		return nil, fmt.Errorf("subscribe invalid protocol level, should not happen: %v",
 			c.Protocol())
 	}
 	//
-	r, e := c.Subscribe(h)
-	if e != nil {
-		llu.Fatalf("v1:%v v2:%v\n", "subscribe failed", e)
-	}
-	return r
+	return c.Subscribe(h)
 }
 
 // Handle a unsubscribe for the different protocol levels.
 func HandleUnsubscribe(c *stompngo.Connection, d, i string) {
+	if e := Unsubscribe(c, d, i); e != nil {
+		fatalf("v1:%v v2:%v d:%v\n", "unsubscribe failed", e, d)
+	}
+	return
+}
+
+// Unsubscribe is HandleUnsubscribe, returning any error.
+func Unsubscribe(c *stompngo.Connection, d, i string) error {
+	if rc := managed(c); rc != nil {
+		return rc.Unsubscribe(d, i)
+	}
+	return unsubscribe(c, d, i)
+}
+
+// unsubscribe is HandleUnsubscribe, returning any error.
+func unsubscribe(c *stompngo.Connection, d, i string) error {
 	sbh := stompngo.Headers{}
 	//
 	switch c.Protocol() {
@@ -236,18 +204,31 @@ func HandleUnsubscribe(c *stompngo.Connection, d, i string) {
 	case stompngo.SPL_10:
 		sbh = sbh.Add("destination", d)
 	default:
-		llu.Fatalf("v1:%v v2:%v\n", "unsubscribe invalid protocol level, should not happen",
+		return fmt.Errorf("unsubscribe invalid protocol level, should not happen: %v",
 			c.Protocol())
 	}
-	e := c.Unsubscribe(sbh)
-	if e != nil {
-		llu.Fatalf("v1:%v v2:%v d:%v\n", "unsubscribe failed", e, d)
-	}
-	return
+	return c.Unsubscribe(sbh)
 }
 
 // Handle ACKs for the different protocol levels.
 func HandleAck(c *stompngo.Connection, h stompngo.Headers, id string) {
+	if e := Ack(c, h, id); e != nil {
+		fatalf("v1:%v v2:%v v3:%v\n", "ack failed", e, c.Protocol())
+	}
+	return
+}
+
+// Ack is HandleAck, returning any error.  h are the headers of the MESSAGE
+// being acked.
+func Ack(c *stompngo.Connection, h stompngo.Headers, id string) error {
+	if rc := managed(c); rc != nil {
+		return rc.Ack(h, id)
+	}
+	return ack(c, h, id)
+}
+
+// ack is HandleAck, returning any error.
+func ack(c *stompngo.Connection, h stompngo.Headers, id string) error {
 	ah := stompngo.Headers{}
 	//
 	switch c.Protocol() {
@@ -258,47 +239,54 @@ func HandleAck(c *stompngo.Connection, h stompngo.Headers, id string) {
 	case stompngo.SPL_10:
 		ah = ah.Add("message-id", h.Value("message-id"))
 	default:
-		llu.Fatalf("v1:%v v2:%v\n", "ack invalid protocol level, should not happen",
+		return fmt.Errorf("ack invalid protocol level, should not happen: %v",
 			c.Protocol())
 	}
 	if cv, ok := h.Contains(stompngo.HK_RECEIPT); ok {
 		ah = ah.Add(stompngo.HK_RECEIPT, cv)
 	}
-	e := c.Ack(ah)
-	if e != nil {
-		llu.Fatalf("v1:%v v2:%v v3:%v\n", "ack failed", e, c.Protocol())
+	return c.Ack(ah)
+}
+
+// Handle NACKs for the different protocol levels.  STOMP 1.0 has no NACK.
+func HandleNack(c *stompngo.Connection, h stompngo.Headers, id string) {
+	if e := Nack(c, h, id); e != nil {
+		fatalf("v1:%v v2:%v v3:%v\n", "nack failed", e, c.Protocol())
 	}
 	return
 }
 
+// Nack is HandleNack, returning any error.
+func Nack(c *stompngo.Connection, h stompngo.Headers, id string) error {
+	if rc := managed(c); rc != nil {
+		return rc.Nack(h, id)
+	}
+	return nack(c, h, id)
+}
+
+// nack is HandleNack, returning any error.
+func nack(c *stompngo.Connection, h stompngo.Headers, id string) error {
+	nh := stompngo.Headers{}
+	//
+	switch c.Protocol() {
+	case stompngo.SPL_12:
+		nh = nh.Add("id", h.Value("ack"))
+	case stompngo.SPL_11:
+		nh = nh.Add("message-id", h.Value("message-id")).Add("subscription", id)
+	default:
+		return fmt.Errorf("nack invalid protocol level: %v", c.Protocol())
+	}
+	return c.Nack(nh)
+}
+
+// Show all run parameters, with their sources, using the utility logger.
 func ShowRunParms(exampid string) {
-	llu.Printf("%sHOST:%v\n", exampid, os.Getenv("STOMP_HOST"))
-	llu.Printf("%sPORT:%v\n", exampid, os.Getenv("STOMP_PORT"))
-	llu.Printf("%sPROTOCOL:%v\n", exampid, senv.Protocol())
-	llu.Printf("%sVHOST:%v\n", exampid, senv.Vhost())
-	llu.Printf("%sNQS:%v\n", exampid, Nqs())
-	llu.Printf("%sNMSGS:%v\n", exampid, senv.Nmsgs())
-	llu.Printf("%sSUBCHANCAP:%v\n", exampid, senv.SubChanCap())
-	llu.Printf("%sRECVFACT:%v\n", exampid, RecvFactor())
-	llu.Printf("%sSENDFACT:%v\n", exampid, SendFactor())
-	llu.Printf("%sRECVWAIT:%t\n", exampid, RecvWait())
-	llu.Printf("%sSENDWAIT:%t\n", exampid, SendWait())
-	llu.Printf("%sACKMODE:%v\n", exampid, AckMode())
+	runConfig().ShowRunParms(exampid, llu)
 }
 
+// Show all run parameters, with their sources, using a given logger.
 func ShowRunParmsLogger(exampid string, lgr *log.Logger) {
-	lgr.Printf("%sHOST:%v\n", exampid, os.Getenv("STOMP_HOST"))
-	lgr.Printf("%sPORT:%v\n", exampid, os.Getenv("STOMP_PORT"))
-	lgr.Printf("%sPROTOCOL:%v\n", exampid, senv.Protocol())
-	lgr.Printf("%sVHOST:%v\n", exampid, senv.Vhost())
-	lgr.Printf("%sNQS:%v\n", exampid, Nqs())
-	lgr.Printf("%sNMSGS:%v\n", exampid, senv.Nmsgs())
-	lgr.Printf("%sSUBCHANCAP:%v\n", exampid, senv.SubChanCap())
-	lgr.Printf("%sRECVFACT:%v\n", exampid, RecvFactor())
-	lgr.Printf("%sSENDFACT:%v\n", exampid, SendFactor())
-	lgr.Printf("%sRECVWAIT:%t\n", exampid, RecvWait())
-	lgr.Printf("%sSENDWAIT:%t\n", exampid, SendWait())
-	lgr.Printf("%sACKMODE:%v\n", exampid, AckMode())
+	runConfig().ShowRunParms(exampid, lgr)
 }
 
 // Return broker identity
@@ -315,76 +303,159 @@ func ServerIdent(c *stompngo.Connection) string {
 func CommonConnect(exampid, tag string, l *log.Logger) (net.Conn,
 	*stompngo.Connection,
 	error) {
+	return CommonConnectContext(context.Background(), exampid, tag, l)
+}
 
-	l.Printf("%stag:%s consess:%v common_connect_starts\n",
-		exampid, tag, Lcs)
+// Common example connect logic, with a context, using the current run
+// parameters.  See Config.Connect.
+func CommonConnectContext(ctx context.Context, exampid, tag string,
+	l *log.Logger) (net.Conn, *stompngo.Connection, error) {
+	return runConfig().Connect(ctx, exampid, tag, l)
+}
 
-	// Set up the connection.
-	h, p := senv.HostAndPort()
-	hap := net.JoinHostPort(h, p)
-	n, e := net.Dial("tcp", hap)
-	if e != nil {
-		return nil, nil, e
-	}
+/*
+Connect is the common example connect logic, using the broker, failover and
+heartbeat monitor run parameters in c.  The context deadline bounds the dial,
+any TLS handshake, and the CONNECT exchange.  An expired deadline returns a
+*TimeoutError.
+*/
+func (c *Config) Connect(ctx context.Context, exampid, tag string,
+	l *log.Logger) (net.Conn, *stompngo.Connection, error) {
+	return c.connect(ctx, c.DialOptions(exampid, tag, l))
+}
 
-	l.Printf("%stag:%s connsess:%s common_connect_host_and_port:%v\n",
-		exampid, tag, Lcs,
-		hap)
+// DialOptions returns dial options with the broker and heartbeat monitor run
+// parameters in c.
+func (c *Config) DialOptions(exampid, tag string, l *log.Logger) DialOptions {
+	return DialOptions{Exampid: exampid, Tag: tag, Logger: l,
+		Broker: c.Broker, Monitor: c.monitor()}
+}
 
-	// Create connect headers and connect to stompngo
-	ch := ConnectHeaders()
-	l.Printf("%stag:%s connsess:%s common_connect_headers headers:%v\n",
-		exampid, tag, Lcs,
-		ch)
-	conn, e := stompngo.Connect(n, ch)
-	if e != nil {
-		return nil, conn, e
+// connect resolves the broker if needed, and dials it, or the failover broker
+// list if there is one.
+func (c *Config) connect(ctx context.Context, o DialOptions) (net.Conn,
+	*stompngo.Connection, error) {
+	if o.Logger == nil {
+		o.Logger = llu
+	}
+	lp := "common_connect"
+	if o.TLS != nil {
+		lp = "common_tls_connect"
+	}
+	o.Logger.Printf("%stag:%s consess:%v %s_starts\n",
+		o.Exampid, o.Tag, Lcs,
+		lp)
+
+	// Resolve the broker, possibly from a profile
+	if o.Broker == nil {
+		b, e := ResolveBroker()
+		if e != nil {
+			return nil, nil, e
+		}
+		o.Broker = b
+	}
+	if o.Broker.Profile != "" {
+		o.Logger.Printf("%stag:%s connsess:%s %s_profile:%s\n",
+			o.Exampid, o.Tag, Lcs,
+			lp, o.Broker.Profile)
 	}
-	SetLogger(conn) // Maybe set a connection logger
-	l.Printf("%stag:%s connsess:%s common_connect_complete host:%s port:%s vhost:%s protocol:%s server:%s\n",
-		exampid, tag, conn.Session(),
-		h, p, senv.Vhost(), conn.Protocol(), ServerIdent(conn))
-
-	// Show connect response
-	l.Printf("%stag:%s connsess:%s common_connect_response connresp:%v\n",
-		exampid, tag, conn.Session(),
-		conn.ConnectResponse)
 
-	// Heartbeat Data
-	l.Printf("%stag:%s connsess:%s common_connect_heart_beat_send hbsend:%d\n",
-		exampid, tag, conn.Session(),
-		conn.SendTickerInterval())
-	l.Printf("%stag:%s connsess:%s common_connect_heart_beat_recv hbrecv:%d\n",
-		exampid, tag, conn.Session(),
-		conn.ReceiveTickerInterval())
+	// A failover broker list retries, otherwise connect once
+	if c.Failover != "" {
+		f, e := c.failover(o.Broker)
+		if e != nil {
+			return nil, nil, e
+		}
+		n, conn, _, e := newFailoverDialer(o, f).dial(ctx)
+		return n, conn, e
+	}
+	return DialContext(ctx, o)
+}
 
-	l.Printf("%stag:%s connsess:%s common_connect_local_addr:%s\n",
-		exampid, tag, conn.Session(),
-		n.LocalAddr().String())
-	l.Printf("%stag:%s connsess:%s common_connect_remote_addr:%s\n",
-		exampid, tag, conn.Session(),
-		n.RemoteAddr().String())
+// Common example disconnect logic, using the current run parameters.  See
+// Config.Disconnect.
+func CommonDisconnect(n net.Conn, conn *stompngo.Connection,
+	exampid, tag string,
+	l *log.Logger) error {
+	return runConfig().Disconnect(context.Background(), n, conn, exampid, tag, l)
+}
 
-	//
-	return n, conn, nil
+/*
+Disconnect is the common example disconnect logic.  With the discreceipt or
+disctimeout run parameter it waits for the DISCONNECT receipt, bounded by
+DisconnectContext, see CommonDisconnectContext.  Otherwise it sends
+DISCONNECT and closes the network connection.
+*/
+func (c *Config) Disconnect(ctx context.Context, n net.Conn,
+	conn *stompngo.Connection,
+	exampid, tag string,
+	l *log.Logger) error {
+	if !c.DiscReceipt && c.DiscTimeout == "" {
+		// Disconnect from the Stomp server
+		e := conn.Disconnect(stompngo.Headers{})
+		if e != nil {
+			_ = n.Close()
+			return e
+		}
+		return disconnectClose(n, conn, exampid, tag, l)
+	}
+	dctx, cancel := c.DisconnectContext(ctx)
+	defer cancel()
+	return CommonDisconnectContext(dctx, n, conn, exampid, tag, l)
 }
 
-// Common example disconnect logic
-func CommonDisconnect(n net.Conn, conn *stompngo.Connection,
+/*
+CommonDisconnectContext sends DISCONNECT with a receipt request, and waits
+for the RECEIPT before closing the network connection.  The receipt
+confirms that the broker has processed all prior frames, e.g. persistent
+SENDs.
+
+If the context is done first, the network connection is closed, and a
+*TimeoutError is returned.  A wrong or missing receipt is also an error.
+*/
+func CommonDisconnectContext(ctx context.Context, n net.Conn,
+	conn *stompngo.Connection,
 	exampid, tag string,
 	l *log.Logger) error {
 
 	// Disconnect from the Stomp server
-	e := conn.Disconnect(stompngo.Headers{})
+	st := time.Now()
+	rid := "disconnect-" + stompngo.Uuid()
+	dc := make(chan error, 1)
+	go func() {
+		dc <- conn.Disconnect(stompngo.Headers{stompngo.HK_RECEIPT, rid})
+	}()
+	var e error
+	select {
+	case e = <-dc:
+		if e == nil {
+			e = checkReceipt(conn.DisconnectReceipt, rid)
+		}
+	case <-ctx.Done():
+		_ = n.Close() // Unblock the receipt wait
+		<-dc
+		e = ctxErr("disconnect", ctx)
+	}
+	l.Printf("%stag:%s consess:%v common_disconnect_receipt confirmed:%t receipt-id:%s elapsed:%v\n",
+		exampid, tag, conn.Session(),
+		e == nil, rid, time.Since(st))
 	if e != nil {
+		_ = n.Close()
 		return e
 	}
+	return disconnectClose(n, conn, exampid, tag, l)
+}
+
+// disconnectClose closes the network connection after a DISCONNECT.
+func disconnectClose(n net.Conn, conn *stompngo.Connection,
+	exampid, tag string,
+	l *log.Logger) error {
 	l.Printf("%stag:%s consess:%v common_disconnect_complete local_addr:%s remote_addr:%s\n",
 		exampid, tag, conn.Session(),
 		n.LocalAddr().String(), n.RemoteAddr().String())
 
 	// Close the network connection
-	e = n.Close()
+	e := n.Close()
 	if e != nil {
 		return e
 	}
@@ -402,90 +473,21 @@ func CommonDisconnect(n net.Conn, conn *stompngo.Connection,
 // Common example TLS connect logic
 func CommonTLSConnect(exampid, tag string, l *log.Logger,
 	c *tls.Config) (net.Conn, *stompngo.Connection, error) {
-
-	l.Printf("%stag:%s consess:%s common_tls_connect_starts\n",
-		exampid, tag, Lcs)
-
-	// Set up the connection.
-	h, p := senv.HostAndPort()
-	hap := net.JoinHostPort(h, p)
-	n, e := net.Dial("tcp", hap)
-	if e != nil {
-		return nil, nil, e
-	}
-
-	c.ServerName = h // SNI
-
-	nc := tls.Client(n, c) // Returns: *tls.Conn : implements net.Conn
-	e = nc.Handshake()
-	if e != nil {
-		if e.Error() == "EOF" {
-			l.Printf("%stag:%s consess:%s common_tls_handshake_EOF_Is_the_broker_port_TLS_enabled? port:%s\n",
-				exampid, tag, Lcs,
-				p)
-		}
-		l.Fatalf("%stag:%s consess:%s common_tls_handshake_failed error:%v\n",
-			exampid, tag, Lcs,
-			e.Error())
-	}
-	l.Printf("%stag:%s consess:%s common_tls_handshake_complete\n",
-		exampid, tag, Lcs)
-
-	l.Printf("%stag:%s connsess:%s common_tls_connect_host_and_port:%v\n",
-		exampid, tag, Lcs,
-		hap)
-
-	// Create connect headers and connect to stompngo
-	ch := ConnectHeaders()
-	l.Printf("%stag:%s connsess:%s common_tls_connect_headers headers:%v\n",
-		exampid, tag, Lcs,
-		ch)
-	conn, e := stompngo.Connect(nc, ch)
-	if e != nil {
-		return nil, nil, e
-	}
-	SetLogger(conn)
-	l.Printf("%stag:%s connsess:%s common_tls_connect_complete host:%s vhost:%s protocol:%s server:%s\n",
-		exampid, tag, conn.Session(),
-		h, senv.Vhost(), conn.Protocol(), ServerIdent(conn))
-
-	// Show connect response
-	l.Printf("%stag:%s connsess:%s common_tls_connect_response connresp:%v\n",
-		exampid, tag, conn.Session(),
-		conn.ConnectResponse)
-
-	// Show heartbeat data (if heart beats are being used)
-	if senv.Heartbeats() != "" {
-		l.Printf("%stag:%s connsess:%s common_tls_connect_heart_beat_send hbsend:%v\n",
-			exampid, tag, conn.Session(),
-			conn.SendTickerInterval())
-		l.Printf("%stag:%s connsess:%s common_tls_connect_heart_beat_recv hbrecv:%v\n",
-			exampid, tag, conn.Session(),
-			conn.ReceiveTickerInterval())
-	}
-
-	l.Printf("%stag:%s connsess:%s common_tls_connect_local_addr:%s\n",
-		exampid, tag, conn.Session(),
-		n.LocalAddr().String())
-	l.Printf("%stag:%s connsess:%s common_tls_connect_remote_addr:%s\n",
-		exampid, tag, conn.Session(),
-		n.RemoteAddr().String())
-
-	//
-	return nc, conn, nil
+	rc := runConfig()
+	o := rc.DialOptions(exampid, tag, l)
+	o.TLS = c
+	return rc.connect(context.Background(), o)
 }
 
 // Example destination
 func Dest() string {
-	d := senv.Dest()
-	if os.Getenv("STOMP_ARTEMIS") == "" {
-		return d
-	}
-	pref := "jms.queue"
-	if strings.Index(d, "topic") >= 0 {
-		pref = "jms.topic"
-	}
-	return pref + strings.Replace(d, "/", ".", -1)
+	return artemisDest(senv.Dest())
+}
+
+// Convert a destination name to Artemis form if requested, by STOMP_ARTEMIS
+// or the active broker profile.
+func artemisDest(d string) string {
+	return brokerOrEnv().Destination(d)
 }
 
 // Set Logger
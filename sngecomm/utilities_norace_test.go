@@ -0,0 +1,105 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// stompngo sets and reads its connected flag with no locking, so a test that
+// uses a dropped connection does not run with the race detector.
+
+//go:build !race
+// +build !race
+
+package sngecomm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gmallard/stompngo"
+	"github.com/gmallard/stompngo_examples/sngecomm/testbroker"
+)
+
+/*
+Test that the Handle* helpers end the run when a broker drops the
+connection.
+*/
+func TestHandleFaults(t *testing.T) {
+	fs, e := testbroker.ParseFaults("drop cmd=MESSAGE after=1")
+	if e != nil {
+		t.Fatal(e)
+	}
+	b, e := testbroker.Start(testbroker.Options{Faults: fs})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer b.Close()
+	SetDialFunc(b.Dial)
+	defer SetDialFunc(nil)
+	fatalf = func(f string, a ...interface{}) { panic(fmt.Sprintf(f, a...)) }
+	defer func() { fatalf = llu.Fatalf }()
+	fatal := func(f func()) (s string) {
+		defer func() {
+			if r := recover(); r != nil {
+				s = fmt.Sprint(r)
+			}
+		}()
+		f()
+		return ""
+	}
+	lg := log.New(ioutil.Discard, "", 0)
+	n, conn, e := CommonConnect("test: ", "faults", lg)
+	if e != nil {
+		t.Fatalf("CommonConnect, expected no error, got [%v]\n", e)
+	}
+	defer n.Close()
+	d := "/queue/sngecomm.faults"
+	r := HandleSubscribe(conn, d, "sub1", "client")
+	b.Publish(d, []byte("m1"))
+	b.Publish(d, []byte("m2"))
+	var m stompngo.Message
+	for _, we := range []bool{false, true} {
+		select {
+		case md := <-r:
+			if (md.Error != nil) != we {
+				t.Fatalf("receive, expected error %t, got [%v]\n", we, md.Error)
+			}
+			if !we {
+				m = md.Message
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("receive, timed out")
+		}
+	}
+	// The connection is down once its reader ends
+	for st := time.Now(); conn.Connected(); time.Sleep(5 * time.Millisecond) {
+		if time.Since(st) > 5*time.Second {
+			t.Fatal("Connected, expected false")
+		}
+	}
+	if s := fatal(func() { HandleAck(conn, m.Headers, "sub1") }); !strings.Contains(s, "ack failed") {
+		t.Errorf("HandleAck, expected ack failed, got [%s]\n", s)
+	}
+	if s := fatal(func() { HandleSubscribe(conn, d, "sub2", "auto") }); !strings.Contains(s, "subscribe failed") {
+		t.Errorf("HandleSubscribe, expected subscribe failed, got [%s]\n", s)
+	}
+	// Both messages are requeued, unacked
+	if s := b.Stats(); s.Faults != 1 || s.Acked != 0 || b.Depth(d) != 2 {
+		t.Errorf("Expected 1 fault, and 2 messages requeued, got [%+v] depth %d\n",
+			s, b.Depth(d))
+	}
+}
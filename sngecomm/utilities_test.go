@@ -17,9 +17,20 @@
 package sngecomm
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
 	"os"
+	"strings"
 	"testing"
-	// "github.com/gmallard/stompngo"
+	"time"
+
+	"github.com/gmallard/stompngo"
+	"github.com/gmallard/stompngo_examples/sngecomm/testbroker"
 )
 
 type headersData struct {
@@ -82,3 +93,171 @@ func TestConnectHeaders1x(t *testing.T) {
 		}
 	}
 }
+
+/*
+Test a DISCONNECT confirmed by its receipt, only when that is requested.
+*/
+func TestDisconnectReceipt(t *testing.T) {
+	l, fc := testBroker(t)
+	defer l.Close()
+	for _, dr := range []bool{false, true} {
+		n, conn, e := Dial(dialOpts(l.Addr().String()))
+		if e != nil {
+			t.Fatal(e)
+		}
+		var lb bytes.Buffer
+		cfg := DefaultConfig()
+		cfg.DiscReceipt = dr
+		e = cfg.Disconnect(context.Background(), n, conn, "test: ", "disc",
+			log.New(&lb, "", 0))
+		if e != nil {
+			t.Errorf("Disconnect %t, expected no error, got [%v]\n", dr, e)
+		}
+		nextFrame(t, fc, "DISCONNECT")
+		if c := strings.Contains(lb.String(), "common_disconnect_receipt confirmed:true"); c != dr {
+			t.Errorf("Disconnect %t, expected a confirmed receipt %t, got [%s]\n", dr, dr,
+				lb.String())
+		}
+	}
+}
+
+/*
+Test a DISCONNECT the broker never confirms.
+*/
+func TestDisconnectTimeout(t *testing.T) {
+	l := testServer(t, func(c net.Conn) {
+		defer c.Close()
+		r := bufio.NewReader(c)
+		if _, e := r.ReadString(0); e != nil {
+			return
+		}
+		fmt.Fprintf(c, "CONNECTED\nversion:1.2\nheart-beat:0,0\n\n\x00")
+		for { // Say nothing more
+			if _, e := r.ReadString(0); e != nil {
+				return
+			}
+		}
+	})
+	defer l.Close()
+	n, conn, e := Dial(dialOpts(l.Addr().String()))
+	if e != nil {
+		t.Fatal(e)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	e = CommonDisconnectContext(ctx, n, conn, "test: ", "disc",
+		log.New(ioutil.Discard, "", 0))
+	checkTimeout(t, e, "disconnect")
+}
+
+/*
+Test the common connect, subscribe, ack, nack, unsubscribe and disconnect
+helpers against a test broker, at the configured protocol level.
+*/
+func TestCommonHelpers(t *testing.T) {
+	b, e := testbroker.Start(testbroker.Options{})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer b.Close()
+	SetDialFunc(b.Dial)
+	defer SetDialFunc(nil)
+	lg := log.New(ioutil.Discard, "", 0)
+	n, conn, e := CommonConnect("test: ", "helpers", lg)
+	if e != nil {
+		t.Fatalf("CommonConnect, expected no error, got [%v]\n", e)
+	}
+	if s := ServerIdent(conn); s != "testbroker" {
+		t.Errorf("ServerIdent, expected testbroker, got [%s]\n", s)
+	}
+	d := "/queue/sngecomm.helpers"
+	r := HandleSubscribe(conn, d, "sub1", "client")
+	recv := func() stompngo.Message {
+		select {
+		case md := <-r:
+			return md.Message
+		case <-time.After(5 * time.Second):
+			t.Fatal("receive, timed out")
+		}
+		return stompngo.Message{}
+	}
+	b.Publish(d, []byte("m1"))
+	b.Publish(d, []byte("m2"))
+	m := recv()
+	HandleAck(conn, m.Headers, "sub1")
+	m = recv()
+	if conn.Protocol() != stompngo.SPL_10 {
+		HandleNack(conn, m.Headers, "sub1")
+		if m = recv(); m.Headers.Value("redelivered") != "true" {
+			t.Errorf("HandleNack, expected a redelivery, got [%v]\n", m.Headers)
+		}
+	}
+	HandleAck(conn, m.Headers, "sub1")
+	if !b.WaitFor(5*time.Second, func() bool { return b.Stats().Acked == 2 }) {
+		t.Errorf("HandleAck, expected 2 acks, got [%+v]\n", b.Stats())
+	}
+	// The ack headers for the protocol level
+	want := map[string][]string{
+		stompngo.SPL_10: {"message-id"},
+		stompngo.SPL_11: {"message-id", "subscription"},
+		stompngo.SPL_12: {"id"},
+	}[conn.Protocol()]
+	for _, f := range b.Frames("ACK") {
+		for _, k := range want {
+			if f.Value(k) == "" {
+				t.Errorf("HandleAck %s, expected a %s header, got [%v]\n",
+					conn.Protocol(), k, f.Headers)
+			}
+		}
+	}
+	HandleUnsubscribe(conn, d, "sub1")
+	if e = CommonDisconnect(n, conn, "test: ", "helpers", lg); e != nil {
+		t.Errorf("CommonDisconnect, expected no error, got [%v]\n", e)
+	}
+	if s := b.Stats(); s.Frames["UNSUBSCRIBE"] != 1 || s.Errors != 0 {
+		t.Errorf("Expected an UNSUBSCRIBE and no errors, got [%+v]\n", s)
+	}
+}
+
+/*
+Test that Config.Connect uses its own failover run parameter, not that of the
+most recently loaded Config.
+*/
+func TestConfigConnect(t *testing.T) {
+	b, e := testbroker.Start(testbroker.Options{})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer b.Close()
+	SetDialFunc(b.Dial)
+	defer SetDialFunc(nil)
+	lastConfigLock.Lock()
+	lc := lastConfig
+	lastConfig = DefaultConfig()
+	lastConfig.Failover = "failover:(other:61613)"
+	lastConfigLock.Unlock()
+	defer func() {
+		lastConfigLock.Lock()
+		lastConfig = lc
+		lastConfigLock.Unlock()
+	}()
+	for _, fo := range []string{"", "failover:(broker:61613)"} {
+		var lb bytes.Buffer
+		cfg := DefaultConfig()
+		cfg.Failover = fo
+		n, conn, e := cfg.Connect(context.Background(), "test: ", "config",
+			log.New(&lb, "", 0))
+		if e != nil {
+			t.Fatalf("Connect %q, expected no error, got [%v]\n", fo, e)
+		}
+		if e = cfg.Disconnect(context.Background(), n, conn, "test: ", "config",
+			log.New(ioutil.Discard, "", 0)); e != nil {
+			t.Errorf("Disconnect %q, expected no error, got [%v]\n", fo, e)
+		}
+		if f := strings.Contains(lb.String(), "host_and_port:broker:"); f != (fo != "") ||
+			strings.Contains(lb.String(), "host_and_port:other:") {
+			t.Errorf("Connect %q, expected the failover broker %t, got [%s]\n", fo,
+				fo != "", lb.String())
+		}
+	}
+}
@@ -0,0 +1,296 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package sngecomm
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// WebSocket subprotocols offered, most preferred first.
+var wsProtocols = []string{"v12.stomp", "v11.stomp", "v10.stomp"}
+
+// WebSocket opcodes, RFC 6455.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// wsGUID is the RFC 6455 key suffix for Sec-WebSocket-Accept.
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// wsCloseWait bounds the close frame write.
+const wsCloseWait = time.Second
+
+/*
+wsConn is STOMP over a WebSocket, as a net.Conn.
+
+Reads return the payload of text, binary and continuation frames as one
+byte stream, so STOMP frames may span WebSocket messages.  Pings are
+answered, and a close frame is io.EOF.
+
+Writes are gathered until one ends a STOMP frame (a trailing NUL), or is a
+heartbeat, then sent as one masked message.  Some brokers need each STOMP
+frame in its own message.  The message is text when it is valid UTF-8, and
+binary otherwise.
+*/
+type wsConn struct {
+	net.Conn
+	br       *bufio.Reader
+	left     uint64        // Unread payload in the current frame
+	mask     []byte        // Current frame mask, servers should not mask
+	mo       int           // Mask offset
+	wmu      chan struct{} // Write lock, so Close need not wait for it
+	wb       []byte        // Gathered writes
+	protocol string        // Negotiated subprotocol
+}
+
+// wsAccept is the Sec-WebSocket-Accept value for a key.
+func wsAccept(k string) string {
+	h := sha1.Sum([]byte(k + wsGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// wsHandshake upgrades a connection to a STOMP WebSocket.  path is the
+// request path, and hap the Host header.
+func wsHandshake(n net.Conn, useTLS bool, hap, path string) (*wsConn, error) {
+	kb := make([]byte, 16)
+	if _, e := rand.Read(kb); e != nil {
+		return nil, e
+	}
+	k := base64.StdEncoding.EncodeToString(kb)
+	s := "ws"
+	if useTLS {
+		s = "wss"
+	}
+	u, e := url.Parse(s + "://" + hap + path)
+	if e != nil {
+		return nil, e
+	}
+	rq := &http.Request{Method: "GET", URL: u, Host: hap,
+		Header: http.Header{
+			"Upgrade":                {"websocket"},
+			"Connection":             {"Upgrade"},
+			"Sec-WebSocket-Key":      {k},
+			"Sec-WebSocket-Version":  {"13"},
+			"Sec-WebSocket-Protocol": {strings.Join(wsProtocols, ", ")},
+		}}
+	if e = rq.Write(n); e != nil {
+		return nil, e
+	}
+	br := bufio.NewReader(n)
+	rs, e := http.ReadResponse(br, rq)
+	if e != nil {
+		return nil, e
+	}
+	_ = rs.Body.Close()
+	if rs.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("websocket upgrade %s: %s", path, rs.Status)
+	}
+	if !strings.EqualFold(rs.Header.Get("Upgrade"), "websocket") {
+		return nil, fmt.Errorf("websocket upgrade %s: bad Upgrade %q", path,
+			rs.Header.Get("Upgrade"))
+	}
+	if rs.Header.Get("Sec-WebSocket-Accept") != wsAccept(k) {
+		return nil, fmt.Errorf("websocket upgrade %s: bad Sec-WebSocket-Accept", path)
+	}
+	p := rs.Header.Get("Sec-WebSocket-Protocol")
+	if p != "" && !hasString(wsProtocols, p) {
+		return nil, fmt.Errorf("websocket upgrade %s: unexpected subprotocol %q", path, p)
+	}
+	return &wsConn{Conn: n, br: br, wmu: make(chan struct{}, 1), protocol: p}, nil
+}
+
+// hasString reports whether ss contains s.
+func hasString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Read reads message payload.
+func (w *wsConn) Read(b []byte) (int, error) {
+	for w.left == 0 {
+		op, l, e := w.header()
+		if e != nil {
+			return 0, e
+		}
+		switch op {
+		case wsContinuation, wsText, wsBinary:
+			w.left = l
+		case wsClose, wsPing, wsPong:
+			if l > 125 {
+				return 0, fmt.Errorf("websocket: control frame too long")
+			}
+			p := make([]byte, l)
+			if _, e = io.ReadFull(w.br, p); e != nil {
+				return 0, e
+			}
+			w.unmask(p)
+			switch op {
+			case wsPing:
+				if e = w.send(wsPong, p); e != nil {
+					return 0, e
+				}
+			case wsClose:
+				if len(p) > 2 {
+					p = p[:2] // Echo the status code only
+				}
+				_ = w.send(wsClose, p)
+				return 0, io.EOF
+			}
+		default:
+			return 0, fmt.Errorf("websocket: unknown opcode %d", op)
+		}
+	}
+	if uint64(len(b)) > w.left {
+		b = b[:w.left]
+	}
+	n, e := w.br.Read(b)
+	w.unmask(b[:n])
+	w.left -= uint64(n)
+	return n, e
+}
+
+// header reads a frame header, returning the opcode and payload length.
+func (w *wsConn) header() (byte, uint64, error) {
+	h := make([]byte, 2)
+	if _, e := io.ReadFull(w.br, h); e != nil {
+		return 0, 0, e
+	}
+	op, masked := h[0]&0x0f, h[1]&0x80 != 0
+	l := uint64(h[1] & 0x7f)
+	switch l {
+	case 126:
+		if _, e := io.ReadFull(w.br, h); e != nil {
+			return 0, 0, e
+		}
+		l = uint64(binary.BigEndian.Uint16(h))
+	case 127:
+		x := make([]byte, 8)
+		if _, e := io.ReadFull(w.br, x); e != nil {
+			return 0, 0, e
+		}
+		l = binary.BigEndian.Uint64(x)
+	}
+	w.mask, w.mo = nil, 0
+	if masked {
+		w.mask = make([]byte, 4)
+		if _, e := io.ReadFull(w.br, w.mask); e != nil {
+			return 0, 0, e
+		}
+	}
+	return op, l, nil
+}
+
+// unmask unmasks frame payload, continuing from the last call.
+func (w *wsConn) unmask(b []byte) {
+	if w.mask == nil {
+		return
+	}
+	for i := range b {
+		b[i] ^= w.mask[(w.mo+i)%4]
+	}
+	w.mo = (w.mo + len(b)) % 4
+}
+
+// Write gathers data until it ends a STOMP frame, or is a heartbeat.
+func (w *wsConn) Write(b []byte) (int, error) {
+	w.wmu <- struct{}{}
+	defer func() { <-w.wmu }()
+	w.wb = append(w.wb, b...)
+	n := len(w.wb)
+	if n == 0 || (w.wb[n-1] != 0 && strings.Trim(string(w.wb), "\r\n") != "") {
+		return len(b), nil // More of the frame follows
+	}
+	op := byte(wsText)
+	if !utf8.Valid(w.wb) {
+		op = wsBinary
+	}
+	e := w.frame(op, w.wb)
+	w.wb = w.wb[:0]
+	if e != nil {
+		return 0, e
+	}
+	return len(b), nil
+}
+
+// send writes one control frame.
+func (w *wsConn) send(op byte, p []byte) error {
+	w.wmu <- struct{}{}
+	defer func() { <-w.wmu }()
+	return w.frame(op, p)
+}
+
+// frame writes one final, masked frame.  The caller holds wmu.
+func (w *wsConn) frame(op byte, p []byte) error {
+	f := []byte{0x80 | op, 0x80}
+	switch l := len(p); {
+	case l < 126:
+		f[1] |= byte(l)
+	case l <= 0xffff:
+		f[1] |= 126
+		f = append(f, 0, 0)
+		binary.BigEndian.PutUint16(f[2:], uint16(l))
+	default:
+		f[1] |= 127
+		f = append(f, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(f[2:], uint64(l))
+	}
+	m := make([]byte, 4)
+	if _, e := rand.Read(m); e != nil {
+		return e
+	}
+	f = append(f, m...)
+	for i, c := range p {
+		f = append(f, c^m[i%4])
+	}
+	_, e := w.Conn.Write(f)
+	return e
+}
+
+// Close sends a normal closure, and closes the network connection.  Close
+// unblocks I/O, so the closure is skipped when a write is in progress, and is
+// only given wsCloseWait.
+func (w *wsConn) Close() error {
+	select {
+	case w.wmu <- struct{}{}:
+		_ = w.Conn.SetWriteDeadline(time.Now().Add(wsCloseWait))
+		_ = w.frame(wsClose, []byte{0x03, 0xe8}) // 1000
+		<-w.wmu
+	default:
+	}
+	return w.Conn.Close()
+}
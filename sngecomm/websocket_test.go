@@ -0,0 +1,259 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package sngecomm
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gmallard/stompngo"
+)
+
+// wsMessage is a message received by the WebSocket stand-in.
+type wsMessage struct {
+	op byte
+	p  string
+}
+
+// wsServerFrame writes an unmasked frame.
+func wsServerFrame(w io.Writer, fin bool, op byte, p []byte) {
+	h := []byte{op, byte(len(p))}
+	if fin {
+		h[0] |= 0x80
+	}
+	if len(p) > 125 {
+		h = []byte{h[0], 126, byte(len(p) >> 8), byte(len(p))}
+	}
+	_, _ = w.Write(append(h, p...))
+}
+
+// serveTestWS runs a STOMP over WebSocket stand-in on a listener, relaying
+// to a test broker at hap.  Client messages are sent to mc.  Broker data is
+// sent after a ping, in two fragments.
+func serveTestWS(l net.Listener, hap string, mc chan wsMessage) {
+	go func() {
+		for {
+			c, e := l.Accept()
+			if e != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				br := bufio.NewReader(c)
+				rq, e := http.ReadRequest(br)
+				if e != nil || !strings.Contains(rq.Header.Get("Sec-WebSocket-Protocol"),
+					"v12.stomp") {
+					fmt.Fprintf(c, "HTTP/1.1 400 Bad Request\r\n\r\n")
+					return
+				}
+				fmt.Fprintf(c, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n"+
+					"Connection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n"+
+					"Sec-WebSocket-Protocol: v12.stomp\r\n\r\n",
+					wsAccept(rq.Header.Get("Sec-WebSocket-Key")))
+				bc, e := net.Dial("tcp", hap)
+				if e != nil {
+					return
+				}
+				defer bc.Close()
+				go func() {
+					b := make([]byte, 4096)
+					for {
+						n, e := bc.Read(b)
+						if e != nil {
+							return
+						}
+						wsServerFrame(c, true, wsPing, []byte("p"))
+						h := n / 2
+						wsServerFrame(c, false, wsText, b[:h])
+						wsServerFrame(c, true, wsContinuation, b[h:n])
+					}
+				}()
+				w := &wsConn{Conn: c, br: br}
+				for {
+					op, n, e := w.header()
+					if e != nil {
+						return
+					}
+					p := make([]byte, n)
+					if _, e = io.ReadFull(br, p); e != nil || w.mask == nil {
+						return
+					}
+					w.unmask(p)
+					mc <- wsMessage{op, string(p)}
+					switch op {
+					case wsClose:
+						return
+					case wsText, wsBinary:
+						_, _ = bc.Write(p)
+					}
+				}
+			}(c)
+		}
+	}()
+}
+
+// nextMessage waits for a WebSocket message with a given opcode.
+func nextMessage(t *testing.T, mc chan wsMessage, op byte) wsMessage {
+	for {
+		select {
+		case m := <-mc:
+			if m.op == op {
+				return m
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no WebSocket message, opcode %d", op)
+		}
+	}
+}
+
+/*
+Test STOMP over WebSocket: the upgrade, pings, fragments, and one STOMP
+frame per message.
+*/
+func TestWebSocketDial(t *testing.T) {
+	bl, fc := testBroker(t)
+	defer bl.Close()
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer l.Close()
+	mc := make(chan wsMessage, 64)
+	serveTestWS(l, bl.Addr().String(), mc)
+	o := dialOpts(l.Addr().String())
+	o.Broker.WebSocket = "/stomp"
+	n, conn, e := Dial(o)
+	if e != nil {
+		t.Fatalf("Dial, expected no error, got [%v]\n", e)
+	}
+	defer n.Close()
+	if w, ok := n.(*wsConn); !ok || w.protocol != "v12.stomp" {
+		t.Fatalf("Dial, expected a v12.stomp *wsConn, got [%T]\n", n)
+	}
+	if m := nextMessage(t, mc, wsText); !strings.HasPrefix(m.p, "CONNECT") {
+		t.Errorf("CONNECT message, got [%q]\n", m.p)
+	}
+	nextMessage(t, mc, wsPong) // The CONNECTED frame follows a ping
+	bc := nextFrame(t, fc, "CONNECT").c
+	//
+	big := strings.Repeat("x", 10000)
+	for _, b := range []string{big, "\xff\xfe"} {
+		if e = conn.Send(stompngo.Headers{"destination", "/queue/a"}, b); e != nil {
+			t.Fatalf("Send, expected no error, got [%v]\n", e)
+		}
+	}
+	if m := nextMessage(t, mc, wsText); !strings.HasSuffix(m.p, big+"\x00") {
+		t.Errorf("SEND message, expected one frame per message, got [%d] bytes\n", len(m.p))
+	}
+	if m := nextMessage(t, mc, wsBinary); !strings.HasSuffix(m.p, "\xff\xfe\x00") {
+		t.Errorf("SEND binary message, got [%q]\n", m.p)
+	}
+	//
+	sc, e := subscribe(conn, "/queue/a", "s1", stompngo.AckModeAuto)
+	if e != nil {
+		t.Fatal(e)
+	}
+	nextFrame(t, fc, "SUBSCRIBE")
+	fmt.Fprintf(bc, "MESSAGE\nsubscription:s1\nmessage-id:m1\ndestination:/queue/a\n\nhello\x00")
+	select {
+	case md := <-sc:
+		if md.Error != nil || md.Message.BodyString() != "hello" {
+			t.Errorf("MESSAGE, got [%v] [%q]\n", md.Error, md.Message.BodyString())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no MESSAGE")
+	}
+	if e = CommonDisconnect(n, conn, "test: ", "websocket", o.Logger); e != nil {
+		t.Errorf("Disconnect, got [%v]\n", e)
+	}
+	nextMessage(t, mc, wsClose)
+}
+
+/*
+Test STOMP over WebSocket with TLS, and a refused upgrade.
+*/
+func TestWebSocketTLS(t *testing.T) {
+	bl, fc := testBroker(t)
+	defer bl.Close()
+	l, e := tls.Listen("tcp", "127.0.0.1:0",
+		&tls.Config{Certificates: []tls.Certificate{testCert(t)}})
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer l.Close()
+	serveTestWS(l, bl.Addr().String(), make(chan wsMessage, 64))
+	o := dialOpts(l.Addr().String())
+	o.Broker.WebSocket = "/stomp"
+	o.TLS = &tls.Config{InsecureSkipVerify: true}
+	n, _, e := Dial(o)
+	if e != nil {
+		t.Fatalf("Dial, expected no error, got [%v]\n", e)
+	}
+	n.Close()
+	nextFrame(t, fc, "CONNECT")
+	//
+	hl := testServer(t, func(c net.Conn) {
+		defer c.Close()
+		if _, e := http.ReadRequest(bufio.NewReader(c)); e == nil {
+			fmt.Fprintf(c, "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n")
+		}
+	})
+	defer hl.Close()
+	o = dialOpts(hl.Addr().String())
+	o.Broker.WebSocket = "/nothere"
+	_, _, e = Dial(o)
+	dialErr(t, e, "websocket")
+}
+
+/*
+Test that Close does not wait for a blocked Write, and unblocks it.
+*/
+func TestWebSocketCloseBlocked(t *testing.T) {
+	c, s := net.Pipe() // Nothing reads s, so writes block
+	defer s.Close()
+	w := &wsConn{Conn: c, wmu: make(chan struct{}, 1)}
+	we := make(chan error, 1)
+	go func() {
+		_, e := w.Write([]byte("SEND\n\nbody\x00"))
+		we <- e
+	}()
+	for len(w.wmu) == 0 { // Wait for the Write to hold the lock
+		time.Sleep(time.Millisecond)
+	}
+	ce := make(chan error, 1)
+	go func() { ce <- w.Close() }()
+	select {
+	case <-ce:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close, blocked by a Write")
+	}
+	select {
+	case e := <-we:
+		if e == nil {
+			t.Error("Write, expected an error after Close")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Write, still blocked after Close")
+	}
+}
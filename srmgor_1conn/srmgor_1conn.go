@@ -27,9 +27,10 @@ same STOMP connection.
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
-	"net"
 	"os"
 	"runtime"
 	"sync"
@@ -37,8 +38,6 @@ import (
 
 	//
 	"github.com/gmallard/stompngo"
-	// senv methods could be used in general by stompngo clients.
-	"github.com/gmallard/stompngo/senv"
 	// sngecomm methods are used specifically for these example clients.
 	"github.com/gmallard/stompngo_examples/sngecomm"
 )
@@ -49,40 +48,73 @@ var (
 
 	exampid = "srmgor_1conn: "
 
-	wgs sync.WaitGroup
-	wgr sync.WaitGroup
-	wga sync.WaitGroup
-
-	// We 'stagger' between each message send and message receive for a random
-	// amount of time.
-	// Vary these for experimental purposes.  YMMV.
-	max int64 = 1e9      // Max stagger time (nanoseconds)
-	min int64 = max / 10 // Min stagger time (nanoseconds)
+	lhl = 44
 
-	// Wait flags
-	sw = true
-	rw = true
+	tag = "1conn"
+)
 
-	// Sleep multipliers
-	sf float64 = 1.0
-	rf float64 = 1.0
+// Result is the outcome of a Run.
+type Result struct {
+	Sent     int            // Messages sent
+	Received map[string]int // Messages received and checked, by destination
+	Acked    int
+	Elapsed  time.Duration
+}
 
+// A runner is the state of one Run.
+type runner struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	cfg    *sngecomm.Config
+	ll     *log.Logger
+	conn   *stompngo.Connection
+	// Wait flags
+	sw, rw bool
 	//
-	n    net.Conn             // Network Connection
-	conn *stompngo.Connection // Stomp Connection
+	mu  sync.Mutex
+	r   Result
+	err error // The first error
+}
 
-	lhl = 44
+// A usableError ends the run, but leaves the connection working, so it is
+// disconnected rather than closed.
+type usableError struct{ error }
 
-	tag = "1conn"
-)
+// fail records the first error, and ends the run.
+func (rn *runner) fail(e error) {
+	rn.mu.Lock()
+	if rn.err == nil {
+		rn.err = e
+	}
+	rn.mu.Unlock()
+	rn.cancel()
+}
+
+// stagger waits for a stagger time, or until the run ends.
+func (rn *runner) stagger(tmr *time.Timer, dt time.Duration) bool {
+	tmr.Reset(dt)
+	select {
+	case <-tmr.C:
+	case <-rn.ctx.Done():
+		return false
+	}
+	runtime.Gosched()
+	return true
+}
 
 // Send messages to a particular queue
-func sender(qn, mc int) {
+func (rn *runner) sender(qn, mc int) error {
+	cfg, ll, conn := rn.cfg, rn.ll, rn.conn
 	ltag := tag + "-sender"
 
 	qns := fmt.Sprintf("%d", qn) // string queue number
+	sd := cfg.NewSendDelay(qns)  // Stagger times
 	id := stompngo.Uuid()        // A unique sender id
-	d := sngecomm.Dest() + "." + string(exampid[:len(exampid)-2]) + "." + qns
+	d := cfg.Destination() + "." + string(exampid[:len(exampid)-2]) + "." + qns
+	pg, e := cfg.NewPayloadGenerator(cfg.VariablePayload(), qns) // Bodies
+	if e != nil {
+		return usableError{fmt.Errorf("payload_error qnum:%v error:%v", qn, e)}
+	}
 
 	ll.Printf("%stag:%s connsess:%s queue_info id:%v d:%v qnum:%v mc:%v\n",
 		exampid, ltag, conn.Session(),
@@ -90,7 +122,7 @@ func sender(qn, mc int) {
 	//
 	wh := stompngo.Headers{"destination", d, "senderId", id,
 		"qnum", qns} // send Headers
-	if senv.Persistent() {
+	if cfg.Persistent {
 		wh = wh.Add("persistent", "true")
 	}
 	//
@@ -103,46 +135,57 @@ func sender(qn, mc int) {
 		ll.Printf("%stag:%s connsess:%s send_headers id:%v d:%v qnum:%v headers:%v\n",
 			exampid, ltag, conn.Session(),
 			id, d, qn, sh)
-		e := conn.Send(sh, string(sngecomm.Partial()))
+		e := conn.SendBytes(sh, pg.Next())
 		if e != nil {
-			ll.Fatalf("%stag:%s connsess:%s send_error qnum:%v error:%v",
-				exampid, tag, conn.Session(),
-				qn, e.Error()) // Handle this ......
+			return fmt.Errorf("send_error qnum:%v error:%v", qn, e)
 		}
+		rn.mu.Lock()
+		rn.r.Sent++
+		rn.mu.Unlock()
 		if i == mc {
 			break
 		}
-		if sw {
-			dt := time.Duration(sngecomm.ValueBetween(min, max, sf))
+		if rn.sw {
+			dt := sd.Next()
 			ll.Printf("%stag:%s connsess:%s send_stagger id:%v d:%v qnum:%v stagger:%v\n",
 				exampid, ltag, conn.Session(),
 				id, d, qn, dt)
-			tmr.Reset(dt)
-			_ = <-tmr.C
-			runtime.Gosched()
+			if !rn.stagger(tmr, dt) {
+				return rn.ctx.Err()
+			}
 		}
 	}
 	// Sending is done
 	ll.Printf("%stag:%s connsess:%s finish_info id:%v d:%v qnum:%v mc:%v\n",
 		exampid, ltag, conn.Session(),
 		id, d, qn, mc)
-	wgs.Done()
+	return nil
 }
 
 // Receive messages from a particular queue
-func receiver(qn, mc int) {
+func (rn *runner) receiver(qn, mc int) (e error) {
+	cfg, ll, conn := rn.cfg, rn.ll, rn.conn
 	ltag := tag + "-receiver"
 
 	qns := fmt.Sprintf("%d", qn) // string queue number
-	pbc := sngecomm.Pbc()
+	rd := cfg.NewRecvDelay(qns)  // Stagger times
+	pbc := cfg.Pbc
 	id := stompngo.Uuid() // A unique subscription ID
-	d := sngecomm.Dest() + "." + string(exampid[:len(exampid)-2]) + "." + qns
+	d := cfg.Destination() + "." + string(exampid[:len(exampid)-2]) + "." + qns
 
 	ll.Printf("%stag:%s connsess:%s queue_info id:%v d:%v qnum:%v mc:%v\n",
 		exampid, ltag, conn.Session(),
 		id, d, qn, mc)
 	// Subscribe
-	sc := sngecomm.HandleSubscribe(conn, d, id, sngecomm.AckMode())
+	sc, e := sngecomm.SubscribeContext(rn.ctx, conn, d, id, cfg.AckMode)
+	if e != nil {
+		return e
+	}
+	defer func() {
+		if e != nil { // Stopped early, so keep the connection reader moving
+			go sngecomm.Drain(sc)
+		}
+	}()
 	ll.Printf("%stag:%s connsess:%s subscribe_complete id:%v d:%v qnum:%v mc:%v\n",
 		exampid, ltag, conn.Session(),
 		id, d, qn, mc)
@@ -158,15 +201,17 @@ func receiver(qn, mc int) {
 		select {
 		case md = <-sc:
 		case md = <-conn.MessageData:
-			// A RECEIPT or ERROR frame is unexpected here
-			ll.Fatalf("%stag:%s connsess:%s bad_frame qnum:%v headers:%v body:%s",
-				exampid, tag, conn.Session(),
-				qn, md.Message.Headers, md.Message.Body) // Handle this ......
+			// A RECEIPT or ERROR frame is unexpected here.  Read errors
+			// arrive here too, and are receive errors.
+			if md.Error == nil {
+				return fmt.Errorf("bad_frame qnum:%v command:%v headers:%v body:%s",
+					qn, md.Message.Command, md.Message.Headers, md.Message.Body)
+			}
+		case <-rn.ctx.Done():
+			return rn.ctx.Err()
 		}
 		if md.Error != nil {
-			ll.Fatalf("%stag:%s connsess:%s recv_error qnum:%v error:%v",
-				exampid, tag, conn.Session(),
-				qn, md.Error) // Handle this ......
+			return fmt.Errorf("recv_error qnum:%v error:%v", qn, md.Error)
 		}
 
 		// Process the inbound message .................
@@ -188,38 +233,45 @@ func receiver(qn, mc int) {
 		// Sanity check the message Command, and the queue and message numbers
 		mns := fmt.Sprintf("%d", i) // message number
 		if md.Message.Command != stompngo.MESSAGE {
-			ll.Fatalf("%stag:%s connsess:%s bad_frame qnum:%v command:%v headers:%v body:%v\n",
-				exampid, tag, conn.Session(),
-				qn, md.Message.Command, md.Message.Headers, string(md.Message.Body)) // Handle this ......
-
+			return fmt.Errorf("bad_frame qnum:%v command:%v headers:%v body:%v",
+				qn, md.Message.Command, md.Message.Headers, string(md.Message.Body))
 		}
 		if !md.Message.Headers.ContainsKV("qnum", qns) || !md.Message.Headers.ContainsKV("msgnum", mns) {
-			ll.Fatalf("%stag:%s connsess:%s dirty_message qns:%v msgnum:%v command:%v headers:%v body:%v\n",
-				exampid, tag, conn.Session(),
-				qns, mns, md.Message.Command, md.Message.Headers, string(md.Message.Body)) // Handle this ......) // Handle this ......
+			return usableError{fmt.Errorf("dirty_message qns:%v msgnum:%v command:%v headers:%v",
+				qns, mns, md.Message.Command, md.Message.Headers)}
+		}
+		rn.mu.Lock()
+		rn.r.Received[d]++
+		rn.mu.Unlock()
+
+		// Handle ACKs if needed
+		if cfg.AckMode != "auto" {
+			if e = sngecomm.Ack(conn, md.Message.Headers, id); e != nil {
+				return fmt.Errorf("ack_error qnum:%v error:%v", qn, e)
+			}
+			rn.mu.Lock()
+			rn.r.Acked++
+			rn.mu.Unlock()
 		}
 
 		if i == mc {
 			break
 		}
 
-		if rw {
-			dt := time.Duration(sngecomm.ValueBetween(min, max, rf))
+		if rn.rw {
+			dt := rd.Next()
 			ll.Printf("%stag:%s connsess:%s recv_stagger id:%v d:%v qnum:%v stagger:%v\n",
 				exampid, ltag, conn.Session(),
 				id, d, qn, dt)
-			tmr.Reset(dt)
-			_ = <-tmr.C
-			runtime.Gosched()
-		}
-
-		// Handle ACKs if needed
-		if sngecomm.AckMode() != "auto" {
-			sngecomm.HandleAck(conn, md.Message.Headers, id)
+			if !rn.stagger(tmr, dt) {
+				return rn.ctx.Err()
+			}
 		}
 	}
 	// Unsubscribe
-	sngecomm.HandleUnsubscribe(conn, d, id)
+	if e = sngecomm.Unsubscribe(conn, d, id); e != nil {
+		return e
+	}
 	ll.Printf("%stag:%s connsess:%s unsubscribe_complete id:%v d:%v qnum:%v mc:%v\n",
 		exampid, ltag, conn.Session(),
 		id, d, qn, mc)
@@ -228,126 +280,113 @@ func receiver(qn, mc int) {
 	ll.Printf("%stag:%s connsess:%s recv_end id:%v d:%v qnum:%v mc:%v\n",
 		exampid, ltag, conn.Session(),
 		id, d, qn, mc)
-
-	wgr.Done()
+	return nil
 }
 
 /*
 	Start all sender go routines.
 */
-func startSenders(nqs int) {
+func (rn *runner) startSenders(nqs int) {
+	ll, conn := rn.ll, rn.conn
 	ltag := tag + "-startsenders"
 
 	ll.Printf("%stag:%s connsess:%s queue_count nqs:%v\n",
 		exampid, ltag, conn.Session(),
 		nqs)
 
-	mc := senv.Nmsgs() // message count
+	mc := rn.cfg.Nmsgs // message count
 	ll.Printf("%stag:%s connsess:%s message_count mc:%v\n",
 		exampid, ltag, conn.Session(),
 		mc)
+	var wgs sync.WaitGroup
 	for i := 1; i <= nqs; i++ { // all queues
 		wgs.Add(1)
-		go sender(i, mc)
+		go func(qn int) {
+			defer wgs.Done()
+			if e := rn.sender(qn, mc); e != nil {
+				rn.fail(e)
+			}
+		}(i)
 	}
 	wgs.Wait()
 
 	ll.Printf("%stag:%s connsess:%s ends nqs:%v mc:%v\n",
 		exampid, ltag, conn.Session(),
 		nqs, mc)
-	wga.Done()
 }
 
 /*
 	Start all receiver go routines.
 */
-func startReceivers(nqs int) {
+func (rn *runner) startReceivers(nqs int) {
+	ll, conn := rn.ll, rn.conn
 	ltag := tag + "-startreceivers"
 
 	ll.Printf("%stag:%s connsess:%s queue_count nqs:%v\n",
 		exampid, ltag, conn.Session(),
 		nqs)
 
-	mc := senv.Nmsgs() // get message count
+	mc := rn.cfg.Nmsgs // get message count
 	ll.Printf("%stag:%s connsess:%s message_count mc:%v\n",
 		exampid, ltag, conn.Session(),
 		mc)
 
+	var wgr sync.WaitGroup
 	for i := 1; i <= nqs; i++ { // all queues
 		wgr.Add(1)
-		go receiver(i, mc)
+		go func(qn int) {
+			defer wgr.Done()
+			if e := rn.receiver(qn, mc); e != nil {
+				rn.fail(e)
+			}
+		}(i)
 	}
 	wgr.Wait()
 
 	ll.Printf("%stag:%s connsess:%s ends nqs:%v mc:%v\n",
 		exampid, ltag, conn.Session(),
 		nqs, mc)
-	wga.Done()
 }
 
-// Show a number of writers and readers operating concurrently from unique
-// destinations.
-func main() {
+/*
+Run sends and receives cfg.Nmsgs messages on each of cfg.Nqs queues, with a
+go routine for each sender and receiver, all on one connection.  Receivers
+check that each message has the right queue and message numbers, in order.
+The first error from any go routine ends the run, and is returned.
+*/
+func Run(ctx context.Context, cfg *sngecomm.Config, ll *log.Logger) (Result, error) {
 
 	st := time.Now()
 
-	if sngecomm.LogFile() == "" {
-		ll = log.New(os.Stdout, "E1CN", log.Ldate|log.Lmicroseconds|log.Lshortfile)
-	} else {
-		f, _ := os.Create(sngecomm.LogFile())
-		ll = log.New(f, "E1CN ", log.Ldate|log.Lmicroseconds|log.Lshortfile)
-	}
-
-	sngecomm.ShowRunParmsLogger(exampid, ll)
+	rn := &runner{cfg: cfg, ll: ll, r: Result{Received: map[string]int{}}}
+	rn.ctx, rn.cancel = context.WithCancel(ctx)
+	defer rn.cancel()
 
 	ll.Printf("%stag:%s connsess:%s main_starts\n",
 		exampid, tag, sngecomm.Lcs)
 
-	ll.Printf("%stag:%s connsess:%s main_profiling pprof:%v\n",
-		exampid, tag, sngecomm.Lcs,
-		sngecomm.Pprof())
-
-	ll.Printf("%stag:%s connsess:%s main_current_GOMAXPROCS gmp:%v\n",
-		exampid, tag, sngecomm.Lcs,
-		runtime.GOMAXPROCS(-1))
-
-	if sngecomm.SetMAXPROCS() {
-		nc := runtime.NumCPU()
-		ll.Printf("%stag:%s connsess:%s main_current_num_cpus cncpu:%v\n",
-			exampid, tag, sngecomm.Lcs,
-			nc)
-		gmp := runtime.GOMAXPROCS(nc)
-		ll.Printf("%stag:%s connsess:%s main_previous_num_cpus pncpu:%v\n",
-			exampid, tag, sngecomm.Lcs,
-			gmp)
-		ll.Printf("%stag:%s connsess:%s main_current_GOMAXPROCS gmp:%v\n",
-			exampid, tag, sngecomm.Lcs,
-			runtime.GOMAXPROCS(-1))
-	}
 	// Wait flags
-	sw = sngecomm.SendWait()
-	rw = sngecomm.RecvWait()
-	sf = sngecomm.SendFactor()
-	rf = sngecomm.RecvFactor()
-	ll.Printf("%stag:%s connsess:%s main_wait_sleep_factors sw:%v rw:%v sf:%v rf:%v\n",
+	rn.sw = cfg.SendWait
+	rn.rw = cfg.RecvWait
+	ll.Printf("%stag:%s connsess:%s main_wait_sleep_factors sw:%v rw:%v sf:%v rf:%v sd:%v rd:%v\n",
 		exampid, tag, sngecomm.Lcs,
-		sw, rw, sf, rf)
+		rn.sw, rn.rw, cfg.SendFactor, cfg.RecvFactor, cfg.SendDelay, cfg.RecvDelay)
 	// Number of queues
-	nqs := sngecomm.Nqs()
+	nqs := cfg.Nqs
 
 	// Standard example connect sequence
-	var e error
-	n, conn, e = sngecomm.CommonConnect(exampid, tag, ll)
+	cctx, cancel := cfg.OpContext(ctx)
+	n, conn, e := cfg.Connect(cctx, exampid, tag, ll)
+	cancel()
 	if e != nil {
 		if conn != nil {
 			ll.Printf("%stag:%s  connsess:%s Connect Response headers:%v body%s\n",
 				exampid, tag, conn.Session(), conn.ConnectResponse.Headers,
 				string(conn.ConnectResponse.Body))
 		}
-		ll.Fatalf("%stag:%s connsess:%s main_on_connect error:%v",
-			exampid, tag, sngecomm.Lcs,
-			e.Error()) // Handle this ......
+		return rn.r, e
 	}
+	rn.conn = conn
 
 	// Many receivers running under the same connection can cause
 	// (wire read) performance issues.  This is *very* dependent on the broker
@@ -357,31 +396,111 @@ func main() {
 	// received from the wire as soon as possible.  Those messages are then
 	// buffered internally for (possibly later) application processing. In
 	// this example, buffering occurs in the stompngo package.
-	conn.SetSubChanCap(senv.SubChanCap()) // Experiment with this value, YMMV
+	conn.SetSubChanCap(cfg.SubChanCap) // Experiment with this value, YMMV
 
 	// Run everything
+	var wga sync.WaitGroup
 	wga.Add(2)
-	go startReceivers(nqs)
-	go startSenders(nqs)
+	go func() {
+		defer wga.Done()
+		rn.startReceivers(nqs)
+	}()
+	go func() {
+		defer wga.Done()
+		rn.startSenders(nqs)
+	}()
 	wga.Wait()
+	rn.mu.Lock()
+	re := rn.err
+	rn.mu.Unlock()
+	if re != nil {
+		ue, ok := re.(usableError)
+		if !ok { // The connection failed, or the broker is not answering
+			_ = n.Close()
+			return rn.r, re
+		}
+		re = ue.error
+	}
 
-	// Standard example disconnect sequence
-	e = sngecomm.CommonDisconnect(n, conn, exampid, tag, ll)
+	// Standard example disconnect sequence, after a usable error too
+	e = cfg.Disconnect(ctx, n, conn, exampid, tag, ll)
+	if re != nil {
+		return rn.r, re
+	}
 	if e != nil {
-		ll.Fatalf("%stag:%s connsess:%s main_on_disconnect error:%v",
-			exampid, tag, conn.Session(),
-			e.Error()) // Handle this ......
+		return rn.r, e
 	}
 
 	sngecomm.ShowStatsLogger(exampid, tag, conn, ll)
 
+	rn.r.Elapsed = time.Now().Sub(st)
 	ll.Printf("%stag:%s connsess:%s main_elapsed:%v\n",
 		exampid, tag, conn.Session(),
-		time.Now().Sub(st))
+		rn.r.Elapsed)
+
+	if cfg.TrackElt {
+		// Elapsed time tracking is not in every stompngo version
+		if et, ok := interface{}(conn).(interface {
+			ShowEltd(*log.Logger)
+			ShowEltdCsv()
+		}); ok {
+			et.ShowEltd(ll)
+			et.ShowEltdCsv()
+		} else {
+			ll.Printf("%stag:%s connsess:%s main_trackelt unsupported\n",
+				exampid, tag, conn.Session())
+		}
+	}
+	return rn.r, nil
+}
+
+// Show a number of writers and readers operating concurrently from unique
+// destinations.
+func main() {
+
+	cfg, e := sngecomm.LoadConfig(flag.CommandLine, os.Args[1:])
+	if e != nil {
+		log.Fatalf("%stag:%s connsess:%s main_config error:%v",
+			exampid, tag, sngecomm.Lcs,
+			e.Error()) // Handle this ......
+	}
+
+	if cfg.LogFile == "" {
+		ll = log.New(os.Stdout, "E1CN", log.Ldate|log.Lmicroseconds|log.Lshortfile)
+	} else {
+		f, _ := os.Create(cfg.LogFile)
+		ll = log.New(f, "E1CN ", log.Ldate|log.Lmicroseconds|log.Lshortfile)
+	}
 
-	if os.Getenv("STOMP_TRACKELT") != "" {
-		conn.ShowEltd(ll)
-		conn.ShowEltdCsv()
+	cfg.ShowRunParms(exampid, ll)
+
+	ll.Printf("%stag:%s connsess:%s main_profiling pprof:%v\n",
+		exampid, tag, sngecomm.Lcs,
+		cfg.Pprof)
+
+	ll.Printf("%stag:%s connsess:%s main_current_GOMAXPROCS gmp:%v\n",
+		exampid, tag, sngecomm.Lcs,
+		runtime.GOMAXPROCS(-1))
+
+	if cfg.SetMaxProcs {
+		nc := runtime.NumCPU()
+		ll.Printf("%stag:%s connsess:%s main_current_num_cpus cncpu:%v\n",
+			exampid, tag, sngecomm.Lcs,
+			nc)
+		gmp := runtime.GOMAXPROCS(nc)
+		ll.Printf("%stag:%s connsess:%s main_previous_num_cpus pncpu:%v\n",
+			exampid, tag, sngecomm.Lcs,
+			gmp)
+		ll.Printf("%stag:%s connsess:%s main_current_GOMAXPROCS gmp:%v\n",
+			exampid, tag, sngecomm.Lcs,
+			runtime.GOMAXPROCS(-1))
+	}
+
+	r, e := Run(context.Background(), cfg, ll)
+	if e != nil {
+		ll.Fatalf("%stag:%s connsess:%s main_run sent:%d error:%v",
+			exampid, tag, sngecomm.Lcs,
+			r.Sent, e.Error()) // Handle this ......
 	}
 
 	time.Sleep(250 * time.Millisecond)
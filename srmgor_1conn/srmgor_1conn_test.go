@@ -0,0 +1,106 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gmallard/stompngo_examples/sngecomm/testbroker"
+	"github.com/gmallard/stompngo_examples/sngecomm/testbroker/brokertest"
+)
+
+/*
+Test srmgor_1conn against a test broker, with auto and client acks.
+*/
+func TestRun(t *testing.T) {
+	lg := log.New(ioutil.Discard, "", 0)
+	for _, am := range []string{"auto", "client", "client-individual"} {
+		b, cfg, done := brokertest.Start(t, testbroker.Options{})
+		//
+		cfg.Dest = "/queue/srmgor.test"
+		cfg.Nqs, cfg.Nmsgs, cfg.Mdml = 3, 5, 100
+		cfg.AckMode = am
+		cfg.SendWait, cfg.RecvWait = false, false
+		r, e := Run(context.Background(), cfg, lg)
+		done()
+		if e != nil {
+			t.Fatalf("%s, expected no error, got [%v]\n", am, e)
+		}
+		wa := 0
+		if am != "auto" {
+			wa = 15
+		}
+		if r.Sent != 15 || r.Acked != wa || len(r.Received) != 3 {
+			t.Fatalf("%s, expected 15 sent, %d acked, 3 queues, got [%+v]\n", am, wa, r)
+		}
+		s := b.Stats()
+		if s.Connections != 1 || s.Delivered != 15 || s.Acked != wa || s.Redelivered != 0 {
+			t.Errorf("%s, expected 1 connection, 15 delivered, %d acked, got [%+v]\n",
+				am, wa, s)
+		}
+		// Message numbers are in order for each queue
+		next := map[string]int{}
+		for _, f := range b.Frames("SEND") {
+			d := f.Value("destination")
+			next[d]++
+			if f.Value("msgnum") != strconv.Itoa(next[d]) {
+				t.Errorf("%s, %s expected msgnum %d, got [%v]\n", am, d, next[d], f.Headers)
+			}
+		}
+		for q := 1; q <= cfg.Nqs; q++ {
+			d := fmt.Sprintf("%s.srmgor_1conn.%d", cfg.Dest, q)
+			if r.Received[d] != 5 || next[d] != 5 || b.Unacked(d) != 0 || b.Depth(d) != 0 {
+				t.Errorf("%s, %s expected 5 sent and received, got %d and %d\n", am, d,
+					next[d], r.Received[d])
+			}
+		}
+	}
+}
+
+/*
+Test that a receiver fails on a repeated message.
+*/
+func TestRunDirty(t *testing.T) {
+	d2 := "/queue/srmgor.dirty.srmgor_1conn.2"
+	fs, e := testbroker.ParseFaults("redeliver dest=" + d2 + " after=2 count=1")
+	if e != nil {
+		t.Fatal(e)
+	}
+	b, cfg, done := brokertest.Start(t, testbroker.Options{Faults: fs})
+	defer done()
+	//
+	cfg.Dest = "/queue/srmgor.dirty"
+	cfg.Nqs, cfg.Nmsgs, cfg.Mdml = 3, 5, 100
+	cfg.SendWait, cfg.RecvWait = false, false
+	r, e := Run(context.Background(), cfg, log.New(ioutil.Discard, "", 0))
+	if e == nil || !strings.HasPrefix(e.Error(), "dirty_message qns:2 msgnum:4") ||
+		!strings.Contains(e.Error(), "redelivered:true") {
+		t.Fatalf("Run, expected a dirty message, got [%v]\n", e)
+	}
+	if r.Received[d2] != 3 || r.Sent != 15 {
+		t.Errorf("Run, expected 15 sent, 3 received from %s, got [%+v]\n", d2, r)
+	}
+	if s := b.Stats(); s.Faults != 1 || s.Redelivered != 1 {
+		t.Errorf("Stats, expected 1 fault and redelivery, got [%+v]\n", s)
+	}
+}
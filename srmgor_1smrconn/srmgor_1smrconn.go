@@ -21,25 +21,24 @@
 /*
 Send and receive many STOMP messages using multiple queues and goroutines
 to service each send or receive instance. All senders use one STOMP connection.
-All receivers are balanced across multiple STOMP connections.  Balancing
-configuration is taken from environment variables.
+All receivers are balanced across a pool of STOMP connections.  The pool is
+configured with STOMP_POOL (e.g. leastloaded:1,4), or STOMP_RECVCONNS.
 */
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
 	"net"
 	"os"
 	"runtime"
-	"strconv"
 	"sync"
 	"time"
 
 	//
 	"github.com/gmallard/stompngo"
-	// senv methods could be used in general by stompngo clients.
-	"github.com/gmallard/stompngo/senv"
 	// sngecomm methods are used specifically for these example clients.
 	"github.com/gmallard/stompngo_examples/sngecomm"
 )
@@ -47,79 +46,112 @@ import (
 var (
 	exampid = "srmgor_1smrconn: "
 
-	// We 'stagger' between each message send and message receive for a random
-	// amount of time.
-	// Vary these for experimental purposes.  YMMV.
-	max int64 = 1e9      // Max stagger time (nanoseconds)
-	min int64 = max / 10 // Min stagger time (nanoseconds)
-
-	// Wait flags
-	sw = true
-	rw = true
+	ll *log.Logger
 
-	// Sleep multipliers
-	sf float64 = 1.0
-	rf float64 = 1.0
+	tag = "1smrconn"
+)
 
-	lhl = 44
+// Result is the outcome of a Run.
+type Result struct {
+	Sent     int            // Messages sent
+	Received map[string]int // Messages received and checked, by destination
+	Acked    int
+	Pool     sngecomm.PoolStats // The receiver pool
+	Elapsed  time.Duration
+}
 
-	wgs sync.WaitGroup
-	wgr sync.WaitGroup
-	wga sync.WaitGroup
+// A runner is the state of one Run.
+type runner struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	cfg    *sngecomm.Config
+	ll     *log.Logger
+	// Wait flags
+	sw, rw bool
+	//
+	mu  sync.Mutex
+	r   Result
+	err error // The first error
+}
 
-	ll *log.Logger
+// fail records the first error, and ends the run.
+func (rn *runner) fail(e error) {
+	rn.mu.Lock()
+	if rn.err == nil {
+		rn.err = e
+	}
+	rn.mu.Unlock()
+	rn.cancel()
+}
 
-	tag = "1smrconn"
-)
+// stagger waits for a stagger time, or until the run ends.
+func (rn *runner) stagger(tmr *time.Timer, dt time.Duration) bool {
+	tmr.Reset(dt)
+	select {
+	case <-tmr.C:
+	case <-rn.ctx.Done():
+		return false
+	}
+	runtime.Gosched()
+	return true
+}
 
 /*
 openSconn opens a stompngo Connection.
 */
-func openSconn() (net.Conn, *stompngo.Connection) {
+func (rn *runner) openSconn() (net.Conn, *stompngo.Connection, error) {
 	ltag := tag + "-opensconn"
 
 	// Standard example connect sequence
-	n, conn, e := sngecomm.CommonConnect(exampid, ltag, ll)
-	if e != nil {
-		ll.Fatalf("%stag:%s consess:%s connect_error error:%s\n",
-			exampid, ltag, sngecomm.Lcs,
-			e.Error()) // Handle this ......
-	}
-	return n, conn
+	ctx, cancel := rn.cfg.OpContext(rn.ctx)
+	defer cancel()
+	return rn.cfg.Connect(ctx, exampid, ltag, rn.ll)
 }
 
 /*
 closeSconn closes a stompngo Connection.
 */
-func closeSconn(n net.Conn, conn *stompngo.Connection) {
+func (rn *runner) closeSconn(n net.Conn, conn *stompngo.Connection) error {
 	ltag := tag + "-closesconn"
 
 	// Standard example disconnect sequence
-	e := sngecomm.CommonDisconnect(n, conn, exampid, ltag, ll)
-	if e != nil {
-		ll.Fatalf("%stag:%s connsess:%s disconnect_error error:%s\n",
-			exampid, ltag, conn.Session(),
-			e.Error()) // Handle this ......
-	}
-	return
+	return rn.cfg.Disconnect(context.Background(), n, conn, exampid, ltag, rn.ll)
 }
 
 /*
-runReceive receives all messages from a specified queue.
+runReceive receives all messages from a specified queue, using a connection
+checked out from the receiver pool.
 */
-func runReceive(conn *stompngo.Connection, q int, w *sync.WaitGroup) {
+func (rn *runner) runReceive(p *sngecomm.Pool, q int) (e error) {
+	cfg, ll := rn.cfg, rn.ll
 	ltag := tag + "-runreceive"
 
+	pc, e := p.CheckoutContext(rn.ctx)
+	if e != nil {
+		return fmt.Errorf("checkout_error q:%d error:%v", q, e)
+	}
+	defer p.Return(pc)
+	conn := pc.Conn()
+
 	qns := fmt.Sprintf("%d", q) // queue number
+	rd := cfg.NewRecvDelay(qns) // Stagger times
 	id := stompngo.Uuid()       // A unique subscription ID
-	d := sngecomm.Dest() + "." + string(exampid[:len(exampid)-2]) + "." + qns
+	d := cfg.Destination() + "." + string(exampid[:len(exampid)-2]) + "." + qns
 
-	ll.Printf("%stag:%s connsess:%s starts id:%s qns:%s d:%s\n",
+	ll.Printf("%stag:%s connsess:%s starts id:%s qns:%s d:%s pooled_conn:%d\n",
 		exampid, ltag, conn.Session(),
-		id, qns, d)
+		id, qns, d, pc.ID())
 
 	// Subscribe (use common helper)
-	sc := sngecomm.HandleSubscribe(conn, d, id, sngecomm.AckMode())
+	sc, e := sngecomm.SubscribeContext(rn.ctx, conn, d, id, cfg.AckMode)
+	if e != nil {
+		return e
+	}
+	defer func() {
+		if e != nil { // Stopped early, so keep the connection reader moving
+			go sngecomm.Drain(sc)
+		}
+	}()
 	ll.Printf("%stag:%s connsess:%s subscribe_done id:%s qns:%s d:%s\n",
 		exampid, ltag, conn.Session(),
 		id, qns, d)
@@ -127,9 +159,9 @@ func runReceive(conn *stompngo.Connection, q int, w *sync.WaitGroup) {
 	//
 	tmr := time.NewTimer(100 * time.Hour)
 
-	pbc := sngecomm.Pbc() // Print byte count
+	pbc := cfg.Pbc // Print byte count
 
-	nmsgs := senv.Nmsgs()
+	nmsgs := cfg.Nmsgs
 
 	// Receive loop
 	var md stompngo.MessageData
@@ -140,16 +172,18 @@ func runReceive(conn *stompngo.Connection, q int, w *sync.WaitGroup) {
 		select {
 		case md = <-sc:
 		case md = <-conn.MessageData:
-			// Frames RECEIPT or ERROR not expected here
-			ll.Fatalf("%stag:%s connsess:%s send_error qns:%v md:%v",
-				exampid, ltag, conn.Session(),
-				qns, md) // Handle this ......
+			// Frames RECEIPT or ERROR not expected here.  Read errors
+			// arrive here too, and are receive errors.
+			if md.Error == nil {
+				return fmt.Errorf("bad_frame qns:%v command:%v headers:%v",
+					qns, md.Message.Command, md.Message.Headers)
+			}
+		case <-rn.ctx.Done():
+			return rn.ctx.Err()
 		}
 
 		if md.Error != nil {
-			ll.Fatalf("%stag:%s connsess:%s receive_error qns:%v error:%v\n",
-				exampid, ltag, conn.Session(),
-				qns, md.Error)
+			return fmt.Errorf("receive_error qns:%v error:%v", qns, md.Error)
 		}
 
 		// Process the inbound message .................
@@ -159,15 +193,16 @@ func runReceive(conn *stompngo.Connection, q int, w *sync.WaitGroup) {
 		// Sanity check the message Command, and the queue and message numbers
 		mns := fmt.Sprintf("%d", mc) // string message number
 		if md.Message.Command != stompngo.MESSAGE {
-			ll.Fatalf("%stag:%s connsess:%s bad_frame qns:%s mc:%d md:%v\n",
-				exampid, ltag, conn.Session(),
-				qns, mc, md)
+			return fmt.Errorf("bad_frame qns:%s mc:%d command:%v headers:%v",
+				qns, mc, md.Message.Command, md.Message.Headers)
 		}
 		if !md.Message.Headers.ContainsKV("qnum", qns) || !md.Message.Headers.ContainsKV("msgnum", mns) {
-			ll.Fatalf("%stag:%s connsess:%s dirty_message qns:%v msgnum:%v md:%v",
-				exampid, tag, conn.Session(),
-				qns, mns, md) // Handle this ......
+			return fmt.Errorf("dirty_message qns:%v msgnum:%v headers:%v",
+				qns, mns, md.Message.Headers)
 		}
+		rn.mu.Lock()
+		rn.r.Received[d]++
+		rn.mu.Unlock()
 
 		sl := len(md.Message.Body)
 		if pbc > 0 {
@@ -183,234 +218,227 @@ func runReceive(conn *stompngo.Connection, q int, w *sync.WaitGroup) {
 			md.Message.Headers.Value("msgnum"))
 
 		// Handle ACKs if needed
-		if sngecomm.AckMode() != "auto" {
-			ah := stompngo.Headers{}
-			sngecomm.HandleAck(conn, ah, id)
+		if cfg.AckMode != "auto" {
+			if e = sngecomm.Ack(conn, md.Message.Headers, id); e != nil {
+				return fmt.Errorf("ack_error qns:%v error:%v", qns, e)
+			}
+			rn.mu.Lock()
+			rn.r.Acked++
+			rn.mu.Unlock()
 		}
 		if mc == nmsgs {
 			break
 		}
-		if rw {
-			dt := time.Duration(sngecomm.ValueBetween(min, max, rf))
+		if rn.rw {
+			dt := rd.Next()
 			ll.Printf("%stag:%s connsess:%s recv_stagger dt:%v qns:%s mc:%d\n",
 				exampid, ltag, conn.Session(),
 				dt, qns, mc)
-			tmr.Reset(dt)
-			_ = <-tmr.C
-			runtime.Gosched()
+			if !rn.stagger(tmr, dt) {
+				return rn.ctx.Err()
+			}
 		}
 	}
 	// Unsubscribe
-	sngecomm.HandleUnsubscribe(conn, d, id)
-
+	if e = sngecomm.Unsubscribe(conn, d, id); e != nil {
+		return e
+	}
 	ll.Printf("%stag:%s connsess:%s runRecieve_ends id:%s qns:%s\n",
 		exampid, ltag, conn.Session(),
 		id, qns)
-	w.Done()
+	return nil
 }
 
 /*
-receiverConnection starts individual receivers for this connection.
+startReceivers creates the receiver connection pool, and starts one receiver
+for each destination.  The pool is taken from STOMP_POOL, or else built from
+STOMP_RECVCONNS.
 */
-func receiverConnection(conn *stompngo.Connection, cn, qpc int) {
-	ltag := tag + "-receiverconnection"
-
-	ll.Printf("%stag:%s connsess:%s starts cn:%d qpc:%d\n",
-		exampid, ltag, conn.Session(),
-		cn, qpc)
-
-	// cn -> a connection number: 1..n
-	// qpc -> destinations per connection
-	// Ex:
-	// 1, 2
-	// 2, 2
-	// 3, 2
-
-	// This code runs *once* for each connection
-
-	// These calcs are what causes a skip below.  It is a safety valve to keep
-	// from starting one too many connections.
-	cb := cn - 1       // this connection number, zero based
-	q1 := qpc*cb + 1   // 1st queue number
-	ql := q1 + qpc - 1 // last queue number
-	if ql > sngecomm.Nqs() {
-		ql = sngecomm.Nqs() // truncate last if over max destinations
-	}
-
-	var wgrconn sync.WaitGroup
-
-	var skipped bool
-	if q1 <= ql {
-		ll.Printf("%stag:%s connsess:%s startq cn:%d q1:%d ql: %d\n",
-			exampid, ltag, conn.Session(),
-			cn, q1, ql)
-		skipped = false
-	} else {
-		// Skips are possible, at least with the current calling code, see above
-		ll.Printf("%stag:%s connsess:%s startskip cn:%d q1:%d ql: %d\n",
-			exampid, ltag, conn.Session(),
-			cn, q1, ql)
-		skipped = true
-	}
-
-	for q := q1; q <= ql; q++ {
-		wgrconn.Add(1)
-		go runReceive(conn, q, &wgrconn)
-	}
-	wgrconn.Wait()
-	//
-	ll.Printf("%stag:%s connsess:%s ends cn:%d qpc:%d skipped:%t\n",
-		exampid, ltag, conn.Session(),
-		cn, qpc, skipped)
-	wgr.Done()
-}
-
-/*
-startReceivers creates connections per environment variables, and starts each
-connection.
-*/
-func startReceivers() {
+func (rn *runner) startReceivers() error {
+	cfg, ll := rn.cfg, rn.ll
 
 	ltag := tag + "-startreceivers"
 
-	// This was a performance experiment.  With number of connections.
-	// My recollection is that it did not work out.
-	// However ..... I will leave this code in place for now.
-
 	// Figure out number of receiver connections wanted
-	nrc := sngecomm.Nqs() // 1 receiver per each destination
-	nqs := nrc            // Number of queues (destinations) starts the same
-
-	if s := os.Getenv("STOMP_RECVCONNS"); s != "" {
-		i, e := strconv.ParseInt(s, 10, 32)
-		if nil != e {
-			ll.Fatalf("%stag:%s connsess:%s RECVCONNS_conversion_error error:%v\n",
-				exampid, ltag, sngecomm.Lcs,
-				e.Error())
-		} else {
-			nrc = int(i)
-		}
-	}
-
-	// Limit max receiver connection count to number of destinations
-	if nrc > nqs {
-		nrc = nqs
+	nrc := cfg.Nqs // 1 receiver per each destination
+	if cfg.RecvConns > 0 && cfg.RecvConns < nrc {
+		nrc = cfg.RecvConns
 	}
-
-	// Next calc. destinations per receiver
-	dpr := nqs / nrc // Calculation first guess.
-	if nqs%nrc != 0 {
-		dpr += 1 // Bump destinations per receiver by 1.
-	}
-	// Destinations per receiver must be at least 1
-	if dpr == 0 {
-		dpr = 1
+	po, e := cfg.PoolOptions(fmt.Sprintf("%s:%d", sngecomm.RoundRobin, nrc))
+	if e != nil {
+		return e
 	}
+	po.Dial = cfg.DialOptions(exampid, ltag, ll)
 
-	ll.Printf("%stag:%s connsess:%s start nrc:%d dpr:%d\n",
+	ll.Printf("%stag:%s connsess:%s start strategy:%s min:%d max:%d\n",
 		exampid, ltag, sngecomm.Lcs,
-		nrc, dpr)
-
-	// So the idea seems to be allow more than one destination per receiver
-	ncm := make([]net.Conn, 0)
-	csm := make([]*stompngo.Connection, 0)
-	for c := 1; c <= nrc; c++ { // :-)
-		n, conn := openSconn()
-		ncm = append(ncm, n)
-		csm = append(csm, conn)
+		po.Strategy, po.Min, po.Max)
+
+	ctx, cancel := cfg.OpContext(rn.ctx)
+	p, e := sngecomm.NewPool(ctx, po)
+	cancel()
+	if e != nil {
+		return e
+	}
+	var wgr sync.WaitGroup
+	for q := 1; q <= cfg.Nqs; q++ {
 		wgr.Add(1)
-		ll.Printf("%stag:%s connsess:%s connstart conn_number:%d nrc:%d dpr:%d\n",
-			exampid, ltag, conn.Session(),
-			c, nrc, dpr)
-		go receiverConnection(conn, c, dpr)
+		go func(q int) {
+			defer wgr.Done()
+			if e := rn.runReceive(p, q); e != nil {
+				rn.fail(e)
+			}
+		}(q)
 	}
 	wgr.Wait()
-	ll.Printf("%stag:%s connsess:%s wait_done nrc:%d dpr:%d\n",
+	ll.Printf("%stag:%s connsess:%s wait_done nqs:%d\n",
 		exampid, ltag, sngecomm.Lcs,
-		nrc, dpr)
+		cfg.Nqs)
+	sngecomm.ShowPoolStats(exampid, ltag, p)
+	p.Close()
+	rn.mu.Lock()
+	rn.r.Pool = p.Stats()
+	rn.mu.Unlock()
 	//
-	for c := 1; c <= nrc; c++ {
-		ll.Printf("%stag:%s connsess:%s connend conn_number:%d nrc:%d dpr:%d\n",
-			exampid, ltag, csm[c-1].Session(),
-			c, nrc, dpr)
-		sngecomm.ShowStats(exampid, ltag, csm[c-1])
-		closeSconn(ncm[c-1], csm[c-1])
-	}
-	//
-	wga.Done()
+	return nil
 }
 
 /*
 runSender sends all messages to a specified queue.
 */
-func runSender(conn *stompngo.Connection, qns string) {
+func (rn *runner) runSender(conn *stompngo.Connection, qns string) error {
+	cfg, ll := rn.cfg, rn.ll
 	ltag := tag + "-runsender"
+	sd := cfg.NewSendDelay(qns)                                  // Stagger times
+	pg, e := cfg.NewPayloadGenerator(cfg.VariablePayload(), qns) // Bodies
+	if e != nil {
+		return fmt.Errorf("payload_error qns:%v error:%v", qns, e)
+	}
 
-	d := sngecomm.Dest() + "." + string(exampid[:len(exampid)-2]) + "." + qns
+	d := cfg.Destination() + "." + string(exampid[:len(exampid)-2]) + "." + qns
 	id := stompngo.Uuid() // A unique sender id
 	ll.Printf("%stag:%s connsess:%s start id:%s dest:%s\n",
 		exampid, ltag, conn.Session(),
 		id, d)
 	wh := stompngo.Headers{"destination", d, "senderId", id,
 		"qnum", qns} // basic send Headers
-	if senv.Persistent() {
+	if cfg.Persistent {
 		wh = wh.Add("persistent", "true")
 	}
 	tmr := time.NewTimer(100 * time.Hour)
-	nmsgs := senv.Nmsgs()
+	nmsgs := cfg.Nmsgs
 	for mc := 1; mc <= nmsgs; mc++ {
 		sh := append(wh, "msgnum", fmt.Sprintf("%d", mc))
 		// Generate a message to send ...............
 		ll.Printf("%stag:%s  connsess:%s send id:%s qns:%s mc:%d\n",
 			exampid, ltag, conn.Session(),
 			id, qns, mc)
-		e := conn.Send(sh, string(sngecomm.Partial()))
+		e := conn.SendBytes(sh, pg.Next())
 		if e != nil {
-			ll.Fatalf("%stag:%s connsess:%s send_error qns:%v error:%v",
-				exampid, ltag, conn.Session(),
-				qns, e.Error()) // Handle this ......
+			return fmt.Errorf("send_error qns:%v error:%v", qns, e)
 		}
+		rn.mu.Lock()
+		rn.r.Sent++
+		rn.mu.Unlock()
 		if mc == nmsgs {
 			break
 		}
-		if sw {
-			dt := time.Duration(sngecomm.ValueBetween(min, max, sf))
+		if rn.sw {
+			dt := sd.Next()
 			ll.Printf("%stag:%s connsess:%s send_stagger dt:%v qns:%s mc:%d\n",
 				exampid, ltag, conn.Session(),
 				dt, qns, mc)
-			tmr.Reset(dt)
-			_ = <-tmr.C
-			runtime.Gosched()
+			if !rn.stagger(tmr, dt) {
+				return rn.ctx.Err()
+			}
 		}
 	}
 	ll.Printf("%stag:%s connsess:%s end id:%s dest:%s\n",
 		exampid, ltag, conn.Session(),
 		id, d)
 	//
-	wgs.Done()
+	return nil
 }
 
 /*
 startSender initializes the single send connection, and starts one sender go
 for each destination.
 */
-func startSender() {
+func (rn *runner) startSender() error {
 	ltag := tag + "-startsender"
 
-	n, conn := openSconn()
-	ll.Printf("%stag:%s connsess:%s start\n",
+	n, conn, e := rn.openSconn()
+	if e != nil {
+		return e
+	}
+	rn.ll.Printf("%stag:%s connsess:%s start\n",
 		exampid, ltag, conn.Session())
-	for i := 1; i <= sngecomm.Nqs(); i++ {
+	var wgs sync.WaitGroup
+	for i := 1; i <= rn.cfg.Nqs; i++ {
 		wgs.Add(1)
-		go runSender(conn, fmt.Sprintf("%d", i))
+		go func(qns string) {
+			defer wgs.Done()
+			if e := rn.runSender(conn, qns); e != nil {
+				rn.fail(e)
+			}
+		}(fmt.Sprintf("%d", i))
 	}
 	wgs.Wait()
-	ll.Printf("%stag:%s connsess:%s end\n",
+	rn.ll.Printf("%stag:%s connsess:%s end\n",
 		exampid, ltag, conn.Session())
 	sngecomm.ShowStats(exampid, ltag, conn)
-	closeSconn(n, conn)
-	//
-	wga.Done()
+	if rn.ctx.Err() != nil {
+		return n.Close()
+	}
+	return rn.closeSconn(n, conn)
+}
+
+/*
+Run sends cfg.Nmsgs messages to each of cfg.Nqs queues, with a go routine for
+each queue, on one connection.  One receiver go routine for each queue
+checks that the messages have the right queue and message numbers, in order.
+Receivers use a pool of connections.  The first error from any go routine
+ends the run, and is returned.
+*/
+func Run(ctx context.Context, cfg *sngecomm.Config, ll *log.Logger) (Result, error) {
+
+	st := time.Now()
+
+	rn := &runner{cfg: cfg, ll: ll, r: Result{Received: map[string]int{}}}
+	rn.ctx, rn.cancel = context.WithCancel(ctx)
+	defer rn.cancel()
+
+	ll.Printf("%stag:%s connsess:%s main_starts\n",
+		exampid, tag, sngecomm.Lcs)
+
+	// Wait flags
+	rn.sw = cfg.SendWait
+	rn.rw = cfg.RecvWait
+	ll.Printf("%stag:%s connsess:%s main_wait_sleep_factors sw:%v rw:%v sf:%v rf:%v sd:%v rd:%v\n",
+		exampid, tag, sngecomm.Lcs,
+		rn.sw, rn.rw, cfg.SendFactor, cfg.RecvFactor, cfg.SendDelay, cfg.RecvDelay)
+
+	var wga sync.WaitGroup
+	for _, f := range []func() error{rn.startReceivers, rn.startSender} {
+		wga.Add(1)
+		go func(f func() error) {
+			defer wga.Done()
+			if e := f(); e != nil {
+				rn.fail(e)
+			}
+		}(f)
+	}
+	wga.Wait()
+	if rn.err != nil {
+		return rn.r, rn.err
+	}
+
+	// The end
+	rn.r.Elapsed = time.Now().Sub(st)
+	ll.Printf("%stag:%s connsess:%s main_elapsed:%v\n",
+		exampid, tag, sngecomm.Lcs,
+		rn.r.Elapsed)
+	return rn.r, nil
 }
 
 /*
@@ -418,29 +446,31 @@ main is the driver for all logic.
 */
 func main() {
 
-	st := time.Now()
+	cfg, e := sngecomm.LoadConfig(flag.CommandLine, os.Args[1:])
+	if e != nil {
+		log.Fatalf("%stag:%s connsess:%s main_config error:%v",
+			exampid, tag, sngecomm.Lcs,
+			e.Error()) // Handle this ......
+	}
 
-	if sngecomm.LogFile() == "" {
+	if cfg.LogFile == "" {
 		ll = log.New(os.Stdout, "E1SMR ", log.Ldate|log.Lmicroseconds|log.Lshortfile)
 	} else {
-		f, _ := os.Create(sngecomm.LogFile())
+		f, _ := os.Create(cfg.LogFile)
 		ll = log.New(f, "E1SMR ", log.Ldate|log.Lmicroseconds|log.Lshortfile)
 	}
 
-	sngecomm.ShowRunParmsLogger(exampid, ll)
-
-	ll.Printf("%stag:%s connsess:%s main_starts\n",
-		exampid, tag, sngecomm.Lcs)
+	cfg.ShowRunParms(exampid, ll)
 
 	ll.Printf("%stag:%s connsess:%s main_profiling pprof:%v\n",
 		exampid, tag, sngecomm.Lcs,
-		sngecomm.Pprof())
+		cfg.Pprof)
 
 	ll.Printf("%stag:%s connsess:%s main_current_GOMAXPROCS gmp:%v\n",
 		exampid, tag, sngecomm.Lcs,
 		runtime.GOMAXPROCS(-1))
 
-	if sngecomm.SetMAXPROCS() {
+	if cfg.SetMaxProcs {
 		nc := runtime.NumCPU()
 		ll.Printf("%stag:%s connsess:%s main_current_num_cpus cncpu:%v\n",
 			exampid, tag, sngecomm.Lcs,
@@ -453,24 +483,12 @@ func main() {
 			exampid, tag, sngecomm.Lcs,
 			runtime.GOMAXPROCS(-1))
 	}
-	// Wait flags
-	sw = sngecomm.SendWait()
-	rw = sngecomm.RecvWait()
-	sf = sngecomm.SendFactor()
-	rf = sngecomm.RecvFactor()
-	ll.Printf("%stag:%s connsess:%s main_wait_sleep_factors sw:%v rw:%v sf:%v rf:%v\n",
-		exampid, tag, sngecomm.Lcs,
-		sw, rw, sf, rf)
-
-	wga.Add(1)
-	go startReceivers()
-	wga.Add(1)
-	go startSender()
-	wga.Wait()
 
-	// The end
-	ll.Printf("%stag:%s connsess:%s main_elapsed:%v\n",
-		exampid, tag, sngecomm.Lcs,
-		time.Now().Sub(st))
+	r, e := Run(context.Background(), cfg, ll)
+	if e != nil {
+		ll.Fatalf("%stag:%s connsess:%s main_run sent:%d error:%v",
+			exampid, tag, sngecomm.Lcs,
+			r.Sent, e.Error()) // Handle this ......
+	}
 	time.Sleep(250 * time.Millisecond)
 }
@@ -0,0 +1,95 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"testing"
+
+	"github.com/gmallard/stompngo_examples/sngecomm/testbroker"
+	"github.com/gmallard/stompngo_examples/sngecomm/testbroker/brokertest"
+)
+
+/*
+Test srmgor_1smrconn against a test broker, with auto and client acks, and
+one and two receiver connections.
+*/
+func TestRun(t *testing.T) {
+	lg := log.New(ioutil.Discard, "", 0)
+	tests := []struct {
+		am string
+		rc int // Receiver connections
+	}{
+		{"auto", 0},
+		{"client", 2},
+		{"client-individual", 1},
+	}
+	for _, tc := range tests {
+		am := tc.am
+		b, cfg, done := brokertest.Start(t, testbroker.Options{})
+		//
+		cfg.Dest = "/queue/srmgor.test"
+		cfg.Nqs, cfg.Nmsgs, cfg.Mdml = 3, 5, 100
+		cfg.AckMode, cfg.RecvConns = am, tc.rc
+		cfg.SendWait, cfg.RecvWait = false, false
+		r, e := Run(context.Background(), cfg, lg)
+		done()
+		if e != nil {
+			t.Fatalf("%s, expected no error, got [%v]\n", am, e)
+		}
+		wa := 0
+		if am != "auto" {
+			wa = 15
+		}
+		if r.Sent != 15 || r.Acked != wa || len(r.Received) != 3 {
+			t.Fatalf("%s, expected 15 sent, %d acked, 3 queues, got [%+v]\n", am, wa, r)
+		}
+		// One sender connection, and the receiver pool
+		wc := 1 + cfg.Nqs
+		if tc.rc > 0 {
+			wc = 1 + tc.rc
+		}
+		if r.Pool.Opened != wc-1 {
+			t.Errorf("%s, expected %d pooled connections, got [%+v]\n", am, wc-1, r.Pool)
+		}
+		s := b.Stats()
+		if s.Connections != wc || s.Delivered != 15 || s.Acked != wa || s.Redelivered != 0 {
+			t.Errorf("%s, expected %d connections, 15 delivered, %d acked, got [%+v]\n",
+				am, wc, wa, s)
+		}
+		// Message numbers are in order for each queue
+		next := map[string]int{}
+		for _, f := range b.Frames("SEND") {
+			d := f.Value("destination")
+			next[d]++
+			if f.Value("msgnum") != strconv.Itoa(next[d]) {
+				t.Errorf("%s, %s expected msgnum %d, got [%v]\n", am, d, next[d], f.Headers)
+			}
+		}
+		for q := 1; q <= cfg.Nqs; q++ {
+			d := fmt.Sprintf("%s.srmgor_1smrconn.%d", cfg.Dest, q)
+			if r.Received[d] != 5 || next[d] != 5 || b.Unacked(d) != 0 || b.Depth(d) != 0 {
+				t.Errorf("%s, %s expected 5 sent and received, got %d and %d\n", am, d,
+					next[d], r.Received[d])
+			}
+		}
+	}
+}
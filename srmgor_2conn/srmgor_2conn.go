@@ -26,19 +26,17 @@ STOMP connection, as do all receivers.
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"runtime"
-	"strconv"
 	"sync"
 	"time"
 
 	//
 	"github.com/gmallard/stompngo"
-	// senv methods could be used in general by stompngo clients.
-	"github.com/gmallard/stompngo/senv"
 	// sngecomm methods are used specifically for these example clients.
 	"github.com/gmallard/stompngo_examples/sngecomm"
 )
@@ -46,24 +44,6 @@ import (
 var (
 	exampid = "srmgor_2conn: "
 
-	wgs sync.WaitGroup
-	wgr sync.WaitGroup
-	wga sync.WaitGroup
-
-	// We 'stagger' between each message send and message receive for a random
-	// amount of time.
-	// Vary these for experimental purposes.  YMMV.
-	max int64 = 1e9      // Max stagger time (nanoseconds)
-	min int64 = max / 10 // Min stagger time (nanoseconds)
-
-	// Wait flags
-	sw = true
-	rw = true
-
-	// Sleep multipliers
-	sf float64 = 1.0
-	rf float64 = 1.0
-
 	// Possible profile file
 	cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
 
@@ -72,19 +52,69 @@ var (
 	tag = "2conn"
 )
 
+// Result is the outcome of a Run.
+type Result struct {
+	Sent     int            // Messages sent
+	Received map[string]int // Messages received and checked, by destination
+	Acked    int
+	Elapsed  time.Duration
+}
+
+// A runner is the state of one Run.
+type runner struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	cfg    *sngecomm.Config
+	ll     *log.Logger
+	// Wait flags
+	sw, rw bool
+	//
+	mu  sync.Mutex
+	r   Result
+	err error // The first error
+}
+
+// fail records the first error, and ends the run.
+func (rn *runner) fail(e error) {
+	rn.mu.Lock()
+	if rn.err == nil {
+		rn.err = e
+	}
+	rn.mu.Unlock()
+	rn.cancel()
+}
+
+// stagger waits for a stagger time, or until the run ends.
+func (rn *runner) stagger(tmr *time.Timer, dt time.Duration) bool {
+	runtime.Gosched() // yield for this example
+	tmr.Reset(dt)
+	select {
+	case <-tmr.C:
+		return true
+	case <-rn.ctx.Done():
+		return false
+	}
+}
+
 // Send messages to a particular queue
-func sender(conn *stompngo.Connection, qn, nmsgs int) {
+func (rn *runner) sender(conn *stompngo.Connection, qn, nmsgs int) error {
+	cfg, ll := rn.cfg, rn.ll
 	ltag := tag + "-sender"
 
 	qns := fmt.Sprintf("%d", qn) // queue number
-	d := sngecomm.Dest() + "." + string(exampid[:len(exampid)-2]) + "." + qns
+	sd := cfg.NewSendDelay(qns)  // Stagger times
+	d := cfg.Destination() + "." + string(exampid[:len(exampid)-2]) + "." + qns
+	pg, e := cfg.NewPayloadGenerator(cfg.VariablePayload(), qns) // Bodies
+	if e != nil {
+		return fmt.Errorf("payload_error qnum:%v error:%v", qn, e)
+	}
 	ll.Printf("%stag:%s connsess:%s starts qn:%d nmsgs:%d d:%s\n",
 		exampid, ltag, conn.Session(),
 		qn, nmsgs, d)
 	//
 	wh := stompngo.Headers{"destination", d,
 		"qnum", qns} // send Headers
-	if senv.Persistent() {
+	if cfg.Persistent {
 		wh = wh.Add("persistent", "true")
 	}
 	//
@@ -97,41 +127,44 @@ func sender(conn *stompngo.Connection, qn, nmsgs int) {
 		ll.Printf("%stag:%s connsess:%s message qns:%s si:%s\n",
 			exampid, ltag, conn.Session(),
 			qns, si)
-		e := conn.Send(sh, string(sngecomm.Partial()))
+		e := conn.SendBytes(sh, pg.Next())
 		if e != nil {
-			ll.Fatalf("%stag:%s connsess:%s send_error qnum:%v error:%v",
-				exampid, ltag, conn.Session(),
-				qn, e.Error()) // Handle this ......
+			return fmt.Errorf("send_error qnum:%v error:%v", qn, e)
 		}
+		rn.mu.Lock()
+		rn.r.Sent++
+		rn.mu.Unlock()
 		if i == nmsgs {
 			break
 		}
-		if sw {
-			runtime.Gosched() // yield for this example
-			dt := time.Duration(sngecomm.ValueBetween(min, max, sf))
+		if rn.sw {
+			dt := sd.Next()
 			ll.Printf("%stag:%s connsess:%s send_stagger dt:%v qns:%s\n",
 				exampid, ltag, conn.Session(),
 				dt, qns)
-			tmr.Reset(dt)
-			_ = <-tmr.C
+			if !rn.stagger(tmr, dt) {
+				return rn.ctx.Err()
+			}
 		}
 	}
 	// Sending is done
 	ll.Printf("%stag:%s connsess:%s sender_ends qn:%d nmsgs:%d\n",
 		exampid, ltag, conn.Session(),
 		qn, nmsgs)
-	wgs.Done()
+	return nil
 }
 
 // Asynchronously process all messages for a given subscription.
-func receiveWorker(sc <-chan stompngo.MessageData, qns string, nmsgs int,
-	qc chan<- bool, conn *stompngo.Connection, id string) {
+func (rn *runner) receiveWorker(sc <-chan stompngo.MessageData, d, qns string,
+	nmsgs int, conn *stompngo.Connection, id string) error {
+	cfg, ll := rn.cfg, rn.ll
+	rd := cfg.NewRecvDelay(qns) // Stagger times
 	//
 	ltag := tag + "-receiveWorker"
 
 	tmr := time.NewTimer(100 * time.Hour)
 
-	pbc := sngecomm.Pbc() // Print byte count
+	pbc := cfg.Pbc // Print byte count
 
 	// Receive loop
 	var md stompngo.MessageData
@@ -140,24 +173,28 @@ func receiveWorker(sc <-chan stompngo.MessageData, qns string, nmsgs int,
 		select {
 		case md = <-sc:
 		case md = <-conn.MessageData:
-			// Frames RECEIPT or ERROR not expected here
-			ll.Fatalf("%stag:%s connsess:%s bad_frame qns:%v md:%v",
-				exampid, ltag, conn.Session(),
-				qns, md) // Handle this ......
+			// Frames RECEIPT or ERROR not expected here.  Read errors
+			// arrive here too, and are receive errors.
+			if md.Error == nil {
+				return fmt.Errorf("bad_frame qns:%v command:%v headers:%v body:%s",
+					qns, md.Message.Command, md.Message.Headers, md.Message.Body)
+			}
+		case <-rn.ctx.Done():
+			return rn.ctx.Err()
 		}
 		if md.Error != nil {
-			ll.Fatalf("%stag:%s connsess:%s recv_error qns:%v error:%v",
-				exampid, ltag, conn.Session(),
-				qns, md.Error) // Handle this ......
+			return fmt.Errorf("recv_error qns:%v error:%v", qns, md.Error)
 		}
 
 		// Sanity check the queue and message numbers
 		mns := fmt.Sprintf("%d", i) // message number
 		if !md.Message.Headers.ContainsKV("qnum", qns) || !md.Message.Headers.ContainsKV("msgnum", mns) {
-			ll.Fatalf("%stag:%s connsess:%s dirty_message qnum:%v msgnum:%v md:%v",
-				exampid, ltag, conn.Session(),
-				qns, mns, md) // Handle this ......
+			return fmt.Errorf("dirty_message qnum:%v msgnum:%v command:%v headers:%v",
+				qns, mns, md.Message.Command, md.Message.Headers)
 		}
+		rn.mu.Lock()
+		rn.r.Received[d]++
+		rn.mu.Unlock()
 
 		// Process the inbound message .................
 		sl := len(md.Message.Body)
@@ -169,9 +206,13 @@ func receiveWorker(sc <-chan stompngo.MessageData, qns string, nmsgs int,
 		}
 
 		// Handle ACKs if needed
-		if sngecomm.AckMode() != "auto" {
-			ah := []string{}
-			sngecomm.HandleAck(conn, ah, id)
+		if cfg.AckMode != "auto" {
+			if e := sngecomm.Ack(conn, md.Message.Headers, id); e != nil {
+				return fmt.Errorf("ack_error qns:%v error:%v", qns, e)
+			}
+			rn.mu.Lock()
+			rn.r.Acked++
+			rn.mu.Unlock()
 		}
 		ll.Printf("%stag:%s connsess:%s recv_message body:%s qns:%s msgnum:%s i:%v\n",
 			exampid, ltag, conn.Session(),
@@ -181,22 +222,22 @@ func receiveWorker(sc <-chan stompngo.MessageData, qns string, nmsgs int,
 		if i == nmsgs {
 			break
 		}
-		if rw {
-			runtime.Gosched() // yield for this example
-			dt := time.Duration(sngecomm.ValueBetween(min, max, rf))
+		if rn.rw {
+			dt := rd.Next()
 			ll.Printf("%stag:%s connsess:%s recv_stagger dt:%v qns:%s\n",
 				exampid, ltag, conn.Session(),
 				dt, qns)
-			tmr.Reset(dt)
-			_ = <-tmr.C
+			if !rn.stagger(tmr, dt) {
+				return rn.ctx.Err()
+			}
 		}
 	}
-	//
-	qc <- true
+	return nil
 }
 
 // Receive messages from a particular queue
-func receiver(conn *stompngo.Connection, qn, nmsgs int) {
+func (rn *runner) receiver(conn *stompngo.Connection, qn, nmsgs int) (e error) {
+	cfg, ll := rn.cfg, rn.ll
 	ltag := tag + "-receiver"
 
 	qns := fmt.Sprintf("%d", qn) // queue number
@@ -204,13 +245,21 @@ func receiver(conn *stompngo.Connection, qn, nmsgs int) {
 		exampid, ltag, conn.Session(),
 		qn, nmsgs)
 	//
-	qp := sngecomm.Dest() // queue name prefix
+	qp := cfg.Destination() // queue name prefix
 	q := qp + "." + string(exampid[:len(exampid)-2]) + "." + qns
 	ll.Printf("%stag:%s connsess:%s queue_info q:%s qn:%d nmsgs:%d\n",
 		exampid, ltag, conn.Session(),
 		q, qn, nmsgs)
 	id := stompngo.Uuid() // A unique subscription ID
-	sc := sngecomm.HandleSubscribe(conn, q, id, sngecomm.AckMode())
+	sc, e := sngecomm.SubscribeContext(rn.ctx, conn, q, id, cfg.AckMode)
+	if e != nil {
+		return e
+	}
+	defer func() {
+		if e != nil { // Stopped early, so keep the connection reader moving
+			go sngecomm.Drain(sc)
+		}
+	}()
 	ll.Printf("%stag:%s connsess:%s subscribe_complete\n",
 		exampid, ltag, conn.Session())
 	// Many receivers running under the same connection can cause
@@ -221,18 +270,7 @@ func receiver(conn *stompngo.Connection, qn, nmsgs int) {
 	// received from the wire as soon as possible.  Those messages are then
 	// buffered internally for (possibly later) application processing.
 
-	bs := -1 //
-	if s := os.Getenv("STOMP_CONN2BUFFER"); s != "" {
-		i, e := strconv.ParseInt(s, 10, 32)
-		if nil != e {
-			ll.Fatalf("%stag:%s connsess:%s CONN2BUFFER_conversion_error error:%v",
-				exampid, ltag, conn.Session(),
-				e.Error()) // Handle this ......
-
-		} else {
-			bs = int(i)
-		}
-	}
+	bs := cfg.Conn2Buffer
 	if bs < 1 {
 		bs = nmsgs
 	}
@@ -241,23 +279,43 @@ func receiver(conn *stompngo.Connection, qn, nmsgs int) {
 		bs, qn)
 
 	// Process all inputs async .......
-	// var mc chan stompngo.MessageData
-	mdc := make(chan stompngo.MessageData, bs)      // MessageData Buffer size
-	dc := make(chan bool)                           // Receive processing done channel
-	go receiveWorker(mdc, qns, nmsgs, dc, conn, id) // Start async processor
+	mdc := make(chan stompngo.MessageData, bs) // MessageData Buffer size
+	dc := make(chan error, 1)                  // Receive processing done channel
+	// Start async processor
+	go func() {
+		dc <- rn.receiveWorker(mdc, q, qns, nmsgs, conn, id)
+	}()
 	for i := 1; i <= nmsgs; i++ {
-		mdc <- <-sc // Receive message data as soon as possible, and internally queue it
+		// Receive message data as soon as possible, and internally queue it
+		var md stompngo.MessageData
+		select {
+		case md = <-sc:
+		case <-rn.ctx.Done():
+			<-dc
+			return rn.ctx.Err()
+		}
+		select {
+		case mdc <- md:
+		case <-rn.ctx.Done():
+			<-dc
+			return rn.ctx.Err()
+		}
 	}
 	ll.Printf("%stag:%s connsess:%s waitforWorkersBegin qns:%s\n",
 		exampid, ltag, conn.Session(),
 		qns)
-	<-dc // Wait until receive processing is done for this queue
+	// Wait until receive processing is done for this queue
+	if e = <-dc; e != nil {
+		return e
+	}
 	ll.Printf("%stag:%s connsess:%s waitforWorkersEnd qns:%s\n",
 		exampid, ltag, conn.Session(),
 		qns)
 
 	// Unsubscribe
-	sngecomm.HandleUnsubscribe(conn, q, id)
+	if e = sngecomm.Unsubscribe(conn, q, id); e != nil {
+		return e
+	}
 	ll.Printf("%stag:%s connsess:%s unsubscribe_complete\n",
 		exampid, ltag, conn.Session())
 
@@ -265,114 +323,140 @@ func receiver(conn *stompngo.Connection, qn, nmsgs int) {
 	ll.Printf("%stag:%s connsess:%s ends qns:%s\n",
 		exampid, ltag, conn.Session(),
 		qns)
-	wgr.Done()
+	return nil
 }
 
-func startSenders(qn int) {
-	ltag := tag + "-startsenders"
+// run connects, runs f for each queue on the connection, and disconnects.
+func (rn *runner) run(ltag string, qn int,
+	f func(*stompngo.Connection, int, int) error) error {
+	cfg, ll := rn.cfg, rn.ll
 
-	ll.Printf("%stag:%s connsess:%s queue qn:%v\n",
+	ll.Printf("%stag:%s connsess:%s starts qn:%d\n",
 		exampid, ltag, sngecomm.Lcs,
 		qn)
 
 	// Standard example connect sequence
-	n, conn, e := sngecomm.CommonConnect(exampid, ltag, ll)
+	ctx, cancel := cfg.OpContext(rn.ctx)
+	n, conn, e := cfg.Connect(ctx, exampid, ltag, ll)
+	cancel()
 	if e != nil {
-		ll.Fatalf("%stag:%s connsess:%s on_connect error:%v",
-			exampid, ltag, sngecomm.Lcs,
-			e.Error()) // Handle this ......
+		return e
 	}
 
-	nmsgs := senv.Nmsgs() // message count
+	nmsgs := cfg.Nmsgs // message count
 	ll.Printf("%stag:%s connsess:%s message_count nmsgs:%d qn:%d\n",
 		exampid, ltag, conn.Session(),
 		nmsgs, qn)
+	var wg sync.WaitGroup
 	for i := 1; i <= qn; i++ { // all queues
-		wgs.Add(1)
-		go sender(conn, i, nmsgs)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if e := f(conn, i, nmsgs); e != nil {
+				rn.fail(e)
+			}
+		}(i)
 	}
 	ll.Printf("%stag:%s connsess:%s starts_done\n",
 		exampid, ltag, conn.Session())
-	wgs.Wait()
+	wg.Wait()
+	if rn.ctx.Err() != nil {
+		return n.Close()
+	}
 
-	// Standard example disconnect sequence
-	e = sngecomm.CommonDisconnect(n, conn, exampid, ltag, ll)
+	// Standard example disconnect sequence.  The connection is done, so
+	// another go routine failing does not cut the disconnect short.
+	e = cfg.Disconnect(context.Background(), n, conn, exampid, ltag, ll)
 	if e != nil {
-		ll.Fatalf("%stag:%s connsess:%s on_disconnect error:%v",
-			exampid, ltag, conn.Session(),
-			e.Error()) // Handle this ......
+		return e
 	}
 
 	sngecomm.ShowStats(exampid, ltag, conn)
-	wga.Done()
+	return nil
 }
 
-func startReceivers(qn int) {
-	ltag := tag + "-startreceivers"
+/*
+Run sends cfg.Nmsgs messages to each of cfg.Nqs queues, with a go routine for
+each queue, all on one connection.  One receiver go routine for each queue,
+all on a second connection, checks that the messages have the right queue
+and message numbers, in order.  The first error from any go routine ends the
+run, and is returned.
+*/
+func Run(ctx context.Context, cfg *sngecomm.Config, ll *log.Logger) (Result, error) {
 
-	ll.Printf("%stag:%s connsess:%s starts qn:%d\n",
-		exampid, ltag, sngecomm.Lcs,
-		qn)
+	st := time.Now()
 
-	// Standard example connect sequence
-	n, conn, e := sngecomm.CommonConnect(exampid, ltag, ll)
-	if e != nil {
-		ll.Fatalf("%stag:%s connsess:%s on_connect error:%v",
-			exampid, ltag, sngecomm.Lcs,
-			e.Error()) // Handle this ......
-	}
+	rn := &runner{cfg: cfg, ll: ll, r: Result{Received: map[string]int{}}}
+	rn.ctx, rn.cancel = context.WithCancel(ctx)
+	defer rn.cancel()
 
-	nmsgs := senv.Nmsgs() // get message count
-	ll.Printf("%stag:%s connsess:%s message_count nmsgs:%d qn:%d\n",
-		exampid, ltag, conn.Session(),
-		nmsgs, qn)
-	for i := 1; i <= qn; i++ { // all queues
-		wgr.Add(1)
-		go receiver(conn, i, nmsgs)
-	}
-	ll.Printf("%stag:%s connsess:%s starts_done\n",
-		exampid, ltag, conn.Session())
-	wgr.Wait()
+	ll.Printf("%stag:%s connsess:%s main_starts\n",
+		exampid, tag, sngecomm.Lcs)
 
-	// Standard example disconnect sequence
-	e = sngecomm.CommonDisconnect(n, conn, exampid, ltag, ll)
-	if e != nil {
-		ll.Fatalf("%stag:%s connsess:%s on_disconnect error:%v",
-			exampid, ltag, conn.Session(),
-			e.Error()) // Handle this ......
+	//
+	rn.sw = cfg.SendWait
+	rn.rw = cfg.RecvWait
+	ll.Printf("%stag:%s connsess:%s main_wait_sleep_factors sw:%v rw:%v sf:%v rf:%v sd:%v rd:%v\n",
+		exampid, tag, sngecomm.Lcs,
+		rn.sw, rn.rw, cfg.SendFactor, cfg.RecvFactor, cfg.SendDelay, cfg.RecvDelay)
+	//
+	q := cfg.Nqs
+	//
+	var wga sync.WaitGroup
+	wga.Add(2)
+	go func() {
+		defer wga.Done()
+		if e := rn.run(tag+"-startreceivers", q, rn.receiver); e != nil {
+			rn.fail(e)
+		}
+	}()
+	go func() {
+		defer wga.Done()
+		if e := rn.run(tag+"-startsenders", q, rn.sender); e != nil {
+			rn.fail(e)
+		}
+	}()
+	wga.Wait()
+	if rn.err != nil {
+		return rn.r, rn.err
 	}
 
-	sngecomm.ShowStats(exampid, ltag, conn)
-	wga.Done()
+	rn.r.Elapsed = time.Now().Sub(st)
+	ll.Printf("%stag:%s connsess:%s main_elapsed:%v\n",
+		exampid, tag, sngecomm.Lcs,
+		rn.r.Elapsed)
+	return rn.r, nil
 }
 
 // Show a number of writers and readers operating concurrently from unique
 // destinations.
 func main() {
 
-	st := time.Now()
+	cfg, e := sngecomm.LoadConfig(flag.CommandLine, os.Args[1:])
+	if e != nil {
+		log.Fatalf("%stag:%s connsess:%s main_config error:%v",
+			exampid, tag, sngecomm.Lcs,
+			e.Error()) // Handle this ......
+	}
 
-	if sngecomm.LogFile() == "" {
+	if cfg.LogFile == "" {
 		ll = log.New(os.Stdout, "E2CN ", log.Ldate|log.Lmicroseconds|log.Lshortfile)
 	} else {
-		f, _ := os.Create(sngecomm.LogFile())
+		f, _ := os.Create(cfg.LogFile)
 		ll = log.New(f, "E2CN ", log.Ldate|log.Lmicroseconds|log.Lshortfile)
 	}
 
-	sngecomm.ShowRunParmsLogger(exampid, ll)
-
-	ll.Printf("%stag:%s connsess:%s main_starts\n",
-		exampid, tag, sngecomm.Lcs)
+	cfg.ShowRunParms(exampid, ll)
 
 	ll.Printf("%stag:%s connsess:%s main_profiling pprof:%v\n",
 		exampid, tag, sngecomm.Lcs,
-		sngecomm.Pprof())
+		cfg.Pprof)
 
 	ll.Printf("%stag:%s connsess:%s main_current_GOMAXPROCS gmp:%v\n",
 		exampid, tag, sngecomm.Lcs,
 		runtime.GOMAXPROCS(-1))
 
-	if sngecomm.SetMAXPROCS() {
+	if cfg.SetMaxProcs {
 		nc := runtime.NumCPU()
 		ll.Printf("%stag:%s connsess:%s main_current_num_cpus cncpu:%v\n",
 			exampid, tag, sngecomm.Lcs,
@@ -385,24 +469,12 @@ func main() {
 			exampid, tag, sngecomm.Lcs,
 			runtime.GOMAXPROCS(-1))
 	}
-	//
-	sw = sngecomm.SendWait()
-	rw = sngecomm.RecvWait()
-	sf = sngecomm.SendFactor()
-	rf = sngecomm.RecvFactor()
-	ll.Printf("%stag:%s connsess:%s main_wait_sleep_factors sw:%v rw:%v sf:%v rf:%v\n",
-		exampid, tag, sngecomm.Lcs,
-		sw, rw, sf, rf)
-	//
-	q := sngecomm.Nqs()
-	//
-	wga.Add(2)
-	go startReceivers(q)
-	go startSenders(q)
-	wga.Wait()
 
-	ll.Printf("%stag:%s connsess:%s main_elapsed:%v\n",
-		exampid, tag, sngecomm.Lcs,
-		time.Now().Sub(st))
+	r, e := Run(context.Background(), cfg, ll)
+	if e != nil {
+		ll.Fatalf("%stag:%s connsess:%s main_run sent:%d error:%v",
+			exampid, tag, sngecomm.Lcs,
+			r.Sent, e.Error()) // Handle this ......
+	}
 	time.Sleep(250 * time.Millisecond)
 }
@@ -27,11 +27,12 @@ operates under a unique network connection.
 
 		# A few queues and a few messages:
 		STOMP_NQS=5 STOMP_NMSGS=10 go run srmgor_manyconn.go
-
 */
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
 	"net"
@@ -42,8 +43,6 @@ import (
 
 	//
 	"github.com/gmallard/stompngo"
-	// senv methods could be used in general by stompngo clients.
-	"github.com/gmallard/stompngo/senv"
 	// sngecomm methods are used specifically for these example clients.
 	"github.com/gmallard/stompngo_examples/sngecomm"
 )
@@ -51,47 +50,80 @@ import (
 var (
 	exampid = "srmgor_manyconn: "
 
-	wgs sync.WaitGroup
-	wgr sync.WaitGroup
-
-	// We 'stagger' between each message send and message receive for a random
-	// amount of time.
-	// Vary these for experimental purposes.  YMMV.
-	max int64 = 1e9      // Max stagger time (nanoseconds)
-	min int64 = max / 10 // Min stagger time (nanoseconds)
+	ll *log.Logger
 
-	// Wait flags
-	sw = true
-	rw = true
+	tag = "manyconn"
+)
 
-	// Sleep multipliers
-	sf float64 = 1.0
-	rf float64 = 1.0
+// Result is the outcome of a Run.
+type Result struct {
+	Sent     int            // Messages sent
+	Received map[string]int // Messages received and checked, by destination
+	Acked    int
+	Elapsed  time.Duration
+}
 
+// A runner is the state of one Run.
+type runner struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	cfg    *sngecomm.Config
+	ll     *log.Logger
+	// Wait flags
+	sw, rw bool
 	// Number of messages
-	nmsgs = senv.Nmsgs()
+	nmsgs int
+	//
+	mu  sync.Mutex
+	r   Result
+	err error // The first error
+}
 
-	ll *log.Logger
+// fail records the first error, and ends the run.
+func (rn *runner) fail(e error) {
+	rn.mu.Lock()
+	if rn.err == nil {
+		rn.err = e
+	}
+	rn.mu.Unlock()
+	rn.cancel()
+}
 
-	tag = "manyconn"
-)
+// stagger waits for a stagger time, or until the run ends.
+func (rn *runner) stagger(tmr *time.Timer, dt time.Duration) bool {
+	runtime.Gosched() // yield for this example
+	tmr.Reset(dt)
+	select {
+	case <-tmr.C:
+		return true
+	case <-rn.ctx.Done():
+		return false
+	}
+}
 
-func sendMessages(conn *stompngo.Connection, qnum int, nc net.Conn) {
+func (rn *runner) sendMessages(conn *stompngo.Connection, qnum int, nc net.Conn) error {
+	cfg, ll := rn.cfg, rn.ll
 	ltag := tag + "-sendmessages"
 
 	qns := fmt.Sprintf("%d", qnum) // queue number
-	d := sngecomm.Dest() + "." + string(exampid[:len(exampid)-2]) + "." + qns
+	sd := cfg.NewSendDelay(qns)    // Stagger times
+	d := cfg.Destination() + "." + string(exampid[:len(exampid)-2]) + "." + qns
+	pg, e := cfg.NewPayloadGenerator(cfg.VariablePayload(), qns) // Bodies
+	if e != nil {
+		return fmt.Errorf("payload_error qnum:%v error:%v", qnum, e)
+	}
 	ll.Printf("%stag:%s connsess:%s start d:%s qnum:%d\n",
 		exampid, ltag, conn.Session(),
 		d, qnum)
 	wh := stompngo.Headers{"destination", d,
 		"qnum", qns} // send Headers
-	if senv.Persistent() {
+	if cfg.Persistent {
 		wh = wh.Add("persistent", "true")
 	}
 	//
 	tmr := time.NewTimer(100 * time.Hour)
 	// Send messages
+	nmsgs := rn.nmsgs
 	for mc := 1; mc <= nmsgs; mc++ {
 		mcs := fmt.Sprintf("%d", mc)
 		sh := append(wh, "msgnum", mcs)
@@ -100,41 +132,54 @@ func sendMessages(conn *stompngo.Connection, qnum int, nc net.Conn) {
 		ll.Printf("%stag:%s connsess:%s message mc:%d qnum:%d\n",
 			exampid, ltag, conn.Session(),
 			mc, qnum)
-		e := conn.Send(sh, string(sngecomm.Partial()))
+		e := conn.SendBytes(sh, pg.Next())
 		if e != nil {
-			ll.Fatalf("%stag:%s connsess:%s send_error qnum:%v error:%v",
-				exampid, ltag, conn.Session(),
-				qnum, e.Error()) // Handle this ......
+			return fmt.Errorf("send_error qnum:%v error:%v", qnum, e)
 		}
+		rn.mu.Lock()
+		rn.r.Sent++
+		rn.mu.Unlock()
 		if mc == nmsgs {
 			break
 		}
-		if sw {
-			runtime.Gosched() // yield for this example
-			dt := time.Duration(sngecomm.ValueBetween(min, max, sf))
+		if rn.sw {
+			dt := sd.Next()
 			ll.Printf("%stag:%s connsess:%s send_stagger dt:%v qnum:%d mc:%d\n",
 				exampid, ltag, conn.Session(),
 				dt, qnum, mc)
-			tmr.Reset(dt)
-			_ = <-tmr.C
+			if !rn.stagger(tmr, dt) {
+				return rn.ctx.Err()
+			}
 		}
 	}
+	return nil
 }
 
-func receiveMessages(conn *stompngo.Connection, qnum int, nc net.Conn) {
+func (rn *runner) receiveMessages(conn *stompngo.Connection, qnum int, nc net.Conn) (e error) {
+	cfg, ll := rn.cfg, rn.ll
 	ltag := tag + "-receivemessages"
 
 	qns := fmt.Sprintf("%d", qnum) // queue number
-	d := sngecomm.Dest() + "." + string(exampid[:len(exampid)-2]) + "." + qns
+	rd := cfg.NewRecvDelay(qns)    // Stagger times
+	d := cfg.Destination() + "." + string(exampid[:len(exampid)-2]) + "." + qns
 	id := stompngo.Uuid() // A unique subscription ID
+	nmsgs := rn.nmsgs
 
 	ll.Printf("%stag:%s connsess:%s receiveMessages_start id:%s d:%s qnum:%d nmsgs:%d\n",
 		exampid, ltag, conn.Session(),
 		id, d, qnum, nmsgs)
 	// Subscribe
-	sc := sngecomm.HandleSubscribe(conn, d, id, sngecomm.AckMode())
+	sc, e := sngecomm.SubscribeContext(rn.ctx, conn, d, id, cfg.AckMode)
+	if e != nil {
+		return e
+	}
+	defer func() {
+		if e != nil { // Stopped early, so keep the connection reader moving
+			go sngecomm.Drain(sc)
+		}
+	}()
 
-	pbc := sngecomm.Pbc() // Print byte count
+	pbc := cfg.Pbc // Print byte count
 
 	//
 	tmr := time.NewTimer(100 * time.Hour)
@@ -144,29 +189,32 @@ func receiveMessages(conn *stompngo.Connection, qnum int, nc net.Conn) {
 		select {
 		case md = <-sc:
 		case md = <-conn.MessageData:
-			// Frames RECEIPT or ERROR not expected here
-			ll.Fatalf("%stag:%s connsess:%s send_error qns:%v md:%v",
-				exampid, ltag, conn.Session(),
-				qns, md) // Handle this ......
+			// Frames RECEIPT or ERROR not expected here.  Read errors
+			// arrive here too, and are receive errors.
+			if md.Error == nil {
+				return fmt.Errorf("bad_frame qns:%v command:%v headers:%v body:%s",
+					qns, md.Message.Command, md.Message.Headers, md.Message.Body)
+			}
+		case <-rn.ctx.Done():
+			return rn.ctx.Err()
 		}
 		if md.Error != nil {
-			ll.Fatalf("%stag:%s connsess:%s receive_error qns:%v error:%v\n",
-				exampid, ltag, conn.Session(),
-				qns, md.Error)
+			return fmt.Errorf("receive_error qns:%v error:%v", qns, md.Error)
 		}
 
 		if md.Message.Command != stompngo.MESSAGE {
-			ll.Fatalf("%stag:%s connsess:%s bad_frame qns:%s mc:%d md:%v\n",
-				exampid, ltag, conn.Session(),
-				qns, mc, md)
+			return fmt.Errorf("bad_frame qns:%s mc:%d command:%v headers:%v",
+				qns, mc, md.Message.Command, md.Message.Headers)
 		}
 
 		mcs := fmt.Sprintf("%d", mc) // message number
 		if !md.Message.Headers.ContainsKV("qnum", qns) || !md.Message.Headers.ContainsKV("msgnum", mcs) {
-			ll.Fatalf("%stag:%s connsess:%s dirty_message qns:%v msgnum:%v md:%v",
-				exampid, tag, conn.Session(),
-				qns, mcs, md) // Handle this ......
+			return fmt.Errorf("dirty_message qns:%v msgnum:%v command:%v headers:%v",
+				qns, mcs, md.Message.Command, md.Message.Headers)
 		}
+		rn.mu.Lock()
+		rn.r.Received[d]++
+		rn.mu.Unlock()
 
 		// Process the inbound message .................
 		sl := len(md.Message.Body)
@@ -180,26 +228,27 @@ func receiveMessages(conn *stompngo.Connection, qnum int, nc net.Conn) {
 			exampid, ltag, conn.Session(),
 			d, string(md.Message.Body[0:sl]), qnum,
 			md.Message.Headers.Value("msgnum"))
-		if mc == nmsgs {
-			break
-		}
 		// Handle ACKs if needed
-		if sngecomm.AckMode() != "auto" {
-			ah := []string{}
-			sngecomm.HandleAck(conn, ah, id)
+		if cfg.AckMode != "auto" {
+			if e = sngecomm.Ack(conn, md.Message.Headers, id); e != nil {
+				return fmt.Errorf("ack_error qns:%v error:%v", qns, e)
+			}
+			rn.mu.Lock()
+			rn.r.Acked++
+			rn.mu.Unlock()
 		}
 		if mc == nmsgs {
 			break
 		}
 		//
-		if rw {
-			runtime.Gosched() // yield for this example
-			dt := time.Duration(sngecomm.ValueBetween(min, max, rf))
+		if rn.rw {
+			dt := rd.Next()
 			ll.Printf("%stag:%s connsess:%s recv_stagger dt:%v qns:%s mc:%d\n",
 				exampid, ltag, conn.Session(),
 				dt, qns, mc)
-			tmr.Reset(dt)
-			_ = <-tmr.C
+			if !rn.stagger(tmr, dt) {
+				return rn.ctx.Err()
+			}
 		}
 	}
 	ll.Printf("%stag:%s connsess:%s end d:%s qnum:%d nmsgs:%d\n",
@@ -207,133 +256,102 @@ func receiveMessages(conn *stompngo.Connection, qnum int, nc net.Conn) {
 		d, qnum, nmsgs)
 
 	// Unsubscribe
-	sngecomm.HandleUnsubscribe(conn, d, id)
-	//
+	return sngecomm.Unsubscribe(conn, d, id)
 }
 
-func runReceiver(qnum int) {
-	ltag := tag + "-runreceiver"
+// runConn connects, runs f for a queue on the connection, and disconnects.
+func (rn *runner) runConn(ltag, st string, qnum int,
+	f func(*stompngo.Connection, int, net.Conn) error) error {
+	cfg, ll := rn.cfg, rn.ll
 
 	ll.Printf("%stag:%s connsess:%s start qnum:%d\n",
 		exampid, ltag, sngecomm.Lcs,
 		qnum)
 
 	// Standard example connect sequence
-	n, conn, e := sngecomm.CommonConnect(exampid, ltag, ll)
+	ctx, cancel := cfg.OpContext(rn.ctx)
+	n, conn, e := cfg.Connect(ctx, exampid, ltag, ll)
+	cancel()
 	if e != nil {
-		ll.Fatalf("%stag:%s connsess:%s error:%s\n",
-			exampid, ltag, sngecomm.Lcs,
-			e.Error()) // Handle this ......
+		return e
 	}
 
-	//
-	conn.SetSubChanCap(senv.SubChanCap()) // Experiment with this value, YMMV
-	// Receives
-	receiveMessages(conn, qnum, n)
+	if st == "recv_" {
+		conn.SetSubChanCap(cfg.SubChanCap) // Experiment with this value, YMMV
+	}
+	if e = f(conn, qnum, n); e != nil {
+		_ = n.Close()
+		return e
+	}
+	if rn.ctx.Err() != nil {
+		return n.Close()
+	}
 
-	ll.Printf("%stag:%s connsess:%s receives_complete qnum:%d\n",
+	ll.Printf("%stag:%s connsess:%s complete qnum:%d\n",
 		exampid, ltag, conn.Session(),
 		qnum)
 
-	// Standard example disconnect sequence
-	e = sngecomm.CommonDisconnect(n, conn, exampid, ltag, ll)
+	// Standard example disconnect sequence.  The connection is done, so
+	// another go routine failing does not cut the disconnect short.
+	e = cfg.Disconnect(context.Background(), n, conn, exampid, ltag, ll)
 	if e != nil {
-		ll.Fatalf("%stag:%s connsess:%s error:%s\n",
-			exampid, ltag, conn.Session(),
-			e.Error()) // Handle this ......
+		return e
 	}
 
-	sngecomm.ShowStats(exampid, "recv_"+fmt.Sprintf("%d", qnum), conn)
-	wgr.Done()
+	sngecomm.ShowStats(exampid, st+fmt.Sprintf("%d", qnum), conn)
+	return nil
 }
 
-func runSender(qnum int) {
-
-	ltag := tag + "-runsender"
-
-	ll.Printf("%stag:%s connsess:%s start qnum:%d\n",
-		exampid, ltag, sngecomm.Lcs,
-		qnum)
-	// Standard example connect sequence
-	n, conn, e := sngecomm.CommonConnect(exampid, ltag, ll)
-	if e != nil {
-		ll.Fatalf("%stag:%s connsess:%s error:%s\n",
-			exampid, ltag, sngecomm.Lcs,
-			e.Error()) // Handle this ......
-	}
-
-	//
-	sendMessages(conn, qnum, n)
-
-	ll.Printf("%stag:%s connsess:%s sends_complete qnum:%d\n",
-		exampid, ltag, conn.Session(),
-		qnum)
+func (rn *runner) runReceiver(qnum int) error {
+	return rn.runConn(tag+"-runreceiver", "recv_", qnum, rn.receiveMessages)
+}
 
-	// Standard example disconnect sequence
-	e = sngecomm.CommonDisconnect(n, conn, exampid, ltag, ll)
-	if e != nil {
-		ll.Fatalf("%stag:%s connsess:%s error:%s\n",
-			exampid, ltag, conn.Session(),
-			e.Error()) // Handle this ......
-	}
-	sngecomm.ShowStats(exampid, "send_"+fmt.Sprintf("%d", qnum), conn)
-	wgs.Done()
+func (rn *runner) runSender(qnum int) error {
+	return rn.runConn(tag+"-runsender", "send_", qnum, rn.sendMessages)
 }
 
-func main() {
+/*
+Run sends cfg.Nmsgs messages to each of cfg.Nqs queues, and receives them,
+with a go routine and a connection for each sender and each receiver.
+Receivers check that the messages have the right queue and message numbers,
+in order.  The first error from any go routine ends the run, and is
+returned.
+*/
+func Run(ctx context.Context, cfg *sngecomm.Config, ll *log.Logger) (Result, error) {
 
 	st := time.Now()
 
-	if sngecomm.LogFile() == "" {
-		ll = log.New(os.Stdout, "EMSMR", log.Ldate|log.Lmicroseconds|log.Lshortfile)
-	} else {
-		f, _ := os.Create(sngecomm.LogFile())
-		ll = log.New(f, "EMSMR ", log.Ldate|log.Lmicroseconds|log.Lshortfile)
-	}
-
-	sngecomm.ShowRunParmsLogger(exampid, ll)
+	rn := &runner{cfg: cfg, ll: ll, r: Result{Received: map[string]int{}}}
+	rn.ctx, rn.cancel = context.WithCancel(ctx)
+	defer rn.cancel()
 
 	ll.Printf("%stag:%s connsess:%s main_starts\n",
 		exampid, tag, sngecomm.Lcs)
 
-	ll.Printf("%stag:%s connsess:%s main_profiling pprof:%v\n",
-		exampid, tag, sngecomm.Lcs,
-		sngecomm.Pprof())
-
-	ll.Printf("%stag:%s connsess:%s main_current_GOMAXPROCS gmp:%v\n",
-		exampid, tag, sngecomm.Lcs,
-		runtime.GOMAXPROCS(-1))
-
-	if sngecomm.SetMAXPROCS() {
-		nc := runtime.NumCPU()
-		ll.Printf("%stag:%s connsess:%s main_current_num_cpus cncpu:%v\n",
-			exampid, tag, sngecomm.Lcs,
-			nc)
-		gmp := runtime.GOMAXPROCS(nc)
-		ll.Printf("%stag:%s connsess:%s main_previous_num_cpus pncpu:%v\n",
-			exampid, tag, sngecomm.Lcs,
-			gmp)
-		ll.Printf("%stag:%s connsess:%s main_current_GOMAXPROCS gmp:%v\n",
-			exampid, tag, sngecomm.Lcs,
-			runtime.GOMAXPROCS(-1))
-	}
 	//
-	sw = sngecomm.SendWait()
-	rw = sngecomm.RecvWait()
-	sf = sngecomm.SendFactor()
-	rf = sngecomm.RecvFactor()
-	ll.Printf("%stag:%s connsess:%s main_wait_sleep_factors sw:%v rw:%v sf:%v rf:%v\n",
+	rn.sw = cfg.SendWait
+	rn.rw = cfg.RecvWait
+	ll.Printf("%stag:%s connsess:%s main_wait_sleep_factors sw:%v rw:%v sf:%v rf:%v sd:%v rd:%v\n",
 		exampid, tag, sngecomm.Lcs,
-		sw, rw, sf, rf)
+		rn.sw, rn.rw, cfg.SendFactor, cfg.RecvFactor, cfg.SendDelay, cfg.RecvDelay)
 	//
-	numq := sngecomm.Nqs()
-	nmsgs = senv.Nmsgs() // message count
+	numq := cfg.Nqs
+	rn.nmsgs = cfg.Nmsgs // message count
 	//
+	var wgs, wgr sync.WaitGroup
+	start := func(wg *sync.WaitGroup, f func(int) error, q int) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if e := f(q); e != nil {
+				rn.fail(e)
+			}
+		}()
+	}
 	ll.Printf("%stag:%s connsess:%s main_starting_receivers\n",
 		exampid, tag, sngecomm.Lcs)
 	for q := 1; q <= numq; q++ {
-		wgr.Add(1)
-		go runReceiver(q)
+		start(&wgr, rn.runReceiver, q)
 	}
 	ll.Printf("%stag:%s connsess:%s main_started_receivers\n",
 		exampid, tag, sngecomm.Lcs)
@@ -341,8 +359,7 @@ func main() {
 	ll.Printf("%stag:%s connsess:%s main_starting_senders\n",
 		exampid, tag, sngecomm.Lcs)
 	for q := 1; q <= numq; q++ {
-		wgs.Add(1)
-		go runSender(q)
+		start(&wgs, rn.runSender, q)
 	}
 	ll.Printf("%stag:%s connsess:%s main_started_senders\n",
 		exampid, tag, sngecomm.Lcs)
@@ -353,11 +370,64 @@ func main() {
 	wgr.Wait()
 	ll.Printf("%stag:%s connsess:%s main_receivers_complete\n",
 		exampid, tag, sngecomm.Lcs)
+	if rn.err != nil {
+		return rn.r, rn.err
+	}
 	//
 
 	// The end
+	rn.r.Elapsed = time.Now().Sub(st)
 	ll.Printf("%stag:%s connsess:%s main_elapsed:%v\n",
 		exampid, tag, sngecomm.Lcs,
-		time.Now().Sub(st))
+		rn.r.Elapsed)
+	return rn.r, nil
+}
+
+func main() {
+
+	cfg, e := sngecomm.LoadConfig(flag.CommandLine, os.Args[1:])
+	if e != nil {
+		log.Fatalf("%stag:%s connsess:%s main_config error:%v",
+			exampid, tag, sngecomm.Lcs,
+			e.Error()) // Handle this ......
+	}
+
+	if cfg.LogFile == "" {
+		ll = log.New(os.Stdout, "EMSMR", log.Ldate|log.Lmicroseconds|log.Lshortfile)
+	} else {
+		f, _ := os.Create(cfg.LogFile)
+		ll = log.New(f, "EMSMR ", log.Ldate|log.Lmicroseconds|log.Lshortfile)
+	}
+
+	cfg.ShowRunParms(exampid, ll)
+
+	ll.Printf("%stag:%s connsess:%s main_profiling pprof:%v\n",
+		exampid, tag, sngecomm.Lcs,
+		cfg.Pprof)
+
+	ll.Printf("%stag:%s connsess:%s main_current_GOMAXPROCS gmp:%v\n",
+		exampid, tag, sngecomm.Lcs,
+		runtime.GOMAXPROCS(-1))
+
+	if cfg.SetMaxProcs {
+		nc := runtime.NumCPU()
+		ll.Printf("%stag:%s connsess:%s main_current_num_cpus cncpu:%v\n",
+			exampid, tag, sngecomm.Lcs,
+			nc)
+		gmp := runtime.GOMAXPROCS(nc)
+		ll.Printf("%stag:%s connsess:%s main_previous_num_cpus pncpu:%v\n",
+			exampid, tag, sngecomm.Lcs,
+			gmp)
+		ll.Printf("%stag:%s connsess:%s main_current_GOMAXPROCS gmp:%v\n",
+			exampid, tag, sngecomm.Lcs,
+			runtime.GOMAXPROCS(-1))
+	}
+
+	r, e := Run(context.Background(), cfg, ll)
+	if e != nil {
+		ll.Fatalf("%stag:%s connsess:%s main_run sent:%d error:%v",
+			exampid, tag, sngecomm.Lcs,
+			r.Sent, e.Error()) // Handle this ......
+	}
 	time.Sleep(250 * time.Millisecond)
 }
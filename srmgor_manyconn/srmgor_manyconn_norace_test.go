@@ -0,0 +1,36 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+// The broker closes the connection while SUBSCRIBE is in flight, and
+// stompngo sets and reads its connected flag with no locking, so this test
+// does not run with the race detector.
+
+//go:build !race
+// +build !race
+
+package main
+
+import (
+	"testing"
+)
+
+/*
+Test that a receiver fails on an ERROR frame.
+*/
+func TestRunErrorFrame(t *testing.T) {
+	runFault(t, "error cmd=SUBSCRIBE dest="+faultDest,
+		"bad_frame qns:1 command:ERROR")
+}
@@ -0,0 +1,116 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gmallard/stompngo_examples/sngecomm/testbroker"
+	"github.com/gmallard/stompngo_examples/sngecomm/testbroker/brokertest"
+)
+
+/*
+Test srmgor_manyconn against a test broker, with auto and client acks.
+*/
+func TestRun(t *testing.T) {
+	lg := log.New(ioutil.Discard, "", 0)
+	for _, am := range []string{"auto", "client", "client-individual"} {
+		b, cfg, done := brokertest.Start(t, testbroker.Options{})
+		//
+		cfg.Dest = "/queue/srmgor.test"
+		cfg.Nqs, cfg.Nmsgs, cfg.Mdml = 3, 5, 100
+		cfg.AckMode = am
+		cfg.SendWait, cfg.RecvWait = false, false
+		r, e := Run(context.Background(), cfg, lg)
+		done()
+		if e != nil {
+			t.Fatalf("%s, expected no error, got [%v]\n", am, e)
+		}
+		wa := 0
+		if am != "auto" {
+			wa = 15
+		}
+		if r.Sent != 15 || r.Acked != wa || len(r.Received) != 3 {
+			t.Fatalf("%s, expected 15 sent, %d acked, 3 queues, got [%+v]\n", am, wa, r)
+		}
+		s := b.Stats()
+		if s.Connections != 2*cfg.Nqs || s.Delivered != 15 || s.Acked != wa || s.Redelivered != 0 {
+			t.Errorf("%s, expected 6 connections, 15 delivered, %d acked, got [%+v]\n",
+				am, wa, s)
+		}
+		// Message numbers are in order for each queue
+		next := map[string]int{}
+		for _, f := range b.Frames("SEND") {
+			d := f.Value("destination")
+			next[d]++
+			if f.Value("msgnum") != strconv.Itoa(next[d]) {
+				t.Errorf("%s, %s expected msgnum %d, got [%v]\n", am, d, next[d], f.Headers)
+			}
+		}
+		for q := 1; q <= cfg.Nqs; q++ {
+			d := fmt.Sprintf("%s.srmgor_manyconn.%d", cfg.Dest, q)
+			if r.Received[d] != 5 || next[d] != 5 || b.Unacked(d) != 0 || b.Depth(d) != 0 {
+				t.Errorf("%s, %s expected 5 sent and received, got %d and %d\n", am, d,
+					next[d], r.Received[d])
+			}
+		}
+	}
+}
+
+// faultDest is the queue 1 destination used by runFault.
+const faultDest = "/queue/srmgor.faults.srmgor_manyconn.1"
+
+// runFault runs with a fault script, and checks for an error that starts
+// with err, and a short receive on queue 1.
+func runFault(t *testing.T, script, err string) {
+	fs, e := testbroker.ParseFaults(script)
+	if e != nil {
+		t.Fatal(e)
+	}
+	_, cfg, done := brokertest.Start(t, testbroker.Options{Faults: fs})
+	//
+	cfg.Dest = "/queue/srmgor.faults"
+	cfg.Nqs, cfg.Nmsgs, cfg.Mdml = 2, 5, 100
+	// With no ACKs.  stompngo does not lock its connected flag, which
+	// an ACK reads and a failed read sets.
+	cfg.AckMode = "auto"
+	cfg.SendWait, cfg.RecvWait = false, false
+	r, e := Run(context.Background(), cfg, log.New(ioutil.Discard, "", 0))
+	done()
+	if e == nil || !strings.HasPrefix(e.Error(), err) {
+		t.Errorf("%q, expected error [%s...], got [%v]\n", script, err, e)
+	}
+	if r.Received[faultDest] == cfg.Nmsgs {
+		t.Errorf("%q, expected a short receive, got [%+v]\n", script, r)
+	}
+}
+
+/*
+Test that receivers fail on bad frames, and on out of order messages.
+*/
+func TestRunFaults(t *testing.T) {
+	runFault(t, "redeliver dest="+faultDest+" after=1 count=1",
+		"dirty_message qns:1 msgnum:3")
+	runFault(t, "malformed cmd=MESSAGE dest="+faultDest+" after=2",
+		"receive_error qns:1")
+}
@@ -45,13 +45,14 @@ Subscribe and receive messages from a STOMP broker.
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"log"
 	"os"
 	"time"
 	//
 	"github.com/gmallard/stompngo"
-	// senv methods could be used in general by stompngo clients.
-	"github.com/gmallard/stompngo/senv"
 	// sngecomm methods are used specifically for these example clients.
 	"github.com/gmallard/stompngo_examples/sngecomm"
 )
@@ -63,42 +64,64 @@ var (
 	tag = "subscribemain"
 )
 
-// Connect to a STOMP broker, subscribe and receive some messages and disconnect.
-func main() {
+// Result is the outcome of a Run.
+type Result struct {
+	Messages []stompngo.Message // Received, in order, without any EOF message
+	EOF      bool               // An EOF message ended the run
+	Elapsed  time.Duration
+}
+
+/*
+Run connects to a STOMP broker, subscribes and receives cfg.Nmsgs messages,
+or until an EOF message with cfg.UseEOF, and disconnects.  A RECEIPT or
+ERROR frame while receiving is an error.
+*/
+func Run(ctx context.Context, cfg *sngecomm.Config, ll *log.Logger) (Result, error) {
 
 	st := time.Now()
+	var r Result
 
-	// Standard example connect sequence
-	n, conn, e := sngecomm.CommonConnect(exampid, tag, ll)
+	// Standard example connect sequence, bounded by any timeout
+	cctx, cancel := cfg.OpContext(ctx)
+	n, conn, e := cfg.Connect(cctx, exampid, tag, ll)
+	cancel()
 	if e != nil {
-		ll.Fatalf("%stag:%s connsess:%s main_on_connect error:%v",
-			exampid, tag, sngecomm.Lcs,
-			e.Error()) // Handle this ......
+		return r, e
+	}
+	fail := func(e error) (Result, error) {
+		_ = n.Close()
+		return r, e
 	}
 
-	pbc := sngecomm.Pbc() // Print byte count
+	pbc := cfg.Pbc // Print byte count
 
 	// *NOTE* your application functionaltiy goes here!
 	// With Stomp, you must SUBSCRIBE to a destination in order to receive.
 	// Subscribe returns a channel of MessageData struct.
 	// Here we use a common utility routine to handle the differing subscribe
 	// requirements of each protocol level.
-	d := senv.Dest()
+	d := cfg.Destination()
 	id := stompngo.Uuid()
-	sc := sngecomm.HandleSubscribe(conn, d, id, "auto")
+	sctx, cancel := cfg.OpContext(ctx)
+	sc, e := sngecomm.SubscribeContext(sctx, conn, d, id, "auto")
+	cancel()
+	if e != nil {
+		return fail(e)
+	}
 	ll.Printf("%stag:%s connsess:%s stomp_subscribe_complete\n",
 		exampid, tag, conn.Session())
 	// Read data from the returned channel
 	var md stompngo.MessageData
-	for i := 1; i <= senv.Nmsgs(); i++ {
+	for i := 1; i <= cfg.Nmsgs; i++ {
 
 		select {
 		case md = <-sc:
 		case md = <-conn.MessageData:
 			// Frames RECEIPT or ERROR not expected here
-			ll.Fatalf("%stag:%s connsess:%s bad_frame error:%v",
-				exampid, tag, conn.Session(),
-				e.Error()) // Handle this ......
+			return fail(fmt.Errorf("unexpected %s frame: %s", md.Message.Command,
+				md.Message.Headers.Value("message")))
+		case <-ctx.Done():
+			return fail(ctx.Err())
 		}
 
 		ll.Printf("%stag:%s connsess:%s channel_read_complete\n",
@@ -111,9 +134,7 @@ func main() {
 		// a) a Message struct
 		// b) an Error value.  Check the error value as usual
 		if md.Error != nil {
-			ll.Fatalf("%stag:%s connsess:%s error_read error:%v",
-				exampid, tag, conn.Session(),
-				e.Error()) // Handle this ......
+			return fail(md.Error)
 		}
 		//
 		ll.Printf("%stag:%s connsess:%s frame_type cmd:%s\n",
@@ -121,9 +142,7 @@ func main() {
 			md.Message.Command)
 
 		if md.Message.Command != stompngo.MESSAGE {
-			ll.Fatalf("%stag:%s connsess:%s error_frame_type error:%v",
-				exampid, tag, conn.Session(),
-				e.Error()) // Handle this ......
+			return fail(fmt.Errorf("unexpected %s frame", md.Message.Command))
 		}
 		wh := md.Message.Headers
 		for j := 0; j < len(wh)-1; j += 2 {
@@ -142,29 +161,51 @@ func main() {
 				ss)
 		}
 		mbs := string(md.Message.Body)
-		if sngecomm.UseEOF() && mbs == sngecomm.EOFMsg {
+		if cfg.UseEOF && mbs == sngecomm.EOFMsg {
 			ll.Printf("%stag:%s connsess:%s received EOF\n",
 				exampid, tag, conn.Session())
+			r.EOF = true
 			break
 		}
+		r.Messages = append(r.Messages, md.Message)
 	}
 	// It is polite to unsubscribe, although unnecessary if a disconnect follows.
 	// Again we use a utility routine to handle the different protocol level
 	// requirements.
-	sngecomm.HandleUnsubscribe(conn, d, id)
+	if e = sngecomm.Unsubscribe(conn, d, id); e != nil {
+		return fail(e)
+	}
 	ll.Printf("%stag:%s connsess:%s stomp_unsubscribe_complete\n",
 		exampid, tag, conn.Session())
 
 	// Standard example disconnect sequence
-	e = sngecomm.CommonDisconnect(n, conn, exampid, tag, ll)
+	e = cfg.Disconnect(ctx, n, conn, exampid, tag, ll)
 	if e != nil {
-		ll.Fatalf("%stag:%s connsess:%s main_on_disconnect error:%v",
-			exampid, tag, conn.Session(),
-			e.Error()) // Handle this ......
+		return r, e
 	}
 
+	r.Elapsed = time.Now().Sub(st)
 	ll.Printf("%stag:%s connsess:%s main_elapsed:%v\n",
 		exampid, tag, conn.Session(),
-		time.Now().Sub(st))
+		r.Elapsed)
+	return r, nil
+}
+
+// Connect to a STOMP broker, subscribe and receive some messages and disconnect.
+func main() {
+
+	cfg, e := sngecomm.LoadConfig(flag.CommandLine, os.Args[1:])
+	if e != nil {
+		ll.Fatalf("%stag:%s connsess:%s main_config error:%v",
+			exampid, tag, sngecomm.Lcs,
+			e.Error()) // Handle this ......
+	}
+
+	r, e := Run(context.Background(), cfg, ll)
+	if e != nil {
+		ll.Fatalf("%stag:%s connsess:%s main_run received:%d error:%v",
+			exampid, tag, sngecomm.Lcs,
+			len(r.Messages), e.Error()) // Handle this ......
+	}
 
 }
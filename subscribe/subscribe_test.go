@@ -0,0 +1,78 @@
+//
+// Copyright © 2019 Guy M. Allard
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"testing"
+
+	"github.com/gmallard/stompngo_examples/sngecomm"
+	"github.com/gmallard/stompngo_examples/sngecomm/testbroker"
+	"github.com/gmallard/stompngo_examples/sngecomm/testbroker/brokertest"
+)
+
+/*
+Test subscribe against a test broker, ending at a message count and at an
+EOF message.
+*/
+func TestRun(t *testing.T) {
+	b, cfg, done := brokertest.Start(t, testbroker.Options{})
+	defer done()
+	lg := log.New(ioutil.Discard, "", 0)
+	//
+	tests := []struct {
+		nmsgs  int
+		useEOF bool
+		want   int
+	}{
+		{3, false, 3},
+		{10, true, 5},
+	}
+	for i, tc := range tests {
+		cfg.Dest = fmt.Sprintf("/queue/subscribe.test.%d", i)
+		cfg.Nmsgs, cfg.UseEOF = tc.nmsgs, tc.useEOF
+		// Exactly what Run reads.  Messages left for the subscription could
+		// be taken by DISCONNECT for its RECEIPT.
+		for j := 1; j <= tc.want; j++ {
+			b.Publish(cfg.Dest, []byte(fmt.Sprintf("body %d", j)), "seq", fmt.Sprint(j))
+		}
+		if tc.useEOF {
+			b.Publish(cfg.Dest, []byte(sngecomm.EOFMsg))
+		}
+		r, e := Run(context.Background(), cfg, lg)
+		if e != nil {
+			t.Fatalf("%d, expected no error, got [%v]\n", i, e)
+		}
+		if len(r.Messages) != tc.want || r.EOF != tc.useEOF {
+			t.Fatalf("%d, expected %d messages, EOF %t, got %d, %t\n", i, tc.want,
+				tc.useEOF, len(r.Messages), r.EOF)
+		}
+		for j, m := range r.Messages {
+			if m.Headers.Value("seq") != fmt.Sprint(j+1) ||
+				string(m.Body) != fmt.Sprintf("body %d", j+1) ||
+				m.Headers.Value("destination") != cfg.Dest {
+				t.Errorf("%d, message %d, got [%v] [%s]\n", i, j+1, m.Headers, m.Body)
+			}
+		}
+	}
+	if s := b.Stats(); s.Frames["UNSUBSCRIBE"] != 2 || s.Frames["DISCONNECT"] != 2 {
+		t.Errorf("Stats, expected 2 UNSUBSCRIBEs and DISCONNECTs, got [%+v]\n", s)
+	}
+}
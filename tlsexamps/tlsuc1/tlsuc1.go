@@ -32,6 +32,9 @@ Connect and Disconnect from a STOMP broker with a TLS connection, use case 1.
 		go build
 		STOMP_PORT=61611 ./tlsuc1
 
+	STOMP_TLS_MINVERSION, STOMP_TLS_CIPHERSUITES and the other STOMP_TLS_*
+	variables apply.  See sngecomm.TLSConfigFromEnv.
+
 */
 package main
 
@@ -61,16 +64,16 @@ func main() {
 	ll.Printf("%stag:%s connsess:%s starts\n",
 		exampid, tag, sngecomm.Lcs)
 
-	// TLS Configuration.
-	tc = new(tls.Config)
-	tc.InsecureSkipVerify = true // Do *not* check the server's certificate
-
-	// Usually one will use the default cipher suites that go provides.
-	// However, if a custom cipher squite list is needed/required this
-	// is how it is accomplished.
-	if sngecomm.UseCustomCiphers() { // Set custom cipher suite list
-		tc.CipherSuites = append(tc.CipherSuites, sngecomm.CustomCiphers()...)
+	// TLS Configuration, from the STOMP_TLS_* environment variables, STOMP_URL
+	// or the broker profile.  See sngecomm.TLSConfigFromEnv.
+	var e error
+	tc, e = sngecomm.TLSConfigFromEnv()
+	if e != nil {
+		ll.Fatalf("%stag:%s connsess:%s main_tls_config error:%v",
+			exampid, tag, sngecomm.Lcs,
+			e.Error()) // Handle this ......
 	}
+	tc.InsecureSkipVerify = true // Do *not* check the broker's certificate
 
 	// Standard example TLS connect sequence
 	n, conn, e := sngecomm.CommonTLSConnect(exampid, tag, ll, tc)
@@ -81,7 +84,7 @@ func main() {
 	}
 
 	nc := n.(*tls.Conn)
-	sngecomm.DumpTLSConfig(exampid, tc, nc)
+	sngecomm.ReportTLS(exampid, tag, ll, tc, nc)
 
 	// *NOTE* application specific functionaltiy starts here!
 	// For you to add.
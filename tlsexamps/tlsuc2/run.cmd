@@ -4,5 +4,6 @@ IF [%CERTBASE%]==[] SET CERTBASE=%USERPROFILE%\Documents\tls-certs
 IF [%CACERT%]==[] SET CACERT=ca.crt
 @echo on
 go build
-tlsuc2.exe -srvCAFile=%CERTBASE%\%CACERT%
+SET STOMP_TLS_CAFILE=%CERTBASE%\%CACERT%
+tlsuc2.exe
 @echo off
@@ -1,9 +1,10 @@
 #!/bin/sh
 #
 set -x
-CERTBASE=${CERTBASE:-/ad3/gma/ad3/sslwork/2017-01}
+# Generate with: go run ../../cmd/tlspki/main.go -dir $HOME/tls-certs
+CERTBASE=${CERTBASE:-$HOME/tls-certs}
 CACERT=${CACERT:-ca.crt}
 go build
-./tlsuc2 -srvCAFile=$CERTBASE/$CACERT
+STOMP_TLS_CAFILE=$CERTBASE/$CACERT ./tlsuc2
 set +x
 
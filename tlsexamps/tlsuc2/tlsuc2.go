@@ -31,40 +31,30 @@ Connect and Disconnect from a STOMP broker with a TLS connection, use case 2.
 	Example use might be:
 
 		go build
-		STOMP_PORT=61611 ./tlsuc2 -srvCAFile=/ad3/gma/sslwork/2016-02/ca.crt # PEM format file
+		go run ../../cmd/tlspki/main.go -dir $HOME/tls-certs # A test PKI, once
+		STOMP_PORT=61611 STOMP_TLS_CAFILE=$HOME/tls-certs/ca.crt ./tlsuc2 # PEM format file
 
 */
 package main
 
 import (
 	"crypto/tls"
-	"crypto/x509"
-	"encoding/pem"
-	"flag"
-	"io/ioutil"
 	"log"
 	"os"
 	"time"
-	//
-	"github.com/gmallard/stompngo/senv"
 	// sngecomm methods are used specifically for these example clients.
 	"github.com/gmallard/stompngo_examples/sngecomm"
 )
 
 var (
-	exampid   = "tlsuc2: "
-	tc        *tls.Config
-	srvCAFile string // Name of file with broker's CA certificate, PEM format
+	exampid = "tlsuc2: "
+	tc      *tls.Config
 
 	ll = log.New(os.Stdout, "TLSU2 ", log.Ldate|log.Lmicroseconds|log.Lshortfile)
 
 	tag = "tuc2main"
 )
 
-func init() {
-	flag.StringVar(&srvCAFile, "srvCAFile", "DUMMY", "Name of file with broker CA certificate")
-}
-
 // Connect to a STOMP broker using TLS and disconnect.
 func main() {
 
@@ -73,47 +63,22 @@ func main() {
 	ll.Printf("%stag:%s connsess:%s starts\n",
 		exampid, tag, sngecomm.Lcs)
 
-	flag.Parse() // Parse flags
-	ll.Printf("%stag:%s connsess:%s main_using_srvCAFile:%s\n",
-		exampid, tag, sngecomm.Lcs,
-		srvCAFile)
-
-	// TLS Configuration.
-	tc = new(tls.Config)
-	tc.InsecureSkipVerify = false // *Do* check the broker's certificate
-	// Be polite, allow SNI (Server Virtual Hosting)
-	tc.ServerName = senv.Host()
-
-	// Usually one will use the default cipher suites that go provides.
-	// However, if a custom cipher squite list is needed/required this
-	// is how it is accomplished.
-	if sngecomm.UseCustomCiphers() { // Set custom cipher suite list
-		tc.CipherSuites = append(tc.CipherSuites, sngecomm.CustomCiphers()...)
-	}
-
-	// Finish TLS Config initialization, so client can authenticate broker.
-	b, e := ioutil.ReadFile(srvCAFile) // Read broker's CA cert (PEM)
+	// TLS Configuration, from the STOMP_TLS_* environment variables, STOMP_URL
+	// or the broker profile.  See sngecomm.TLSConfigFromEnv.
+	var e error
+	tc, e = sngecomm.TLSConfigFromEnv()
 	if e != nil {
-		ll.Fatalf("%stag:%s connsess:%s main_read_file error:%v",
+		ll.Fatalf("%stag:%s connsess:%s main_tls_config error:%v",
 			exampid, tag, sngecomm.Lcs,
 			e.Error()) // Handle this ......
 	}
-	k, _ := pem.Decode(b) // Decode PEM format (*pem.Block)
-	if k == nil {
-		ll.Fatalf("%stag:%s connsess:%s main_decode error:%v",
-			exampid, tag, sngecomm.Lcs,
-			e.Error()) // Handle this ......
-	}
-	c, e := x509.ParseCertificate(k.Bytes) // Create *x509.Certificate
-	if e != nil {
-		ll.Fatalf("%stag:%s connsess:%s main_parse_cert error:%v",
+	tc.InsecureSkipVerify = false // *Do* check the broker's certificate
+	if tc.RootCAs == nil {
+		ll.Fatalf("%stag:%s connsess:%s main_tls_config error:%s",
 			exampid, tag, sngecomm.Lcs,
-			e.Error()) // Handle this ......
+			"STOMP_TLS_CAFILE is required") // Handle this ......
 	}
 
-	tc.RootCAs = x509.NewCertPool() // Create a cert "pool"
-	tc.RootCAs.AddCert(c)           // Add the CA cert to the pool
-
 	// Standard example TLS connect sequence
 	n, conn, e := sngecomm.CommonTLSConnect(exampid, tag, ll, tc)
 	if e != nil {
@@ -123,7 +88,7 @@ func main() {
 	}
 
 	nc := n.(*tls.Conn)
-	sngecomm.DumpTLSConfig(exampid, tc, nc)
+	sngecomm.ReportTLS(exampid, tag, ll, tc, nc)
 
 	// *NOTE* application specific functionaltiy starts here!
 	// For you to add.
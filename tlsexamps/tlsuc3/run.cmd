@@ -5,6 +5,8 @@ IF [%CLICERT%]==[] SET CLICERT=client.crt
 IF [%CLIKEY%]==[] SET CLIKEY=client.key
 @echo on
 go build
-tlsuc3.exe -cliCertFile=%CERTBASE%\%CLICERT% -cliKeyFile=%CERTBASE%\%CLIKEY%
+SET STOMP_TLS_CERTFILE=%CERTBASE%\%CLICERT%
+SET STOMP_TLS_KEYFILE=%CERTBASE%\%CLIKEY%
+tlsuc3.exe
 @echo off
 
@@ -2,11 +2,12 @@
 #
 set -x
 go build
-CERTBASE=${CERTBASE:-/ad3/gma/ad3/sslwork/2017-01}
+# Generate with: go run ../../cmd/tlspki/main.go -dir $HOME/tls-certs
+CERTBASE=${CERTBASE:-$HOME/tls-certs}
 CLICERT=${CLICERT:-client.crt}
 CLIKEY=${CLIKEY:-client.key}
 #
-./tlsuc3 -cliCertFile=$CERTBASE/$CLICERT \
-	-cliKeyFile=$CERTBASE/$CLIKEY
+STOMP_TLS_CERTFILE=$CERTBASE/$CLICERT \
+	STOMP_TLS_KEYFILE=$CERTBASE/$CLIKEY ./tlsuc3
 set +x
 
@@ -30,38 +30,39 @@ Connect and Disconnect from a STOMP broker with a TLS connection, use case 3.
 	Example use might be:
 
 		go build
-		STOMP_PORT=61611 ./tlsuc3 -cliCertFile=/ad3/gma/sslwork/2016-02/client.crt -cliKeyFile=/ad3/gma/sslwork/2016-02/client.key
+		go run ../../cmd/tlspki/main.go -dir $HOME/tls-certs # A test PKI, once
+		. $HOME/tls-certs/tlsuc3.env # STOMP_TLS_CERTFILE and STOMP_TLS_KEYFILE
+		STOMP_PORT=61611 ./tlsuc3
+
+	Or with a PKCS#12 client certificate and key:
+
+		STOMP_PORT=61611 STOMP_TLS_PKCS12FILE=client.p12 STOMP_TLS_PKCS12PASSWORD=secret ./tlsuc3
+
+	For a long running client whose certificate is renewed in place, reload
+	it on each reconnect:
+
+		STOMP_PORT=61611 STOMP_TLS_CERTRELOAD=true STOMP_TLS_CERTWARN=4h ./tlsuc3
 
 */
 package main
 
 import (
 	"crypto/tls"
-	"flag"
 	"log"
 	"os"
 	"time"
-	// senv methods could be used in general by stompngo clients.
-	"github.com/gmallard/stompngo/senv"
 	// sngecomm methods are used specifically for these example clients.
 	"github.com/gmallard/stompngo_examples/sngecomm"
 )
 
 var (
-	exampid     = "tlsuc3:"
-	tc          *tls.Config
-	cliCertFile string
-	cliKeyFile  string
-	ll          = log.New(os.Stdout, "TLSU3 ", log.Ldate|log.Lmicroseconds|log.Lshortfile)
+	exampid = "tlsuc3:"
+	tc      *tls.Config
+	ll      = log.New(os.Stdout, "TLSU3 ", log.Ldate|log.Lmicroseconds|log.Lshortfile)
 
 	tag = "tuc3main"
 )
 
-func init() {
-	flag.StringVar(&cliCertFile, "cliCertFile", "DUMMY_CERT", "Name of client cert file")
-	flag.StringVar(&cliKeyFile, "cliKeyFile", "DUMMY_KEY", "Name of client key file")
-}
-
 // Connect to a STOMP broker using TLS and disconnect.
 func main() {
 
@@ -70,39 +71,22 @@ func main() {
 	ll.Printf("%stag:%s connsess:%s starts\n",
 		exampid, tag, sngecomm.Lcs)
 
-	flag.Parse() // Parse flags
-	ll.Printf("%stag:%s connsess:%s main_using_cliCertFile:%s\n",
-		exampid, tag, sngecomm.Lcs,
-		cliCertFile)
-	ll.Printf("%stag:%s connsess:%s main_using_cliKeyFile:%s\n",
-		exampid, tag, sngecomm.Lcs,
-		cliKeyFile)
-
-	// TLS Configuration.
-	tc = new(tls.Config)
-	tc.InsecureSkipVerify = true // Do *not* check the broker's certificate
-	// Be polite, allow SNI (Server Virtual Hosting)
-	tc.ServerName = senv.Host()
-
-	// Usually one will use the default cipher suites that go provides.
-	// However, if a custom cipher squite list is needed/required this
-	// is how it is accomplished.
-	if sngecomm.UseCustomCiphers() { // Set custom cipher suite list
-		tc.CipherSuites = append(tc.CipherSuites, sngecomm.CustomCiphers()...)
-	}
-
-	// Finish TLS Config initialization, so broker can authenticate client.
-	// cc -> tls.Certificate
-	cc, e := tls.LoadX509KeyPair(cliCertFile, cliKeyFile)
+	// TLS Configuration, from the STOMP_TLS_* environment variables, STOMP_URL
+	// or the broker profile.  See sngecomm.TLSConfigFromEnv.
+	var e error
+	tc, e = sngecomm.TLSConfigFromEnv()
 	if e != nil {
-		ll.Fatalf("%stag:%s connsess:%s main_load_pair error:%v",
+		ll.Fatalf("%stag:%s connsess:%s main_tls_config error:%v",
 			exampid, tag, sngecomm.Lcs,
 			e.Error()) // Handle this ......
 	}
-	// Add cert to config
-	tc.Certificates = append(tc.Certificates, cc)
-	// This is OK, but does not seem to be required
-	tc.BuildNameToCertificate() // Build names map
+	tc.InsecureSkipVerify = true // Do *not* check the broker's certificate
+	// So the broker can authenticate the client.
+	if len(tc.Certificates) == 0 && tc.GetClientCertificate == nil {
+		ll.Fatalf("%stag:%s connsess:%s main_tls_config error:%s",
+			exampid, tag, sngecomm.Lcs,
+			"STOMP_TLS_CERTFILE and STOMP_TLS_KEYFILE, or STOMP_TLS_PKCS12FILE, are required") // Handle this ......
+	}
 
 	// Standard example TLS connect sequence
 	n, conn, e := sngecomm.CommonTLSConnect(exampid, tag, ll, tc)
@@ -113,7 +97,7 @@ func main() {
 	}
 
 	nc := n.(*tls.Conn)
-	sngecomm.DumpTLSConfig(exampid, tc, nc)
+	sngecomm.ReportTLS(exampid, tag, ll, tc, nc)
 
 	// *NOTE* application specific functionaltiy starts here!
 	// For you to add.
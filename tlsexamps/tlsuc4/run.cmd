@@ -6,5 +6,8 @@ IF [%CLIKEY%]==[] SET CLIKEY=client.key
 IF [%CACERT%]==[] SET CACERT=ca.crt
 @echo on
 go build
-tlsuc4.exe -cliCertFile=%CERTBASE%\%CLICERT% -cliKeyFile=%CERTBASE%\%CLIKEY% -srvCAFile=%CERTBASE%\%CACERT%
+SET STOMP_TLS_CAFILE=%CERTBASE%\%CACERT%
+SET STOMP_TLS_CERTFILE=%CERTBASE%\%CLICERT%
+SET STOMP_TLS_KEYFILE=%CERTBASE%\%CLIKEY%
+tlsuc4.exe
 @echo off
@@ -1,13 +1,14 @@
 #!/bin/sh
 #
 set -x
-CERTBASE=${CERTBASE:-/ad3/gma/ad3/sslwork/2017-01}
+# Generate with: go run ../../cmd/tlspki/main.go -dir $HOME/tls-certs
+CERTBASE=${CERTBASE:-$HOME/tls-certs}
 CACERT=${CACERT:-ca.crt}
 CLICERT=${CLICERT:-client.crt}
 CLIKEY=${CLIKEY:-client.key}
 go build
-./tlsuc4 -srvCAFile=$CERTBASE/$CACERT \
-	-cliCertFile=$CERTBASE/$CLICERT \
-	-cliKeyFile=$CERTBASE/$CLIKEY
+STOMP_TLS_CAFILE=$CERTBASE/$CACERT \
+	STOMP_TLS_CERTFILE=$CERTBASE/$CLICERT \
+	STOMP_TLS_KEYFILE=$CERTBASE/$CLIKEY ./tlsuc4
 set +x
 
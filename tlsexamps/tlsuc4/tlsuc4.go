@@ -30,44 +30,38 @@ Connect and Disconnect from a STOMP broker with a TLS connection, use case 4.
 	Example use might be:
 
 		go build
-		STOMP_PORT=61611 ./tlsuc4 -srvCAFile=/ad3/gma/sslwork/2016-02/ca.crt -cliCertFile=/ad3/gma/sslwork/2016-02/client.crt -cliKeyFile=/ad3/gma/sslwork/2016-02/client.key
+		go run ../../cmd/tlspki/main.go -dir $HOME/tls-certs # A test PKI, once
+		. $HOME/tls-certs/tlsuc4.env # STOMP_TLS_CAFILE, _CERTFILE and _KEYFILE
+		STOMP_PORT=61611 ./tlsuc4
+
+	The STOMP_TLS_* values may instead come from a broker profile.
+
+	For a long running client whose certificate is renewed in place, reload
+	it on each reconnect:
+
+		STOMP_PORT=61611 STOMP_TLS_CERTRELOAD=true STOMP_TLS_CERTWARN=4h ./tlsuc4
 
 */
 package main
 
 import (
 	"crypto/tls"
-	"crypto/x509"
-	"encoding/pem"
-	"flag"
-	"io/ioutil"
 	"log"
 	"os"
 	"time"
-	// senv methods could be used in general by stompngo clients.
-	"github.com/gmallard/stompngo/senv"
 	// sngecomm methods are used specifically for these example clients.
 	"github.com/gmallard/stompngo_examples/sngecomm"
 )
 
 var (
-	exampid     = "tlsuc4:"
-	tc          *tls.Config
-	srvCAFile   string // Name of file with broker's CA certificate, PEM format
-	cliCertFile string
-	cliKeyFile  string
+	exampid = "tlsuc4:"
+	tc      *tls.Config
 
 	ll = log.New(os.Stdout, "TLSU4 ", log.Ldate|log.Lmicroseconds|log.Lshortfile)
 
 	tag = "tuc4main"
 )
 
-func init() {
-	flag.StringVar(&srvCAFile, "srvCAFile", "DUMMY", "Name of file with broker CA certificate")
-	flag.StringVar(&cliCertFile, "cliCertFile", "DUMMY_CERT", "Name of client cert file")
-	flag.StringVar(&cliKeyFile, "cliKeyFile", "DUMMY_KEY", "Name of client key file")
-}
-
 // Connect to a STOMP broker using TLS and disconnect.
 func main() {
 
@@ -76,61 +70,27 @@ func main() {
 	ll.Printf("%stag:%s connsess:%s starts\n",
 		exampid, tag, sngecomm.Lcs)
 
-	flag.Parse() // Parse flags
-	ll.Printf("%stag:%s connsess:%s main_using_srvCAFile:%s\n",
-		exampid, tag, sngecomm.Lcs,
-		srvCAFile)
-	ll.Printf("%stag:%s connsess:%s main_using_cliCertFile:%s\n",
-		exampid, tag, sngecomm.Lcs,
-		cliCertFile)
-	ll.Printf("%stag:%s connsess:%s main_using_cliKeyFile:%s\n",
-		exampid, tag, sngecomm.Lcs,
-		cliKeyFile)
-
-	// TLS Configuration.
-	tc = new(tls.Config)
-	tc.InsecureSkipVerify = false // *Do* check the broker's certificate
-	// Be polite, allow SNI (Server Virtual Hosting)
-	tc.ServerName = senv.Host()
-	// Finish TLS Config initialization, so client can authenticate broker,
-	// and broker can authenticate client.
-
-	// Usually one will use the default cipher suites that go provides.
-	// However, if a custom cipher squite list is needed/required this
-	// is how it is accomplished.
-	if sngecomm.UseCustomCiphers() { // Set custom cipher suite list
-		tc.CipherSuites = append(tc.CipherSuites, sngecomm.CustomCiphers()...)
-	}
-
-	b, e := ioutil.ReadFile(srvCAFile) // Read broker's CA cert (PEM)
+	// TLS Configuration, from the STOMP_TLS_* environment variables, STOMP_URL
+	// or the broker profile.  See sngecomm.TLSConfigFromEnv.
+	var e error
+	tc, e = sngecomm.TLSConfigFromEnv()
 	if e != nil {
-		ll.Fatalf("%stag:%s connsess:%s main_read_file error:%v",
+		ll.Fatalf("%stag:%s connsess:%s main_tls_config error:%v",
 			exampid, tag, sngecomm.Lcs,
 			e.Error()) // Handle this ......
 	}
-	k, _ := pem.Decode(b) // Decode PEM format
-	if k == nil {
-		ll.Fatalf("%stag:%s connsess:%s main_decode error:%v",
+	tc.InsecureSkipVerify = false // *Do* check the broker's certificate
+	if tc.RootCAs == nil {
+		ll.Fatalf("%stag:%s connsess:%s main_tls_config error:%s",
 			exampid, tag, sngecomm.Lcs,
-			e.Error()) // Handle this ......
+			"STOMP_TLS_CAFILE is required") // Handle this ......
 	}
-	//
-	c, e := x509.ParseCertificate(k.Bytes) // Create *x509.Certificate
-	if e != nil {
-		ll.Fatalf("%stag:%s connsess:%s main_parse_cert error:%v",
+	// So the broker can authenticate the client.
+	if len(tc.Certificates) == 0 && tc.GetClientCertificate == nil {
+		ll.Fatalf("%stag:%s connsess:%s main_tls_config error:%s",
 			exampid, tag, sngecomm.Lcs,
-			e.Error()) // Handle this ......
-	}
-	tc.RootCAs = x509.NewCertPool() // Create a cert "pool"
-	tc.RootCAs.AddCert(c)           // Add the CA cert to the pool
-	// Finish TLS Config initialization, so broker can authenticate client.
-	cc, e := tls.LoadX509KeyPair(cliCertFile, cliKeyFile)
-	if e != nil {
-		ll.Fatalf("%s %s\n", exampid, e.Error()) // Handle this ......
+			"STOMP_TLS_CERTFILE and STOMP_TLS_KEYFILE, or STOMP_TLS_PKCS12FILE, are required") // Handle this ......
 	}
-	tc.Certificates = append(tc.Certificates, cc) // Add cert
-	// This is OK, but does not seem to be required
-	tc.BuildNameToCertificate() // Build names map
 
 	// Standard example TLS connect sequence
 	n, conn, e := sngecomm.CommonTLSConnect(exampid, tag, ll, tc)
@@ -141,7 +101,7 @@ func main() {
 	}
 
 	nc := n.(*tls.Conn)
-	sngecomm.DumpTLSConfig(exampid, tc, nc)
+	sngecomm.ReportTLS(exampid, tag, ll, tc, nc)
 
 	// *NOTE* application specific functionaltiy starts here!
 	// For you to add.